@@ -0,0 +1,93 @@
+// Access control for the receiver, by client address. With `--allow-from`,
+// only clients in the given networks (e.g. the application subnets) can
+// deliver to failmail, and with `--deny-from`, clients in the given networks
+// can't. Refused clients get a 554 as soon as they connect, and are
+// disconnected.
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The response sent to clients whose addresses aren't allowed to connect.
+var DENIED_RESPONSE = Response{554, "Connections from your address are not allowed", "5.7.1"}
+
+// `AccessList` decides which clients can connect, by IP address. A nil list
+// allows every client.
+type AccessList struct {
+	Allow []*net.IPNet // if non-empty, only clients in one of these are allowed
+	Deny  []*net.IPNet // clients in any of these are refused, even if they're allowed
+}
+
+// Returns an access list for comma-separated lists of networks to allow and
+// deny, or nil if both are empty.
+func NewAccessList(allow string, deny string) (*AccessList, error) {
+	allowNets, err := ParseNetworks(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := ParseNetworks(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allowNets) == 0 && len(denyNets) == 0 {
+		return nil, nil
+	}
+	return &AccessList{allowNets, denyNets}, nil
+}
+
+// Parses a comma-separated list of networks in CIDR notation (e.g.
+// "10.0.0.0/8,fd00::/8"). A bare IP address is a network of just that
+// address.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range SplitAddresses(list) {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", cidr)
+			} else if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Returns true if a client at `addr` can connect. Clients without an IP
+// address (on Unix sockets) are local, and always allowed.
+func (a *AccessList) Allowed(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+
+	ip := net.ParseIP(remoteHost(addr))
+	if ip == nil {
+		return true
+	}
+
+	for _, network := range a.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, network := range a.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	access, err := NewAccessList("10.0.0.0/8, 192.168.1.5, fd00::/8", "10.1.0.0/16")
+	if err != nil {
+		t.Fatalf("unexpected error creating access list: %s", err)
+	}
+
+	for addr, allowed := range map[string]bool{
+		"10.0.0.1:1234":      true,
+		"10.1.0.1:1234":      false,
+		"192.168.1.5:1234":   true,
+		"192.168.1.6:1234":   false,
+		"[fd00::1]:1234":     true,
+		"[2001:db8::1]:1234": false,
+	} {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if access.Allowed(tcpAddr) != allowed {
+			t.Errorf("expected %s to be allowed: %v", addr, allowed)
+		}
+	}
+	if !access.Allowed(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Errorf("expected clients on Unix sockets to be allowed")
+	}
+
+	// Without --allow-from, everything that isn't denied is allowed.
+	access, _ = NewAccessList("", "10.0.0.0/8")
+	if access.Allowed(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) || !access.Allowed(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}) {
+		t.Errorf("expected only the denied network to be refused")
+	}
+
+	if access, err := NewAccessList("", ""); access != nil || err != nil || !access.Allowed(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) {
+		t.Errorf("expected no access list to allow everything: %v, %s", access, err)
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", "10.0.0"} {
+		if _, err := NewAccessList(invalid, ""); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestListenerDeniesConnection(t *testing.T) {
+	access, _ := NewAccessList("", "127.0.0.0/8")
+	socket, err := NewTCPServerSocket("127.0.0.1:10051")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	listener := &Listener{Socket: socket, Access: access}
+	done := make(chan TerminationRequest, 1)
+	go listener.Listen(context.Background(), make(chan *StorageRequest, 1), done, time.Second)
+	defer func() { done <- GracefulShutdown }()
+
+	conn, err := textproto.Dial("tcp", "127.0.0.1:10051")
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+	if _, _, err := conn.ReadCodeLine(554); err != nil {
+		t.Errorf("expected the connection to be refused: %s", err)
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"log"
 	"regexp"
 	"sort"
+	"strings"
 )
 
+// `AddressRewriter` redirects recipients matching `Source` to `Dest`, which
+// can refer to groups captured by `Source`.
 type AddressRewriter struct {
 	Source *regexp.Regexp
 	Dest   string
+	Log    bool // if true, each decision to rewrite an address or not is logged
+	DryRun bool // if true, rewrites are logged, but addresses are left alone
 }
 
 func (r AddressRewriter) RewriteAll(addresses []string) []string {
@@ -26,7 +32,12 @@ func (r AddressRewriter) RewriteAll(addresses []string) []string {
 }
 
 func (r AddressRewriter) Rewrite(address string) string {
-	if r.Source == nil || !r.Source.MatchString(address) {
+	if r.Source == nil {
+		return address
+	} else if !r.Source.MatchString(address) {
+		if r.Log || r.DryRun {
+			log.Printf("rewrite: %s left alone (didn't match %s)", address, r.Source)
+		}
 		return address
 	}
 
@@ -34,5 +45,25 @@ func (r AddressRewriter) Rewrite(address string) string {
 	for _, s := range r.Source.FindAllStringSubmatchIndex(address, -1) {
 		res = r.Source.ExpandString(res, r.Dest, address, s)
 	}
+
+	switch {
+	case r.DryRun:
+		log.Printf("rewrite (dry run): would rewrite %s -> %s (matched %s)", address, res, r.Source)
+		return address
+	case r.Log:
+		log.Printf("rewrite: %s -> %s (matched %s)", address, res, r.Source)
+	}
 	return string(res)
 }
+
+// `SplitAddresses` splits a comma-separated list of addresses, ignoring
+// whitespace and empty entries.
+func SplitAddresses(list string) []string {
+	result := make([]string, 0)
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"log"
+	"os"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 )
 
 func TestRewriteEverything(t *testing.T) {
-	rewriter := &AddressRewriter{regexp.MustCompile(`.*`), "user@example.com"}
+	rewriter := &AddressRewriter{Source: regexp.MustCompile(`.*`), Dest: "user@example.com"}
 
 	if addr := rewriter.Rewrite("test@example.com"); addr != "user@example.com" {
 		t.Errorf("expected no rewrite for test@example.com, got %s", addr)
@@ -15,7 +19,7 @@ func TestRewriteEverything(t *testing.T) {
 }
 
 func TestRewriteMatching(t *testing.T) {
-	rewriter := &AddressRewriter{regexp.MustCompile(`failmail\+([^@]*)@example.com`), "$1@example.com"}
+	rewriter := &AddressRewriter{Source: regexp.MustCompile(`failmail\+([^@]*)@example.com`), Dest: "$1@example.com"}
 
 	if addr := rewriter.Rewrite("test@example.com"); addr != "test@example.com" {
 		t.Errorf("expected no rewrite for test@example.com, got %s", addr)
@@ -27,10 +31,48 @@ func TestRewriteMatching(t *testing.T) {
 }
 
 func TestRewriteAll(t *testing.T) {
-	rewriter := &AddressRewriter{regexp.MustCompile(`failmail\+([^@]*)@example.com`), "$1@example.com"}
+	rewriter := &AddressRewriter{Source: regexp.MustCompile(`failmail\+([^@]*)@example.com`), Dest: "$1@example.com"}
 
 	results := rewriter.RewriteAll([]string{"test@example.com", "failmail+test@example.com", "root@example.com"})
 	if !reflect.DeepEqual(results, []string{"root@example.com", "test@example.com"}) {
 		t.Errorf("expected 2 unique rewritten addresses, got %v", results)
 	}
 }
+
+func TestRewriteLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	rewriter := &AddressRewriter{Source: regexp.MustCompile(`failmail\+([^@]*)@example.com`), Dest: "$1@example.com", Log: true}
+	results := rewriter.RewriteAll([]string{"test@example.com", "failmail+user@example.com"})
+	if !reflect.DeepEqual(results, []string{"test@example.com", "user@example.com"}) {
+		t.Errorf("expected logging not to change the rewrites, got %v", results)
+	}
+	if logged := buf.String(); !strings.Contains(logged, "rewrite: failmail+user@example.com -> user@example.com") || !strings.Contains(logged, "rewrite: test@example.com left alone") {
+		t.Errorf("expected each decision to be logged, got %#v", logged)
+	}
+}
+
+func TestRewriteDryRun(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	rewriter := &AddressRewriter{Source: regexp.MustCompile(`failmail\+([^@]*)@example.com`), Dest: "$1@example.com", DryRun: true}
+	if addr := rewriter.Rewrite("failmail+user@example.com"); addr != "failmail+user@example.com" {
+		t.Errorf("expected a dry run not to rewrite, got %s", addr)
+	}
+	if logged := buf.String(); !strings.Contains(logged, "rewrite (dry run): would rewrite failmail+user@example.com -> user@example.com") {
+		t.Errorf("expected the rewrite to be logged, got %#v", logged)
+	}
+}
+
+func TestSplitAddresses(t *testing.T) {
+	if addrs := SplitAddresses(" a@example.com,b@example.com, ,"); !reflect.DeepEqual(addrs, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("unexpected addresses: %#v", addrs)
+	}
+	if addrs := SplitAddresses(""); len(addrs) != 0 {
+		t.Errorf("expected no addresses: %#v", addrs)
+	}
+}
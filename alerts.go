@@ -0,0 +1,86 @@
+// Meta-alerts, which tell operators when failmail itself can't deliver a
+// summary, via a channel other than the one that's failing.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/syslog"
+	"strings"
+	"time"
+)
+
+// `Alerter` is the interface that wraps the method to report a summary that
+// couldn't be delivered.
+type Alerter interface {
+	Alert(failed OutgoingMessage, sendErr error) error
+}
+
+// `AlertSubject` returns the subject of the summary that couldn't be
+// delivered, for use in alerts.
+func AlertSubject(failed OutgoingMessage) string {
+	if summary, ok := failed.(*SummaryMessage); ok {
+		return summary.Subject
+	}
+	if hookMsg, err := NewHookMessage(failed.Sender(), failed.Recipients(), failed.Contents()); err == nil {
+		return hookMsg.Headers.Get("Subject")
+	}
+	return ""
+}
+
+// `UpstreamAlerter` sends an alert email via a secondary upstream.
+type UpstreamAlerter struct {
+	Upstream Upstream
+	From     string
+	To       []string
+}
+
+func (a *UpstreamAlerter) Alert(failed OutgoingMessage, sendErr error) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", a.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(a.To, ", "))
+	fmt.Fprintf(buf, "Subject: [failmail] failed to deliver a summary\r\n")
+	fmt.Fprintf(buf, "Date: %s\r\n", nowGetter().Format(time.RFC822))
+	fmt.Fprintf(buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(buf, "\r\n")
+	fmt.Fprintf(buf, "failmail couldn't deliver a summary to %s.\r\n\r\n", strings.Join(failed.Recipients(), ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\nError: %s\r\n", AlertSubject(failed), sendErr)
+	return a.Upstream.Send(&message{a.From, a.To, buf.Bytes()})
+}
+
+// `WebhookAlerter` POSTs a JSON description of the failure to a URL.
+type WebhookAlerter struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// `SyslogAlerter` logs the failure to syslog at the error level.
+type SyslogAlerter struct {
+	Writer *syslog.Writer
+}
+
+func NewSyslogAlerter() (*SyslogAlerter, error) {
+	writer, err := syslog.New(syslog.LOG_MAIL|syslog.LOG_ERR, "failmail")
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAlerter{writer}, nil
+}
+
+func (a *SyslogAlerter) Alert(failed OutgoingMessage, sendErr error) error {
+	return a.Writer.Err(fmt.Sprintf("failed to deliver summary %#v to %v: %s", AlertSubject(failed), failed.Recipients(), sendErr))
+}
+
+// `MultiAlerter` alerts via each of several `Alerter`s, so that one failing
+// channel doesn't prevent the others from being tried.
+type MultiAlerter []Alerter
+
+func (m MultiAlerter) Alert(failed OutgoingMessage, sendErr error) error {
+	var firstErr error
+	for _, alerter := range m {
+		if err := alerter.Alert(failed, sendErr); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,38 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// `WebhookAlert` is the JSON body POSTed by a `WebhookAlerter`.
+type WebhookAlert struct {
+	From    string
+	To      []string
+	Subject string
+	Error   string
+}
+
+func (a *WebhookAlerter) Alert(failed OutgoingMessage, sendErr error) error {
+	body, err := json.Marshal(&WebhookAlert{failed.Sender(), failed.Recipients(), AlertSubject(failed), sendErr.Error()})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: a.Timeout}
+	resp, err := client.Post(a.URL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
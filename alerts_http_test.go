@@ -0,0 +1,34 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookAlerter(t *testing.T) {
+	alerts := make(chan *WebhookAlert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := new(WebhookAlert)
+		json.NewDecoder(r.Body).Decode(alert)
+		alerts <- alert
+	}))
+	defer server.Close()
+
+	alerter := &WebhookAlerter{server.URL, time.Second}
+	failed := &message{"failmail@example.com", []string{"test@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+	if err := alerter.Alert(failed, errors.New("fail")); err != nil {
+		t.Fatalf("unexpected error sending alert: %s", err)
+	}
+
+	alert := <-alerts
+	if alert.Subject != "test" || alert.Error != "fail" || len(alert.To) != 1 {
+		t.Errorf("unexpected webhook alert: %#v", alert)
+	}
+}
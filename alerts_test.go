@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type TestAlerter struct {
+	Alerts []string
+}
+
+func (a *TestAlerter) Alert(failed OutgoingMessage, sendErr error) error {
+	a.Alerts = append(a.Alerts, AlertSubject(failed)+": "+sendErr.Error())
+	return nil
+}
+
+func TestUpstreamAlerter(t *testing.T) {
+	upstream := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	alerter := &UpstreamAlerter{upstream, "failmail@example.com", []string{"ops@example.com"}}
+
+	failed := &message{"failmail@example.com", []string{"test@example.com"}, []byte("Subject: [failmail] test\r\n\r\nbody\r\n")}
+	if err := alerter.Alert(failed, errors.New("connection refused")); err != nil {
+		t.Fatalf("unexpected error sending alert: %s", err)
+	}
+
+	if count := len(upstream.Sends); count != 1 {
+		t.Fatalf("expected one alert to be sent, got %d", count)
+	}
+	alert := upstream.Sends[0]
+	if to := alert.Recipients(); len(to) != 1 || to[0] != "ops@example.com" {
+		t.Errorf("unexpected alert recipients: %v", to)
+	}
+	contents := string(alert.Contents())
+	if !strings.Contains(contents, "Subject: [failmail] test\r\nError: connection refused\r\n") {
+		t.Errorf("unexpected alert contents: %s", contents)
+	}
+}
+
+func TestMultiAlerter(t *testing.T) {
+	first := &UpstreamAlerter{&TestUpstream{nil, errors.New("alert failed")}, "failmail@example.com", []string{"ops@example.com"}}
+	second := &TestAlerter{}
+
+	failed := &message{"failmail@example.com", []string{"test@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+	if err := (MultiAlerter{first, second}).Alert(failed, errors.New("fail")); err == nil {
+		t.Errorf("expected an error from the failing alerter")
+	}
+	if len(second.Alerts) != 1 || second.Alerts[0] != "test: fail" {
+		t.Errorf("expected the second alerter to be called: %v", second.Alerts)
+	}
+}
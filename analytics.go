@@ -0,0 +1,170 @@
+// Analytics over a window of time, for dashboards that graph error volume by
+// application. They're computed from the audit log (including its rotated
+// files): for each batch key, how many messages were received and summaries
+// were sent in the window, how fast messages arrived, and how that compares
+// with the window before it.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	TREND_NEW  = "new"  // messages arrived in the window, but none in the previous one
+	TREND_GONE = "gone" // messages arrived in the previous window, but none in this one
+	TREND_UP   = "up"
+	TREND_DOWN = "down"
+	TREND_FLAT = "flat"
+)
+
+// Changes smaller than this (as a fraction of the previous window's count)
+// are reported as `TREND_FLAT`.
+const TREND_THRESHOLD = 0.1
+
+// `KeyAnalytics` describes the messages with one batch key.
+type KeyAnalytics struct {
+	Key       string
+	Messages  int      // messages received (stored, relayed, or dropped) in the window
+	Dropped   int      // of those, how many were dropped
+	Summaries int      // summaries sent in the window
+	Rate      float64  // messages per hour in the window
+	Previous  int      // messages received in the previous window
+	Change    *float64 `json:",omitempty"` // the change from the previous window, as a fraction of it
+	Trend     string
+}
+
+// `Analytics` describes the messages received in a window of time, by batch
+// key, with the keys that received the most messages first.
+type Analytics struct {
+	Window   string
+	Start    time.Time
+	End      time.Time
+	Messages int
+	Previous int
+	Keys     []*KeyAnalytics
+}
+
+// Returns analytics for the `window` up to now, and compares them with the
+// `window` before that.
+func (a *AuditLog) Analyze(window time.Duration) (*Analytics, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+
+	end := nowGetter()
+	start := end.Add(-window)
+	previousStart := start.Add(-window)
+
+	keys := make(map[string]*KeyAnalytics, 0)
+	forKey := func(key string) *KeyAnalytics {
+		if _, ok := keys[key]; !ok {
+			keys[key] = &KeyAnalytics{Key: key}
+		}
+		return keys[key]
+	}
+
+	analytics := &Analytics{Window: window.String(), Start: start, End: end, Keys: make([]*KeyAnalytics, 0)}
+	err := a.Entries(func(entry *AuditEntry) {
+		if entry.Time.Before(previousStart) || entry.Time.After(end) {
+			return
+		}
+		current := !entry.Time.Before(start)
+		switch entry.Event {
+		case AUDIT_STORED, AUDIT_RELAYED, AUDIT_DROPPED:
+			stats := forKey(entry.Key)
+			if !current {
+				stats.Previous += 1
+				analytics.Previous += 1
+				return
+			}
+			stats.Messages += 1
+			analytics.Messages += 1
+			if entry.Event == AUDIT_DROPPED {
+				stats.Dropped += 1
+			}
+		case AUDIT_SENT:
+			if current {
+				forKey(entry.Key).Summaries += 1
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stats := range keys {
+		stats.Rate = float64(stats.Messages) / window.Hours()
+		stats.Trend = trend(stats.Messages, stats.Previous)
+		if stats.Previous > 0 {
+			change := float64(stats.Messages-stats.Previous) / float64(stats.Previous)
+			stats.Change = &change
+		}
+		analytics.Keys = append(analytics.Keys, stats)
+	}
+	sort.Slice(analytics.Keys, func(i, j int) bool {
+		if analytics.Keys[i].Messages != analytics.Keys[j].Messages {
+			return analytics.Keys[i].Messages > analytics.Keys[j].Messages
+		}
+		return analytics.Keys[i].Key < analytics.Keys[j].Key
+	})
+	return analytics, nil
+}
+
+// Returns how the number of messages in a window compares with the number in
+// the previous one.
+func trend(current, previous int) string {
+	switch {
+	case previous == 0 && current > 0:
+		return TREND_NEW
+	case current == 0 && previous > 0:
+		return TREND_GONE
+	case float64(current) > float64(previous)*(1+TREND_THRESHOLD):
+		return TREND_UP
+	case float64(current) < float64(previous)*(1-TREND_THRESHOLD):
+		return TREND_DOWN
+	default:
+		return TREND_FLAT
+	}
+}
+
+// Calls `visit` with each entry in the log, oldest file first. Lines that
+// can't be read (e.g. one that's still being written) are skipped.
+func (a *AuditLog) Entries(visit func(*AuditEntry)) error {
+	paths := make([]string, 0, a.Keep+1)
+	for i := a.Keep; i >= 1; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", a.Path, i))
+	}
+	paths = append(paths, a.Path)
+
+	for _, path := range paths {
+		if err := readAuditEntries(path, visit); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readAuditEntries(path string, visit func(*AuditEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := new(AuditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err == nil {
+			visit(entry)
+		}
+	}
+	return scanner.Err()
+}
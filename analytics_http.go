@@ -0,0 +1,42 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The window `/api/analytics` covers when none is given.
+const DEFAULT_ANALYTICS_WINDOW = 24 * time.Hour
+
+// Serves `/api/analytics`: GET, with an optional `window` query parameter
+// (e.g. "24h", the default), reports the messages received in that window,
+// by batch key.
+func (a *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("must be a GET"))
+		return
+	}
+
+	window := DEFAULT_ANALYTICS_WINDOW
+	if param := r.URL.Query().Get("window"); param != "" {
+		var err error
+		if window, err = time.ParseDuration(param); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	analytics, err := a.Analyze(window)
+	if err != nil && window <= 0 {
+		writeJSONError(w, http.StatusBadRequest, err)
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+	} else {
+		writeJSON(w, analytics)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAnalyticsHTTP(t *testing.T) {
+	audit, cleanup := makeTestAuditLog(t, 0, 0)
+	defer cleanup()
+
+	now := time.Unix(1393650000, 0)
+	defer patchTime(now)()
+	writeAuditEntries(t, audit,
+		&AuditEntry{Time: now.Add(-2 * time.Hour), Event: AUDIT_STORED, Key: "db"},
+		&AuditEntry{Time: now.Add(-30 * time.Hour), Event: AUDIT_STORED, Key: "db"},
+	)
+
+	server := NewHTTPServer("")
+	server.Handle("/api/analytics", audit)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/api/analytics", nil))
+	analytics := new(Analytics)
+	if err := json.Unmarshal(w.Body.Bytes(), analytics); err != nil {
+		t.Fatalf("invalid analytics %#v: %s", w.Body.String(), err)
+	}
+	if analytics.Window != "24h0m0s" || analytics.Messages != 1 || analytics.Previous != 1 {
+		t.Errorf("unexpected analytics for the default window: %#v", analytics)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/api/analytics?window=1h", nil))
+	analytics = new(Analytics)
+	json.Unmarshal(w.Body.Bytes(), analytics)
+	if analytics.Messages != 0 || analytics.Previous != 1 || len(analytics.Keys) != 1 || analytics.Keys[0].Trend != TREND_GONE {
+		t.Errorf("unexpected analytics for a 1h window: %#v", analytics)
+	}
+
+	for _, window := range []string{"soon", "-1h"} {
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/api/analytics?window="+window, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected a bad request for window %s, got %d", window, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/api/analytics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be disallowed, got %d", w.Code)
+	}
+}
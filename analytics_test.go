@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func writeAuditEntries(t *testing.T, audit *AuditLog, entries ...*AuditEntry) {
+	for _, entry := range entries {
+		if err := audit.Write(entry); err != nil {
+			t.Fatalf("couldn't write to audit log: %s", err)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	audit, cleanup := makeTestAuditLog(t, 0, 0)
+	defer cleanup()
+
+	now := time.Unix(1393650000, 0)
+	defer patchTime(now)()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	writeAuditEntries(t, audit,
+		&AuditEntry{Time: ago(3 * time.Hour), Event: AUDIT_STORED, Key: "db"},
+		&AuditEntry{Time: ago(90 * time.Minute), Event: AUDIT_STORED, Key: "db"},
+		&AuditEntry{Time: ago(90 * time.Minute), Event: AUDIT_STORED, Key: "cron"},
+		&AuditEntry{Time: ago(30 * time.Minute), Event: AUDIT_STORED, Key: "db"},
+		&AuditEntry{Time: ago(20 * time.Minute), Event: AUDIT_RELAYED, Key: "db"},
+		&AuditEntry{Time: ago(10 * time.Minute), Event: AUDIT_DROPPED, Key: "db"},
+		&AuditEntry{Time: ago(10 * time.Minute), Event: AUDIT_STORED, Key: "web"},
+		&AuditEntry{Time: ago(5 * time.Minute), Event: AUDIT_SENT, Key: "db"},
+	)
+
+	analytics, err := audit.Analyze(time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error analyzing audit log: %s", err)
+	}
+	if analytics.Messages != 4 || analytics.Previous != 2 || !analytics.Start.Equal(ago(time.Hour)) {
+		t.Errorf("unexpected totals: %#v", analytics)
+	}
+	if len(analytics.Keys) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(analytics.Keys))
+	}
+
+	db, web, cron := analytics.Keys[0], analytics.Keys[1], analytics.Keys[2]
+	if db.Key != "db" || db.Messages != 3 || db.Dropped != 1 || db.Summaries != 1 || db.Rate != 3 || db.Previous != 1 {
+		t.Errorf("unexpected analytics for db: %#v", db)
+	}
+	if db.Trend != TREND_UP || db.Change == nil || *db.Change != 2 {
+		t.Errorf("expected db to be trending up: %#v", db)
+	}
+	if web.Key != "web" || web.Messages != 1 || web.Trend != TREND_NEW || web.Change != nil {
+		t.Errorf("unexpected analytics for web: %#v", web)
+	}
+	if cron.Key != "cron" || cron.Messages != 0 || cron.Previous != 1 || cron.Trend != TREND_GONE {
+		t.Errorf("unexpected analytics for cron: %#v", cron)
+	}
+
+	if _, err := audit.Analyze(0); err == nil {
+		t.Errorf("expected an error for an empty window")
+	}
+}
+
+func TestAnalyzeRotatedLogs(t *testing.T) {
+	audit, cleanup := makeTestAuditLog(t, 0, 2)
+	defer cleanup()
+
+	now := time.Unix(1393650000, 0)
+	defer patchTime(now)()
+	writeAuditEntries(t, audit, &AuditEntry{Time: now.Add(-2 * time.Hour), Event: AUDIT_STORED, Key: "db"})
+	if err := audit.rotate(); err != nil {
+		t.Fatalf("couldn't rotate audit log: %s", err)
+	}
+	writeAuditEntries(t, audit, &AuditEntry{Time: now.Add(-time.Hour), Event: AUDIT_STORED, Key: "db"})
+
+	analytics, err := audit.Analyze(3 * time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error analyzing audit log: %s", err)
+	}
+	if analytics.Messages != 2 || len(analytics.Keys) != 1 || analytics.Keys[0].Messages != 2 {
+		t.Errorf("expected messages from the rotated log to be counted: %#v", analytics)
+	}
+}
+
+func TestTrend(t *testing.T) {
+	for _, test := range []struct {
+		current, previous int
+		expected          string
+	}{
+		{0, 0, TREND_FLAT},
+		{5, 0, TREND_NEW},
+		{0, 5, TREND_GONE},
+		{20, 10, TREND_UP},
+		{5, 10, TREND_DOWN},
+		{105, 100, TREND_FLAT},
+	} {
+		if actual := trend(test.current, test.previous); actual != test.expected {
+			t.Errorf("expected trend(%d, %d) to be %s, got %s", test.current, test.previous, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// An audit log of the messages failmail handles, for when it has to be shown
+// what happened to a message. Each message that's stored, relayed, or dropped
+// is recorded, as is each summary that's sent (along with the ids of the
+// messages in it), one JSON object per line, so that a message can be traced
+// from the client that sent it to the summary it ended up in.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_STORED  = "stored"
+	AUDIT_RELAYED = "relayed"
+	AUDIT_DROPPED = "dropped"
+	AUDIT_SENT    = "sent"
+)
+
+// `AuditEntry` is a line of the audit log.
+type AuditEntry struct {
+	Time     time.Time
+	Event    string
+	Id       MessageId   `json:",omitempty"` // the id of the message in the store
+	Summary  string      `json:",omitempty"` // the id of the summary sent
+	Key      string      // the batch key
+	From     string      `json:",omitempty"`
+	To       []string    `json:",omitempty"`
+	Client   string      `json:",omitempty"`
+	User     string      `json:",omitempty"`
+	Size     int         `json:",omitempty"`
+	Messages []MessageId `json:",omitempty"` // the ids of the messages in the summary
+	Parts    int         `json:",omitempty"` // the number of emails the summary was split into
+}
+
+// `AuditLog` appends `AuditEntry`s to a file, rotating it when it grows past
+// `MaxSize`. Rotated files are renamed with the suffixes .1, .2, and so on,
+// up to `Keep`, with .1 being the most recent.
+type AuditLog struct {
+	Path    string
+	MaxSize int64
+	Keep    int
+	Durable bool    // if true, each entry is synced to disk as it's written
+	Batch   GroupBy // determines the batch key recorded for received messages
+
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+func NewAuditLog(path string, maxSize int64, keep int, durable bool, batch GroupBy) (*AuditLog, error) {
+	audit := &AuditLog{Path: path, MaxSize: maxSize, Keep: keep, Durable: durable, Batch: batch}
+	if err := audit.open(); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Renames the current file to .1 (and .1 to .2, and so on, discarding the
+// oldest), and starts a new one.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", a.Path, a.Keep))
+	for i := a.Keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.Path, i), fmt.Sprintf("%s.%d", a.Path, i+1))
+	}
+	var err error
+	if a.Keep > 0 {
+		err = os.Rename(a.Path, a.Path+".1")
+	} else {
+		err = os.Remove(a.Path)
+	}
+	if openErr := a.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// Appends an entry to the log. A nil `AuditLog` ignores it.
+func (a *AuditLog) Write(entry *AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("couldn't rotate audit log: %s", err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err == nil && a.Durable {
+		err = a.file.Sync()
+	}
+	return err
+}
+
+// Returns an entry describing a received message.
+func (a *AuditLog) received(event string, id MessageId, msg *ReceivedMessage) *AuditEntry {
+	entry := &AuditEntry{
+		Time:   nowGetter(),
+		Event:  event,
+		Id:     id,
+		From:   msg.Sender(),
+		To:     msg.Recipients(),
+		Client: msg.ClientAddr,
+		User:   msg.AuthUser,
+		Size:   msg.Size(),
+	}
+	if a.Batch != nil {
+		entry.Key, _ = a.Batch(msg)
+	}
+	return entry
+}
+
+// Records that a message was stored, relayed, or dropped. A nil `AuditLog`
+// ignores it.
+func (a *AuditLog) Received(event string, id MessageId, msg *ReceivedMessage) error {
+	if a == nil {
+		return nil
+	}
+	return a.Write(a.received(event, id, msg))
+}
+
+// Records that a summary was sent, in `parts` emails. A nil `AuditLog`
+// ignores it.
+func (a *AuditLog) Sent(summary *SummaryMessage, parts int) error {
+	if a == nil {
+		return nil
+	}
+	ids := make([]MessageId, 0, len(summary.StoredMessages))
+	for _, stored := range summary.StoredMessages {
+		ids = append(ids, stored.Id)
+	}
+	return a.Write(&AuditEntry{
+		Time:     nowGetter(),
+		Event:    AUDIT_SENT,
+		Summary:  summary.Id,
+		Key:      summary.Key,
+		From:     summary.From,
+		To:       summary.To,
+		Messages: ids,
+		Parts:    parts,
+	})
+}
+
+// Closes the log. A nil `AuditLog` ignores it.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+// Returns a new, random summary id, so that summaries can be matched up with
+// their entries in the audit log.
+func NewSummaryId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", nowGetter().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
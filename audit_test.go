@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func makeTestAuditLog(t *testing.T, maxSize int64, keep int) (*AuditLog, func()) {
+	tmp, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %s", err)
+	}
+	audit, err := NewAuditLog(path.Join(tmp, "audit.log"), maxSize, keep, false, GroupByExpr("batch", `{{.Header.Get "Subject"}}`))
+	if err != nil {
+		os.RemoveAll(tmp)
+		t.Fatalf("couldn't open audit log: %s", err)
+	}
+	return audit, func() {
+		audit.Close()
+		os.RemoveAll(tmp)
+	}
+}
+
+func readAuditLog(t *testing.T, file string) []map[string]interface{} {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("couldn't read audit log: %s", err)
+	}
+	entries := make([]map[string]interface{}, 0)
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		entry := make(map[string]interface{}, 0)
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid audit log line %#v: %s", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogWriter(t *testing.T) {
+	audit, cleanup := makeTestAuditLog(t, 0, 0)
+	defer cleanup()
+
+	store := NewMemoryStore()
+	hook := &Hook{HOOK_ON_RECEIVE, `grep -q drop && echo '{"Drop": true}'`, time.Second}
+	writer := &MessageWriter{Store: store, Hook: hook, Audit: audit}
+
+	received := make(chan *StorageRequest, 2)
+	errors := make(chan error, 2)
+	keep := makeReceivedMessage(t, "From: app@example.com\r\nTo: ops@example.com\r\nSubject: keep\r\n\r\nbody\r\n")
+	keep.ClientAddr = "10.0.0.5"
+	received <- &StorageRequest{keep, errors}
+	received <- &StorageRequest{makeReceivedMessage(t, "To: ops@example.com\r\nSubject: drop\r\n\r\nbody\r\n"), errors}
+	close(received)
+	writer.Run(received)
+
+	entries := readAuditLog(t, audit.Path)
+	if len(entries) != 2 {
+		t.Fatalf("expected two audit log entries, got %d", len(entries))
+	}
+	stored := entries[0]
+	if stored["Event"] != AUDIT_STORED || stored["Key"] != "keep" || stored["From"] != "app@example.com" || stored["Client"] != "10.0.0.5" {
+		t.Errorf("unexpected entry for stored message: %#v", stored)
+	} else if stored["Size"] != float64(len(keep.Data)) || stored["Id"] == nil {
+		t.Errorf("unexpected id or size for stored message: %#v", stored)
+	}
+	if dropped := entries[1]; dropped["Event"] != AUDIT_DROPPED || dropped["Key"] != "drop" || dropped["Id"] != nil {
+		t.Errorf("unexpected entry for dropped message: %#v", dropped)
+	}
+}
+
+func TestAuditLogSummaries(t *testing.T) {
+	audit, cleanup := makeTestAuditLog(t, 0, 0)
+	defer cleanup()
+
+	buf := makeMessageBuffer()
+	buf.Audit = audit
+	outgoing := make(chan *SendRequest, 64)
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	for i := 0; i < 2; i++ {
+		buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	}
+
+	ids := make(chan string, 1)
+	go func() {
+		for req := range outgoing {
+			parsed, _ := mail.ReadMessage(bytes.NewBuffer(req.Message.Contents()))
+			ids <- parsed.Header.Get("X-Failmail-Summary-Id")
+			req.SendErrors <- nil
+		}
+	}()
+
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, true); err != nil {
+		t.Errorf("unexpected error from flush: %s", err)
+	}
+	close(outgoing)
+
+	id := <-ids
+	entries := readAuditLog(t, audit.Path)
+	if id == "" || len(entries) != 1 {
+		t.Fatalf("expected a summary id and an audit log entry, got %#v and %d", id, len(entries))
+	}
+	sent := entries[0]
+	if sent["Event"] != AUDIT_SENT || sent["Summary"] != id || sent["Key"] != "test" || sent["Parts"] != 1.0 {
+		t.Errorf("unexpected entry for summary: %#v", sent)
+	} else if messages := sent["Messages"].([]interface{}); len(messages) != 2 {
+		t.Errorf("expected the summary's messages to be listed: %#v", messages)
+	}
+}
+
+func TestAuditLogRotates(t *testing.T) {
+	audit, cleanup := makeTestAuditLog(t, 150, 2)
+	defer cleanup()
+
+	for i := 0; i < 8; i++ {
+		if err := audit.Write(&AuditEntry{Time: time.Unix(1393650000, 0).UTC(), Event: AUDIT_STORED, Key: "test"}); err != nil {
+			t.Fatalf("unexpected error writing to audit log: %s", err)
+		}
+	}
+
+	for _, suffix := range []string{"", ".1", ".2"} {
+		if info, err := os.Stat(audit.Path + suffix); err != nil {
+			t.Errorf("expected audit log %s to exist: %s", suffix, err)
+		} else if info.Size() > 150 {
+			t.Errorf("expected audit log %s to be rotated, but it has %d bytes", suffix, info.Size())
+		}
+	}
+	if _, err := os.Stat(audit.Path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only two rotated audit logs to be kept")
+	}
+}
+
+func TestAuditLogNil(t *testing.T) {
+	var audit *AuditLog
+	if err := audit.Received(AUDIT_STORED, nil, makeReceivedMessage(t, "Subject: test\r\n\r\n")); err != nil {
+		t.Errorf("unexpected error from nil audit log: %s", err)
+	}
+	if err := audit.Close(); err != nil {
+		t.Errorf("unexpected error closing nil audit log: %s", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Detection of auto-generated mail (vacation replies, bulk mail, and other
+// machine-generated responses), so that it can be dropped or batched on its
+// own instead of cluttering summaries of the errors failmail is meant for.
+package main
+
+import (
+	"log"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+const (
+	AUTO_GENERATED_KEEP  = "keep"
+	AUTO_GENERATED_DROP  = "drop"
+	AUTO_GENERATED_BATCH = "batch"
+
+	// The batch key used for auto-generated messages in "batch" mode.
+	AUTO_GENERATED_KEY = "auto-generated"
+)
+
+// Headers set by common autoresponders that don't use `Auto-Submitted`.
+var autoReplyHeaders = []string{"X-Autoreply", "X-Autorespond", "X-Autoresponder"}
+
+// Subjects typical of vacation and out-of-office replies.
+var autoReplySubject = regexp.MustCompile(`(?i)^\s*(auto(matic)?[- ]?(reply|response)|autoreply|out of (the )?office|vacation|away from (the )?office)\b`)
+
+// `IsAutoGenerated` returns true if the headers mark a message as generated
+// automatically rather than sent by an application: an `Auto-Submitted`
+// header other than "no" (RFC 3834), `Precedence: bulk` or `junk`, or the
+// headers and subjects used by vacation responders.
+func IsAutoGenerated(header mail.Header) bool {
+	if auto := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); auto != "" && auto != "no" {
+		return true
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "junk":
+		return true
+	}
+
+	for _, name := range autoReplyHeaders {
+		if header.Get(name) != "" {
+			return true
+		}
+	}
+	return autoReplySubject.MatchString(header.Get("Subject"))
+}
+
+// `GroupByAutoGenerated` puts auto-generated messages into a batch of their
+// own, and batches all other messages using `batch`.
+func GroupByAutoGenerated(batch GroupBy) GroupBy {
+	return func(r *ReceivedMessage) (string, error) {
+		if r.Parsed != nil && IsAutoGenerated(r.Parsed.Header) {
+			return AUTO_GENERATED_KEY, nil
+		}
+		return batch(r)
+	}
+}
+
+// Returns true if the message should be dropped because it's auto-generated.
+func dropAutoGenerated(msg *ReceivedMessage) bool {
+	if msg.Parsed == nil || !IsAutoGenerated(msg.Parsed.Header) {
+		return false
+	}
+	log.Printf("dropping auto-generated message with subject %#v", msg.Parsed.Header.Get("Subject"))
+	return true
+}
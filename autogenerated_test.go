@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsAutoGenerated(t *testing.T) {
+	auto := []string{
+		"Auto-Submitted: auto-replied\r\nSubject: test\r\n\r\nbody\r\n",
+		"Precedence: bulk\r\nSubject: test\r\n\r\nbody\r\n",
+		"Precedence: Junk\r\nSubject: test\r\n\r\nbody\r\n",
+		"X-Autoreply: yes\r\nSubject: test\r\n\r\nbody\r\n",
+		"Subject: Out of Office: test\r\n\r\nbody\r\n",
+		"Subject: Automatic reply: test\r\n\r\nbody\r\n",
+	}
+	for _, data := range auto {
+		if msg := makeReceivedMessage(t, data); !IsAutoGenerated(msg.Parsed.Header) {
+			t.Errorf("expected message to be auto-generated: %#v", data)
+		}
+	}
+
+	notAuto := []string{
+		"Subject: test\r\n\r\nbody\r\n",
+		"Auto-Submitted: no\r\nSubject: test\r\n\r\nbody\r\n",
+		"Precedence: list\r\nSubject: test\r\n\r\nbody\r\n",
+		"Subject: error in vacationd\r\n\r\nbody\r\n",
+	}
+	for _, data := range notAuto {
+		if msg := makeReceivedMessage(t, data); IsAutoGenerated(msg.Parsed.Header) {
+			t.Errorf("expected message not to be auto-generated: %#v", data)
+		}
+	}
+}
+
+func TestGroupByAutoGenerated(t *testing.T) {
+	batch := GroupByAutoGenerated(GroupByExpr("batch", `{{.Header.Get "Subject"}}`))
+
+	if key, err := batch(makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n")); key != "test" || err != nil {
+		t.Errorf("unexpected key for a normal message: %#v, %s", key, err)
+	}
+	if key, err := batch(makeReceivedMessage(t, "Auto-Submitted: auto-generated\r\nSubject: test\r\n\r\nbody\r\n")); key != AUTO_GENERATED_KEY || err != nil {
+		t.Errorf("unexpected key for an auto-generated message: %#v, %s", key, err)
+	}
+}
+
+func TestMessageWriterDropAutoGenerated(t *testing.T) {
+	store := NewMemoryStore()
+	writer := &MessageWriter{Store: store, DropAutoGenerated: true}
+
+	received := make(chan *StorageRequest, 2)
+	errors := make(chan error, 2)
+	received <- &StorageRequest{makeReceivedMessage(t, "Precedence: bulk\r\nSubject: test\r\n\r\nbody\r\n"), errors}
+	received <- &StorageRequest{makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n"), errors}
+	close(received)
+	writer.Run(received)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errors; err != nil {
+			t.Errorf("unexpected storage error: %s", err)
+		}
+	}
+	if msgs, _ := store.MessagesNewerThan(time.Time{}); len(msgs) != 1 {
+		t.Errorf("expected only the normal message to be stored, got %d", len(msgs))
+	}
+}
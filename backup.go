@@ -0,0 +1,363 @@
+// Backups of the store, for recovering queued-but-unsent mail after losing a
+// host. `failmail backup` writes the messages in a disk-backed store (with
+// their metadata, whose modification times are the messages' receive times),
+// the messages in the failed maildir, and the files failmail keeps alongside
+// them to a tar archive; `failmail restore` puts them back.
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The directories in a backup archive.
+const (
+	BACKUP_STORE  = "store"
+	BACKUP_FAILED = "failed"
+
+	// The name of the `--history` file in a backup archive.
+	BACKUP_HISTORY = "history"
+)
+
+// `Backup` identifies what's backed up and restored: the maildir behind a
+// disk-backed store, the failed maildir, and the history file, any of which
+// may be omitted.
+type Backup struct {
+	Store   *Maildir
+	Failed  *Maildir
+	History string
+}
+
+// Counts of what a backup or restore copied.
+type BackupCounts struct {
+	Messages int
+	Failed   int
+	Skipped  int // messages restored that were already present
+}
+
+// Writes the backup to a tar archive. Each message is written along with its
+// metadata, and since metadata is written last and removed first, a message
+// removed while the backup is running is either written in full or left out,
+// so the archive is consistent even if the server is running.
+func (b *Backup) Write(w io.Writer) (*BackupCounts, error) {
+	archive := tar.NewWriter(w)
+	counts := new(BackupCounts)
+
+	if b.Store != nil {
+		n, err := backupMaildir(archive, b.Store, BACKUP_STORE)
+		if err != nil {
+			return counts, err
+		}
+		counts.Messages = n
+		if err := backupFile(archive, path.Join(b.Store.Path, ".receipts"), path.Join(BACKUP_STORE, ".receipts")); err != nil {
+			return counts, err
+		}
+	}
+	if b.Failed != nil {
+		n, err := backupMaildir(archive, b.Failed, BACKUP_FAILED)
+		if err != nil {
+			return counts, err
+		}
+		counts.Failed = n
+	}
+	if b.History != "" {
+		if err := backupFile(archive, b.History, BACKUP_HISTORY); err != nil {
+			return counts, err
+		}
+	}
+	return counts, archive.Close()
+}
+
+// Writes the messages in a maildir, and their metadata, to the archive under
+// `dir`, and returns the number written. Messages in the failed maildir
+// written before envelopes were recorded have no metadata, and are written
+// without it.
+func backupMaildir(archive *tar.Writer, maildir *Maildir, dir string) (int, error) {
+	files, err := maildir.List(MAILDIR_CUR)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, info := range files {
+		if info.IsDir() {
+			continue
+		}
+		name := info.Name()
+
+		metaInfo, err := os.Stat(maildir.path(name, MAILDIR_META))
+		var meta []byte
+		if err == nil {
+			meta, err = maildir.ReadBytes(name, MAILDIR_META)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return count, err
+		} else if os.IsNotExist(err) && dir == BACKUP_STORE {
+			// Without metadata, a message isn't (or is no longer) in the
+			// store.
+			continue
+		}
+
+		data, err := maildir.ReadBytes(name, MAILDIR_CUR)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return count, err
+		}
+
+		if err := writeTarFile(archive, path.Join(dir, string(MAILDIR_CUR), name), data, info.ModTime()); err != nil {
+			return count, err
+		}
+		if meta != nil {
+			if err := writeTarFile(archive, path.Join(dir, string(MAILDIR_META), name), meta, metaInfo.ModTime()); err != nil {
+				return count, err
+			}
+		}
+		count += 1
+	}
+	return count, nil
+}
+
+// Writes a file to the archive as `name`, if it exists.
+func backupFile(archive *tar.Writer, file string, name string) error {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return writeTarFile(archive, name, data, info.ModTime())
+}
+
+func writeTarFile(archive *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(data)
+	return err
+}
+
+// Restores a backup from a tar archive. Messages are restored with their
+// original receive times, so they're summarized as if they'd never left the
+// store. Messages that are already present are left alone, as is an existing
+// history file.
+func (b *Backup) Restore(r io.Reader) (*BackupCounts, error) {
+	archive := tar.NewReader(r)
+	counts := new(BackupCounts)
+
+	// Metadata is restored after all of the messages, since its presence
+	// marks a message as stored.
+	type pending struct {
+		maildir *Maildir
+		name    string
+		data    []byte
+		modTime time.Time
+	}
+	metas := make([]*pending, 0)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return counts, err
+		} else if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return counts, err
+		}
+
+		parts := strings.Split(path.Clean(header.Name), "/")
+		if len(parts) == 1 && parts[0] == BACKUP_HISTORY && b.History != "" {
+			if err := restoreFile(b.History, data); err != nil {
+				return counts, err
+			}
+			continue
+		}
+
+		var maildir *Maildir
+		switch parts[0] {
+		case BACKUP_STORE:
+			maildir = b.Store
+		case BACKUP_FAILED:
+			maildir = b.Failed
+		}
+		switch {
+		case maildir == nil:
+			continue
+		case len(parts) == 2 && parts[1] == ".receipts" && maildir == b.Store:
+			if err := restoreFile(path.Join(maildir.Path, ".receipts"), data); err != nil {
+				return counts, err
+			}
+		case len(parts) == 3 && parts[1] == string(MAILDIR_META) && validDeadLetterId(parts[2]):
+			metas = append(metas, &pending{maildir, parts[2], data, header.ModTime})
+		case len(parts) == 3 && parts[1] == string(MAILDIR_CUR) && validDeadLetterId(parts[2]):
+			if _, err := os.Stat(maildir.path(parts[2], MAILDIR_CUR)); err == nil {
+				counts.Skipped += 1
+				continue
+			}
+			if err := maildir.WriteFile(parts[2], MAILDIR_CUR, data, header.ModTime); err != nil {
+				return counts, err
+			}
+			if maildir == b.Store {
+				counts.Messages += 1
+			} else {
+				counts.Failed += 1
+			}
+		}
+	}
+
+	for _, meta := range metas {
+		if _, err := os.Stat(meta.maildir.path(meta.name, MAILDIR_META)); err == nil {
+			continue
+		}
+		if err := meta.maildir.WriteFile(meta.name, MAILDIR_META, meta.data, meta.modTime); err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+// Writes `data` to `file`, unless it already exists.
+func restoreFile(file string, data []byte) error {
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// How backup archives are compressed, based on their names.
+const (
+	ARCHIVE_TAR  = "tar"
+	ARCHIVE_GZIP = "gzip"
+	ARCHIVE_ZSTD = "zstd" // see zstd.go
+)
+
+// Returns how the archive is compressed, based on its name, or an error
+// naming `flag` if it isn't a name failmail writes.
+func archiveFormat(flag string, archive string) (string, error) {
+	switch {
+	case strings.HasSuffix(archive, ".tar.gz") || strings.HasSuffix(archive, ".tgz"):
+		return ARCHIVE_GZIP, nil
+	case strings.HasSuffix(archive, ".tar.zst"):
+		return ARCHIVE_ZSTD, nil
+	case strings.HasSuffix(archive, ".tar"):
+		return ARCHIVE_TAR, nil
+	default:
+		return "", fmt.Errorf("%s must end in .tar, .tar.gz, .tgz, or .tar.zst", flag)
+	}
+}
+
+// `BackupCommand` writes the store, the failed maildir, and the history file
+// to the archive given by `--to`.
+func BackupCommand(config *Config, out io.Writer) error {
+	if config.To == "" {
+		return fmt.Errorf("--to is required")
+	}
+	format, err := archiveFormat("--to", config.To)
+	if err != nil {
+		return err
+	}
+	backup, err := config.Backup()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that a failed backup doesn't
+	// replace a good one.
+	tmpPath := config.To + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	var w io.WriteCloser = file
+	switch format {
+	case ARCHIVE_GZIP:
+		w = gzip.NewWriter(file)
+	case ARCHIVE_ZSTD:
+		w = newZstdWriter(file)
+	}
+	counts, err := backup.Write(w)
+	if err == nil && format != ARCHIVE_TAR {
+		err = w.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, config.To); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "backed up %s and %s\n", Plural(counts.Messages, "message", "messages"), Plural(counts.Failed, "failed message", "failed messages"))
+	return nil
+}
+
+// `RestoreCommand` restores the store, the failed maildir, and the history
+// file from the archive given by `--archive`.
+func RestoreCommand(config *Config, out io.Writer) error {
+	if config.Archive == "" {
+		return fmt.Errorf("--archive is required")
+	}
+	format, err := archiveFormat("--archive", config.Archive)
+	if err != nil {
+		return err
+	}
+	backup, err := config.Backup()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(config.Archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	switch format {
+	case ARCHIVE_GZIP:
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ARCHIVE_ZSTD:
+		r = newZstdReader(file)
+	}
+
+	counts, err := backup.Restore(r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "restored %s and %s", Plural(counts.Messages, "message", "messages"), Plural(counts.Failed, "failed message", "failed messages"))
+	if counts.Skipped > 0 {
+		fmt.Fprintf(out, " (skipped %s already present)", Plural(counts.Skipped, "message", "messages"))
+	}
+	fmt.Fprintf(out, "\n")
+	return nil
+}
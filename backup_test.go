@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestBackup(t *testing.T) (*Backup, *DiskStore, func()) {
+	storeMaildir, cleanupStore := makeTestMaildir(t)
+	failedMaildir, cleanupFailed := makeTestMaildir(t)
+	store, _ := NewDiskStore(storeMaildir)
+	backup := &Backup{Store: storeMaildir, Failed: failedMaildir, History: path.Join(failedMaildir.Path, "history.json")}
+	return backup, store, func() { cleanupStore(); cleanupFailed() }
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	backup, store, cleanup := makeTestBackup(t)
+	defer cleanup()
+
+	received := time.Unix(1393650000, 0)
+	store.Add(received, makeReceivedMessage(t, "Subject: test\r\n\r\nqueued\r\n"))
+	data := []byte("To: ops@example.com\r\nSubject: failed\r\n\r\ntest\r\n")
+	SaveDeadLetter(backup.Failed, &message{"app@example.com", []string{"ops@example.com"}, data}, data)
+	ioutil.WriteFile(backup.History, []byte("{}\n"), 0644)
+
+	archive := new(bytes.Buffer)
+	if counts, err := backup.Write(archive); err != nil {
+		t.Fatalf("unexpected error writing backup: %s", err)
+	} else if counts.Messages != 1 || counts.Failed != 1 {
+		t.Errorf("expected one message and one failed message, got %#v", counts)
+	}
+
+	restored, restoredStore, cleanupRestored := makeTestBackup(t)
+	defer cleanupRestored()
+	if counts, err := restored.Restore(bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatalf("unexpected error restoring backup: %s", err)
+	} else if counts.Messages != 1 || counts.Failed != 1 || counts.Skipped != 0 {
+		t.Errorf("expected one message and one failed message, got %#v", counts)
+	}
+
+	msgs, err := restoredStore.MessagesNewerThan(time.Time{})
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected one restored message, got %d (%v)", len(msgs), err)
+	} else if !msgs[0].Received.Equal(received) {
+		t.Errorf("expected the receive time to be kept, got %s", msgs[0].Received)
+	} else if string(msgs[0].Contents()) != "Subject: test\r\n\r\nqueued\r\n" {
+		t.Errorf("unexpected restored message %#v", string(msgs[0].Contents()))
+	}
+
+	dead := &DeadLetters{Sender: &Sender{FailedMaildir: restored.Failed}}
+	if letters, err := dead.List(); err != nil || len(letters) != 1 || letters[0].From != "app@example.com" {
+		t.Errorf("expected the failed message to be restored with its envelope, got %#v (%v)", letters, err)
+	}
+	if history, err := ioutil.ReadFile(restored.History); err != nil || string(history) != "{}\n" {
+		t.Errorf("expected the history file to be restored, got %#v (%v)", string(history), err)
+	}
+
+	// Restoring again leaves the messages that are already present alone.
+	if counts, err := restored.Restore(bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatalf("unexpected error restoring backup again: %s", err)
+	} else if counts.Messages != 0 || counts.Failed != 0 || counts.Skipped != 2 {
+		t.Errorf("expected both messages to be skipped, got %#v", counts)
+	}
+	if msgs, _ := restoredStore.MessagesNewerThan(time.Time{}); len(msgs) != 1 {
+		t.Errorf("expected one message after restoring again, got %d", len(msgs))
+	}
+}
+
+func TestBackupSkipsRemovedMessages(t *testing.T) {
+	backup, store, cleanup := makeTestBackup(t)
+	defer cleanup()
+
+	id, _ := store.Add(time.Unix(1393650000, 0), makeReceivedMessage(t, "Subject: test\r\n\r\nsent\r\n"))
+	// A message whose metadata is gone is being removed from the store.
+	os.Remove(backup.Store.path(id.(string), MAILDIR_META))
+
+	archive := new(bytes.Buffer)
+	if counts, err := backup.Write(archive); err != nil {
+		t.Fatalf("unexpected error writing backup: %s", err)
+	} else if counts.Messages != 0 {
+		t.Errorf("expected a removed message to be left out, got %#v", counts)
+	}
+}
+
+func TestBackupArchiveNames(t *testing.T) {
+	formats := map[string]string{
+		"backup.tar":     ARCHIVE_TAR,
+		"backup.tar.gz":  ARCHIVE_GZIP,
+		"backup.tgz":     ARCHIVE_GZIP,
+		"backup.tar.zst": ARCHIVE_ZSTD,
+	}
+	for name, expected := range formats {
+		if format, err := archiveFormat("--to", name); err != nil || format != expected {
+			t.Errorf("expected %s to be %s, got %s (%v)", name, expected, format, err)
+		}
+	}
+	if _, err := archiveFormat("--to", "backup.tar.xz"); err == nil || !strings.HasPrefix(err.Error(), "--to ") {
+		t.Errorf("expected an error naming --to for an unsupported archive, got %v", err)
+	}
+}
+
+func TestBackupCommandZstd(t *testing.T) {
+	backup, store, cleanup := makeTestBackup(t)
+	defer cleanup()
+	store.Add(time.Unix(1393650000, 0), makeReceivedMessage(t, "Subject: test\r\n\r\nqueued\r\n"))
+
+	dir, err := ioutil.TempDir("", "failmail-backup")
+	if err != nil {
+		t.Fatalf("failed to make a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{MessageStore: backup.Store.Path, FailDir: backup.Failed.Path, To: path.Join(dir, "backup.tar.zst")}
+	if err := BackupCommand(config, ioutil.Discard); err != nil {
+		t.Fatalf("unexpected error backing up: %s", err)
+	}
+	if data, err := ioutil.ReadFile(config.To); err != nil || len(data) < 4 || !bytes.Equal(data[:4], []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		t.Fatalf("expected a zstd archive, got %d bytes (%v)", len(data), err)
+	}
+
+	restored, restoredStore, cleanupRestored := makeTestBackup(t)
+	defer cleanupRestored()
+	config = &Config{MessageStore: restored.Store.Path, FailDir: restored.Failed.Path, Archive: config.To}
+	out := new(bytes.Buffer)
+	if err := RestoreCommand(config, out); err != nil {
+		t.Fatalf("unexpected error restoring: %s", err)
+	} else if out.String() != "restored 1 message and 0 failed messages\n" {
+		t.Errorf("unexpected output %#v", out.String())
+	}
+	if msgs, _ := restoredStore.MessagesNewerThan(time.Time{}); len(msgs) != 1 {
+		t.Errorf("expected one restored message, got %d", len(msgs))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBcryptHashMatches(t *testing.T) {
+	for _, test := range []struct {
+		password string
+		hash     string
+	}{
+		{"", "$2a$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s."},
+		{"a", "$2a$06$m0CrhHm10qJ3lXRY.5zDGO3rS2KdeeWLuGmsfGlMfOxih58VYVfxe"},
+		{"abc", "$2a$06$If6bvum7DFjUnE9p2uDeDu0YHzrHM6tf.iqN8.yx.jNN1ILEf7h0i"},
+		{"abcdefghijklmnopqrstuvwxyz", "$2a$06$.rCVZVOThsIa97pEDOxvGuRRgzG64bvtJ0938xuqzv18d3ZpQhstC"},
+		{"~!@#$%^&*()      ~!@#$%^&*()PNBFRD", "$2a$06$fPIsBO8qRqkjj273rfaOI.HtSV9jLDpTbZn782DC6/t7qT67P6FfO"},
+	} {
+		hash, err := ParseBcryptHash(test.hash)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %s", test.hash, err)
+		}
+		if !hash.Matches(test.password) {
+			t.Errorf("expected %s to be the hash of %#v", test.hash, test.password)
+		}
+		if hash.Matches(test.password + "x") {
+			t.Errorf("expected %s not to be the hash of %#v", test.hash, test.password+"x")
+		}
+	}
+}
+
+func TestParseBcryptHashInvalid(t *testing.T) {
+	for _, invalid := range []string{
+		"",
+		"password",
+		"$1$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s.",
+		"$2a$03$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s.",
+		"$2a$15$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s.",
+		"$2a$31$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s.",
+		"$2a$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s",
+		"$2a$06$DCq7YPn5Rq63x1Lad4cll!TV4S6ytwfsfvkgY8jIucDrjc8deX1s.",
+	} {
+		if _, err := ParseBcryptHash(invalid); err == nil {
+			t.Errorf("expected an error parsing %#v", invalid)
+		}
+	}
+
+	// htpasswd writes "$2y$", which is the same as "$2a$" for passwords
+	// without 8-bit characters.
+	if hash, err := ParseBcryptHash("$2y$06$m0CrhHm10qJ3lXRY.5zDGO3rS2KdeeWLuGmsfGlMfOxih58VYVfxe"); err != nil || !hash.Matches("a") {
+		t.Errorf("expected a $2y$ hash to match: %s", err)
+	}
+}
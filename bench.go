@@ -0,0 +1,268 @@
+// Load generation, for sizing instances before rolling them out. `failmail
+// bench` sends synthetic messages to a failmail receiver over SMTP at a fixed
+// rate, and reports how long the receiver took to accept them.
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of distinct subjects in the messages sent by `Bench`, so that
+// they're summarized as a realistic number of groups.
+const BENCH_SUBJECTS = 10
+
+// `Bench` sends messages to the SMTP server at `Addr` at `Rate` messages per
+// second for `Duration`, over at most `Connections` connections at once.
+type Bench struct {
+	Addr        string
+	Auth        smtp.Auth // if non-nil, used to authenticate each connection
+	Rate        float64
+	Duration    time.Duration
+	Connections int
+}
+
+// `BenchResult` describes the messages sent by a run of `Bench`.
+type BenchResult struct {
+	Sent      int             // messages the server accepted
+	Failed    map[string]int  // messages the server didn't accept, by error
+	Skipped   int             // messages not sent because every connection was busy
+	Latencies []time.Duration // the time from MAIL to the server accepting the data, for each message accepted
+	Elapsed   time.Duration
+	lock      sync.Mutex
+}
+
+// Parses a rate like "500/s", "100/m", or "500" (per second), and returns it
+// in messages per second.
+func ParseRate(rate string) (float64, error) {
+	count, unit := rate, "s"
+	if index := strings.Index(rate, "/"); index >= 0 {
+		count, unit = rate[:index], rate[index+1:]
+	}
+
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %#v: expected a positive number of messages", rate)
+	}
+	switch unit {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	default:
+		return 0, fmt.Errorf("invalid rate %#v: expected /s, /m, or /h", rate)
+	}
+}
+
+// Sends messages until `Duration` has passed, and waits for the messages in
+// progress to be accepted. A message that's due while every connection is
+// still busy is skipped, rather than sent late, so that the server sees the
+// requested rate or less.
+func (b *Bench) Run() *BenchResult {
+	result := &BenchResult{Failed: make(map[string]int, 0), Latencies: make([]time.Duration, 0)}
+	start := time.Now()
+
+	pending := make(chan int, 0)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < b.Connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.send(pending, result)
+		}()
+	}
+
+	interval := time.Duration(float64(time.Second) / b.Rate)
+	ticker := time.NewTicker(interval)
+	deadline := time.After(b.Duration)
+loop:
+	for n := 0; ; n++ {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			break loop
+		}
+
+		select {
+		case pending <- n:
+		default:
+			result.record(0, nil, true)
+		}
+	}
+	ticker.Stop()
+	close(pending)
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	return result
+}
+
+// Sends a message for each number received on `pending` over one connection,
+// reconnecting after errors.
+func (b *Bench) send(pending <-chan int, result *BenchResult) {
+	var client *smtp.Client
+	defer func() {
+		if client != nil {
+			client.Quit()
+		}
+	}()
+
+	for n := range pending {
+		var err error
+		if client == nil {
+			if client, err = b.dial(); err != nil {
+				client = nil
+				result.record(0, err, false)
+				continue
+			}
+		}
+
+		started := time.Now()
+		if err := b.sendMessage(client, n); err != nil {
+			client.Close()
+			client = nil
+			result.record(0, err, false)
+		} else {
+			result.record(time.Since(started), nil, false)
+		}
+	}
+}
+
+func (b *Bench) dial() (*smtp.Client, error) {
+	client, err := smtp.Dial(b.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if b.Auth != nil {
+		if err := client.Auth(b.Auth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (b *Bench) sendMessage(client *smtp.Client, n int) error {
+	if err := client.Mail("bench@failmail.example.com"); err != nil {
+		return err
+	}
+	if err := client.Rcpt("bench@example.com"); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(BenchMessage(n, nowGetter())); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Returns the `n`th synthetic message sent by `Bench`.
+func BenchMessage(n int, now time.Time) []byte {
+	return []byte(fmt.Sprintf("From: bench@failmail.example.com\r\n"+
+		"To: bench@example.com\r\n"+
+		"Subject: failmail bench error %d\r\n"+
+		"Date: %s\r\n"+
+		"Message-Id: <bench.%d.%d@failmail.example.com>\r\n"+
+		"\r\n"+
+		"Synthetic message %d, sent by failmail bench.\r\n",
+		n%BENCH_SUBJECTS, now.Format(time.RFC1123Z), now.UnixNano(), n, n))
+}
+
+func (r *BenchResult) record(latency time.Duration, err error, skipped bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch {
+	case skipped:
+		r.Skipped += 1
+	case err != nil:
+		r.Failed[strings.TrimSpace(err.Error())] += 1
+	default:
+		r.Sent += 1
+		r.Latencies = append(r.Latencies, latency)
+	}
+}
+
+// Returns the latency that `p` (between 0 and 1) of the accepted messages
+// were accepted within, or 0 if none were.
+func (r *BenchResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(r.Latencies))
+	copy(sorted, r.Latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	index := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
+
+// Writes a report of the results to `out`.
+func (r *BenchResult) Report(out io.Writer) {
+	failed := 0
+	for _, count := range r.Failed {
+		failed += count
+	}
+	rate := float64(r.Sent) / r.Elapsed.Seconds()
+	fmt.Fprintf(out, "sent %s in %s (%.1f/s), %d failed, %d skipped\n",
+		Plural(r.Sent, "message", "messages"), r.Elapsed/time.Millisecond*time.Millisecond, rate, failed, r.Skipped)
+
+	if r.Sent > 0 {
+		fmt.Fprintf(out, "accept latency: p50 %s, p90 %s, p99 %s, max %s\n",
+			r.Percentile(0.5), r.Percentile(0.9), r.Percentile(0.99), r.Percentile(1))
+	}
+
+	errors := make([]string, 0, len(r.Failed))
+	for err, _ := range r.Failed {
+		errors = append(errors, err)
+	}
+	sort.Strings(errors)
+	for _, err := range errors {
+		fmt.Fprintf(out, "  %d: %s\n", r.Failed[err], err)
+	}
+	if r.Skipped > 0 {
+		fmt.Fprintf(out, "(messages are skipped when all --connections are busy; try more connections)\n")
+	}
+}
+
+// `BenchCommand` sends synthetic messages to the receiver at `--bind-addr` at
+// `--rate` for `--duration`, and reports how quickly they were accepted.
+func BenchCommand(config *Config, out io.Writer) error {
+	rate, err := ParseRate(config.Rate)
+	if err != nil {
+		return fmt.Errorf("--rate: %s", err)
+	} else if config.Duration <= 0 {
+		return fmt.Errorf("--duration must be positive")
+	} else if config.Connections < 1 {
+		return fmt.Errorf("--connections must be at least 1")
+	}
+
+	bench := &Bench{Addr: config.BindAddr, Rate: rate, Duration: config.Duration, Connections: config.Connections}
+	if config.Credentials != "" {
+		parts := strings.SplitN(config.Credentials, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("credentials must be in username:password format")
+		}
+		host, _, _ := net.SplitHostPort(config.BindAddr)
+		bench.Auth = smtp.PlainAuth("", parts[0], parts[1], host)
+	}
+
+	fmt.Fprintf(out, "sending %s for %s to %s\n", config.Rate, config.Duration, config.BindAddr)
+	bench.Run().Report(out)
+	return nil
+}
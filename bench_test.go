@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for rate, expected := range map[string]float64{"500/s": 500, "500": 500, "120/m": 2, "7200/h": 2, "0.5/s": 0.5} {
+		if actual, err := ParseRate(rate); err != nil || actual != expected {
+			t.Errorf("expected %s to be %v/s, got %v (%v)", rate, expected, actual, err)
+		}
+	}
+	for _, rate := range []string{"", "fast", "0/s", "-1/s", "10/d"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Errorf("expected an error parsing %#v", rate)
+		}
+	}
+}
+
+func TestBenchResultPercentile(t *testing.T) {
+	result := &BenchResult{Latencies: make([]time.Duration, 0)}
+	if p := result.Percentile(0.5); p != 0 {
+		t.Errorf("expected 0 with no latencies, got %s", p)
+	}
+	for i := 100; i > 0; i-- {
+		result.Latencies = append(result.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	for p, expected := range map[float64]time.Duration{0.5: 50 * time.Millisecond, 0.99: 99 * time.Millisecond, 1: 100 * time.Millisecond, 0: time.Millisecond} {
+		if actual := result.Percentile(p); actual != expected {
+			t.Errorf("expected p%v to be %s, got %s", p*100, expected, actual)
+		}
+	}
+}
+
+func TestBench(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10036")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	defer socket.Close()
+
+	listener := &Listener{Socket: socket}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 0)
+	go listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+
+	// Refuse the first message, and every fourth one after it.
+	lock := new(sync.Mutex)
+	handled := 0
+	subjects := make(map[string]int, 0)
+	go func() {
+		for req := range received {
+			lock.Lock()
+			handled += 1
+			subjects[req.Message.Parsed.Header.Get("Subject")] += 1
+			refuse := handled%4 == 1
+			lock.Unlock()
+			if refuse {
+				req.StorageErrors <- fmt.Errorf("refused")
+			} else {
+				req.StorageErrors <- nil
+			}
+		}
+	}()
+
+	bench := &Bench{Addr: "localhost:10036", Rate: 1000, Duration: 20 * time.Millisecond, Connections: 2}
+	result := bench.Run()
+	shutdown <- GracefulShutdown
+
+	// How many messages are sent in the time depends on the scheduler, but
+	// every one of them is either accepted or refused.
+	lock.Lock()
+	defer lock.Unlock()
+	failed := 0
+	for _, count := range result.Failed {
+		failed += count
+	}
+	if handled == 0 || result.Sent+failed != handled {
+		t.Errorf("expected each message handled to be sent or failed, got %d handled: %#v", handled, result)
+	}
+	if refused := (handled + 3) / 4; failed != refused || len(result.Latencies) != result.Sent {
+		t.Errorf("expected %d of %d messages to be refused, got %#v", refused, handled, result)
+	}
+	if handled > 1 && len(subjects) < 2 {
+		t.Errorf("expected messages with several subjects, got %v", subjects)
+	}
+
+	out := new(bytes.Buffer)
+	result.Report(out)
+	if !strings.Contains(out.String(), "accept latency: p50") || !strings.Contains(out.String(), "refused") {
+		t.Errorf("unexpected report: %s", out.String())
+	}
+}
@@ -0,0 +1,206 @@
+// Extracting readable text from message bodies. Many applications send MIME
+// messages: multipart, with HTML alternatives and attachments, or with their
+// text base64 or quoted-printable encoded, or in a legacy charset. Rather than
+// putting the raw MIME body into summaries, failmail uses the message's
+// text/plain part (or its text/html part, converted to text), decoded to
+// UTF-8. The message itself is stored as it was received.
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// The header of a message (a `mail.Header`), or of one part of a multipart
+// message (a `textproto.MIMEHeader`).
+type partHeader interface {
+	Get(key string) string
+}
+
+// Returns the readable text of a body with the given header. Bodies without
+// any text (e.g. a lone PDF) are described instead, and text bodies that
+// can't be decoded as the header says are returned as they are.
+func TextBody(header partHeader, body io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	if text, ok := textPart(header, data); ok {
+		return text, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && mediaType != "text/plain" && mediaType != "text/html" {
+		return fmt.Sprintf("[%s message body]", mediaType), nil
+	}
+	return string(data), nil
+}
+
+// Returns the text of a part, and true if there is any: the decoded text of
+// text/plain (or untyped) and text/html parts, and the text of the best
+// part of multipart ones.
+func textPart(header partHeader, data []byte) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return multipartText(params["boundary"], data)
+	} else if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", false
+	}
+
+	decoded, err := decodeTransfer(header.Get("Content-Transfer-Encoding"), data)
+	if err != nil {
+		return "", false
+	}
+	text := decodeCharset(params["charset"], decoded)
+	if mediaType == "text/html" {
+		return HTMLText(text), true
+	}
+	return text, true
+}
+
+// Returns the text of the best part of a multipart body: the first
+// text/plain part, or failing that, the first text/html part, looking inside
+// nested multipart parts, and skipping attachments.
+func multipartText(boundary string, data []byte) (string, bool) {
+	if boundary == "" {
+		return "", false
+	}
+
+	var htmlText string
+	var found bool
+	reader := multipart.NewReader(strings.NewReader(string(data)), boundary)
+	for {
+		part, err := reader.NextRawPart()
+		if err != nil {
+			break
+		}
+		partData, err := ioutil.ReadAll(part)
+		if err != nil {
+			break
+		}
+		if isAttachment(part.Header) {
+			continue
+		}
+
+		text, ok := textPart(part.Header, partData)
+		if !ok {
+			continue
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediaType != "text/html" {
+			return text, true
+		} else if !found {
+			htmlText, found = text, true
+		}
+	}
+	return htmlText, found
+}
+
+func isAttachment(header textproto.MIMEHeader) bool {
+	disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	return disposition == "attachment"
+}
+
+// Decodes a body encoded with the given Content-Transfer-Encoding.
+func decodeTransfer(encoding string, data []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "7bit", "8bit", "binary":
+		return data, nil
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(string(data))))
+	case "base64":
+		// Encoded bodies are wrapped, which the decoder doesn't expect.
+		stripped := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(data))
+		return base64.StdEncoding.DecodeString(stripped)
+	}
+	return nil, fmt.Errorf("unknown transfer encoding: %s", encoding)
+}
+
+// The characters Windows-1252 has in place of ISO-8859-1's C1 controls, from
+// 0x80 to 0x9f (or 0 where it has none).
+var windows1252 = [32]rune{
+	'€', 0, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0, 'Ž', 0,
+	0, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0, 'ž', 'Ÿ',
+}
+
+// Converts text in the given charset to UTF-8. Only the charsets that are
+// common in mail from older systems are converted: ISO-8859-1 and
+// Windows-1252, and Shift_JIS. Text in any other charset is left as it is,
+// unless it isn't valid UTF-8 either, in which case it's most likely
+// unlabelled (or mislabelled) Windows-1252.
+func decodeCharset(charset string, data []byte) string {
+	if decode := charsetDecoder(charset); decode != nil {
+		return decode(data)
+	} else if !utf8.Valid(data) {
+		return decodeWindows1252(data)
+	}
+	return string(data)
+}
+
+// Returns the function that converts text in the given charset to UTF-8, or
+// nil if it's one failmail doesn't convert.
+func charsetDecoder(charset string) func([]byte) string {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		return decodeWindows1252
+	case "shift_jis", "shift-jis", "sjis", "x-sjis", "windows-31j", "cp932", "ms_kanji":
+		return decodeShiftJIS
+	}
+	return nil
+}
+
+// Converts Windows-1252 (or ISO-8859-1, which it's a superset of) to UTF-8.
+func decodeWindows1252(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+		if b >= 0x80 && b < 0xa0 && windows1252[b-0x80] != 0 {
+			runes[i] = windows1252[b-0x80]
+		}
+	}
+	return string(runes)
+}
+
+var (
+	htmlInvisible   = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>`)
+	htmlComment     = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlLineBreak   = regexp.MustCompile(`(?i)<br\b[^>]*>|</?(p|div|li|tr|h[1-6]|table|ul|ol|blockquote|pre)\b[^>]*>|<hr\b[^>]*>`)
+	htmlTag         = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlSpaces      = regexp.MustCompile(`[ \t\r\f\v\x{a0}]+`)
+	htmlLineIndents = regexp.MustCompile(`(?m)^ | $`)
+	htmlBlankLines  = regexp.MustCompile(`\n{3,}`)
+)
+
+// Converts HTML to plain text, roughly as it reads in a browser: without
+// tags, scripts, or styles, with line breaks between blocks, and with
+// entities decoded.
+func HTMLText(body string) string {
+	text := htmlInvisible.ReplaceAllString(body, "")
+	text = htmlComment.ReplaceAllString(text, "")
+	text = strings.Replace(text, "\n", " ", -1)
+	text = htmlLineBreak.ReplaceAllString(text, "\n")
+	text = htmlTag.ReplaceAllString(text, "")
+	text = htmlSpaces.ReplaceAllString(html.UnescapeString(text), " ")
+	text = htmlLineIndents.ReplaceAllString(text, "")
+	text = htmlBlankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
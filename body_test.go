@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func readTextBody(t *testing.T, data string) string {
+	parsed, err := mail.ReadMessage(bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatalf("failed to parse message: %s", err)
+	}
+	body, err := TextBody(parsed.Header, parsed.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading body: %s", err)
+	}
+	return body
+}
+
+func TestTextBodyPlain(t *testing.T) {
+	if body := readTextBody(t, "Subject: test\r\n\r\nplain body\r\n"); body != "plain body\r\n" {
+		t.Errorf("expected a body without MIME headers as is: %#v", body)
+	}
+
+	qp := "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\ncaf=C3=A9 is a very long line that has been wrapped with a soft line br=\r\neak\r\n"
+	if body := readTextBody(t, qp); body != "café is a very long line that has been wrapped with a soft line break\r\n" {
+		t.Errorf("unexpected quoted-printable body: %#v", body)
+	}
+
+	b64 := "Content-Transfer-Encoding: base64\r\n\r\nZXJyb3IgaW4g\r\nam9iIDEyMw==\r\n"
+	if body := readTextBody(t, b64); body != "error in job 123" {
+		t.Errorf("unexpected base64 body: %#v", body)
+	}
+
+	bad := "Content-Transfer-Encoding: base64\r\n\r\nnot base64!\r\n"
+	if body := readTextBody(t, bad); body != "not base64!\r\n" {
+		t.Errorf("expected a body that can't be decoded as is: %#v", body)
+	}
+
+	pdf := "Content-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0=\r\n"
+	if body := readTextBody(t, pdf); body != "[application/pdf message body]" {
+		t.Errorf("expected a body without text to be described: %#v", body)
+	}
+}
+
+func TestTextBodyMultipart(t *testing.T) {
+	data := strings.Join([]string{
+		"Content-Type: multipart/mixed; boundary=outer",
+		"",
+		"--outer",
+		"Content-Type: multipart/alternative; boundary=inner",
+		"",
+		"--inner",
+		"Content-Type: text/html",
+		"",
+		"<p>the <b>html</b> part</p>",
+		"--inner",
+		"Content-Type: text/plain",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"dGhlIHBsYWluIHBhcnQ=",
+		"--inner--",
+		"--outer",
+		"Content-Type: text/plain",
+		"Content-Disposition: attachment; filename=log.txt",
+		"",
+		"the attachment",
+		"--outer--",
+		"",
+	}, "\r\n")
+	if body := readTextBody(t, data); body != "the plain part" {
+		t.Errorf("expected the text/plain part: %#v", body)
+	}
+
+	data = strings.Join([]string{
+		"Content-Type: multipart/alternative; boundary=b",
+		"",
+		"--b",
+		"Content-Type: text/html",
+		"",
+		"<p>only html</p>",
+		"--b--",
+		"",
+	}, "\r\n")
+	if body := readTextBody(t, data); body != "only html" {
+		t.Errorf("expected the text/html part as text: %#v", body)
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	html := `<html><head><title>t</title><style>p { color: red; }</style></head>
+<body><!-- comment --><h1>Job&nbsp;failed</h1>
+<p>exit   status <b>1</b></p><p>see
+&lt;log&gt;</p><br><ul><li>one</li><li>two</li></ul><script>alert(1)</script></body></html>`
+	expected := "Job failed\n\nexit status 1\n\nsee <log>\n\none\n\ntwo"
+	if text := HTMLText(html); text != expected {
+		t.Errorf("unexpected text from HTML: %#v", text)
+	}
+}
+
+func TestTextBodyCharset(t *testing.T) {
+	latin1 := "Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\ncaf=E9 =93ok=94"
+	if body := readTextBody(t, latin1); body != "café “ok”" {
+		t.Errorf("unexpected body in ISO-8859-1: %#v", body)
+	}
+
+	utf8 := "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\nY2Fmw6k="
+	if body := readTextBody(t, utf8); body != "café" {
+		t.Errorf("unexpected body in UTF-8: %#v", body)
+	}
+
+	sjis := "Content-Type: text/plain; charset=Shift_JIS\r\nContent-Transfer-Encoding: base64\r\n\r\ng0eDiYFbOiDDvcQglVw="
+	if body := readTextBody(t, sjis); body != "エラー: ﾃｽﾄ 表" {
+		t.Errorf("unexpected body in Shift_JIS: %#v", body)
+	}
+
+	unlabelled := "Content-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\ncaf=E9"
+	if body := readTextBody(t, unlabelled); body != "café" {
+		t.Errorf("expected an unlabelled body that isn't UTF-8 to be read as Windows-1252: %#v", body)
+	}
+}
+
+func TestReadBodyKeepsContents(t *testing.T) {
+	data := "Subject: test\r\nContent-Transfer-Encoding: base64\r\n\r\ndGVzdCBib2R5\r\n"
+	msg := makeReceivedMessage(t, data)
+	if body, err := msg.ReadBody(); err != nil || body != "test body" {
+		t.Errorf("unexpected body: %#v, %s", body, err)
+	}
+	if contents := string(msg.Contents()); contents != data {
+		t.Errorf("expected the message's contents to be kept as they are: %#v", contents)
+	}
+}
@@ -0,0 +1,147 @@
+//go:build !minimal
+// +build !minimal
+
+// Chat notifications of summaries, for teams that live in Microsoft Teams or
+// Google Chat rather than in their inboxes. Each summary failmail sends is
+// also posted as a card to an incoming webhook.
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CHAT_TEAMS       = "teams"
+	CHAT_GOOGLE_CHAT = "google-chat"
+
+	// Chat cards are meant to be skimmed, so long summary bodies are cut
+	// short; the full summary is in the email.
+	MAX_CHAT_BODY = 2000
+)
+
+// `ChatUpstream` passes each message to another `Upstream`, then posts a card
+// describing each summary it sent to a chat webhook. Messages that aren't
+// summaries are only passed on.
+type ChatUpstream struct {
+	Format   string // CHAT_TEAMS or CHAT_GOOGLE_CHAT
+	URL      string
+	Timeout  time.Duration
+	Upstream Upstream
+}
+
+func (u *ChatUpstream) Send(m OutgoingMessage) error {
+	return u.SendContext(context.Background(), m)
+}
+
+func (u *ChatUpstream) SendContext(ctx context.Context, m OutgoingMessage) error {
+	if err := sendContext(ctx, u.Upstream, m); err != nil {
+		return err
+	}
+
+	// As with issue trackers, failing the send here would only send the
+	// summary again.
+	if err := u.post(m); err != nil {
+		log.Printf("warning: couldn't post summary to %s: %s", u.Format, err)
+	}
+	return nil
+}
+
+func (u *ChatUpstream) post(m OutgoingMessage) error {
+	summary, err := ReadSentSummary(m)
+	if err != nil || summary == nil {
+		return err
+	}
+
+	var card interface{}
+	switch u.Format {
+	case CHAT_TEAMS:
+		card = TeamsCard(summary)
+	case CHAT_GOOGLE_CHAT:
+		card = GoogleChatCard(summary)
+	default:
+		return fmt.Errorf("unknown chat format %#v", u.Format)
+	}
+
+	req, err := http.NewRequest("POST", u.URL, nil)
+	if err != nil {
+		return err
+	}
+	return callJSON(req, u.Timeout, card, nil)
+}
+
+// Returns the facts about a summary shown on its card, as label/value pairs.
+func chatFacts(summary *SentSummary) [][2]string {
+	facts := [][2]string{{"Messages", fmt.Sprintf("%d", summary.Count)}}
+	if summary.Key != "" {
+		facts = append(facts, [2]string{"Batch", summary.Key})
+	}
+	if !summary.First.IsZero() {
+		facts = append(facts, [2]string{"First", summary.First.Format(time.RFC1123Z)})
+	}
+	if !summary.Last.IsZero() {
+		facts = append(facts, [2]string{"Last", summary.Last.Format(time.RFC1123Z)})
+	}
+	return facts
+}
+
+// Returns the summary's body for a card, cut short if it's too long.
+func chatBody(summary *SentSummary) string {
+	body := strings.TrimSpace(strings.Replace(summary.Body, "\r\n", "\n", -1))
+	if runes := []rune(body); len(runes) > MAX_CHAT_BODY {
+		body = string(runes[:MAX_CHAT_BODY]) + "\n..."
+	}
+	return body
+}
+
+// Returns a Teams message with an adaptive card describing the summary.
+func TeamsCard(summary *SentSummary) map[string]interface{} {
+	facts := make([]map[string]string, 0)
+	for _, fact := range chatFacts(summary) {
+		facts = append(facts, map[string]string{"title": fact[0], "value": fact[1]})
+	}
+
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []map[string]interface{}{
+			{"type": "TextBlock", "text": summary.Subject, "weight": "Bolder", "size": "Medium", "wrap": true},
+			{"type": "FactSet", "facts": facts},
+			{"type": "TextBlock", "text": chatBody(summary), "fontType": "Monospace", "wrap": true},
+		},
+	}
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{
+			{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}
+
+// Returns a Google Chat message with a card describing the summary.
+func GoogleChatCard(summary *SentSummary) map[string]interface{} {
+	widgets := make([]map[string]interface{}, 0)
+	for _, fact := range chatFacts(summary) {
+		widgets = append(widgets, map[string]interface{}{
+			"decoratedText": map[string]string{"topLabel": fact[0], "text": html.EscapeString(fact[1])},
+		})
+	}
+	body := strings.Replace(html.EscapeString(chatBody(summary)), "\n", "<br>", -1)
+	widgets = append(widgets, map[string]interface{}{
+		"textParagraph": map[string]string{"text": body},
+	})
+
+	card := map[string]interface{}{
+		"header":   map[string]string{"title": summary.Subject, "subtitle": "failmail"},
+		"sections": []map[string]interface{}{{"widgets": widgets}},
+	}
+	return map[string]interface{}{
+		"cardsV2": []map[string]interface{}{{"cardId": "failmail", "card": card}},
+	}
+}
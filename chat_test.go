@@ -0,0 +1,90 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatUpstream(t *testing.T) {
+	for _, format := range []string{CHAT_TEAMS, CHAT_GOOGLE_CHAT} {
+		posts := make(chan map[string]interface{}, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			card := make(map[string]interface{}, 0)
+			json.NewDecoder(r.Body).Decode(&card)
+			posts <- card
+		}))
+
+		relay := &TestUpstream{make([]OutgoingMessage, 0), nil}
+		upstream := &ChatUpstream{format, server.URL, time.Second, relay}
+
+		summary := makeSummaryMessage(t, "Subject: error in db\r\n\r\ntimeout\r\n")
+		summary.Key = "db"
+		if err := upstream.Send(summary); err != nil {
+			t.Fatalf("unexpected error sending summary: %s", err)
+		}
+		msg := &message{"test@example.com", []string{"ops@example.com"}, []byte("Subject: relayed\r\n\r\nbody\r\n")}
+		if err := upstream.Send(msg); err != nil {
+			t.Fatalf("unexpected error sending message: %s", err)
+		}
+		server.Close()
+
+		if count := len(relay.Sends); count != 2 {
+			t.Errorf("expected both messages to be sent, got %d", count)
+		}
+		if count := len(posts); count != 1 {
+			t.Fatalf("expected one card to be posted for %s, got %d", format, count)
+		}
+		posted, _ := json.Marshal(<-posts)
+		for _, expected := range []string{`"test"`, `"db"`, `timeout`} {
+			if !strings.Contains(string(posted), expected) {
+				t.Errorf("expected %s card to contain %s: %s", format, expected, posted)
+			}
+		}
+	}
+}
+
+func TestChatUpstreamErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	relay := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	upstream := &ChatUpstream{CHAT_TEAMS, server.URL, time.Second, relay}
+	if err := upstream.Send(makeSummaryMessage(t, "Subject: error in db\r\n\r\ntimeout\r\n")); err != nil {
+		t.Errorf("unexpected error when the webhook fails: %s", err)
+	} else if len(relay.Sends) != 1 {
+		t.Errorf("expected the summary to be sent")
+	}
+}
+
+func TestChatBody(t *testing.T) {
+	summary := &SentSummary{Body: "line 1\r\nline 2\r\n"}
+	if body := chatBody(summary); body != "line 1\nline 2" {
+		t.Errorf("unexpected body: %#v", body)
+	}
+
+	summary.Body = strings.Repeat("x", MAX_CHAT_BODY+10)
+	if body := chatBody(summary); len(body) != MAX_CHAT_BODY+4 || !strings.HasSuffix(body, "\n...") {
+		t.Errorf("expected long body to be cut short, got %d characters", len(body))
+	}
+}
+
+func TestGoogleChatCardEscapes(t *testing.T) {
+	card := GoogleChatCard(&SentSummary{Subject: "test", Key: "<db>", Body: "a < b\nc"})
+	section := card["cardsV2"].([]map[string]interface{})[0]["card"].(map[string]interface{})["sections"]
+	widgets := section.([]map[string]interface{})[0]["widgets"].([]map[string]interface{})
+	if text := widgets[1]["decoratedText"].(map[string]string)["text"]; text != "&lt;db&gt;" {
+		t.Errorf("expected batch key to be escaped: %#v", text)
+	}
+	if text := widgets[2]["textParagraph"].(map[string]string)["text"]; text != "a &lt; b<br>c" {
+		t.Errorf("expected body to be escaped: %#v", text)
+	}
+}
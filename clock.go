@@ -0,0 +1,145 @@
+// Clocks, for testing how messages are batched without waiting for them to
+// be. `MessageBuffer`, `Maildir`, `MessageWriter`, and `Sender` tell the time
+// and wait with a `Clock`, so that embedders (and `failmail test`) can give
+// them a `VirtualClock` and simulate hours of batching in milliseconds.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// `Clock` tells the time, and waits for it to pass.
+type Clock interface {
+	Now() time.Time
+
+	// Returns a channel that receives the time once `d` has passed.
+	After(d time.Duration) <-chan time.Time
+
+	// Blocks until `d` has passed.
+	Sleep(d time.Duration)
+}
+
+// `SystemClock` is the real clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return nowGetter()
+}
+
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (SystemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// Returns `clock`, or the system clock if it's nil.
+func clockOr(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock{}
+	}
+	return clock
+}
+
+// `VirtualClock` is a clock that only moves when it's advanced. Anything
+// waiting on it is woken once the clock has been advanced past the time it's
+// waiting for. It's safe to use from multiple goroutines.
+type VirtualClock struct {
+	now     time.Time
+	waiters []*virtualWaiter
+	lock    sync.Mutex
+}
+
+type virtualWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start, waiters: make([]*virtualWaiter, 0)}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &virtualWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+// Blocks until another goroutine advances the clock by `d`.
+func (c *VirtualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Moves the clock forward by `d`, wakes anything waiting for a time up to
+// the new time, and returns the new time. Like `time.After`, the channels
+// returned by `After` receive the time when they're woken.
+func (c *VirtualClock) Advance(d time.Duration) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+
+	waiting := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			waiting = append(waiting, waiter)
+		} else {
+			waiter.ch <- c.now
+		}
+	}
+	c.waiters = waiting
+	return c.now
+}
+
+// `ticker` fires every `every` on a `Clock`, at fixed times from when it was
+// created, so that the time spent handling one tick doesn't push the rest
+// back. Ticks that were missed while handling one are skipped.
+type ticker struct {
+	C     <-chan time.Time
+	clock Clock
+	every time.Duration
+	next  time.Time
+}
+
+func newTicker(clock Clock, every time.Duration) *ticker {
+	t := &ticker{clock: clock, every: every, next: clock.Now()}
+	t.Next()
+	return t
+}
+
+// Sets `C` to receive the next tick. Call it after each tick is received.
+func (t *ticker) Next() {
+	now := t.clock.Now()
+	t.next = t.next.Add(t.every)
+	if behind := now.Sub(t.next); t.every > 0 && behind >= 0 {
+		t.next = t.next.Add((behind/t.every + 1) * t.every)
+	} else if t.next.Sub(now) > t.every {
+		// The clock went backwards, so start again from now.
+		t.next = now.Add(t.every)
+	}
+	t.C = t.clock.After(t.next.Sub(now))
+}
+
+// Changes how often the ticker fires, if it's different, starting over from
+// now.
+func (t *ticker) Adjust(every time.Duration) {
+	if every == t.every {
+		return
+	}
+	t.every = every
+	t.next = t.clock.Now()
+	t.Next()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Unix(1393650000, 0)
+	clock := NewVirtualClock(start)
+
+	soon := clock.After(time.Minute)
+	later := clock.After(time.Hour)
+	select {
+	case <-soon:
+		t.Fatalf("expected After() not to fire before the clock moves")
+	default:
+	}
+
+	if now := clock.Advance(2 * time.Minute); !now.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("expected Advance() to return the new time, got %s", now)
+	}
+	select {
+	case fired := <-soon:
+		if !fired.Equal(start.Add(2 * time.Minute)) {
+			t.Errorf("expected After() to receive the time it fired, got %s", fired)
+		}
+	default:
+		t.Errorf("expected After() to fire once the clock passed it")
+	}
+	select {
+	case <-later:
+		t.Errorf("expected After() not to fire before its time")
+	default:
+	}
+
+	clock.Advance(time.Hour)
+	select {
+	case <-later:
+	default:
+		t.Errorf("expected After() to fire once the clock passed it")
+	}
+	if now := clock.Now(); !now.Equal(start.Add(62 * time.Minute)) {
+		t.Errorf("unexpected time %s", now)
+	}
+}
+
+func TestTicker(t *testing.T) {
+	start := time.Unix(1393650000, 0)
+	clock := NewVirtualClock(start)
+	tick := newTicker(clock, time.Minute)
+
+	// Handling a tick late doesn't push the next one back.
+	clock.Advance(90 * time.Second)
+	if fired := <-tick.C; !fired.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("unexpected tick at %s", fired)
+	}
+	tick.Next()
+	clock.Advance(29 * time.Second)
+	select {
+	case <-tick.C:
+		t.Errorf("expected no tick before the next minute")
+	default:
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-tick.C:
+	default:
+		t.Errorf("expected a tick on the minute")
+	}
+
+	// Ticks missed while handling one are skipped.
+	clock.Advance(5*time.Minute + 10*time.Second)
+	tick.Next()
+	if tick.next != start.Add(8*time.Minute) {
+		t.Errorf("expected the next tick on the next minute, got %s", tick.next.Sub(start))
+	}
+
+	// Adjusting the ticker starts over from the current time.
+	tick.Adjust(time.Hour)
+	if tick.next != start.Add(7*time.Minute+10*time.Second+time.Hour) {
+		t.Errorf("expected the next tick an hour from now, got %s", tick.next.Sub(start))
+	}
+}
+
+// Advances the clock a step at a time until `done` is closed, or fails the
+// test after `steps` steps.
+func advanceUntil(t *testing.T, clock *VirtualClock, step time.Duration, steps int, done <-chan bool) {
+	for i := 0; i < steps; i++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+			clock.Advance(step)
+		}
+	}
+	t.Fatalf("expected to finish within %s of virtual time", time.Duration(steps)*step)
+}
+
+func TestMessageBufferWithVirtualClock(t *testing.T) {
+	start := time.Unix(1393650000, 0)
+	clock := NewVirtualClock(start)
+	buf := makeMessageBuffer()
+	buf.SoftLimit = 10 * time.Minute
+	buf.HardLimit = time.Hour
+	buf.Clock = clock
+
+	outgoing := make(chan *SendRequest, 1)
+	done := make(chan TerminationRequest, 1)
+	buf.Store.Add(clock.Now(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	go buf.Run(context.Background(), time.Minute, outgoing, done)
+	defer func() { done <- GracefulShutdown }()
+
+	sent := make(chan bool, 0)
+	var summary *SummaryMessage
+	go func() {
+		req := <-outgoing
+		summary = req.Message.(*SummaryMessage)
+		req.SendErrors <- nil
+		close(sent)
+	}()
+	advanceUntil(t, clock, time.Minute, 1000, sent)
+
+	if elapsed := summary.Date.Sub(start); elapsed < buf.SoftLimit || elapsed > buf.SoftLimit+2*time.Minute {
+		t.Errorf("expected the summary to be sent when due on the virtual clock, got %s", elapsed)
+	}
+}
+
+func TestMessageBufferFlushTick(t *testing.T) {
+	start := time.Unix(1393650000, 0)
+	clock := NewVirtualClock(start)
+	buf := makeMessageBuffer()
+	buf.SoftLimit = time.Minute
+	buf.HardLimit = time.Hour
+	buf.FlushTick = time.Minute
+	buf.Clock = clock
+	wakeup := make(chan bool, 1)
+	buf.Wakeup = wakeup
+
+	outgoing := make(chan *SendRequest, 1)
+	done := make(chan TerminationRequest, 1)
+	buf.Store.Add(clock.Now(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	wakeup <- true
+	go buf.Run(context.Background(), 10*time.Minute, outgoing, done)
+	defer func() { done <- GracefulShutdown }()
+
+	sent := make(chan bool, 0)
+	var summary *SummaryMessage
+	go func() {
+		req := <-outgoing
+		summary = req.Message.(*SummaryMessage)
+		req.SendErrors <- nil
+		close(sent)
+	}()
+	advanceUntil(t, clock, time.Minute, 1000, sent)
+
+	if elapsed := summary.Date.Sub(start); elapsed >= 10*time.Minute {
+		t.Errorf("expected the summary to be sent on a flush tick before the next poll, got %s", elapsed)
+	}
+	if stats := buf.Stats(); stats.PollEvery != "10m0s" || stats.FlushEvery != "1m0s" {
+		t.Errorf("unexpected timers in stats: %s, %s", stats.PollEvery, stats.FlushEvery)
+	}
+}
+
+func TestSenderWithVirtualClock(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1393650000, 0))
+	upstream := &FlakyUpstream{Failures: 2}
+	sender := &Sender{Upstream: upstream, Retries: 2, RetryWait: time.Hour, Clock: clock}
+
+	sent := make(chan bool, 0)
+	var err error
+	go func() {
+		err = sender.send(context.Background(), makeSummaryMessage(t, TEST_MESSAGE))
+		close(sent)
+	}()
+	advanceUntil(t, clock, time.Hour, 10, sent)
+
+	if err != nil || upstream.Attempts != 3 {
+		t.Errorf("expected the send to succeed on the third attempt, got %d attempts and %v", upstream.Attempts, err)
+	}
+}
@@ -0,0 +1,253 @@
+// Tools that run in place of the server, selected by giving the name of the
+// tool as the first command line argument (e.g. `failmail tail`). They accept
+// the same flags and config files as the server, so they can operate directly
+// on the server's configured store.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A `Command` runs a tool using the parsed configuration, writing any output
+// for the user to `out`.
+type Command func(config *Config, out io.Writer) error
+
+var COMMANDS = map[string]Command{
+	"tail":    TailCommand,
+	"inspect": InspectCommand,
+	"replay":  ReplayCommand,
+
+	"mbox-import": MboxImportCommand,
+	"mbox-export": MboxExportCommand,
+
+	"backup":  BackupCommand,
+	"restore": RestoreCommand,
+
+	"bench": BenchCommand,
+	"test":  TestCommand,
+
+	"healthcheck": HealthcheckCommand,
+}
+
+// `TailCommand` lists the messages in the store, oldest first.
+func TailCommand(config *Config, out io.Writer) error {
+	store, err := config.Store()
+	if err != nil {
+		return err
+	}
+
+	stored, err := store.MessagesNewerThan(time.Time{})
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(TimeOrdered(stored)))
+
+	batch := config.Batch()
+	now := nowGetter()
+
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "ID\tAGE\tFROM\tTO\tSUBJECT\tBATCH\n")
+	for _, msg := range stored {
+		key, err := batch(msg.ReceivedMessage)
+		if err != nil {
+			key = fmt.Sprintf("[error: %s]", err)
+		}
+		age := now.Sub(msg.Received) / time.Second * time.Second
+		fmt.Fprintf(writer, "%v\t%s\t%s\t%s\t%#v\t%#v\n",
+			msg.Id,
+			age,
+			msg.Sender(),
+			strings.Join(msg.Recipients(), ","),
+			msg.Parsed.Header.Get("Subject"),
+			key)
+	}
+	return writer.Flush()
+}
+
+// `InspectCommand` prints the full contents of the message in the store whose
+// id is given by the `--message-id` flag.
+func InspectCommand(config *Config, out io.Writer) error {
+	if config.MessageId == "" {
+		return fmt.Errorf("--message-id is required")
+	}
+
+	store, err := config.Store()
+	if err != nil {
+		return err
+	}
+
+	stored, err := store.MessagesNewerThan(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range stored {
+		if fmt.Sprint(msg.Id) != config.MessageId {
+			continue
+		}
+		fmt.Fprintf(out, "Id: %v\r\n", msg.Id)
+		fmt.Fprintf(out, "Received: %s\r\n", msg.Received.Format(time.RFC1123Z))
+		fmt.Fprintf(out, "Envelope-From: %s\r\n", msg.Sender())
+		fmt.Fprintf(out, "Envelope-To: %s\r\n\r\n", strings.Join(msg.Recipients(), ", "))
+		_, err := out.Write(msg.Contents())
+		return err
+	}
+	return fmt.Errorf("no message with id %s in the store", config.MessageId)
+}
+
+// `ReplayCommand` feeds the messages in the maildir given by `--dir` through
+// the batching and summarizing configured for the server, and sends the
+// resulting summaries (or, with `--dry-run`, prints them). This is useful for
+// trying out new templates and batch/group expressions on real messages.
+func ReplayCommand(config *Config, out io.Writer) error {
+	if config.Dir == "" {
+		return fmt.Errorf("--dir is required")
+	}
+
+	var since time.Time
+	if config.Since > 0 {
+		since = nowGetter().Add(-config.Since)
+	}
+	msgs, err := ReadMaildirMessages(&Maildir{Path: config.Dir}, since)
+	if err != nil {
+		return err
+	}
+
+	// Summarize from a throwaway store, so the configured one is untouched.
+	replayConfig := *config
+	replayConfig.MemoryStore = true
+	buffer, err := replayConfig.MakeSummarizer()
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		buffer.Store.Add(msg.Received, msg.ReceivedMessage)
+	}
+
+	var sender *Sender
+	if config.DryRun {
+		sender = &Sender{Upstream: &DebugUpstream{out}}
+	} else if sender, err = config.MakeSender(); err != nil {
+		return err
+	}
+
+	outgoing := make(chan *SendRequest, 64)
+	sent := make(chan bool, 0)
+	go func() {
+		sender.Run(context.Background(), outgoing)
+		sent <- true
+	}()
+
+	err = buffer.Flush(context.Background(), nowGetter(), outgoing, true)
+	close(outgoing)
+	<-sent
+	return err
+}
+
+// Reads the messages in a maildir that were written after `since`. The
+// envelope of each message is taken from its From and To/Cc headers, since
+// plain maildirs don't record it.
+func ReadMaildirMessages(maildir *Maildir, since time.Time) ([]*StoredMessage, error) {
+	files, err := maildir.List(MAILDIR_CUR)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*StoredMessage, 0, len(files))
+	for _, info := range files {
+		if info.IsDir() || info.ModTime().Before(since) {
+			continue
+		}
+
+		data, err := maildir.ReadBytes(info.Name(), MAILDIR_CUR)
+		if err != nil {
+			return result, err
+		}
+		parsed, err := mail.ReadMessage(bytes.NewBuffer(data))
+		if err != nil {
+			return result, fmt.Errorf("couldn't parse %s: %s", info.Name(), err)
+		}
+
+		msg := &ReceivedMessage{message: &message{"", HeaderRecipients(parsed.Header), data}, Parsed: parsed}
+		if from, err := parsed.Header.AddressList("From"); err == nil && len(from) > 0 {
+			msg.From = from[0].Address
+		}
+		result = append(result, &StoredMessage{info.Name(), info.ModTime(), msg})
+	}
+	return result, nil
+}
+
+// `MboxImportCommand` adds the messages in the mbox file given by `--mbox` to
+// the store, as if they had just been received.
+func MboxImportCommand(config *Config, out io.Writer) error {
+	if config.Mbox == "" {
+		return fmt.Errorf("--mbox is required")
+	}
+
+	store, err := config.Store()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(config.Mbox)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	msgs, err := ReadMbox(file)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if _, err := store.Add(nowGetter(), msg); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "imported %s\n", Plural(len(msgs), "message", "messages"))
+	return nil
+}
+
+// `MboxExportCommand` writes the messages in the store (or, if `--dir` is
+// given, the messages in that maildir) to the mbox file given by `--mbox`.
+func MboxExportCommand(config *Config, out io.Writer) error {
+	if config.Mbox == "" {
+		return fmt.Errorf("--mbox is required")
+	}
+
+	var msgs []*StoredMessage
+	var err error
+	if config.Dir != "" {
+		msgs, err = ReadMaildirMessages(&Maildir{Path: config.Dir}, time.Time{})
+	} else if store, storeErr := config.Store(); storeErr != nil {
+		return storeErr
+	} else {
+		msgs, err = store.MessagesNewerThan(time.Time{})
+	}
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(TimeOrdered(msgs)))
+
+	file, err := os.Create(config.Mbox)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := WriteMbox(file, msgs); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "exported %s\n", Plural(len(msgs), "message", "messages"))
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestStoreConfig(t *testing.T, msgs ...string) (*Config, []MessageId, func()) {
+	maildir, cleanup := makeTestMaildir(t)
+
+	store, err := NewDiskStore(maildir)
+	if err != nil {
+		cleanup()
+		t.Fatalf("couldn't create disk store: %s", err)
+	}
+
+	ids := make([]MessageId, 0, len(msgs))
+	for i, msg := range msgs {
+		id, err := store.Add(time.Unix(1393650000+int64(i), 0), makeReceivedMessage(t, msg))
+		if err != nil {
+			cleanup()
+			t.Fatalf("failed to add message to store: %s", err)
+		}
+		ids = append(ids, id)
+	}
+
+	config := Defaults()
+	config.MessageStore = maildir.Path
+	return config, ids, cleanup
+}
+
+func TestTailCommand(t *testing.T) {
+	config, _, cleanup := makeTestStoreConfig(t,
+		"From: test@example.com\r\nTo: test2@example.com\r\nSubject: first\r\nX-Failmail-Split: a\r\n\r\ntest 1\r\n",
+		"From: test@example.com\r\nTo: test2@example.com\r\nSubject: second\r\n\r\ntest 2\r\n")
+	defer cleanup()
+	defer patchTime(time.Unix(1393650060, 0))()
+
+	out := new(bytes.Buffer)
+	if err := TailCommand(config, out); err != nil {
+		t.Fatalf("unexpected error from TailCommand(): %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if count := len(lines); count != 3 {
+		t.Fatalf("expected a header and 2 messages, got %d lines: %s", count, out)
+	}
+	if !strings.HasPrefix(lines[0], "ID") {
+		t.Errorf("unexpected header line: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"first"`) || !strings.Contains(lines[1], `"a"`) || !strings.Contains(lines[1], "1m0s") {
+		t.Errorf("unexpected line for first message: %s", lines[1])
+	}
+	if !strings.Contains(lines[2], `"second"`) || !strings.Contains(lines[2], "test2@example.com") {
+		t.Errorf("unexpected line for second message: %s", lines[2])
+	}
+}
+
+func TestInspectCommand(t *testing.T) {
+	config, ids, cleanup := makeTestStoreConfig(t,
+		"From: test@example.com\r\nTo: test2@example.com\r\nSubject: first\r\n\r\ntest 1\r\n")
+	defer cleanup()
+
+	out := new(bytes.Buffer)
+	config.MessageId = fmt.Sprint(ids[0])
+	if err := InspectCommand(config, out); err != nil {
+		t.Fatalf("unexpected error from InspectCommand(): %s", err)
+	}
+	if !strings.Contains(out.String(), "Envelope-To: test2@example.com") {
+		t.Errorf("expected envelope in output: %s", out)
+	}
+	if !strings.HasSuffix(out.String(), "Subject: first\r\n\r\ntest 1\r\n") {
+		t.Errorf("expected message contents in output: %s", out)
+	}
+
+	config.MessageId = "missing"
+	if err := InspectCommand(config, new(bytes.Buffer)); err == nil {
+		t.Errorf("expected an error inspecting a missing message")
+	}
+
+	config.MessageId = ""
+	if err := InspectCommand(config, new(bytes.Buffer)); err == nil {
+		t.Errorf("expected an error inspecting without a message id")
+	}
+}
+
+func TestReplayCommandDryRun(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	maildir.Write([]byte("From: app@example.com\r\nTo: test@example.com\r\nSubject: error\r\n\r\nbody 1\r\n"))
+	maildir.Write([]byte("From: app@example.com\r\nTo: test@example.com\r\nSubject: error\r\n\r\nbody 2\r\n"))
+
+	config := Defaults()
+	config.Dir = maildir.Path
+	config.DryRun = true
+
+	out := new(bytes.Buffer)
+	if err := ReplayCommand(config, out); err != nil {
+		t.Fatalf("unexpected error from ReplayCommand(): %s", err)
+	}
+	if !strings.Contains(out.String(), "Subject: [failmail] 2 instances: error\r\n") {
+		t.Errorf("expected a summary of both messages: %s", out)
+	}
+	if !strings.Contains(out.String(), "To: test@example.com\r\n") {
+		t.Errorf("expected a summary to the original recipient: %s", out)
+	}
+}
+
+func TestReplayCommandSince(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	maildir.Write([]byte("From: app@example.com\r\nTo: test@example.com\r\nSubject: error\r\n\r\nbody 1\r\n"))
+
+	config := Defaults()
+	config.Dir = maildir.Path
+	config.DryRun = true
+	config.Since = time.Hour
+
+	defer patchTime(time.Now().Add(2 * time.Hour))()
+	out := new(bytes.Buffer)
+	if err := ReplayCommand(config, out); err != nil {
+		t.Fatalf("unexpected error from ReplayCommand(): %s", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no summaries for old messages: %s", out)
+	}
+}
+
+func TestMboxImportExportCommands(t *testing.T) {
+	config, _, cleanup := makeTestStoreConfig(t,
+		"From: test@example.com\r\nTo: test2@example.com\r\nSubject: first\r\n\r\ntest 1\r\n")
+	defer cleanup()
+
+	tmp, cleanupDir := makeTestDir(t)
+	defer cleanupDir()
+	config.Mbox = path.Join(tmp, "test.mbox")
+
+	if err := MboxExportCommand(config, new(bytes.Buffer)); err != nil {
+		t.Fatalf("unexpected error from MboxExportCommand(): %s", err)
+	}
+
+	// Avoid clashing with the names of messages already in the maildir.
+	defer patchTime(time.Now().Add(time.Minute))()
+	if err := MboxImportCommand(config, new(bytes.Buffer)); err != nil {
+		t.Fatalf("unexpected error from MboxImportCommand(): %s", err)
+	}
+
+	store, _ := config.Store()
+	if msgs, err := store.MessagesNewerThan(time.Time{}); err != nil {
+		t.Errorf("unexpected error reading store: %s", err)
+	} else if count := len(msgs); count != 2 {
+		t.Errorf("expected the exported message to be imported again, found %d messages", count)
+	} else if to := msgs[1].Recipients(); len(to) != 1 || to[0] != "test2@example.com" {
+		t.Errorf("unexpected recipients for imported message: %v", to)
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
+	"github.com/mpapi/failmail/configure"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -12,37 +14,148 @@ import (
 
 type Config struct {
 	// Options for listening for incoming messages.
-	BindAddr             string        `help:"local bind address"`
-	SocketFd             int           `help:"file descriptor of socket to listen on"`
+	BindAddr             string        `help:"local bind address (or comma-separated addresses)"`
+	SocketFd             string        `help:"file descriptor of socket to listen on (or comma-separated descriptors)"`
 	Credentials          string        `help:"username:password for authenticating to failmail"`
+	CredentialsFile      string        `help:"file of username:bcrypt-hash lines (as from htpasswd -B) for authenticating to failmail, reread on SIGHUP"`
 	TlsCert              string        `help:"PEM certificate file for TLS"`
 	TlsKey               string        `help:"PEM key file for TLS"`
 	Ssl                  bool          `help:"enable TLS immediately (disables STARTTLS)"`
 	ShutdownTimeout      time.Duration `help:"wait this long for open connections to finish when shutting down or reloading"`
+	CommandTimeout       time.Duration `help:"disconnect clients (with a 421) when reading from or writing to them takes this long (0 for no limit)"`
+	IdleTimeout          time.Duration `help:"disconnect clients (with a 421) that take this long to send a command (0 for no limit)"`
+	MaxConnections       int           `help:"refuse connections (with a 421) while this many are open (0 for no limit)"`
+	MessageRate          float64       `help:"refuse messages (with a 450) from each client IP sending more than this many per second (0 for no limit)"`
+	MessageBurst         int           `help:"let each client IP send this many messages at once before --message-rate applies"`
+	AllowFrom            string        `help:"accept connections only from clients in these comma-separated networks (e.g. 10.0.0.0/8)"`
+	DenyFrom             string        `help:"refuse connections (with a 554) from clients in these comma-separated networks, even if --allow-from allows them"`
 	DebugReceiver        bool          `help:"log traffic sent to and from downstream connections"`
 	RewriteSrc           string        `help:"pattern to match on recipients for address rewriting"`
 	RewriteDest          string        `help:"rewrite matching recipients to this address"`
+	RewriteLog           bool          `help:"log each recipient checked against --rewrite-src, and what it's rewritten to"`
+	RewriteDryRun        bool          `help:"log the rewrites --rewrite-src and --rewrite-dest would make, without making them"`
 	AllowUnencryptedAuth bool          `help:"allow non-hashed authentication over unencrypted connections"`
+	RequireTls           bool          `help:"refuse MAIL, RCPT, and DATA (with a 530) until the client switches to TLS with STARTTLS"`
+	SubmitApi            bool          `help:"accept messages POSTed as JSON or raw RFC 822 to /api/messages on the HTTP server"`
+	SubmitOrigins        string        `help:"comma-separated origins of web pages allowed to submit messages with --submit-api (or * for any)"`
+	AutoGenerated        string        `help:"what to do with auto-generated mail (e.g. vacation replies): keep, drop, or batch"`
+	MaxReceived          int           `help:"treat messages with more than this many Received headers as mail loops"`
+	Loops                string        `help:"what to do with messages that loop back through failmail: reject or quarantine"`
+	LoopAlertTo          string        `help:"send summaries of quarantined looping messages to this address"`
+	MaxMessageSize       int           `help:"refuse messages larger than this many bytes (0 for no limit)"`
+	MaxMemory            int           `help:"refuse messages with a temporary error while connections hold this many bytes of message data in memory (0 for no limit)"`
+	SpoolData            bool          `help:"write incoming message data straight to the store instead of holding it in memory"`
+	AcceptBareLF         bool          `help:"accept lines terminated with a bare LF instead of CRLF"`
+	ReadOnly             bool          `help:"answer SMTP but refuse messages with a temporary error (e.g. for maintenance)"`
+
+	// Options for reading the systemd journal.
+	Journal         bool   `help:"also read entries from the systemd journal, and summarize them like received messages"`
+	JournalTo       string `help:"comma-separated addresses to send summaries of journal entries to"`
+	JournalPriority string `help:"read only journal entries of this priority or more urgent (e.g. err, warning)"`
+	JournalMatch    string `help:"space-separated journalctl matches selecting the journal entries to read (e.g. _SYSTEMD_UNIT=nginx.service)"`
+	JournalFilter   string `help:"an expression selecting the journal entries to summarize; others are skipped"`
+	JournalCursor   string `help:"remember the position in the journal in this file, so that entries logged while failmail is stopped aren't missed"`
 
 	// Options for storing messages.
-	MemoryStore  bool   `help:"store messages in memory instead of an on-disk maildir"`
-	MessageStore string `help:"use this directory as a maildir for holding received messages"`
+	MemoryStore      bool          `help:"store messages in memory instead of an on-disk maildir"`
+	MessageStore     string        `help:"use this directory as a maildir for holding received messages"`
+	DurableStore     bool          `help:"sync received messages to disk before acknowledging them"`
+	StoreBatch       int           `help:"store up to this many waiting messages at once (1 to store each separately)"`
+	BatchFilter      string        `help:"an expression selecting the messages to batch; others are relayed upstream immediately, as is"`
+	CountOnly        string        `help:"for batches with keys matching this pattern, store only the first and last messages in each group, and a count"`
+	SampleRate       int           `help:"store only one in this many messages in each group (all are counted)"`
+	SampleRules      string        `help:"semicolon-separated pattern=N rules setting the sample rate for groups with matching keys"`
+	MaxStoreMessages int           `help:"refuse new messages while the store holds this many (0 for no limit)"`
+	MaxStoreBytes    int           `help:"refuse new messages while the store holds this many bytes (0 for no limit)"`
+	DedupWindow      time.Duration `help:"drop messages with the same Message-ID as one stored this recently (0 to disable)"`
+	DedupContent     time.Duration `help:"store messages identical to one stored this recently (but for their Message-IDs and dates) once, with a count (0 to disable)"`
 
 	// Options for summarizing messages.
-	From       string        `help:"from address"`
-	WaitPeriod time.Duration `help:"wait this long for more batchable messages"`
-	MaxWait    time.Duration `help:"wait at most this long from first message to send summary"`
-	Poll       time.Duration `help:"check the store for new messages this frequently"`
-	BatchExpr  string        `help:"an expression used to determine how messages are batched into summary emails"`
-	GroupExpr  string        `help:"an expression used to determine how messages are grouped within summary emails"`
-	Template   string        `help:"path to a summary message template file"`
+	From                string        `help:"from address"`
+	EnvelopeFrom        string        `help:"envelope sender (Return-Path) of summaries, for bounces, if it should differ from --from"`
+	Verp                bool          `help:"send each summary from a variant of --envelope-from (or --from) identifying its batch, id, and recipient, so bounces can be traced"`
+	WaitPeriod          time.Duration `help:"wait this long for more batchable messages"`
+	MaxWait             time.Duration `help:"wait at most this long from first message to send summary"`
+	Poll                time.Duration `help:"check the store for new messages this frequently"`
+	FlushTick           time.Duration `help:"check for batches that are due this frequently, between checks of the store (0 to check only with --poll)"`
+	MaxPoll             time.Duration `help:"while the store is idle, check it less and less often, up to this long apart (0 to always check every --poll)"`
+	DrainTimeout        time.Duration `help:"on SIGQUIT, wait at most this long for batches to come due before sending the rest"`
+	WatchStore          bool          `help:"also check the store as soon as new messages are written to it (Linux only)"`
+	MaxSummarySize      int           `help:"split summaries larger than this many bytes into several emails (0 for no limit)"`
+	RelaySizeCheck      time.Duration `help:"check the relay's SIZE limit at startup and this often, and split or truncate summaries to fit it (0 to disable)"`
+	UrgentAfter         int           `help:"mark summaries of at least this many messages as urgent (0 to disable)"`
+	TopOffenders        int           `help:"rank this many groups by count, and by growth since the last summary, at the head of each summary (0 to disable)"`
+	MessageDate         string        `help:"the time of each message in summaries: its Date header (header) or when it was received (received)"`
+	MaxDateSkew         time.Duration `help:"with --message-date=header, use the receive time instead of Date headers this far off from it (0 for no limit)"`
+	Locale              string        `help:"the language of summaries: de, en, es, or fr"`
+	History             string        `help:"keep a history of recent summaries in this file, to note errors that keep coming back"`
+	HistoryLength       int           `help:"with --history, the number of recent summaries of each batch to remember"`
+	KeepReceipts        time.Duration `help:"record which messages were in each summary, for lookup via the API, for this long (0 to disable)"`
+	BatchExpr           string        `help:"an expression used to determine how messages are batched into summary emails"`
+	GroupExpr           string        `help:"an expression used to determine how messages are grouped within summary emails"`
+	GroupKeys           string        `help:"semicolon-separated name=expr expressions to group messages by together, instead of --group-expr"`
+	SeverityExpr        string        `help:"an expression extracting each message's severity (a syslog level name or number), to sort groups in summaries by"`
+	SeverityPassthrough string        `help:"with --severity-expr, relay messages at least this severe upstream immediately, as is, instead of batching them"`
+	ExprLanguage        string        `help:"the language of --batch-expr and --group-expr: template or expr"`
+	Template            string        `help:"path to a summary message template file"`
+	SummaryManifest     bool          `help:"attach a JSON manifest of each summary's groups (with their fingerprints, counts, and message ids) for automation"`
+	Lease               time.Duration `help:"share the store with other senders, summarizing only while holding a lease of this length on it"`
+	MaxSummariesPerHour int           `help:"send at most this many summaries per hour for each batch and recipient (0 for no limit)"`
+	ExpectTraffic       time.Duration `help:"notify recipients if no messages arrive for this long (0 to disable)"`
+	ExpectTrafficScope  string        `help:"whether --expect-traffic applies to all messages or to each batch: global or batch"`
+	Heartbeat           time.Duration `help:"send an all-quiet message to --heartbeat-to after this long without any messages (0 to disable)"`
+	HeartbeatTo         string        `help:"comma-separated addresses to send all-quiet messages to"`
+	ArchiveRecipient    string        `help:"comma-separated addresses to send a copy of every summary to, without adding them to its headers"`
+	SummaryHeaders      string        `help:"semicolon-separated Name: value headers (whose values may be templates) to add to every summary"`
+	Workers             int           `help:"summarize and send up to this many batches at once"`
 
 	// Options for relaying outgoing messages.
-	RelayAddr     string `help:"upstream relay server address"`
-	RelayUser     string `help:"username for auth to relay server"`
-	RelayPassword string `help:"password for auth to relay server"`
-	FailDir       string `help:"write failed sends to this maildir"`
-	AllDir        string `help:"write all sends to this maildir"`
+	RelayAddr        string `help:"upstream relay server address"`
+	RelayUser        string `help:"username for auth to relay server"`
+	RelayPassword    string `help:"password for auth to relay server"`
+	RelayCaFile      string `help:"PEM file of CA certificates to verify the relay server's certificate with, instead of the system's"`
+	RelayPinSha256   string `help:"comma-separated hex SHA-256 hashes of public keys, one of which the relay server's certificate must have"`
+	FailDir          string `help:"write failed sends to this maildir"`
+	AllDir           string `help:"write all sends to this maildir"`
+	DeliverDir       string `help:"instead of relaying summaries, deliver them to a maildir per recipient under this directory"`
+	DeliverFolder    string `help:"with --deliver-dir, the Maildir++ folder to deliver summaries to (default: the inbox)"`
+	VerifyRecipients bool   `help:"check summary recipients with the relay before sending, and write summaries with none it accepts to --fail-dir"`
+
+	// Options for opening issues for summaries.
+	IssueTracker string `help:"open an issue for each batch (or comment on its open issue) as summaries are sent: github or jira"`
+	IssueApi     string `help:"base URL of the issue tracker (default for github: https://api.github.com)"`
+	IssueProject string `help:"GitHub repository (owner/name) or Jira project key to open issues in"`
+	IssueType    string `help:"type of issue to open in Jira"`
+	IssueUser    string `help:"username for auth to Jira (if empty, --issue-token is sent as a bearer token)"`
+	IssueToken   string `help:"API token for auth to the issue tracker"`
+
+	// Options for posting summaries to chat.
+	ChatWebhook string `help:"also post each summary as a card to this incoming webhook URL"`
+	ChatFormat  string `help:"the kind of chat --chat-webhook posts to: teams or google-chat"`
+
+	// Options for publishing summaries for machine consumers.
+	PublishTo  string `help:"also publish each summary as JSON to --publish-url: sqs or kafka"`
+	PublishUrl string `help:"URL of the SQS queue, or of the topic on a Kafka REST Proxy, to publish to"`
+	PublishRaw bool   `help:"also publish messages relayed without being summarized"`
+
+	// Options for retrying failed sends, and alerting when retries run out.
+	SendRetries  int           `help:"retry failed sends this many times before giving up"`
+	RetryWait    time.Duration `help:"wait this long between retries of a failed send"`
+	AlertRelay   string        `help:"relay server for alerts about summaries that couldn't be sent"`
+	AlertTo      string        `help:"send alerts about summaries that couldn't be sent to this address (via --alert-relay)"`
+	AlertWebhook string        `help:"POST alerts about summaries that couldn't be sent to this URL"`
+	AlertSyslog  bool          `help:"log alerts about summaries that couldn't be sent to syslog"`
+
+	// Options for calling external hooks.
+	OnReceiveHook string        `help:"command or URL to call with each received message before storing it"`
+	PreFlushHook  string        `help:"command or URL to call with each batch of messages before summarizing it"`
+	PreSendHook   string        `help:"command or URL to call with each summary before sending it"`
+	HookTimeout   time.Duration `help:"wait this long for a hook to respond"`
+
+	// Options for auditing.
+	AuditLog     string `help:"record each message stored, relayed, dropped, or summarized in this file, as JSON lines"`
+	AuditMaxSize int    `help:"rotate the audit log when it grows past this many bytes (0 to never rotate)"`
+	AuditKeep    int    `help:"keep this many rotated audit logs"`
 
 	// Options that control what gets run.
 	Receiver bool `help:"receive and store incoming messages"`
@@ -52,32 +165,141 @@ type Config struct {
 	BindHTTP string `help:"local bind address for the HTTP server"`
 	Pidfile  string `help:"write a pidfile to this path"`
 
+	// Options for running as a classic daemon.
+	Daemonize bool   `help:"detach from the terminal and run in the background"`
+	LogFile   string `help:"write the log to this file, reopening it on SIGHUP (e.g. after it's rotated)"`
+
+	// Options set by the process being reloaded, for the new one.
+	HttpFd       int `help:"file descriptor of the HTTP server's socket to listen on"`
+	ReloadedFrom int `help:"pid of the process this one was reloaded from, which hands over the pidfile"`
+
+	// Options for command-line tools (e.g. `failmail inspect`).
+	MessageId string        `help:"id of the message in the store to operate on"`
+	Dir       string        `help:"maildir to read messages from"`
+	Since     time.Duration `help:"only use messages newer than this"`
+	DryRun    bool          `help:"print summaries instead of sending them"`
+	Mbox      string        `help:"mbox file to import or export"`
+	To        string        `help:"backup archive for failmail backup to write (.tar, .tar.gz, or .tar.zst)"`
+	Archive   string        `help:"backup archive for failmail restore to read (.tar, .tar.gz, or .tar.zst)"`
+	Spec      string        `help:"spec file to run with failmail test"`
+
+	// Options for `failmail bench`.
+	Rate        string        `help:"send messages at this rate (e.g. 500/s or 100/m)"`
+	Duration    time.Duration `help:"send messages for this long"`
+	Connections int           `help:"send over at most this many SMTP connections at once"`
+
 	Version bool `help:"show the version number and exit"`
+
+	// Settings from `[domain ...]` sections of the config file, by domain.
+	domains map[string]map[string]string
+}
+
+// Accepts a `[domain example.com]` section of the config file, with settings
+// that override the top-level ones for recipients in that domain.
+func (c *Config) SetSection(name string, settings map[string]string) error {
+	parts := strings.Fields(name)
+	if len(parts) != 2 || parts[0] != "domain" {
+		return fmt.Errorf("unknown config file section [%s]", name)
+	}
+	for setting, _ := range settings {
+		if !TENANT_SETTINGS[setting] {
+			return fmt.Errorf("%s can't be set in config file section [%s]", setting, name)
+		}
+	}
+
+	if c.domains == nil {
+		c.domains = make(map[string]map[string]string, 0)
+	}
+	c.domains[strings.ToLower(parts[1])] = settings
+	return nil
+}
+
+// Returns a copy of the config with the settings for the domain applied.
+func (c *Config) forDomain(domain string) (*Config, error) {
+	copied := *c
+	if err := configure.Bind(c.domains[domain], &copied); err != nil {
+		return nil, fmt.Errorf("in config file section [domain %s]: %s", domain, err)
+	}
+	return &copied, nil
+}
+
+// Returns the `Tenant` for each domain with its own settings.
+func (c *Config) Tenants() (map[string]*Tenant, error) {
+	tenants := make(map[string]*Tenant, len(c.domains))
+	for domain, _ := range c.domains {
+		dc, err := c.forDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		tenants[domain] = &Tenant{
+			Batch:     dc.Batch(),
+			SoftLimit: dc.WaitPeriod,
+			HardLimit: dc.MaxWait,
+			Renderer:  dc.SummaryRenderer(),
+		}
+	}
+	return tenants, nil
 }
 
 func Defaults() *Config {
 	return &Config{
 		BindAddr:        "localhost:2525",
 		ShutdownTimeout: 5 * time.Second,
+		CommandTimeout:  5 * time.Minute,
+		MessageBurst:    10,
+		AutoGenerated:   AUTO_GENERATED_KEEP,
+		MaxReceived:     30,
+		Loops:           LOOPS_REJECT,
+
+		JournalPriority: "err",
 
 		MessageStore: "incoming",
+		SampleRate:   1,
+		StoreBatch:   1,
+
+		From:         DefaultFromAddress("failmail"),
+		WaitPeriod:   30 * time.Second,
+		MaxWait:      5 * time.Minute,
+		Poll:         5 * time.Second,
+		DrainTimeout: 10 * time.Minute,
+		Workers:      1,
+		BatchExpr:    `{{.Header.Get "X-Failmail-Split"}}`,
+		GroupExpr:    `{{.Header.Get "Subject"}}`,
+
+		ExprLanguage: "template",
+
+		ExpectTrafficScope: "global",
+		MessageDate:        DATE_HEADER,
+		Locale:             "en",
+		RelaySizeCheck:     time.Hour,
+
+		HistoryLength: 10,
 
-		From:       DefaultFromAddress("failmail"),
-		WaitPeriod: 30 * time.Second,
-		MaxWait:    5 * time.Minute,
-		Poll:       5 * time.Second,
-		BatchExpr:  `{{.Header.Get "X-Failmail-Split"}}`,
-		GroupExpr:  `{{.Header.Get "Subject"}}`,
+		IssueType: "Bug",
 
 		RelayAddr: "localhost:25",
 		FailDir:   "failed",
+		RetryWait: 10 * time.Second,
+
+		HookTimeout: 10 * time.Second,
+
+		AuditMaxSize: 100 * 1024 * 1024,
+		AuditKeep:    5,
 
 		BindHTTP: "localhost:8025",
+
+		Rate:        "100/s",
+		Duration:    10 * time.Second,
+		Connections: 10,
 	}
 }
 
 func (c *Config) Auth() (Auth, error) {
-	if c.Credentials == "" {
+	if c.Credentials != "" && c.CredentialsFile != "" {
+		return nil, fmt.Errorf("--credentials and --credentials-file can't be used together")
+	} else if c.CredentialsFile != "" {
+		return LoadCredentialsFile(c.CredentialsFile, c.AllowUnencryptedAuth)
+	} else if c.Credentials == "" {
 		return nil, nil
 	}
 
@@ -90,19 +312,166 @@ func (c *Config) Auth() (Auth, error) {
 }
 
 func (c *Config) Batch() GroupBy {
-	return GroupByExpr("batch", c.BatchExpr)
+	batch := c.groupBy("batch", c.BatchExpr)
+	if c.AutoGenerated == AUTO_GENERATED_BATCH {
+		batch = GroupByAutoGenerated(batch)
+	}
+	if c.Loops == LOOPS_QUARANTINE {
+		batch = GroupByLoop(c.LoopDetector(), batch)
+	}
+	return batch
 }
 
-func (c *Config) Group() GroupBy {
-	return GroupByExpr("group", c.GroupExpr)
+func (c *Config) LoopDetector() *LoopDetector {
+	return &LoopDetector{
+		MaxReceived: c.MaxReceived,
+		From:        c.From,
+		Quarantine:  c.Loops == LOOPS_QUARANTINE,
+		AlertTo:     c.LoopAlertTo,
+	}
 }
 
-func (c *Config) Upstream() (Upstream, error) {
+func (c *Config) checkLoops() error {
+	switch {
+	case c.Loops != LOOPS_REJECT && c.Loops != LOOPS_QUARANTINE:
+		return fmt.Errorf("--loops must be reject or quarantine")
+	case c.Loops == LOOPS_QUARANTINE && c.LoopAlertTo == "":
+		return fmt.Errorf("--loops=quarantine requires --loop-alert-to")
+	}
+	return nil
+}
+
+// Returns how messages are grouped: by `--group-keys`, if they're given, or
+// else by `--group-expr`.
+func (c *Config) Group() (GroupBy, error) {
+	keys, err := c.CompositeGroup()
+	if err != nil {
+		return nil, err
+	} else if keys != nil {
+		return keys.GroupBy(), nil
+	}
+	return c.groupBy("group", c.GroupExpr), nil
+}
+
+// Returns the `--group-keys` to group messages by, or nil if there are none.
+func (c *Config) CompositeGroup() (*GroupKeys, error) {
+	if c.GroupKeys == "" {
+		return nil, nil
+	}
+	keys, err := ParseGroupKeys(c.GroupKeys, c.groupBy)
+	if err != nil {
+		return nil, fmt.Errorf("--group-keys: %s", err)
+	}
+	return keys, nil
+}
+
+// Returns the `Severities` for --severity-expr, or nil if it isn't given.
+func (c *Config) Severities() (*Severities, error) {
+	if c.SeverityExpr == "" {
+		if c.SeverityPassthrough != "" {
+			return nil, fmt.Errorf("--severity-passthrough requires --severity-expr")
+		}
+		return nil, nil
+	}
+
+	passthrough := NormalizeSeverity(c.SeverityPassthrough)
+	if c.SeverityPassthrough != "" && passthrough == "" {
+		return nil, fmt.Errorf("--severity-passthrough must be one of: %s", strings.Join(JOURNAL_PRIORITIES, ", "))
+	}
+	return &Severities{c.groupBy("severity", c.SeverityExpr), passthrough}, nil
+}
+
+func (c *Config) groupBy(name string, expr string) GroupBy {
+	if c.ExprLanguage == "expr" {
+		return GroupByScript(name, expr)
+	}
+	return GroupByExpr(name, expr)
+}
+
+// Returns a `Hook` that calls `target`, or nil if `target` is empty.
+func (c *Config) Hook(name string, target string) *Hook {
+	if target == "" {
+		return nil
+	}
+	return &Hook{name, target, c.HookTimeout}
+}
+
+// Returns an error if any of the options given are for features that are left
+// out of this build (see minimal.go).
+func (c *Config) CheckBuild() error {
+	if !MINIMAL {
+		return nil
+	}
+
+	excluded := []struct {
+		flag  string
+		given bool
+	}{
+		{"--submit-api", c.SubmitApi},
+		{"--issue-tracker", c.IssueTracker != ""},
+		{"--chat-webhook", c.ChatWebhook != ""},
+		{"--publish-to", c.PublishTo != ""},
+		{"--alert-webhook", c.AlertWebhook != ""},
+		{"--on-receive-hook", isHookURL(c.OnReceiveHook)},
+		{"--pre-flush-hook", isHookURL(c.PreFlushHook)},
+		{"--pre-send-hook", isHookURL(c.PreSendHook)},
+	}
+	for _, option := range excluded {
+		if option.given {
+			return fmt.Errorf("%s is not supported in minimal builds", option.flag)
+		}
+	}
+	return nil
+}
+
+// Returns the upstream for the relay, or for each domain's relay, if any of
+// them have their own.
+func (c *Config) relayUpstream() (Upstream, error) {
+	relayTLS, err := c.RelayTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	var upstream Upstream
-	if c.RelayAddr == "debug" {
+	if c.DeliverDir != "" {
+		upstream = NewLocalUpstream(c.DeliverDir, c.DeliverFolder, c.DurableStore)
+	} else if c.RelayAddr == "debug" {
 		upstream = &DebugUpstream{os.Stdout}
 	} else {
-		upstream = &LiveUpstream{c.RelayAddr, c.RelayUser, c.RelayPassword}
+		upstream = &LiveUpstream{c.RelayAddr, c.RelayUser, c.RelayPassword, relayTLS}
+	}
+
+	domains := make(map[string]Upstream, 0)
+	for domain, settings := range c.domains {
+		if settings["relay-addr"] == "" && settings["relay-user"] == "" && settings["relay-password"] == "" {
+			continue
+		}
+		dc, err := c.forDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		domains[domain] = &LiveUpstream{dc.RelayAddr, dc.RelayUser, dc.RelayPassword, relayTLS}
+	}
+	if len(domains) > 0 {
+		upstream = &DomainUpstream{upstream, domains}
+	}
+	return upstream, nil
+}
+
+func (c *Config) RelayTLSConfig() (*tls.Config, error) {
+	pins := make([]string, 0)
+	for _, pin := range strings.Split(c.RelayPinSha256, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	return RelayTLSConfig(c.RelayCaFile, pins)
+}
+
+func (c *Config) Upstream() (Upstream, error) {
+	upstream, err := c.relayUpstream()
+	if err != nil {
+		return nil, err
 	}
 
 	if c.AllDir != "" {
@@ -112,6 +481,17 @@ func (c *Config) Upstream() (Upstream, error) {
 		}
 		upstream = NewMultiUpstream(&MaildirUpstream{allMaildir}, upstream)
 	}
+
+	// Summaries can also be filed as issues, posted to chat, and published
+	// (except in minimal builds).
+	upstream, err = c.integrationUpstreams(upstream)
+	if err != nil {
+		return upstream, err
+	}
+
+	if hook := c.Hook(HOOK_PRE_SEND, c.PreSendHook); hook != nil {
+		upstream = &HookUpstream{hook, upstream}
+	}
 	return upstream, nil
 }
 
@@ -133,22 +513,55 @@ func (c *Config) TLSConfig() (SessionSecurity, *tls.Config, error) {
 	}
 }
 
-func (c *Config) SocketWithoutTLS() (ServerSocket, error) {
-	if c.SocketFd > 0 {
-		return NewFileServerSocket(uintptr(c.SocketFd))
-	} else {
-		return NewTCPServerSocket(c.BindAddr)
+// Returns a socket for each of the file descriptors in --socket-fd, if it's
+// given (e.g. on reload), or for each of the addresses in --bind-addr.
+func (c *Config) SocketsWithoutTLS() ([]ServerSocket, error) {
+	sockets := make([]ServerSocket, 0)
+	if c.SocketFd != "" && c.SocketFd != "0" {
+		// Check all of the fds before opening any of them.
+		fds := make([]uintptr, 0)
+		for _, fd := range SplitAddresses(c.SocketFd) {
+			n, err := strconv.Atoi(fd)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("--socket-fd must be a comma-separated list of file descriptors")
+			}
+			fds = append(fds, uintptr(n))
+		}
+		for _, fd := range fds {
+			socket, err := NewFileServerSocket(fd)
+			if err != nil {
+				return nil, err
+			}
+			sockets = append(sockets, socket)
+		}
+		return sockets, nil
+	}
+
+	addrs := SplitAddresses(c.BindAddr)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("--bind-addr must have at least one address")
 	}
+	for _, addr := range addrs {
+		socket, err := NewTCPServerSocket(addr)
+		if err != nil {
+			for _, opened := range sockets {
+				opened.Close()
+			}
+			return nil, err
+		}
+		sockets = append(sockets, socket)
+	}
+	return sockets, nil
 }
 
-func (c *Config) Socket() (ServerSocket, error) {
-	socket, err := c.SocketWithoutTLS()
+func (c *Config) Sockets() ([]ServerSocket, error) {
+	sockets, err := c.SocketsWithoutTLS()
 	if err != nil {
 		return nil, err
 	}
 
 	if !c.Ssl {
-		return socket, nil
+		return sockets, nil
 	}
 
 	security, conf, err := c.TLSConfig()
@@ -157,10 +570,33 @@ func (c *Config) Socket() (ServerSocket, error) {
 	}
 
 	if security == SSL {
-		return NewSSLServerSocket(socket, conf), nil
-	} else {
+		for i, socket := range sockets {
+			sockets[i] = NewSSLServerSocket(socket, conf)
+		}
+	}
+	return sockets, nil
+}
+
+// Returns a socket for a listener added while failmail is running (see
+// `ListenerSet`), wrapped in SSL like the others.
+func (c *Config) SocketFor(addr string) (ServerSocket, error) {
+	socket, err := NewTCPServerSocket(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.Ssl {
 		return socket, nil
 	}
+
+	security, conf, err := c.TLSConfig()
+	if err != nil {
+		socket.Close()
+		return nil, err
+	} else if security == SSL {
+		return NewSSLServerSocket(socket, conf), nil
+	}
+	return socket, nil
 }
 
 func (c *Config) SummaryRenderer() SummaryRenderer {
@@ -178,7 +614,7 @@ func (c *Config) Store() (MessageStore, error) {
 	case c.MessageStore == "":
 		return nil, fmt.Errorf("must have either a memory store or a disk-backed store")
 	default:
-		maildir := &Maildir{Path: c.MessageStore}
+		maildir := &Maildir{Path: c.MessageStore, Durable: c.DurableStore}
 		err := maildir.Create()
 		if err != nil {
 			return nil, err
@@ -187,57 +623,415 @@ func (c *Config) Store() (MessageStore, error) {
 	}
 }
 
-func (c *Config) MakeReceiver() (*Listener, error) {
-	auth, err := c.Auth()
+// Returns the backup of the configured disk-backed store, failed maildir,
+// and history file.
+func (c *Config) Backup() (*Backup, error) {
+	store, err := c.Store()
 	if err != nil {
 		return nil, err
 	}
+	disk, ok := store.(*DiskStore)
+	if !ok {
+		return nil, fmt.Errorf("backups require a disk-backed store")
+	}
 
-	security, tlsConfig, err := c.TLSConfig()
-	if err != nil {
+	failed := &Maildir{Path: c.FailDir}
+	if err := failed.Create(); err != nil {
 		return nil, err
 	}
+	return &Backup{Store: disk.Maildir, Failed: failed, History: c.History}, nil
+}
 
+func (c *Config) Rewriter() (AddressRewriter, error) {
 	rewriter := AddressRewriter{}
 	if c.RewriteSrc != "" && c.RewriteDest != "" {
 		rewriter.Source = regexp.MustCompile(c.RewriteSrc)
 		rewriter.Dest = c.RewriteDest
+		rewriter.Log = c.RewriteLog
+		rewriter.DryRun = c.RewriteDryRun
 	} else if c.RewriteSrc != "" || c.RewriteDest != "" {
-		return nil, fmt.Errorf("--rewrite-src and --rewrite-dest must be given together")
+		return rewriter, fmt.Errorf("--rewrite-src and --rewrite-dest must be given together")
+	} else if c.RewriteLog || c.RewriteDryRun {
+		return rewriter, fmt.Errorf("--rewrite-log and --rewrite-dry-run require --rewrite-src and --rewrite-dest")
+	}
+	return rewriter, nil
+}
+
+// Returns a listener for each socket (see `Sockets()`). The listeners share
+// their settings, including the memory budget and the connection limit.
+func (c *Config) MakeReceivers() ([]*Listener, error) {
+	auth, err := c.Auth()
+	if err != nil {
+		return nil, err
+	}
+
+	security, tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	// The listener talks SMTP to clients, and puts any messages they send onto
+	if c.RequireTls && security == UNENCRYPTED {
+		return nil, fmt.Errorf("--require-tls requires --tls-cert and --tls-key")
+	}
+
+	rewriter, err := c.Rewriter()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkLoops(); err != nil {
+		return nil, err
+	}
+
+	if c.CommandTimeout < 0 || c.IdleTimeout < 0 {
+		return nil, fmt.Errorf("--command-timeout and --idle-timeout must not be negative")
+	}
+
+	if c.MessageRate < 0 {
+		return nil, fmt.Errorf("--message-rate must not be negative")
+	} else if c.MessageRate > 0 && c.MessageBurst < 1 {
+		return nil, fmt.Errorf("--message-burst must be at least 1")
+	}
+
+	access, err := NewAccessList(c.AllowFrom, c.DenyFrom)
+	if err != nil {
+		return nil, fmt.Errorf("--allow-from and --deny-from must be comma-separated networks: %s", err)
+	}
+
+	// The listeners talk SMTP to clients, and put any messages they send onto
 	// the `received` channel.
-	if socket, err := c.Socket(); err != nil {
+	sockets, err := c.Sockets()
+	if err != nil {
+		return nil, err
+	}
+	loops := c.LoopDetector()
+	memory := NewMemoryBudget(int64(c.MaxMemory))
+	maxConns := NewConnectionLimit(c.MaxConnections)
+	rate := NewRateLimit(c.MessageRate, c.MessageBurst)
+	listeners := make([]*Listener, 0, len(sockets))
+	for _, socket := range sockets {
+		listeners = append(listeners, &Listener{Socket: socket, Auth: auth, Security: security, TLSConfig: tlsConfig, RequireTLS: c.RequireTls, Debug: c.DebugReceiver, Rewriter: rewriter, Loops: loops, MaxSize: c.MaxMessageSize, Memory: memory, BareLF: c.AcceptBareLF, CommandTimeout: c.CommandTimeout, IdleTimeout: c.IdleTimeout, MaxConns: maxConns, Rate: rate, Access: access})
+	}
+	return listeners, nil
+}
+
+// Returns a spool for incoming message data if --spool-data is given. Since
+// spooled data is moved into the store as is, it requires a disk-backed store.
+func (c *Config) MakeSpool(store MessageStore) (*Spool, error) {
+	if !c.SpoolData {
+		return nil, nil
+	} else if ds, ok := store.(*DiskStore); ok {
+		return &Spool{ds.Maildir}, nil
+	}
+	return nil, fmt.Errorf("--spool-data requires a disk-backed store")
+}
+
+func (c *Config) MakeSubmitter() (*Submitter, error) {
+	if rewriter, err := c.Rewriter(); err != nil {
 		return nil, err
 	} else {
-		return &Listener{Socket: socket, Auth: auth, Security: security, TLSConfig: tlsConfig, Debug: c.DebugReceiver, Rewriter: rewriter}, nil
+		submitter := NewSubmitter(rewriter)
+		submitter.MaxSize = c.MaxMessageSize
+		submitter.Origins = SplitAddresses(c.SubmitOrigins)
+		return submitter, nil
+	}
+}
+
+// Returns the audit log if --audit-log is given.
+func (c *Config) MakeAuditLog() (*AuditLog, error) {
+	if c.AuditLog == "" {
+		return nil, nil
+	} else if c.AuditKeep < 0 {
+		return nil, fmt.Errorf("--audit-keep must not be negative")
 	}
+	return NewAuditLog(c.AuditLog, int64(c.AuditMaxSize), c.AuditKeep, c.DurableStore, c.Batch())
+}
+
+// Returns a reader for the systemd journal if --journal is given.
+func (c *Config) MakeJournalReader() (*JournalReader, error) {
+	if !c.Journal {
+		return nil, nil
+	}
+
+	to := SplitAddresses(c.JournalTo)
+	if len(to) == 0 {
+		return nil, fmt.Errorf("--journal requires --journal-to")
+	}
+	var filter GroupBy
+	if c.JournalFilter != "" {
+		filter = c.groupBy("journal-filter", c.JournalFilter)
+	}
+	command := JournalCommand(c.JournalCursor, c.JournalPriority, strings.Fields(c.JournalMatch))
+	return NewJournalReader(command, c.From, to, filter), nil
+}
+
+func (c *Config) checkAutoGenerated() error {
+	switch c.AutoGenerated {
+	case AUTO_GENERATED_KEEP, AUTO_GENERATED_DROP, AUTO_GENERATED_BATCH:
+		return nil
+	}
+	return fmt.Errorf("--auto-generated must be keep, drop, or batch")
 }
 
 func (c *Config) MakeWriter() (*MessageWriter, error) {
-	if store, err := c.Store(); err != nil {
+	if err := c.checkAutoGenerated(); err != nil {
+		return nil, err
+	} else if c.StoreBatch < 1 {
+		return nil, fmt.Errorf("--store-batch must be at least 1")
+	}
+	group, err := c.Group()
+	if err != nil {
+		return nil, err
+	}
+
+	var counter *Counter
+	if c.CountOnly != "" {
+		if pattern, err := regexp.Compile(c.CountOnly); err != nil {
+			return nil, fmt.Errorf("invalid --count-only pattern: %s", err)
+		} else {
+			counter = NewCounter(pattern, c.Batch(), group)
+		}
+	}
+
+	var sampler *Sampler
+	if rules, err := ParseSampleRules(c.SampleRules); err != nil {
+		return nil, err
+	} else if c.SampleRate > 1 || len(rules) > 0 {
+		sampler = NewSampler(c.SampleRate, rules, c.Batch(), group)
+	}
+
+	severities, err := c.Severities()
+	if err != nil {
+		return nil, err
+	}
+
+	var relay *Relay
+	if c.BatchFilter != "" || c.SeverityPassthrough != "" {
+		upstream, err := c.Upstream()
+		if err != nil {
+			return nil, err
+		}
+		relay = &Relay{Upstream: upstream, Severities: severities, Group: group}
+		if c.BatchFilter != "" {
+			relay.Filter = c.groupBy("filter", c.BatchFilter)
+		}
+	}
+
+	var duplicates *Duplicates
+	if c.DedupWindow < 0 {
+		return nil, fmt.Errorf("--dedup-window must not be negative")
+	} else if c.DedupWindow > 0 {
+		duplicates = NewDuplicates(c.DedupWindow)
+	}
+
+	var contentDedup *ContentDedup
+	if c.DedupContent < 0 {
+		return nil, fmt.Errorf("--dedup-content must not be negative")
+	} else if c.DedupContent > 0 {
+		if counter != nil || sampler != nil {
+			return nil, fmt.Errorf("--dedup-content can't be used with --count-only, --sample-rate, or --sample-rules")
+		}
+		contentDedup = NewContentDedup(c.DedupContent)
+	}
+
+	store, err := c.Store()
+	if err != nil {
+		return nil, err
+	}
+
+	if limits, err := NewStoreLimits(store, c.MaxStoreMessages, c.MaxStoreBytes); err != nil {
 		return nil, err
 	} else {
-		return &MessageWriter{store}, nil
+		return &MessageWriter{
+			Store:             store,
+			Hook:              c.Hook(HOOK_ON_RECEIVE, c.OnReceiveHook),
+			DropAutoGenerated: c.AutoGenerated == AUTO_GENERATED_DROP,
+			Counter:           counter,
+			Sampler:           sampler,
+			Limits:            limits,
+			MaxBatch:          c.StoreBatch,
+			Relay:             relay,
+			Duplicates:        duplicates,
+			ContentDedup:      contentDedup,
+		}, nil
 	}
 }
 
 func (c *Config) MakeSummarizer() (*MessageBuffer, error) {
-	if store, err := c.Store(); err != nil {
+	if c.ExprLanguage != "template" && c.ExprLanguage != "expr" {
+		return nil, fmt.Errorf("--expr-language must be template or expr")
+	} else if err := c.checkAutoGenerated(); err != nil {
 		return nil, err
-	} else {
-		return &MessageBuffer{
-			SoftLimit: c.WaitPeriod,
-			HardLimit: c.MaxWait,
-			Batch:     c.Batch(),
-			Group:     c.Group(),
-			From:      c.From,
-			Store:     store,
-			Renderer:  c.SummaryRenderer(),
-			batches:   NewBatches(),
-		}, nil
+	} else if err := c.checkLoops(); err != nil {
+		return nil, err
+	}
+
+	groupKeys, err := c.CompositeGroup()
+	if err != nil {
+		return nil, err
+	}
+	group, err := c.Group()
+	if err != nil {
+		return nil, err
+	}
+	var headers *SummaryHeaders
+	if c.SummaryHeaders != "" {
+		if headers, err = ParseSummaryHeaders(c.SummaryHeaders); err != nil {
+			return nil, fmt.Errorf("--summary-headers: %s", err)
+		}
+	}
+
+	store, err := c.Store()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.MessageDate != DATE_HEADER && c.MessageDate != DATE_RECEIVED {
+		return nil, fmt.Errorf("--message-date must be header or received")
+	} else if c.MaxDateSkew < 0 {
+		return nil, fmt.Errorf("--max-date-skew must not be negative")
+	}
+
+	locale, err := FindLocale(c.Locale)
+	if err != nil {
+		return nil, err
+	}
+
+	severities, err := c.Severities()
+	if err != nil {
+		return nil, err
+	}
+
+	var watchdog *Watchdog
+	if c.ExpectTrafficScope != "global" && c.ExpectTrafficScope != "batch" {
+		return nil, fmt.Errorf("--expect-traffic-scope must be global or batch")
+	} else if c.ExpectTraffic > 0 {
+		watchdog = NewWatchdog(c.ExpectTraffic, c.ExpectTrafficScope == "batch", c.From)
+	}
+
+	var heartbeat *Heartbeat
+	if c.Heartbeat > 0 {
+		to := SplitAddresses(c.HeartbeatTo)
+		if len(to) == 0 {
+			return nil, fmt.Errorf("--heartbeat requires --heartbeat-to")
+		}
+		heartbeat = &Heartbeat{Interval: c.Heartbeat, From: c.From, To: to}
+	}
+
+	if c.Workers < 1 {
+		return nil, fmt.Errorf("--workers must be at least 1")
+	}
+	if c.Poll <= 0 {
+		return nil, fmt.Errorf("--poll must be positive")
+	} else if c.FlushTick < 0 {
+		return nil, fmt.Errorf("--flush-tick must not be negative")
+	} else if c.MaxPoll != 0 && c.MaxPoll < c.Poll {
+		return nil, fmt.Errorf("--max-poll must be at least --poll")
+	}
+
+	var lease *Lease
+	if c.Lease > 0 {
+		if c.Lease <= c.Poll {
+			return nil, fmt.Errorf("--lease must be longer than --poll")
+		} else if c.Lease <= c.MaxPoll {
+			return nil, fmt.Errorf("--lease must be longer than --max-poll")
+		} else if lease, err = NewLease(store, c.Lease); err != nil {
+			return nil, err
+		}
+	}
+
+	tenants, err := c.Tenants()
+	if err != nil {
+		return nil, err
+	}
+
+	var history *History
+	if c.History != "" {
+		if c.HistoryLength < 2 {
+			return nil, fmt.Errorf("--history-length must be at least 2")
+		} else if history, err = LoadHistory(c.History, c.HistoryLength); err != nil {
+			return nil, err
+		}
 	}
+
+	var receipts *Receipts
+	if c.KeepReceipts < 0 {
+		return nil, fmt.Errorf("--keep-receipts must not be negative")
+	} else if c.KeepReceipts > 0 {
+		if receipts, err = NewReceipts(store, c.KeepReceipts); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.DrainTimeout < 0 {
+		return nil, fmt.Errorf("--drain-timeout must not be negative")
+	} else if c.TopOffenders < 0 {
+		return nil, fmt.Errorf("--top-offenders must not be negative")
+	}
+
+	var wakeup <-chan bool
+	if c.WatchStore {
+		disk, ok := store.(*DiskStore)
+		if !ok {
+			return nil, fmt.Errorf("--watch-store requires a disk-backed store")
+		}
+		watcher, err := WatchMaildir(disk.Maildir)
+		if err != nil {
+			return nil, err
+		}
+		wakeup = watcher.Changes
+	}
+
+	// Only a relay server has a size limit to check.
+	var relaySize *RelaySize
+	if c.RelaySizeCheck < 0 {
+		return nil, fmt.Errorf("--relay-size-check must not be negative")
+	} else if c.RelaySizeCheck > 0 && c.RelayAddr != "debug" && c.DeliverDir == "" {
+		relayTLS, err := c.RelayTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		relay := &LiveUpstream{c.RelayAddr, c.RelayUser, c.RelayPassword, relayTLS}
+		relaySize = &RelaySize{Relay: relay, Every: c.RelaySizeCheck}
+	}
+
+	return &MessageBuffer{
+		SoftLimit:  c.WaitPeriod,
+		HardLimit:  c.MaxWait,
+		Batch:      c.Batch(),
+		Group:      group,
+		GroupKeys:  groupKeys,
+		Bcc:        SplitAddresses(c.ArchiveRecipient),
+		Headers:    headers,
+		Dates:      &MessageDates{c.MessageDate, c.MaxDateSkew},
+		Locale:     locale,
+		From:       c.From,
+		Sender:     c.EnvelopeFrom,
+		Verp:       c.Verp,
+		Store:      store,
+		Renderer:   c.SummaryRenderer(),
+		Lease:      lease,
+		Hook:       c.Hook(HOOK_PRE_FLUSH, c.PreFlushHook),
+		MaxPerHour: c.MaxSummariesPerHour,
+		Silences:   NewSilences(),
+		Watchdog:   watchdog,
+		Heartbeat:  heartbeat,
+		Workers:    c.Workers,
+		Tenants:    tenants,
+		Wakeup:     wakeup,
+		MaxSize:    c.MaxSummarySize,
+		RelaySize:  relaySize,
+		UrgentAt:   c.UrgentAfter,
+		Offenders:  c.TopOffenders,
+		Severities: severities,
+		Manifest:   c.SummaryManifest,
+		History:    history,
+		Receipts:   receipts,
+		DrainFor:   c.DrainTimeout,
+		FlushTick:  c.FlushTick,
+		MaxPoll:    c.MaxPoll,
+		batches:    NewBatches(),
+	}, nil
 }
 
 func (c *Config) MakeSender() (*Sender, error) {
@@ -251,5 +1045,57 @@ func (c *Config) MakeSender() (*Sender, error) {
 		return nil, err
 	}
 
-	return &Sender{upstream, failedMaildir}, nil
+	alerter, err := c.Alerter()
+	if err != nil {
+		return nil, err
+	}
+
+	var verifier RecipientVerifier
+	if c.VerifyRecipients {
+		if c.RelayAddr == "debug" || c.DeliverDir != "" {
+			return nil, fmt.Errorf("--verify-recipients requires a relay server")
+		} else if relay, err := c.relayUpstream(); err != nil {
+			return nil, err
+		} else {
+			verifier = relay.(RecipientVerifier)
+		}
+	}
+
+	return &Sender{
+		Upstream:      upstream,
+		FailedMaildir: failedMaildir,
+		Retries:       c.SendRetries,
+		RetryWait:     c.RetryWait,
+		Alerter:       alerter,
+		Verifier:      verifier,
+		Failures:      new(SendFailures),
+	}, nil
+}
+
+// Returns an `Alerter` for the configured alert channels, or nil if there are
+// none.
+func (c *Config) Alerter() (Alerter, error) {
+	alerters := make(MultiAlerter, 0)
+	if c.AlertRelay != "" || c.AlertTo != "" {
+		if c.AlertRelay == "" || c.AlertTo == "" {
+			return nil, fmt.Errorf("--alert-relay and --alert-to must be given together")
+		}
+		upstream := &LiveUpstream{Addr: c.AlertRelay}
+		alerters = append(alerters, &UpstreamAlerter{upstream, c.From, []string{c.AlertTo}})
+	}
+	if c.AlertWebhook != "" {
+		alerters = append(alerters, &WebhookAlerter{c.AlertWebhook, c.HookTimeout})
+	}
+	if c.AlertSyslog {
+		if alerter, err := NewSyslogAlerter(); err != nil {
+			return nil, err
+		} else {
+			alerters = append(alerters, alerter)
+		}
+	}
+
+	if len(alerters) == 0 {
+		return nil, nil
+	}
+	return alerters, nil
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestConfigStoreDisk(t *testing.T) {
@@ -40,3 +41,90 @@ func TestConfigStoreErrorNoDiskOrMemory(t *testing.T) {
 		t.Errorf("expected an error asking for neither memory nor disk stores")
 	}
 }
+
+func TestConfigSetSection(t *testing.T) {
+	config := Defaults()
+	if err := config.SetSection("domain Ops.Example.com", map[string]string{"wait-period": "5m", "relay-addr": "smtp.ops.example.com:25"}); err != nil {
+		t.Fatalf("unexpected error setting a domain section: %s", err)
+	}
+
+	tenants, err := config.Tenants()
+	if err != nil {
+		t.Fatalf("unexpected error getting tenants: %s", err)
+	}
+	if tenant, ok := tenants["ops.example.com"]; !ok {
+		t.Errorf("expected a tenant for the domain: %v", tenants)
+	} else if tenant.SoftLimit != 5*time.Minute || tenant.HardLimit != config.MaxWait {
+		t.Errorf("unexpected settings for the domain: %#v", tenant)
+	}
+
+	upstream, err := config.Upstream()
+	if err != nil {
+		t.Fatalf("unexpected error getting upstream: %s", err)
+	}
+	if domains, ok := upstream.(*DomainUpstream); !ok {
+		t.Errorf("expected a per-domain upstream, got %#v", upstream)
+	} else if live, ok := domains.Domains["ops.example.com"].(*LiveUpstream); !ok || live.Addr != "smtp.ops.example.com:25" {
+		t.Errorf("unexpected upstream for the domain: %#v", domains.Domains)
+	}
+}
+
+func TestConfigSetSectionErrors(t *testing.T) {
+	config := Defaults()
+	if err := config.SetSection("server", map[string]string{}); err == nil {
+		t.Errorf("expected an error for an unknown section")
+	}
+	if err := config.SetSection("domain example.com", map[string]string{"receiver": "true"}); err == nil {
+		t.Errorf("expected an error for a setting that can't be given per domain")
+	}
+}
+
+func TestConfigMultipleReceivers(t *testing.T) {
+	config := Defaults()
+	configure.ParseArgs(config, "test", []string{"test", "--bind-addr", "localhost:10041, localhost:10042", "--max-memory", "1000", "--max-connections", "5", "--message-rate", "2", "--allow-from", "10.0.0.0/8"})
+	listeners, err := config.MakeReceivers()
+	if err != nil {
+		t.Fatalf("unexpected error making receivers: %s", err)
+	}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Socket.Close()
+		}
+	}()
+
+	if len(listeners) != 2 {
+		t.Fatalf("expected a listener for each address, got %d", len(listeners))
+	}
+	if listeners[0].Memory == nil || listeners[0].Memory != listeners[1].Memory {
+		t.Errorf("expected the listeners to share a memory budget")
+	}
+	if listeners[0].MaxConns == nil || listeners[0].MaxConns != listeners[1].MaxConns {
+		t.Errorf("expected the listeners to share a connection limit")
+	}
+	if listeners[0].Rate == nil || listeners[0].Rate != listeners[1].Rate || listeners[0].Rate.Burst != 10 {
+		t.Errorf("expected the listeners to share a rate limit")
+	}
+	if listeners[0].Access == nil || len(listeners[0].Access.Allow) != 1 {
+		t.Errorf("expected the listeners to have an access list")
+	}
+
+	for _, invalid := range []string{"x", "3,-1"} {
+		config = Defaults()
+		configure.ParseArgs(config, "test", []string{"test", "--socket-fd", invalid})
+		if _, err := config.MakeReceivers(); err == nil {
+			t.Errorf("expected an error from --socket-fd=%s", invalid)
+		}
+	}
+
+	config = Defaults()
+	configure.ParseArgs(config, "test", []string{"test", "--deny-from", "10.0.0.0/33"})
+	if _, err := config.MakeReceivers(); err == nil {
+		t.Errorf("expected an error from an invalid --deny-from")
+	}
+
+	config = Defaults()
+	configure.ParseArgs(config, "test", []string{"test", "--require-tls"})
+	if _, err := config.MakeReceivers(); err == nil || err.Error() != "--require-tls requires --tls-cert and --tls-key" {
+		t.Errorf("expected an error from --require-tls without TLS: %v", err)
+	}
+}
@@ -26,7 +26,20 @@ func ConfigParser() p.Parser {
 		p.Label("value", p.Regexp(`[^\n]*`)),
 		p.Literal("\n"),
 		p.ZeroOrMore(continuationLine))
-	return p.ZeroOrMore(p.Any(comment, blank, line))
+	section := p.Series(
+		p.Literal("["),
+		p.Label("section", p.Regexp(`[^\]\n]+`)),
+		p.Literal("]"),
+		p.Regexp(`[ \t]*\n`))
+	return p.ZeroOrMore(p.Any(comment, blank, section, line))
+}
+
+// `Sectioned` is implemented by configs that accept named sections of
+// settings. In a config file, a `[name]` line starts a section, and the
+// settings after it (up to the next section) belong to that section instead
+// of to the config itself.
+type Sectioned interface {
+	SetSection(name string, settings map[string]string) error
 }
 
 func ReadConfig(reader io.Reader, config interface{}) (err error) {
@@ -48,21 +61,49 @@ func ReadConfig(reader io.Reader, config interface{}) (err error) {
 		}
 	}()
 
-	settings := walk(parsed)
-	err = bind(settings, config)
+	settings, sections, names := walk(parsed)
+	if err = bind(settings, config); err != nil {
+		return
+	}
+
+	if len(names) == 0 {
+		return
+	}
+	sectioned, ok := config.(Sectioned)
+	if !ok {
+		return fmt.Errorf("config file sections aren't supported")
+	}
+	for _, name := range names {
+		if err = sectioned.SetSection(name, sections[name]); err != nil {
+			return
+		}
+	}
 	return
 }
 
-func walk(parsed *p.Node) map[string]string {
+// Returns the settings before the first section, the settings in each
+// section, and the names of the sections in the order they appear.
+func walk(parsed *p.Node) (map[string]string, map[string]map[string]string, []string) {
 	settings := make(map[string]string, 0)
+	sections := make(map[string]map[string]string, 0)
+	names := make([]string, 0)
+
+	current := settings
 	for item := parsed.Next; item != nil; item = item.Next {
-		if key, ok := item.Get("key"); ok && key.Text != "" {
+		if section, ok := item.Get("section"); ok && section.Text != "" {
+			name := strings.TrimSpace(section.Text)
+			if _, ok := sections[name]; !ok {
+				sections[name] = make(map[string]string, 0)
+				names = append(names, name)
+			}
+			current = sections[name]
+		} else if key, ok := item.Get("key"); ok && key.Text != "" {
 			if value, ok := item.Get("value"); ok {
-				settings[normalizeFlag(key.Text)] = strings.TrimSpace(value.Text)
+				current[normalizeFlag(key.Text)] = strings.TrimSpace(value.Text)
 			}
 		}
 	}
-	return settings
+	return settings, sections, names
 }
 
 type field struct {
@@ -80,6 +121,10 @@ func fields(structPointer interface{}) []*field {
 	for i := 0; i < structType.NumField(); i++ {
 		fieldType := structType.Field(i)
 		fieldValue := structValue.Field(i)
+		if fieldType.PkgPath != "" {
+			// Unexported fields aren't settings.
+			continue
+		}
 		result = append(result, &field{fieldType, fieldValue})
 	}
 	return result
@@ -118,6 +163,12 @@ func parseConfigValue(fieldType reflect.Type, value string) (reflect.Value, erro
 	}
 }
 
+// Sets the fields of `config` from settings keyed by flag name, e.g. the
+// settings in a config file section.
+func Bind(settings map[string]string, config interface{}) error {
+	return bind(settings, config)
+}
+
 func bind(settings map[string]string, config interface{}) error {
 	for _, f := range fields(config) {
 		if value, ok := settings[normalizeFlag(f.Definition.Name)]; ok && value != "" {
@@ -81,3 +81,47 @@ func TestReadConfig(t *testing.T) {
 		t.Errorf("Expected Third = true, got %v", config.Third)
 	}
 }
+
+type SectionedConfigTest struct {
+	First    int
+	sections map[string]map[string]string
+}
+
+func (c *SectionedConfigTest) SetSection(name string, settings map[string]string) error {
+	if c.sections == nil {
+		c.sections = make(map[string]map[string]string, 0)
+	}
+	c.sections[name] = settings
+	return nil
+}
+
+func TestReadConfigSections(t *testing.T) {
+	buffer := bytes.NewBufferString("first = 1\n\n[one thing]\nfirst = 2\n# A comment\nsecond = x\n[other]\nfirst = 3\n")
+	config := &SectionedConfigTest{}
+	if err := ReadConfig(buffer, config); err != nil {
+		t.Fatalf("unexpected error reading config: %s", err)
+	}
+
+	if config.First != 1 {
+		t.Errorf("Expected First = 1, got %d", config.First)
+	}
+	if one := config.sections["one thing"]; len(one) != 2 || one["first"] != "2" || one["second"] != "x" {
+		t.Errorf("unexpected settings in first section: %v", one)
+	}
+	if other := config.sections["other"]; len(other) != 1 || other["first"] != "3" {
+		t.Errorf("unexpected settings in second section: %v", other)
+	}
+
+	if err := ReadConfig(bytes.NewBufferString("[section]\nfirst = 2\n"), &ReadConfigTest{}); err == nil {
+		t.Errorf("expected an error for sections in a config that doesn't support them")
+	}
+}
+
+func TestWriteSkipsUnexported(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	if err := Write(buffer, &SectionedConfigTest{First: 1}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	} else if buffer.String() != "first = 1\n" {
+		t.Errorf("unexpected config written: %#v", buffer.String())
+	}
+}
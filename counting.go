@@ -0,0 +1,94 @@
+// Counter-only storage for high-volume batches. During an error storm, a
+// batch can receive many thousands of nearly identical messages; rather than
+// storing each of them, failmail can keep only the first and last messages of
+// each group, with the last one carrying a count of the messages it replaced.
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// `Counter` stores messages in batches whose keys match `Pattern` by count,
+// and all other messages normally.
+type Counter struct {
+	Pattern *regexp.Regexp
+	Batch   GroupBy
+	Group   GroupBy
+	groups  map[string]*countedGroup
+}
+
+// Tracks the stored message that stands in for the latest messages in a
+// group.
+type countedGroup struct {
+	last  MessageId // nil if only the first message has been stored
+	count int       // the number of messages `last` stands in for
+}
+
+func NewCounter(pattern *regexp.Regexp, batch GroupBy, group GroupBy) *Counter {
+	return &Counter{pattern, batch, group, make(map[string]*countedGroup, 0)}
+}
+
+// Returns the key of the group the message is counted in, or false if the
+// message should be stored normally.
+func (c *Counter) key(msg *ReceivedMessage) (string, bool) {
+	batch, err := c.Batch(msg)
+	if err != nil || !c.Pattern.MatchString(batch) {
+		return "", false
+	}
+	group, err := c.Group(msg)
+	if err != nil {
+		return "", false
+	}
+	return strings.Join([]string{batch, group, strings.Join(msg.Recipients(), ",")}, "\x00"), true
+}
+
+// Returns true if the message is in a batch that's stored by count.
+func (c *Counter) Counts(msg *ReceivedMessage) bool {
+	_, ok := c.key(msg)
+	return ok
+}
+
+// Adds a message to the store. If it's in a counted group, it replaces the
+// last message stored for the group (unless that message was the first), and
+// is stored with the count of the messages it stands in for.
+func (c *Counter) Add(store MessageStore, now time.Time, msg *ReceivedMessage) (MessageId, error) {
+	key, ok := c.key(msg)
+	if !ok {
+		return store.Add(now, msg)
+	}
+
+	group, ok := c.groups[key]
+	if !ok {
+		// The first message in the group is stored as is.
+		id, err := store.Add(now, msg)
+		if err == nil {
+			c.groups[key] = &countedGroup{}
+		}
+		return id, err
+	}
+
+	msg.Count = 1
+	if group.last != nil {
+		// If the last message is gone, it's been summarized, so this message
+		// starts a new group.
+		if err := store.Remove(group.last); err != nil {
+			log.Printf("starting a new counted group: %s", err)
+			delete(c.groups, key)
+			return c.Add(store, now, msg)
+		}
+		msg.Count = group.count + 1
+	}
+
+	id, err := store.Add(now, msg)
+	if err != nil {
+		// The replaced message is gone, so start over with this group.
+		delete(c.groups, key)
+		return id, err
+	}
+	group.last = id
+	group.count = msg.Count
+	return id, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func makeCounter() *Counter {
+	return NewCounter(
+		regexp.MustCompile(`^noisy$`),
+		GroupByExpr("batch", `{{.Header.Get "X-Failmail-Split"}}`),
+		GroupByExpr("group", `{{.Header.Get "Subject"}}`),
+	)
+}
+
+func TestCounter(t *testing.T) {
+	store := NewMemoryStore()
+	counter := makeCounter()
+	now := time.Unix(1393650000, 0)
+
+	for i := 0; i < 5; i++ {
+		msg := makeReceivedMessage(t, "To: test@example.com\r\nX-Failmail-Split: noisy\r\nSubject: test\r\n\r\nbody\r\n")
+		if _, err := counter.Add(store, now, msg); err != nil {
+			t.Fatalf("unexpected error adding message: %s", err)
+		}
+	}
+	msg := makeReceivedMessage(t, "To: test@example.com\r\nX-Failmail-Split: quiet\r\nSubject: test\r\n\r\nbody\r\n")
+	counter.Add(store, now, msg)
+	counter.Add(store, now, msg)
+
+	stored, _ := store.MessagesNewerThan(time.Time{})
+	if count := len(stored); count != 4 {
+		t.Fatalf("expected first and last counted messages and two normal ones, got %d", count)
+	}
+
+	summary, err := Summarize(GroupByExpr("group", `{{.Header.Get "X-Failmail-Split"}}`), "failmail@example.com", "test@example.com", stored, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error summarizing: %s", err)
+	}
+	if summary.Subject != "[failmail] 7 instances of 2 messages" {
+		t.Errorf("unexpected summary subject: %s", summary.Subject)
+	}
+	for _, unique := range summary.UniqueMessages {
+		if unique.Template == "noisy" && unique.Count != 5 {
+			t.Errorf("unexpected count for counted messages: %d", unique.Count)
+		}
+	}
+}
+
+func TestCounterAfterSummarizing(t *testing.T) {
+	store := NewMemoryStore()
+	counter := makeCounter()
+	now := time.Unix(1393650000, 0)
+
+	add := func() {
+		msg := makeReceivedMessage(t, "To: test@example.com\r\nX-Failmail-Split: noisy\r\nSubject: test\r\n\r\nbody\r\n")
+		if _, err := counter.Add(store, now, msg); err != nil {
+			t.Fatalf("unexpected error adding message: %s", err)
+		}
+	}
+
+	add()
+	add()
+	add()
+
+	// Simulate summarizing by removing everything from the store.
+	stored, _ := store.MessagesNewerThan(time.Time{})
+	for _, msg := range stored {
+		store.Remove(msg.Id)
+	}
+
+	add()
+	add()
+	stored, _ = store.MessagesNewerThan(time.Time{})
+	total := 0
+	for _, msg := range stored {
+		total += msg.Instances()
+	}
+	if len(stored) != 2 || total != 2 {
+		t.Errorf("expected a new counted group after summarizing: %d messages, %d instances", len(stored), total)
+	}
+}
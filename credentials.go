@@ -0,0 +1,116 @@
+// Credentials for more than one user, so that each application sending to
+// failmail can have its own account, and one can be revoked without changing
+// the others. They're read from a file in htpasswd's format, with bcrypt
+// hashes (as written by `htpasswd -B`): a "username:hash" line for each user.
+// The file is reread on SIGHUP, so accounts can be added and removed without
+// restarting.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// `CredentialsFile` checks credentials against the users in the file at
+// `Path`. It's safe to use from multiple goroutines.
+type CredentialsFile struct {
+	Path                 string
+	allowUnencryptedAuth bool
+
+	users map[string]*BcryptHash
+	lock  sync.RWMutex
+}
+
+func LoadCredentialsFile(path string, allowUnencryptedAuth bool) (*CredentialsFile, error) {
+	c := &CredentialsFile{Path: path, allowUnencryptedAuth: allowUnencryptedAuth}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Rereads the file. If it can't be read, or any line in it is invalid, the
+// users from the last time it was read are kept.
+func (c *CredentialsFile) Reload() error {
+	users, err := readCredentials(c.Path)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.users = users
+	return nil
+}
+
+// Rereads the file each time the process gets a SIGHUP. This doesn't return,
+// so it should be run in its own goroutine.
+func (c *CredentialsFile) ReloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := c.Reload(); err != nil {
+			log.Printf("failed to reload credentials file %s: %s", c.Path, err)
+		} else {
+			log.Printf("reloaded credentials file %s: %d users", c.Path, c.Users())
+		}
+	}
+}
+
+// Returns the number of users in the file.
+func (c *CredentialsFile) Users() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.users)
+}
+
+func (c *CredentialsFile) IsPermitted(security SessionSecurity) bool {
+	return security.IsEncrypted() || c.allowUnencryptedAuth
+}
+
+func (c *CredentialsFile) ValidCredentials(token string) (bool, error) {
+	parts := strings.Split(token, "\x00")
+	if len(parts) != 3 {
+		return false, fmt.Errorf("invalid token")
+	}
+
+	c.lock.RLock()
+	hash, ok := c.users[parts[1]]
+	c.lock.RUnlock()
+	return ok && hash.Matches(parts[2]), nil
+}
+
+// Reads "username:hash" lines from the file at `path`, skipping blank lines
+// and comments (starting with "#").
+func readCredentials(path string) (map[string]*BcryptHash, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]*BcryptHash, 0)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: must be in username:hash format", path, line)
+		}
+		hash, err := ParseBcryptHash(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		users[parts[0]] = hash
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const (
+	TEST_HASH_A   = "$2a$06$m0CrhHm10qJ3lXRY.5zDGO3rS2KdeeWLuGmsfGlMfOxih58VYVfxe"
+	TEST_HASH_ABC = "$2a$06$If6bvum7DFjUnE9p2uDeDu0YHzrHM6tf.iqN8.yx.jNN1ILEf7h0i"
+)
+
+func writeCredentialsFile(t *testing.T, file string, contents string) {
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatalf("couldn't write credentials file: %s", err)
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatalf("unable to create a test directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	file := path.Join(tmp, "users")
+	writeCredentialsFile(t, file, "# accounts\nbilling:"+TEST_HASH_A+"\n\nreports:"+TEST_HASH_ABC+"\n")
+	credentials, err := LoadCredentialsFile(file, false)
+	if err != nil {
+		t.Fatalf("unexpected error loading credentials file: %s", err)
+	}
+
+	for token, expected := range map[string]bool{
+		"\x00billing\x00a":   true,
+		"\x00reports\x00abc": true,
+		"\x00billing\x00abc": false,
+		"\x00other\x00a":     false,
+	} {
+		if valid, err := credentials.ValidCredentials(token); err != nil || valid != expected {
+			t.Errorf("expected %#v to be valid: %v, got %v (%v)", token, expected, valid, err)
+		}
+	}
+	if _, err := credentials.ValidCredentials("billing"); err == nil {
+		t.Errorf("expected an error from an invalid token")
+	}
+	if credentials.IsPermitted(UNENCRYPTED) || !credentials.IsPermitted(TLS_POST_STARTTLS) {
+		t.Errorf("expected authentication to require an encrypted connection")
+	}
+
+	// Revoking one account leaves the other.
+	writeCredentialsFile(t, file, "billing:"+TEST_HASH_A+"\n")
+	if err := credentials.Reload(); err != nil {
+		t.Fatalf("unexpected error reloading credentials file: %s", err)
+	}
+	if valid, _ := credentials.ValidCredentials("\x00reports\x00abc"); valid || credentials.Users() != 1 {
+		t.Errorf("expected the revoked account to be refused after reloading")
+	}
+
+	// An invalid file keeps the accounts from the last reload.
+	writeCredentialsFile(t, file, "billing:secret\n")
+	if err := credentials.Reload(); err == nil || err.Error() != file+":1: not a bcrypt hash" {
+		t.Errorf("expected an error reloading an invalid credentials file: %v", err)
+	}
+	if valid, _ := credentials.ValidCredentials("\x00billing\x00a"); !valid {
+		t.Errorf("expected the accounts to be kept after a failed reload")
+	}
+}
+
+func TestLoadCredentialsFileInvalid(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatalf("unable to create a test directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	file := path.Join(tmp, "users")
+	if _, err := LoadCredentialsFile(file, false); err == nil {
+		t.Errorf("expected an error loading a missing credentials file")
+	}
+	writeCredentialsFile(t, file, TEST_HASH_A+"\n")
+	if _, err := LoadCredentialsFile(file, false); err == nil {
+		t.Errorf("expected an error loading a line without a username")
+	}
+	writeCredentialsFile(t, file, "billing:$2a$31$m0CrhHm10qJ3lXRY.5zDGO3rS2KdeeWLuGmsfGlMfOxih58VYVfxe\n")
+	if _, err := LoadCredentialsFile(file, false); err == nil {
+		t.Errorf("expected an error loading a hash with too high a cost")
+	}
+}
+
+func TestConfigCredentialsFile(t *testing.T) {
+	config := Defaults()
+	config.Credentials = "user:pass"
+	config.CredentialsFile = "/nonexistent/users"
+	if _, err := config.Auth(); err == nil {
+		t.Errorf("expected an error from --credentials with --credentials-file")
+	}
+
+	config.Credentials = ""
+	if _, err := config.Auth(); err == nil {
+		t.Errorf("expected an error from a missing --credentials-file")
+	}
+}
@@ -0,0 +1,124 @@
+// Support for running as a classic daemon, for init scripts that don't use
+// systemd or a supervisor. With `--daemonize`, failmail starts a copy of itself
+// detached from the terminal (in its own session, with its standard streams
+// redirected) and exits, and with `--log-file`, it logs to a file that it
+// reopens on SIGHUP, so that it can be rotated.
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Set in the environment of the detached copy, so that it doesn't detach
+// again.
+const DAEMON_ENV = "FAILMAIL_DAEMON"
+
+// Returns true if this process should detach: `--daemonize` was given, and it
+// isn't already the detached copy, or a copy reloaded from it.
+func ShouldDaemonize(config *Config) bool {
+	daemon := os.Getenv(DAEMON_ENV) != ""
+	os.Unsetenv(DAEMON_ENV)
+	return config.Daemonize && !daemon && config.ReloadedFrom == 0
+}
+
+// Starts a copy of this process, with the same arguments, in a new session
+// with no controlling terminal. Its standard input is /dev/null, and its
+// standard output and error go to `logFile` (if there is one, so that panics
+// are logged) or /dev/null. It stays in the working directory, so relative
+// paths in the arguments still work. Returns the copy's pid.
+func Daemonize(logFile string) (int, error) {
+	input, err := os.Open(os.DevNull)
+	if err != nil {
+		return 0, err
+	}
+	defer input.Close()
+
+	var output *os.File
+	if logFile != "" {
+		output, err = os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	} else {
+		output, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer output.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), DAEMON_ENV+"=1")
+	cmd.Stdin = input
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	return pid, cmd.Process.Release()
+}
+
+// `LogFile` is a log file that can be reopened (e.g. after it's been rotated)
+// while it's being written to.
+type LogFile struct {
+	Path string
+	file *os.File
+	lock sync.Mutex
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	logFile := &LogFile{Path: path}
+	if err := logFile.Reopen(); err != nil {
+		return nil, err
+	}
+	return logFile, nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Write(p)
+}
+
+// Opens the file at `Path` again, creating it if it's been moved away, and
+// closes the one that was open.
+func (l *LogFile) Reopen() error {
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	old := l.file
+	l.file = file
+	l.lock.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+func (l *LogFile) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+// Reopens the log file each time the process gets a SIGHUP. This doesn't
+// return, so it should be run in its own goroutine.
+func (l *LogFile) ReopenOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := l.Reopen(); err != nil {
+			log.Printf("failed to reopen log file %s: %s", l.Path, err)
+		} else {
+			log.Printf("reopened log file %s", l.Path)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLogFileReopen(t *testing.T) {
+	testDir, cleanup := makeTestDir(t)
+	defer cleanup()
+
+	logPath := path.Join(testDir, "failmail.log")
+	logFile, err := OpenLogFile(logPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening log file: %s", err)
+	}
+	defer logFile.Close()
+	logFile.Write([]byte("before\n"))
+
+	// After the log is rotated, writes go to the old file until it's
+	// reopened.
+	rotated := path.Join(testDir, "failmail.log.1")
+	os.Rename(logPath, rotated)
+	logFile.Write([]byte("rotating\n"))
+	if err := logFile.Reopen(); err != nil {
+		t.Fatalf("unexpected error reopening log file: %s", err)
+	}
+	logFile.Write([]byte("after\n"))
+
+	if contents, _ := ioutil.ReadFile(rotated); string(contents) != "before\nrotating\n" {
+		t.Errorf("unexpected contents of the rotated log: %#v", string(contents))
+	}
+	if contents, _ := ioutil.ReadFile(logPath); string(contents) != "after\n" {
+		t.Errorf("unexpected contents of the reopened log: %#v", string(contents))
+	}
+}
+
+func TestShouldDaemonize(t *testing.T) {
+	defer os.Unsetenv(DAEMON_ENV)
+
+	config := Defaults()
+	if ShouldDaemonize(config) {
+		t.Errorf("expected not to daemonize without --daemonize")
+	}
+
+	config.Daemonize = true
+	if !ShouldDaemonize(config) {
+		t.Errorf("expected to daemonize with --daemonize")
+	}
+
+	os.Setenv(DAEMON_ENV, "1")
+	if ShouldDaemonize(config) {
+		t.Errorf("expected the detached copy not to daemonize again")
+	}
+
+	config.ReloadedFrom = 1234
+	if ShouldDaemonize(config) {
+		t.Errorf("expected a reloaded copy not to daemonize again")
+	}
+}
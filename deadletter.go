@@ -0,0 +1,195 @@
+// The failed maildir as a dead-letter queue. Messages that couldn't be sent
+// are written to `--fail-dir`, along with their envelopes, and can be listed,
+// read, sent again, or deleted via the HTTP API, rather than by copying the
+// maildir somewhere and resending its messages by hand.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `DeadLetter` describes a message in the failed maildir.
+type DeadLetter struct {
+	Id       string
+	Failed   time.Time
+	From     string
+	To       []string
+	Subject  string
+	Reason   string `json:",omitempty"` // why the message wasn't sent, if it was diverted without trying
+	Size     int
+	Contents string `json:",omitempty"` // only included when a single message is requested
+}
+
+// Writes a message that couldn't be sent to the failed maildir, with its
+// envelope in the maildir's metadata subdirectory (as a `DiskStore` does), so
+// that it can be sent again to the same recipients. Returns its id.
+func SaveDeadLetter(maildir *Maildir, m OutgoingMessage, data []byte) (string, error) {
+	name, err := maildir.Write(data)
+	if err != nil {
+		return "", err
+	}
+	meta, err := json.Marshal(&DiskMetadata{EnvelopeFrom: m.Sender(), EnvelopeTo: m.Recipients()})
+	if err != nil {
+		return name, err
+	}
+	return name, maildir.WriteFile(name, MAILDIR_META, meta, time.Time{})
+}
+
+// `DeadLetters` manages the messages in a `Sender`'s failed maildir. It's safe
+// to use from multiple goroutines.
+type DeadLetters struct {
+	Sender *Sender
+	lock   sync.Mutex // held while messages are being sent again
+}
+
+// Returns true if `id` names a message file in a maildir subdirectory, rather
+// than a path elsewhere.
+func validDeadLetterId(id string) bool {
+	return id != "" && !strings.HasPrefix(id, ".") && !strings.ContainsAny(id, "/\\")
+}
+
+// Reads a message from the failed maildir, returning a description of it and
+// the message itself. Messages written before envelopes were recorded are
+// sent to the addresses in their headers.
+func (d *DeadLetters) read(id string) (*DeadLetter, *ReceivedMessage, error) {
+	maildir := d.Sender.FailedMaildir
+	if !validDeadLetterId(id) {
+		return nil, nil, os.ErrNotExist
+	}
+	info, err := os.Stat(maildir.path(id, MAILDIR_CUR))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := maildir.ReadBytes(id, MAILDIR_CUR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := new(DiskMetadata)
+	if bytes, err := maildir.ReadBytes(id, MAILDIR_META); err == nil {
+		if err := json.Unmarshal(bytes, meta); err != nil {
+			return nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	msg, err := RawMessage(data, meta.EnvelopeFrom, meta.EnvelopeTo)
+	if err != nil {
+		return nil, nil, err
+	}
+	letter := &DeadLetter{
+		Id:      id,
+		Failed:  info.ModTime(),
+		From:    msg.Sender(),
+		To:      msg.Recipients(),
+		Subject: msg.Parsed.Header.Get("Subject"),
+		Reason:  msg.Parsed.Header.Get(FAILURE_HEADER),
+		Size:    len(data),
+	}
+	return letter, msg, nil
+}
+
+// Returns the messages in the failed maildir, oldest first. Messages that
+// can't be read are skipped.
+func (d *DeadLetters) List() ([]*DeadLetter, error) {
+	files, err := d.Sender.FailedMaildir.List(MAILDIR_CUR)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*DeadLetter, 0, len(files))
+	for _, info := range files {
+		if info.IsDir() {
+			continue
+		}
+		if letter, _, err := d.read(info.Name()); err != nil {
+			log.Printf("warning: couldn't read failed message %s: %s", info.Name(), err)
+		} else {
+			letters = append(letters, letter)
+		}
+	}
+	sort.SliceStable(letters, func(i, j int) bool { return letters[i].Failed.Before(letters[j].Failed) })
+	return letters, nil
+}
+
+// Returns a message in the failed maildir, including its contents.
+func (d *DeadLetters) Get(id string) (*DeadLetter, error) {
+	letter, msg, err := d.read(id)
+	if err != nil {
+		return nil, err
+	}
+	letter.Contents = string(msg.Contents())
+	return letter, nil
+}
+
+// Sends a message in the failed maildir again (retrying as the `Sender`
+// does), and removes it from the maildir if it's sent. A message that fails
+// again is left where it is.
+func (d *DeadLetters) Retry(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.retry(id)
+}
+
+func (d *DeadLetters) retry(id string) error {
+	_, msg, err := d.read(id)
+	if err != nil {
+		return err
+	}
+
+	data := SetHeaders(msg.Contents(), map[string]string{FAILURE_HEADER: ""})
+	if err := d.Sender.send(context.Background(), &message{msg.Sender(), msg.Recipients(), data}); err != nil {
+		return err
+	}
+	log.Printf("sent failed message %s", id)
+	return d.remove(id)
+}
+
+// Sends each message in the failed maildir again, and returns the ids of the
+// messages that were sent, and the errors for those that weren't, by id.
+func (d *DeadLetters) RetryAll() ([]string, map[string]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	letters, err := d.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	sent := make([]string, 0, len(letters))
+	failed := make(map[string]string, 0)
+	for _, letter := range letters {
+		if err := d.retry(letter.Id); err != nil {
+			failed[letter.Id] = err.Error()
+		} else {
+			sent = append(sent, letter.Id)
+		}
+	}
+	return sent, failed, nil
+}
+
+// Removes a message from the failed maildir without sending it.
+func (d *DeadLetters) Delete(id string) error {
+	if !validDeadLetterId(id) {
+		return os.ErrNotExist
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.remove(id)
+}
+
+// Removes a message and its envelope, if it has one.
+func (d *DeadLetters) remove(id string) error {
+	maildir := d.Sender.FailedMaildir
+	if err := maildir.Remove(id, MAILDIR_META); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return maildir.Remove(id, MAILDIR_CUR)
+}
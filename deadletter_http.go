@@ -0,0 +1,67 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Serves `/api/dead-letters`: GET lists the failed messages, and POST to
+// `/api/dead-letters/retry` sends all of them again. For a single message,
+// GET `/api/dead-letters/ID` returns it (including its contents), POST to
+// `/api/dead-letters/ID/retry` sends it again, and DELETE deletes it.
+func (d *DeadLetters) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/dead-letters"), "/")
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case rest == "" && r.Method == "GET":
+		if letters, err := d.List(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+		} else {
+			writeJSON(w, letters)
+		}
+	case rest == "retry" && r.Method == "POST":
+		if sent, failed, err := d.RetryAll(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+		} else {
+			writeJSON(w, map[string]interface{}{"Sent": sent, "Failed": failed})
+		}
+	case len(parts) == 1 && rest != "retry" && r.Method == "GET":
+		if letter, err := d.Get(parts[0]); err != nil {
+			writeDeadLetterError(w, parts[0], err)
+		} else {
+			writeJSON(w, letter)
+		}
+	case len(parts) == 1 && rest != "retry" && r.Method == "DELETE":
+		if err := d.Delete(parts[0]); err != nil {
+			writeDeadLetterError(w, parts[0], err)
+		} else {
+			log.Printf("deleted failed message %s", parts[0])
+			writeJSON(w, map[string]string{"Deleted": parts[0]})
+		}
+	case len(parts) == 2 && parts[1] == "retry" && r.Method == "POST":
+		if err := d.Retry(parts[0]); os.IsNotExist(err) {
+			writeDeadLetterError(w, parts[0], err)
+		} else if err != nil {
+			writeJSONError(w, http.StatusBadGateway, err)
+		} else {
+			writeJSON(w, map[string]string{"Sent": parts[0]})
+		}
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func writeDeadLetterError(w http.ResponseWriter, id string, err error) {
+	if os.IsNotExist(err) {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no failed message %s", id))
+	} else {
+		writeJSONError(w, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,70 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeadLettersHTTP(t *testing.T) {
+	upstream := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	dead, cleanup := makeTestDeadLetters(t, upstream)
+	defer cleanup()
+
+	maildir := dead.Sender.FailedMaildir
+	ids := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		id, _ := maildir.Write([]byte("From: failmail@example.com\r\nTo: ops@example.com\r\nSubject: test\r\n\r\ntest\r\n"))
+		ids = append(ids, id)
+	}
+
+	server := NewHTTPServer("")
+	server.Handle("/api/dead-letters", dead)
+	server.Handle("/api/dead-letters/", dead)
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	letters := make([]*DeadLetter, 0)
+	if w := request("GET", "/api/dead-letters"); w.Code != http.StatusOK {
+		t.Errorf("unexpected status listing messages: %d", w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &letters); err != nil || len(letters) != 3 {
+		t.Errorf("expected three messages, got %s (%v)", w.Body.String(), err)
+	}
+
+	if w := request("GET", "/api/dead-letters/"+ids[0]); w.Code != http.StatusOK {
+		t.Errorf("unexpected status reading a message: %d", w.Code)
+	}
+	if w := request("GET", "/api/dead-letters/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown message, got %d", w.Code)
+	}
+
+	if w := request("DELETE", "/api/dead-letters/"+ids[0]); w.Code != http.StatusOK {
+		t.Errorf("unexpected status deleting a message: %d", w.Code)
+	}
+	if w := request("POST", "/api/dead-letters/"+ids[1]+"/retry"); w.Code != http.StatusOK {
+		t.Errorf("unexpected status retrying a message: %d", w.Code)
+	}
+	if len(upstream.Sends) != 1 {
+		t.Errorf("expected one message to be sent, got %d", len(upstream.Sends))
+	}
+
+	result := make(map[string]interface{}, 0)
+	if w := request("POST", "/api/dead-letters/retry"); w.Code != http.StatusOK {
+		t.Errorf("unexpected status retrying all messages: %d", w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Errorf("invalid response %s: %s", w.Body.String(), err)
+	} else if sent := result["Sent"].([]interface{}); len(sent) != 1 || sent[0] != ids[2] {
+		t.Errorf("expected the remaining message to be sent, got %#v", result)
+	}
+
+	if letters, _ := dead.List(); len(letters) != 0 {
+		t.Errorf("expected no messages left, got %#v", letters)
+	}
+}
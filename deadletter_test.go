@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func makeTestDeadLetters(t *testing.T, upstream Upstream) (*DeadLetters, func()) {
+	failedMaildir, cleanup := makeTestMaildir(t)
+	return &DeadLetters{Sender: &Sender{Upstream: upstream, FailedMaildir: failedMaildir}}, cleanup
+}
+
+func TestDeadLettersKeepEnvelope(t *testing.T) {
+	upstream := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	dead, cleanup := makeTestDeadLetters(t, upstream)
+	defer cleanup()
+
+	data := []byte("To: ops@example.com\r\nSubject: test\r\nX-Failmail-Failure: rejected\r\n\r\ntest\r\n")
+	id, err := SaveDeadLetter(dead.Sender.FailedMaildir, &message{"app@example.com", []string{"bcc@example.com"}, data}, data)
+	if err != nil {
+		t.Fatalf("unexpected error saving message: %s", err)
+	}
+
+	letters, err := dead.List()
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("expected one failed message, got %#v (%v)", letters, err)
+	}
+	letter := letters[0]
+	if letter.Id != id || letter.From != "app@example.com" || !reflect.DeepEqual(letter.To, []string{"bcc@example.com"}) {
+		t.Errorf("expected the message's envelope to be kept, got %#v", letter)
+	} else if letter.Subject != "test" || letter.Reason != "rejected" || letter.Contents != "" {
+		t.Errorf("unexpected description of failed message: %#v", letter)
+	}
+
+	if err := dead.Retry(id); err != nil {
+		t.Fatalf("unexpected error retrying message: %s", err)
+	}
+	if len(upstream.Sends) != 1 {
+		t.Fatalf("expected the message to be sent, got %d sends", len(upstream.Sends))
+	}
+	sent := upstream.Sends[0]
+	if sent.Sender() != "app@example.com" || !reflect.DeepEqual(sent.Recipients(), []string{"bcc@example.com"}) {
+		t.Errorf("expected the message to be sent to its envelope, got %s %v", sent.Sender(), sent.Recipients())
+	} else if string(sent.Contents()) != "To: ops@example.com\r\nSubject: test\r\n\r\ntest\r\n" {
+		t.Errorf("expected the failure header to be removed, got %#v", string(sent.Contents()))
+	}
+	if letters, _ := dead.List(); len(letters) != 0 {
+		t.Errorf("expected the sent message to be removed, got %#v", letters)
+	}
+}
+
+func TestDeadLettersWithoutEnvelope(t *testing.T) {
+	upstream := &TestUpstream{make([]OutgoingMessage, 0), errors.New("fail")}
+	dead, cleanup := makeTestDeadLetters(t, upstream)
+	defer cleanup()
+
+	id, _ := dead.Sender.FailedMaildir.Write([]byte("From: failmail@example.com\r\nTo: ops@example.com\r\nSubject: test\r\n\r\ntest\r\n"))
+	letter, err := dead.Get(id)
+	if err != nil {
+		t.Fatalf("unexpected error reading message: %s", err)
+	} else if letter.From != "failmail@example.com" || !reflect.DeepEqual(letter.To, []string{"ops@example.com"}) || letter.Contents == "" {
+		t.Errorf("expected the envelope to come from the headers, got %#v", letter)
+	}
+
+	if err := dead.Retry(id); err == nil {
+		t.Errorf("expected an error retrying the message")
+	} else if _, err := dead.Get(id); err != nil {
+		t.Errorf("expected a message that fails again to be kept: %s", err)
+	}
+
+	if _, err := dead.Get("../cur/" + id); err == nil {
+		t.Errorf("expected an error reading a path outside the maildir")
+	}
+}
@@ -0,0 +1,235 @@
+// Suppression of duplicate messages. An application that times out waiting
+// for the reply to its DATA command often sends the message again, even
+// though the first attempt succeeded. Such duplicates carry the same
+// Message-ID, so failmail remembers the Message-IDs of the messages it stored
+// recently, and drops any message whose Message-ID it's already seen.
+//
+// Messages that are identical but for their Message-IDs and dates (e.g. the
+// same error mailed separately to several people, or repeated verbatim) can
+// also be stored once, with a count, by hashing their contents.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `Duplicates` remembers the Message-IDs of the messages stored in the last
+// `Window`, and counts the duplicates dropped. It's safe to use from multiple
+// goroutines.
+type Duplicates struct {
+	Window  time.Duration
+	seen    map[string]time.Time
+	dropped int
+	pruned  time.Time
+	lock    sync.Mutex
+}
+
+func NewDuplicates(window time.Duration) *Duplicates {
+	return &Duplicates{Window: window, seen: make(map[string]time.Time, 0)}
+}
+
+// Returns the message's Message-ID, or "" if it doesn't have one.
+func messageIdOf(msg *ReceivedMessage) string {
+	if msg.Parsed == nil {
+		return ""
+	}
+	return strings.TrimSpace(msg.Parsed.Header.Get("Message-Id"))
+}
+
+// Returns true (and counts it) if a message with the same Message-ID was
+// stored in the last `Window`. Messages without a Message-ID are never
+// duplicates. A nil `Duplicates` never finds any.
+func (d *Duplicates) IsDuplicate(msg *ReceivedMessage, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	id := messageIdOf(msg)
+	if id == "" {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if seen, ok := d.seen[id]; !ok || now.Sub(seen) >= d.Window {
+		return false
+	}
+	d.dropped += 1
+	log.Printf("dropping duplicate message %s", id)
+	return true
+}
+
+// Remembers the Message-ID of a message that was stored (or relayed), so
+// that later copies of it are dropped. Only messages that were accepted are
+// remembered, so that a client retrying a message that was refused (e.g.
+// because the store was full) isn't mistaken for sending a duplicate. A nil
+// `Duplicates` ignores it.
+func (d *Duplicates) Remember(msg *ReceivedMessage, now time.Time) {
+	if d == nil {
+		return
+	}
+	id := messageIdOf(msg)
+	if id == "" {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.seen[id] = now
+
+	// Forget Message-IDs once they're out of the window, checking at most
+	// once per window.
+	if now.Sub(d.pruned) >= d.Window {
+		for id, seen := range d.seen {
+			if now.Sub(seen) >= d.Window {
+				delete(d.seen, id)
+			}
+		}
+		d.pruned = now
+	}
+}
+
+// `DuplicateStats` describes the duplicates found so far.
+type DuplicateStats struct {
+	Dropped int // the number of duplicate messages dropped
+	Tracked int // the number of Message-IDs remembered
+}
+
+func (d *Duplicates) Stats() *DuplicateStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return &DuplicateStats{d.dropped, len(d.seen)}
+}
+
+// `ContentDedup` stores messages with the same sender, subject, and body as
+// one received in the last `Window` as a single message, addressed to all of
+// their recipients, with a count.
+type ContentDedup struct {
+	Window time.Duration
+	hashes map[string]*dedupedMessage
+	pruned time.Time
+}
+
+// Tracks the stored message that stands in for identical messages.
+type dedupedMessage struct {
+	id     MessageId
+	stored *ReceivedMessage
+	first  time.Time
+	counts map[string]int // the number of copies sent to each recipient
+}
+
+func NewContentDedup(window time.Duration) *ContentDedup {
+	return &ContentDedup{Window: window, hashes: make(map[string]*dedupedMessage, 0)}
+}
+
+// Returns a hash of the parts of a message that identical messages share:
+// its From and Subject headers and its body. The message is parsed again, so
+// that its body can still be read afterwards.
+func ContentHash(msg *ReceivedMessage) (string, error) {
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(msg.Contents()))
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(parsed.Body)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, part := range []string{parsed.Header.Get("From"), parsed.Header.Get("Subject")} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Adds a message to the store. If an identical message was stored in the
+// last `Window`, it's replaced by a copy addressed to the recipients of both,
+// whose count is the most copies sent to any one recipient.
+func (d *ContentDedup) Add(store MessageStore, now time.Time, msg *ReceivedMessage) (MessageId, error) {
+	d.prune(now)
+
+	hash, err := ContentHash(msg)
+	if err != nil {
+		return store.Add(now, msg)
+	}
+
+	deduped, ok := d.hashes[hash]
+	if ok {
+		// If the stored message is gone, it's been summarized, so this
+		// message is stored as a new one.
+		if err := store.Remove(deduped.id); err == nil {
+			merged := *deduped.stored
+			merged.Count = deduped.add(msg.Recipients())
+			if len(merged.RedirectedTo) > 0 {
+				merged.RedirectedTo = deduped.recipients()
+			} else {
+				merged.message = &message{merged.From, deduped.recipients(), merged.Data}
+			}
+			id, err := store.Add(now, &merged)
+			if err != nil {
+				delete(d.hashes, hash)
+			} else {
+				deduped.id = id
+			}
+			return id, err
+		}
+	}
+
+	id, err := store.Add(now, msg)
+	if err != nil {
+		delete(d.hashes, hash)
+		return id, err
+	}
+	deduped = &dedupedMessage{id: id, stored: msg, first: now, counts: make(map[string]int, 0)}
+	deduped.add(msg.Recipients())
+	d.hashes[hash] = deduped
+	return id, nil
+}
+
+// Forgets the messages first stored more than `Window` ago, checking at most
+// once per window.
+func (d *ContentDedup) prune(now time.Time) {
+	if now.Sub(d.pruned) < d.Window {
+		return
+	}
+	for hash, deduped := range d.hashes {
+		if now.Sub(deduped.first) >= d.Window {
+			delete(d.hashes, hash)
+		}
+	}
+	d.pruned = now
+}
+
+// Counts a copy sent to the recipients, and returns the most copies sent to
+// any one recipient.
+func (m *dedupedMessage) add(recipients []string) int {
+	for _, addr := range recipients {
+		m.counts[addr] += 1
+	}
+	most := 0
+	for _, count := range m.counts {
+		if count > most {
+			most = count
+		}
+	}
+	return most
+}
+
+func (m *dedupedMessage) recipients() []string {
+	result := make([]string, 0, len(m.counts))
+	for addr, _ := range m.counts {
+		result = append(result, addr)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,13 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"net/http"
+)
+
+// Serves `/api/duplicates`, which reports the number of duplicates dropped.
+func (d *Duplicates) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, d.Stats())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicates(t *testing.T) {
+	now := time.Unix(1393650000, 0)
+	dups := NewDuplicates(10 * time.Minute)
+
+	msg := makeReceivedMessage(t, "Message-Id: <1@app.example.com>\r\nSubject: test\r\n\r\nbody\r\n")
+	if dups.IsDuplicate(msg, now) {
+		t.Errorf("expected a new message not to be a duplicate")
+	}
+	dups.Remember(msg, now)
+
+	again := makeReceivedMessage(t, "Message-Id: <1@app.example.com>\r\nSubject: test\r\n\r\nbody\r\n")
+	if !dups.IsDuplicate(again, now.Add(time.Minute)) {
+		t.Errorf("expected a message with the same Message-ID to be a duplicate")
+	}
+	if dups.IsDuplicate(again, now.Add(10*time.Minute)) {
+		t.Errorf("expected a Message-ID to be forgotten after the window")
+	}
+
+	noId := makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n")
+	dups.Remember(noId, now)
+	if dups.IsDuplicate(noId, now) {
+		t.Errorf("expected a message without a Message-ID never to be a duplicate")
+	}
+
+	dups.Remember(makeReceivedMessage(t, "Message-Id: <2@app.example.com>\r\n\r\nbody\r\n"), now.Add(20*time.Minute))
+	if stats := dups.Stats(); stats.Dropped != 1 || stats.Tracked != 1 {
+		t.Errorf("expected one duplicate dropped and expired Message-IDs forgotten, got %#v", stats)
+	}
+
+	var none *Duplicates
+	none.Remember(msg, now)
+	if none.IsDuplicate(msg, now) {
+		t.Errorf("expected a nil Duplicates never to find duplicates")
+	}
+}
+
+func TestMessageWriterDropsDuplicates(t *testing.T) {
+	defer patchTime(time.Unix(1393650000, 0))()
+
+	store := NewMemoryStore()
+	limits, _ := NewStoreLimits(store, 2, 0)
+	limits.CheckEvery = 0
+	writer := &MessageWriter{Store: store, Limits: limits, Duplicates: NewDuplicates(time.Minute)}
+
+	write := func(data string) error {
+		received := make(chan *StorageRequest, 1)
+		errors := make(chan error, 1)
+		received <- &StorageRequest{makeReceivedMessage(t, data), errors}
+		close(received)
+		writer.Run(received)
+		return <-errors
+	}
+
+	first := "Message-Id: <1@app.example.com>\r\nSubject: test\r\n\r\nbody\r\n"
+	second := "Message-Id: <2@app.example.com>\r\nSubject: test\r\n\r\nbody\r\n"
+	third := "Message-Id: <3@app.example.com>\r\nSubject: test\r\n\r\nbody\r\n"
+	for _, data := range []string{first, first, second} {
+		if err := write(data); err != nil {
+			t.Errorf("unexpected storage error: %s", err)
+		}
+	}
+	if msgs, _ := store.MessagesNewerThan(time.Time{}); len(msgs) != 2 {
+		t.Errorf("expected the duplicate not to be stored, got %d messages", len(msgs))
+	}
+
+	// A message refused because the store is full can be sent again.
+	if err := write(third); err != ErrStoreFull {
+		t.Errorf("expected the store to be full, got %v", err)
+	}
+	store.Remove(MessageId(0))
+	if err := write(third); err != nil {
+		t.Errorf("expected a refused message not to be a duplicate, got %v", err)
+	}
+	if msgs, _ := store.MessagesNewerThan(time.Time{}); len(msgs) != 2 {
+		t.Errorf("expected the refused message to be stored when sent again, got %d messages", len(msgs))
+	}
+}
+
+func TestContentDedup(t *testing.T) {
+	now := time.Unix(1393650000, 0)
+	store := NewMemoryStore()
+	dedup := NewContentDedup(10 * time.Minute)
+
+	add := func(id string, to string, body string, at time.Time) {
+		msg := makeReceivedMessage(t, "From: app@example.com\r\nMessage-Id: <"+id+"@app.example.com>\r\nSubject: test\r\n\r\n"+body+"\r\n")
+		msg.To = []string{to}
+		if _, err := dedup.Add(store, at, msg); err != nil {
+			t.Fatalf("unexpected error adding message: %s", err)
+		}
+	}
+	add("1", "a@example.com", "disk full", now)
+	add("2", "b@example.com", "disk full", now.Add(time.Second))
+	add("3", "a@example.com", "disk full", now.Add(2*time.Second))
+	add("4", "a@example.com", "database down", now.Add(3*time.Second))
+
+	msgs, _ := store.MessagesNewerThan(time.Time{})
+	if len(msgs) != 2 {
+		t.Fatalf("expected identical messages to be stored once, got %d messages", len(msgs))
+	}
+	// The bodies are read from the contents, since reading them from the
+	// parsed messages would leave nothing for the summaries.
+	body := func(msg *StoredMessage) string {
+		return strings.SplitN(string(msg.Contents()), "\r\n\r\n", 2)[1]
+	}
+	for _, msg := range msgs {
+		switch body := body(msg); body {
+		case "disk full\r\n":
+			if msg.Instances() != 2 || !reflect.DeepEqual(msg.Recipients(), []string{"a@example.com", "b@example.com"}) {
+				t.Errorf("expected a count of 2 for both recipients, got %d for %v", msg.Instances(), msg.Recipients())
+			}
+		case "database down\r\n":
+			if msg.Instances() != 1 {
+				t.Errorf("expected a different message to be stored separately, got %d instances", msg.Instances())
+			}
+		default:
+			t.Errorf("unexpected body %#v", body)
+		}
+	}
+
+	// Once the stored message is gone (summarized) or the window has passed,
+	// the next copy is stored anew.
+	for _, msg := range msgs {
+		if body(msg) == "disk full\r\n" {
+			store.Remove(msg.Id)
+		}
+	}
+	add("5", "a@example.com", "disk full", now.Add(time.Minute))
+	add("6", "a@example.com", "database down", now.Add(11*time.Minute))
+	msgs, _ = store.MessagesNewerThan(time.Time{})
+	if len(msgs) != 3 {
+		t.Fatalf("expected both messages to be stored anew, got %d messages", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.Instances() != 1 {
+			t.Errorf("expected each message to be stored on its own, got %d instances", msg.Instances())
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Local delivery of summaries, for environments without a relay server.
+// Rather than relaying summaries, failmail can write them straight into a
+// maildir for each recipient, in the Maildir++ layout that IMAP servers like
+// Dovecot and Courier serve.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// `LocalUpstream` delivers messages to a maildir for each recipient, named
+// for the recipient's address under `Root`. If `Folder` is set, messages are
+// delivered to that Maildir++ folder (e.g. "Alerts" or "Alerts.Failmail")
+// instead of the inbox.
+type LocalUpstream struct {
+	Root    string
+	Folder  string
+	Durable bool
+
+	maildirs map[string]*Maildir
+	lock     sync.Mutex
+}
+
+func NewLocalUpstream(root string, folder string, durable bool) *LocalUpstream {
+	return &LocalUpstream{Root: root, Folder: strings.Trim(folder, "."), Durable: durable, maildirs: make(map[string]*Maildir, 0)}
+}
+
+// Returns the maildir for the recipient, creating it if needed.
+func (u *LocalUpstream) maildir(recipient string) (*Maildir, error) {
+	address := NormalizeAddress(recipient)
+	if address == "" || strings.HasPrefix(address, ".") || strings.ContainsAny(address, "/\x00") {
+		return nil, fmt.Errorf("can't deliver locally to %#v", recipient)
+	}
+
+	dir := path.Join(u.Root, address)
+	if u.Folder != "" {
+		dir = path.Join(dir, "."+u.Folder)
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if maildir, ok := u.maildirs[dir]; ok {
+		return maildir, nil
+	}
+
+	// Not `Maildir.Create()`, since the store's metadata directory would show
+	// up as a folder.
+	for _, subdir := range []MaildirSubdir{MAILDIR_CUR, MAILDIR_NEW, MAILDIR_TMP} {
+		if err := os.MkdirAll(path.Join(dir, string(subdir)), os.ModeDir|0755); err != nil {
+			return nil, err
+		}
+	}
+	if u.Folder != "" {
+		// Maildir++ marks folders with an empty `maildirfolder` file.
+		if err := ioutil.WriteFile(path.Join(dir, "maildirfolder"), []byte{}, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	maildir := &Maildir{Path: dir, Durable: u.Durable}
+	u.maildirs[dir] = maildir
+	return maildir, nil
+}
+
+// Delivers the message to each recipient's maildir, as a new (unread)
+// message, and returns the first error.
+func (u *LocalUpstream) Send(m OutgoingMessage) error {
+	var result error
+	for _, to := range m.Recipients() {
+		if err := u.deliver(m, to); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (u *LocalUpstream) deliver(m OutgoingMessage, to string) error {
+	maildir, err := u.maildir(to)
+	if err != nil {
+		return err
+	}
+
+	name, err := maildir.NextUniqueName()
+	if err != nil {
+		return err
+	}
+
+	// Add the headers a delivery agent would, since there's no relay to do it.
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Return-Path: <%s>\r\n", NormalizeAddress(m.Sender()))
+	fmt.Fprintf(buf, "Delivered-To: %s\r\n", NormalizeAddress(to))
+	buf.Write(m.Contents())
+	return maildir.WriteFile(name, MAILDIR_NEW, buf.Bytes(), nowGetter())
+}
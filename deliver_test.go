@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLocalUpstreamSend(t *testing.T) {
+	root, err := ioutil.TempDir("", "deliver")
+	if err != nil {
+		t.Fatalf("unable to create a test directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	upstream := NewLocalUpstream(root, "Alerts", false)
+	msg := &message{"failmail@example.com", []string{"Ops <ops@example.com>", "dev@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+	if err := upstream.Send(msg); err != nil {
+		t.Fatalf("unexpected error delivering: %s", err)
+	}
+
+	for _, address := range []string{"ops@example.com", "dev@example.com"} {
+		folder := path.Join(root, address, ".Alerts")
+		if _, err := os.Stat(path.Join(folder, "maildirfolder")); err != nil {
+			t.Errorf("expected a Maildir++ folder for %s: %s", address, err)
+		}
+
+		maildir := &Maildir{Path: folder}
+		names, err := maildir.List(MAILDIR_NEW)
+		if err != nil || len(names) != 1 {
+			t.Fatalf("expected one new message for %s: %v, %s", address, names, err)
+		}
+		data, err := maildir.ReadBytes(names[0].Name(), MAILDIR_NEW)
+		if err != nil {
+			t.Fatalf("unexpected error reading delivered message: %s", err)
+		}
+		expected := "Return-Path: <failmail@example.com>\r\nDelivered-To: " + address + "\r\nSubject: test\r\n\r\nbody\r\n"
+		if string(data) != expected {
+			t.Errorf("unexpected delivered message: %#v", string(data))
+		}
+	}
+}
+
+func TestLocalUpstreamInbox(t *testing.T) {
+	root, err := ioutil.TempDir("", "deliver")
+	if err != nil {
+		t.Fatalf("unable to create a test directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	upstream := NewLocalUpstream(root, "", false)
+	msg := &message{"failmail@example.com", []string{"ops@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+	if err := upstream.Send(msg); err != nil {
+		t.Fatalf("unexpected error delivering: %s", err)
+	}
+
+	maildir := &Maildir{Path: path.Join(root, "ops@example.com")}
+	if names, err := maildir.List(MAILDIR_NEW); err != nil || len(names) != 1 {
+		t.Errorf("expected one new message in the inbox: %v, %s", names, err)
+	}
+	if _, err := os.Stat(path.Join(root, "ops@example.com", string(MAILDIR_META))); !os.IsNotExist(err) {
+		t.Errorf("expected no metadata directory in the inbox: %s", err)
+	}
+}
+
+func TestLocalUpstreamBadRecipient(t *testing.T) {
+	root, err := ioutil.TempDir("", "deliver")
+	if err != nil {
+		t.Fatalf("unable to create a test directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	upstream := NewLocalUpstream(root, "", false)
+	for _, to := range []string{"../etc", "a/b@example.com", ".hidden"} {
+		msg := &message{"failmail@example.com", []string{to}, []byte("Subject: test\r\n\r\nbody\r\n")}
+		if err := upstream.Send(msg); err == nil || !strings.Contains(err.Error(), "can't deliver") {
+			t.Errorf("expected an error delivering to %#v: %v", to, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -23,8 +25,31 @@ type Listener struct {
 	Security  SessionSecurity
 	TLSConfig *tls.Config
 	Debug     bool
+	Backlog   *ChannelMonitor // if non-nil, records how long handing messages to the writer waits
 	Rewriter  AddressRewriter
-	conns     int
+	Loops     *LoopDetector // if non-nil, checks received messages for mail loops
+	Limits    *StoreLimits  // if non-nil, refuses messages when the store is full
+	ReadOnly  *ReadOnly     // if enabled, refuses messages with a temporary error
+	Spool     *Spool        // if non-nil, message data is written here instead of held in memory
+	MaxSize   int           // if positive, the largest message accepted, in bytes
+	Memory    *MemoryBudget // if non-nil, limits the message data held in memory by all connections
+	BareLF    bool          // if true, accept lines terminated with "\n" instead of "\r\n"
+
+	// If positive, clients are sent a 421 and disconnected when a read or
+	// write takes longer than `CommandTimeout`, or when they take longer than
+	// `IdleTimeout` to send a command.
+	CommandTimeout time.Duration
+	IdleTimeout    time.Duration
+
+	MaxConns *ConnectionLimit // if non-nil, refuses connections (with a 421) while too many are open
+	Rate     *RateLimit       // if non-nil, refuses messages from clients that send too many
+	Access   *AccessList      // if non-nil, refuses connections (with a 554) from clients it doesn't allow
+
+	// If true, MAIL, RCPT, and DATA are refused (with a 530) on unencrypted
+	// connections, until the client switches to TLS with STARTTLS.
+	RequireTLS bool
+
+	conns int
 }
 
 // ServerSocket is a `net.Listener` that can return its file descriptor.
@@ -104,9 +129,10 @@ func NewFileServerSocket(fd uintptr) (*FileServerSocket, error) {
 }
 
 func (f *FileServerSocket) Fd() (uintptr, error) {
-	if tcpListener, ok := f.Listener.(*net.TCPListener); !ok {
-		return 0, fmt.Errorf("%s is not a TCP socket", f)
-	} else if file, err := tcpListener.File(); err != nil {
+	// TCP and Unix sockets can both be passed on.
+	if listener, ok := f.Listener.(interface{ File() (*os.File, error) }); !ok {
+		return 0, fmt.Errorf("%s is not a TCP or Unix socket", f)
+	} else if file, err := listener.File(); err != nil {
 		return 0, err
 	} else {
 		return file.Fd(), err
@@ -121,6 +147,12 @@ func (f *FileServerSocket) String() string {
 // Returns true if the call to `Wait()` returned before hitting the timeout, or
 // false otherwise.
 func WaitWithTimeout(waitGroup *sync.WaitGroup, timeout time.Duration) bool {
+	return WaitWithContext(context.Background(), waitGroup, timeout)
+}
+
+// Like `WaitWithTimeout`, but also stops waiting (and returns false) when
+// `ctx` is cancelled.
+func WaitWithContext(ctx context.Context, waitGroup *sync.WaitGroup, timeout time.Duration) bool {
 	done := make(chan interface{}, 0)
 	go func() {
 		waitGroup.Wait()
@@ -132,6 +164,8 @@ func WaitWithTimeout(waitGroup *sync.WaitGroup, timeout time.Duration) bool {
 		select {
 		case <-timer:
 			return false
+		case <-ctx.Done():
+			return false
 		case <-done:
 			return true
 		}
@@ -139,8 +173,9 @@ func WaitWithTimeout(waitGroup *sync.WaitGroup, timeout time.Duration) bool {
 }
 
 // Listens on a TCP port, putting all messages received via SMTP onto the
-// `received` channel.
-func (l *Listener) Listen(received chan<- *StorageRequest, done <-chan TerminationRequest, shutdownTimeout time.Duration) (uintptr, error) {
+// `received` channel. Cancelling `ctx` stops listening, like a shutdown
+// request, and stops waiting for open connections to finish.
+func (l *Listener) Listen(ctx context.Context, received chan<- *StorageRequest, done <-chan TerminationRequest, shutdownTimeout time.Duration) (uintptr, error) {
 	log.Printf("listening: %s", l.Socket)
 
 	waitGroup := new(sync.WaitGroup)
@@ -156,14 +191,31 @@ func (l *Listener) Listen(received chan<- *StorageRequest, done <-chan Terminati
 			}
 
 			l.conns += 1
+			connLog := ConnLog(NewConnectionId())
+
+			if !l.Access.Allowed(conn.RemoteAddr()) {
+				connLog.Printf("refusing connection from %s: not allowed", conn.RemoteAddr())
+				refuseConnection(conn, DENIED_RESPONSE)
+				continue
+			} else if !l.MaxConns.Acquire() {
+				connLog.Printf("refusing connection from %s: too many connections", conn.RemoteAddr())
+				refuseConnection(conn, TOO_BUSY_RESPONSE)
+				continue
+			} else if l.Rate.Limited(remoteHost(conn.RemoteAddr())) {
+				connLog.Printf("refusing connection from %s: over its rate limit", conn.RemoteAddr())
+				l.MaxConns.Release()
+				refuseConnection(conn, RATE_LIMITED_RESPONSE)
+				continue
+			}
 
 			// Handle each incoming connection in its own goroutine.
-			log.Printf("handling new connection from %s", conn.RemoteAddr())
+			connLog.Printf("handling new connection from %s", conn.RemoteAddr())
 			waitGroup.Add(1)
 			go func() {
 				defer waitGroup.Done()
-				l.handleConnection(conn, received)
-				log.Printf("done handling new connection from %s", conn.RemoteAddr())
+				defer l.MaxConns.Release()
+				l.handleConnection(conn, connLog, received)
+				connLog.Printf("done handling connection from %s", conn.RemoteAddr())
 			}()
 		}
 		// When we've broken out of the loop for any reason (errors, limit),
@@ -181,23 +233,11 @@ func (l *Listener) Listen(received chan<- *StorageRequest, done <-chan Terminati
 		// If we got a reload request, set up a file descriptor to pass to the
 		// reloaded process.
 		if req == Reload {
-			fd, err := l.Socket.Fd()
-			if err != nil {
-				return 0, err
-			}
-
-			// If we don't dup the fd, closing it below (to break the Accept()
-			// loop) will prevent us from being able to use it as a socket in
-			// the child process.
-			newFd, err = syscall.Dup(int(fd))
+			fd, err := reloadFd(l.Socket)
 			if err != nil {
 				return 0, err
 			}
-
-			// If we don't mark the new fd as CLOEXEC, the child process will
-			// inherit it twice (the second one being the one passed to
-			// ExtraFiles).
-			syscall.CloseOnExec(newFd)
+			newFd = fd
 		}
 
 		log.Printf("closing listening socket")
@@ -208,28 +248,128 @@ func (l *Listener) Listen(received chan<- *StorageRequest, done <-chan Terminati
 		// Wait for the Close() to break us out of the Accept() loop.
 		<-acceptFinished
 
+	case <-ctx.Done():
+		log.Printf("cancelled: closing listening socket")
+		if err := l.Socket.Close(); err != nil {
+			return 0, err
+		}
+		<-acceptFinished
+
 	case <-acceptFinished:
 		// If the accept loop is done on its own (e.g. not from a reload
 		// request), fall through to do some cleanup.
 	}
 
-	// Wait for any open sesssions to finish, or time out.
+	// Wait for any open sesssions to finish, or time out (or give up right
+	// away if cancelled).
 	log.Printf("waiting %s for open connections to finish", shutdownTimeout)
-	WaitWithTimeout(waitGroup, shutdownTimeout)
+	WaitWithContext(ctx, waitGroup, shutdownTimeout)
 
 	close(received)
 
 	return uintptr(newFd), nil
 }
 
+// Tells a client why its connection is refused (e.g. that there are too many
+// connections), and disconnects it.
+// This is done in the accept loop, so the client gets only a moment to read
+// the response.
+func refuseConnection(conn net.Conn, resp Response) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	resp.WriteTo(bufio.NewWriter(conn))
+}
+
+// Identifies connections in the log: a prefix that's random for each process
+// (so that IDs aren't reused across restarts and reloads), and a sequence
+// number for each connection.
+var (
+	connectionPrefix = NewSummaryId()[:8]
+	connectionCount  uint64
+)
+
+// Returns a unique ID for a new connection, e.g. "3f9a1c2e-17".
+func NewConnectionId() string {
+	return fmt.Sprintf("%s-%d", connectionPrefix, atomic.AddUint64(&connectionCount, 1))
+}
+
+// `ConnLog` logs lines about a client connection, prefixed with its ID, so
+// that the lines from sessions running at the same time can be told apart.
+// An empty `ConnLog` logs lines without a prefix.
+type ConnLog string
+
+func (c ConnLog) Printf(format string, args ...interface{}) {
+	if c == "" {
+		log.Printf(format, args...)
+	} else {
+		log.Printf("[%s] "+format, append([]interface{}{string(c)}, args...)...)
+	}
+}
+
+// Returns a copy of the socket's file descriptor to pass to the reloaded
+// process, which stays open when the socket is closed.
+func reloadFd(socket ServerSocket) (int, error) {
+	fd, err := socket.Fd()
+	if err != nil {
+		return 0, err
+	}
+
+	// If we don't dup the fd, closing the socket (to break the Accept() loop)
+	// will prevent us from being able to use it as a socket in the child
+	// process.
+	newFd, err := syscall.Dup(int(fd))
+	if err != nil {
+		return 0, err
+	}
+
+	// If we don't mark the new fd as CLOEXEC, the child process will inherit
+	// it twice (the second one being the one passed to ExtraFiles).
+	syscall.CloseOnExec(newFd)
+	return newFd, nil
+}
+
+// Checks a message read from a client, and puts it on the `received` channel
+// for storage. Returns the response to send the client: `resp` if the message
+// was stored, or an error.
+func (l *Listener) store(connLog ConnLog, msg *ReceivedMessage, resp Response, received chan<- *StorageRequest) Response {
+	connLog.Printf("received message with subject %#v", msg.Parsed.Header.Get("Subject"))
+
+	msg.RedirectedTo = l.Rewriter.RewriteAll(msg.To)
+
+	if !l.Loops.Check(msg) {
+		msg.Discard()
+		return Response{554, "Mail loop detected", "5.4.6"}
+	}
+
+	errors := make(chan error, 0)
+	start := time.Now()
+	received <- &StorageRequest{msg, errors}
+	l.Backlog.Sent(start)
+	if err := <-errors; IsStoreFull(err) {
+		return Response{452, "Insufficient system storage, try again later", "4.3.1"}
+	} else if err != nil {
+		return Response{451, err.Error(), "4.3.0"}
+	}
+	return resp
+}
+
 // handleConnection reads SMTP commands from a socket and writes back SMTP
 // responses. Since it takes several commands (MAIL, RCPT, DATA) to fully
 // describe a message, `Session` is used to keep track of the progress building
 // a message. When a message has been fully communicated by a downstream
 // client, it's put on the `received` channel for later batching/summarizing.
-func (l *Listener) handleConnection(conn io.ReadWriteCloser, received chan<- *StorageRequest) {
+func (l *Listener) handleConnection(conn io.ReadWriteCloser, connLog ConnLog, received chan<- *StorageRequest) {
 	defer conn.Close()
 
+	// Disconnect clients that stop responding, rather than waiting on them
+	// forever.
+	var timeouts *deadlineConn
+	if netConn, ok := conn.(net.Conn); ok {
+		if timeouts = newDeadlineConn(netConn, l.CommandTimeout, l.IdleTimeout); timeouts != nil {
+			conn = timeouts
+		}
+	}
+
 	origReader := bufio.NewReader(conn)
 	origWriter := bufio.NewWriter(conn)
 
@@ -237,29 +377,54 @@ func (l *Listener) handleConnection(conn io.ReadWriteCloser, received chan<- *St
 	var reader stringReader
 	var writer stringWriter
 	if l.Debug {
-		prefix := fmt.Sprintf("%v ", conn)
+		prefix := fmt.Sprintf("[%s] ", connLog)
 		reader = &debugReader{origReader, prefix}
 		writer = &debugWriter{origWriter, prefix}
 	} else {
 		reader = origReader
 		writer = origWriter
 	}
+	if l.BareLF {
+		reader = &bareLFReader{reader}
+	}
 
 	session := new(Session)
+	session.log = connLog
+	session.full = l.Limits.Full
+	session.readOnly = l.ReadOnly.Enabled
+	session.maxSize = l.MaxSize
+	session.memory = l.Memory
+	session.rate = l.Rate
+	session.requireTLS = l.RequireTLS
+	defer session.ReleaseMemory()
+	if netConn, ok := conn.(net.Conn); ok {
+		session.client = remoteHost(netConn.RemoteAddr())
+	}
 	if err := session.Start(l.Auth, l.Security).WriteTo(writer); err != nil {
-		log.Printf("error writing to client: %s", err)
+		connLog.Printf("error writing to client: %s", err)
 		return
 	}
 
 	for {
+		timeouts.WaitForCommand()
 		resp, err := session.ReadCommand(reader)
-		if err != nil {
-			log.Printf("error reading from client: %s", err)
+		timeouts.GotCommand()
+		if timeouts.TimedOut(writer) {
+			connLog.Printf("timed out waiting for a command from client")
+			return
+		} else if err != nil {
+			connLog.Printf("error reading from client: %s", err)
 			break
 		}
 
-		if err := resp.WriteTo(writer); err != nil {
-			log.Printf("error writing to client after reading command: %s", err)
+		// The responses to pipelined commands are sent together, once there
+		// are no more commands waiting to be read (RFC 2920).
+		err = resp.Queue(writer)
+		if err == nil && (origReader.Buffered() == 0 || resp.Waits()) {
+			err = writer.Flush()
+		}
+		if err != nil {
+			connLog.Printf("error writing to client after reading command: %s", err)
 			break
 		}
 
@@ -267,44 +432,58 @@ func (l *Listener) handleConnection(conn io.ReadWriteCloser, received chan<- *St
 		case resp.IsClose():
 			return
 		case resp.NeedsData():
-			resp, msg := session.ReadData(reader)
-			if msg != nil {
-				log.Printf("received message with subject %#v", msg.Parsed.Header.Get("Subject"))
-
-				msg.RedirectedTo = l.Rewriter.RewriteAll(msg.To)
-
-				errors := make(chan error, 0)
-				received <- &StorageRequest{msg, errors}
-				if err := <-errors; err != nil {
-					errorResp := Response{451, err.Error()}
-					if err := errorResp.WriteTo(writer); err != nil {
-						log.Printf("error writing to client after storage failure: %s", err)
-						break
-					}
-				} else {
-					if err := resp.WriteTo(writer); err != nil {
-						log.Printf("error writing to client after reading data: %s", err)
-						break
-					}
+			var msg *ReceivedMessage
+			if l.Spool != nil {
+				resp, msg = session.SpoolData(reader, l.Spool)
+			} else {
+				resp, msg = session.ReadData(reader)
+			}
+			if timeouts.TimedOut(writer) {
+				connLog.Printf("timed out reading data from client")
+				return
+			} else if msg == nil {
+				if err := resp.WriteTo(writer); err != nil {
+					connLog.Printf("error writing to client after failing to read data: %s", err)
+					break
+				}
+			} else {
+				// Once the message is stored, its data no longer counts
+				// against the memory budget.
+				resp = l.store(connLog, msg, resp, received)
+				session.ReleaseMemory()
+				if err := resp.WriteTo(writer); err != nil {
+					connLog.Printf("error writing to client after reading data: %s", err)
+					break
 				}
 			}
 		case resp.NeedsAuthResponse():
 			resp := session.ReadAuthResponse(reader)
-			if err := resp.WriteTo(writer); err != nil {
-				log.Printf("error writing to client after reading auth: %s", err)
+			if timeouts.TimedOut(writer) {
+				connLog.Printf("timed out reading auth from client")
+				return
+			} else if err := resp.WriteTo(writer); err != nil {
+				connLog.Printf("error writing to client after reading auth: %s", err)
 				break
 			}
 		case resp.StartsTLS():
 			netConn, ok := conn.(net.Conn)
 			if !ok {
-				log.Printf("error getting underlying connection for STARTTLS")
+				connLog.Printf("error getting underlying connection for STARTTLS")
 				return
 			}
 			tlsConn := tls.Server(netConn, l.TLSConfig)
 			origReader.Reset(tlsConn)
 			origWriter.Reset(tlsConn)
-			session.security = TLS_POST_STARTTLS
+			session.StartTLS()
 			defer tlsConn.Close()
 		}
 	}
 }
+
+// Returns the IP address (without the port) of a remote address.
+func remoteHost(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
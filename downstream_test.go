@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/smtp"
 	"net/textproto"
 	"os"
 	"strings"
@@ -102,7 +105,29 @@ func TestListener(t *testing.T) {
 
 	go connectAndShutdown(t, textproto.NewConn(client), shutdown, GracefulShutdown)
 
-	listener.Listen(received, shutdown, 100*time.Millisecond)
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+}
+
+func TestListenerCancelled(t *testing.T) {
+	socket, client := NewMockSocket()
+	defer client.Close()
+
+	listener := &Listener{Socket: socket}
+	received := make(chan *StorageRequest, 1)
+
+	// The client stays connected, so only cancelling stops the listener from
+	// waiting out the shutdown timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		textproto.NewConn(client).ReadResponse(220)
+		cancel()
+	}()
+
+	start := time.Now()
+	listener.Listen(ctx, received, make(chan TerminationRequest, 0), time.Minute)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected cancelling not to wait for open connections, took %s", elapsed)
+	}
 }
 
 func TestListenerWithFileSocket(t *testing.T) {
@@ -128,7 +153,7 @@ func TestListenerWithFileSocket(t *testing.T) {
 
 	go dialAndShutdown(t, "localhost:10010", shutdown, GracefulShutdown)
 
-	listener.Listen(received, shutdown, 100*time.Millisecond)
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
 }
 
 func TestListenerReload(t *testing.T) {
@@ -144,7 +169,7 @@ func TestListenerReload(t *testing.T) {
 
 	go dialAndShutdown(t, "localhost:10020", shutdown, Reload)
 
-	if fd, err := listener.Listen(received, shutdown, 1*time.Second); err != nil {
+	if fd, err := listener.Listen(context.Background(), received, shutdown, 1*time.Second); err != nil {
 		t.Fatalf("unexpected error returned from Listen(): %s", err)
 	} else if fd <= 0 {
 		t.Fatalf("unexpected file descriptor returned from Listen(): %d", fd)
@@ -184,7 +209,136 @@ func TestListenerWithMessage(t *testing.T) {
 		shutdown <- GracefulShutdown
 	}()
 
-	listener.Listen(received, shutdown, 100*time.Millisecond)
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+}
+
+func TestListenerWithBareLF(t *testing.T) {
+	socket, client := NewMockSocket()
+
+	listener := &Listener{Socket: socket, BareLF: true}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	go func() {
+		req := <-received
+		if data := string(req.Message.Contents()); data != "Subject: test\r\n\r\nbody\r\n" {
+			t.Errorf("expected line endings to be normalized: %#v", data)
+		}
+		req.StorageErrors <- nil
+	}()
+
+	go func() {
+		reader := textproto.NewReader(bufio.NewReader(client))
+		expect := func(line string, code int) {
+			if _, err := client.Write([]byte(line)); err != nil {
+				t.Errorf("unexpected error writing to server: %s", err)
+			}
+			if _, _, err := reader.ReadCodeLine(code); err != nil {
+				t.Errorf("unexpected response from server: %s", err)
+			}
+		}
+
+		if _, _, err := reader.ReadCodeLine(220); err != nil {
+			t.Errorf("unexpected response from server: %s", err)
+		}
+		expect("HELO localhost\n", 250)
+		expect("MAIL FROM:<test@localhost>\n", 250)
+		expect("RCPT TO:<test@localhost>\n", 250)
+		expect("DATA\n", 354)
+		expect("Subject: test\n\nbody\n.\n", 250)
+		expect("QUIT\n", 221)
+
+		if err := client.Close(); err != nil {
+			t.Errorf("failed to close listener: %s", err)
+		}
+
+		shutdown <- GracefulShutdown
+	}()
+
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+}
+
+func TestListenerPipelining(t *testing.T) {
+	socket, client := NewMockSocket()
+
+	listener := &Listener{Socket: socket}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	go func() {
+		req := <-received
+		if to := req.Message.To; len(to) != 2 {
+			t.Errorf("expected both recipients: %#v", to)
+		}
+		req.StorageErrors <- nil
+	}()
+
+	go func() {
+		reader := textproto.NewReader(bufio.NewReader(client))
+		send := func(lines string, codes ...int) {
+			if _, err := client.Write([]byte(lines)); err != nil {
+				t.Errorf("unexpected error writing to server: %s", err)
+			}
+			for _, code := range codes {
+				if _, _, err := reader.ReadResponse(code); err != nil {
+					t.Errorf("unexpected response from server: %s", err)
+				}
+			}
+		}
+
+		if _, _, err := reader.ReadCodeLine(220); err != nil {
+			t.Errorf("unexpected response from server: %s", err)
+		}
+		send("EHLO localhost\r\n", 250)
+		send("MAIL FROM:<test@localhost>\r\nRCPT TO:<a@localhost>\r\nRCPT TO:<b@localhost>\r\nDATA\r\n", 250, 250, 250, 354)
+		send("Subject: test\r\n\r\nbody\r\n.\r\n", 250)
+
+		// A client that pipelines DATA after a failed MAIL gets an error,
+		// rather than being asked for the message.
+		send("RCPT TO:<a@localhost>\r\nDATA\r\nRSET\r\nQUIT\r\n", 503, 503, 250, 221)
+
+		if err := client.Close(); err != nil {
+			t.Errorf("failed to close listener: %s", err)
+		}
+
+		shutdown <- GracefulShutdown
+	}()
+
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+}
+
+func TestListenerRejectsLoop(t *testing.T) {
+	socket, client := NewMockSocket()
+
+	listener := &Listener{Socket: socket, Loops: &LoopDetector{From: "failmail@localhost"}}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	go func() {
+		conn := textproto.NewConn(client)
+
+		if _, _, err := conn.ReadCodeLine(220); err != nil {
+			t.Errorf("unexpected response from server: %s", err)
+		}
+
+		sendAndExpect(conn, t, "HELO localhost", 250)
+		sendAndExpect(conn, t, "MAIL FROM:<failmail@localhost>", 250)
+		sendAndExpect(conn, t, "RCPT TO:<test@localhost>", 250)
+		sendAndExpect(conn, t, "DATA", 354)
+		sendAndExpect(conn, t, "Subject: test\r\n\r\nbody\r\n.", 554)
+		sendAndExpect(conn, t, "QUIT", 221)
+
+		if err := conn.Close(); err != nil {
+			t.Errorf("failed to close listener: %s", err)
+		}
+
+		shutdown <- GracefulShutdown
+	}()
+
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+	if len(received) != 0 {
+		t.Errorf("expected the looping message not to be stored")
+	}
 }
 
 func TestListenerWithBadClient(t *testing.T) {
@@ -194,12 +348,34 @@ func TestListenerWithBadClient(t *testing.T) {
 
 	l := &Listener{}
 	received := make(chan *StorageRequest, 1)
-	l.handleConnection(BadClient{}, received)
-	if msg := string(buf.Bytes()); !strings.Contains(msg, "bad read from bad client") {
+	l.handleConnection(BadClient{}, "test", received)
+	if msg := string(buf.Bytes()); !strings.Contains(msg, "[test] error reading from client: bad read from bad client") {
 		t.Errorf("bad client didn't trigger failure in handleConnection(): %#v", msg)
 	}
 }
 
+func TestNewConnectionId(t *testing.T) {
+	first, second := NewConnectionId(), NewConnectionId()
+	if first == second {
+		t.Errorf("expected each connection to get its own ID: %s", first)
+	}
+	if prefix := strings.SplitN(first, "-", 2)[0]; len(prefix) != 8 || !strings.HasPrefix(second, prefix+"-") {
+		t.Errorf("expected connection IDs to share this process's prefix: %s, %s", first, second)
+	}
+}
+
+func TestConnLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	ConnLog("abc-1").Printf("handling %d", 1)
+	ConnLog("").Printf("handling %d", 2)
+	if logged := buf.String(); !strings.Contains(logged, "[abc-1] handling 1\n") || !strings.Contains(logged, " handling 2\n") || strings.Contains(logged, "[]") {
+		t.Errorf("unexpected log lines: %#v", logged)
+	}
+}
+
 func TestListenerWithBadServer(t *testing.T) {
 	buf := new(bytes.Buffer)
 	log.SetOutput(buf)
@@ -209,7 +385,7 @@ func TestListenerWithBadServer(t *testing.T) {
 	l := &Listener{Socket: socket}
 
 	received := make(chan *StorageRequest, 1)
-	l.Listen(received, make(chan TerminationRequest, 0), 100*time.Millisecond)
+	l.Listen(context.Background(), received, make(chan TerminationRequest, 0), 100*time.Millisecond)
 
 	if msg := string(buf.Bytes()); !strings.Contains(msg, "bad accept") {
 		t.Errorf("bad socket Accept() didn't trigger failure in Listen(): %#v", msg)
@@ -244,7 +420,7 @@ func TestListenerWithAuth(t *testing.T) {
 		shutdown <- GracefulShutdown
 	}()
 
-	listener.Listen(received, shutdown, 100*time.Millisecond)
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
 }
 
 func TestListenerWithPartialAuth(t *testing.T) {
@@ -276,7 +452,7 @@ func TestListenerWithPartialAuth(t *testing.T) {
 		shutdown <- GracefulShutdown
 	}()
 
-	listener.Listen(received, shutdown, 100*time.Millisecond)
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
 }
 
 func TestListenerWithTLS(t *testing.T) {
@@ -319,7 +495,7 @@ func TestListenerWithTLS(t *testing.T) {
 		shutdown <- GracefulShutdown
 	}()
 
-	listener.Listen(received, shutdown, 100*time.Millisecond)
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
 }
 
 func sendAndExpect(conn *textproto.Conn, t *testing.T, line string, code int) {
@@ -405,3 +581,47 @@ func connectAndShutdown(t *testing.T, conn *textproto.Conn, shutdown chan<- Term
 
 	shutdown <- req
 }
+
+func TestListenerStartTLSReadvertises(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10034")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	defer socket.Close()
+
+	cert, _ := makeRelayCert(t)
+	auth := &SingleUserPlainAuth{Username: "testuser", Password: "testpass"}
+	listener := &Listener{Socket: socket, Auth: auth, Security: TLS_PRE_STARTTLS, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	go func() {
+		defer func() { shutdown <- GracefulShutdown }()
+		client, err := smtp.Dial("localhost:10034")
+		if err != nil {
+			t.Errorf("failed to connect to listener: %s", err)
+			return
+		}
+		defer client.Close()
+
+		if ok, _ := client.Extension("AUTH"); ok {
+			t.Errorf("expected AUTH not to be advertised before STARTTLS")
+		}
+		if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+			t.Errorf("unexpected error starting TLS: %s", err)
+			return
+		}
+		if ok, _ := client.Extension("AUTH"); !ok {
+			t.Errorf("expected AUTH to be advertised after STARTTLS")
+		}
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			t.Errorf("expected STARTTLS not to be advertised after STARTTLS")
+		}
+		if err := client.Auth(smtp.PlainAuth("", "testuser", "testpass", "localhost")); err != nil {
+			t.Errorf("unexpected error authenticating after STARTTLS: %s", err)
+		}
+		client.Quit()
+	}()
+
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+}
@@ -0,0 +1,707 @@
+// A small expression language for batching and grouping messages, as an
+// alternative to templates for `--batch-expr` and `--group-expr` (selected by
+// `--expr-language=expr`).
+//
+// Expressions are made of string literals ("..." or `...`), integers,
+// variables, function calls, and operators:
+//
+//	(header("X-Service") || from) + ": " + replace(`\d+`, subject, "N")
+//
+// The variables are:
+//
+//	from       the envelope sender
+//	to         the list of envelope recipients
+//	subject    the Subject header
+//	body       the message body
+//	received   the time the message was received
+//	client     the IP address of the client that sent the message
+//	user       the user the client authenticated as, or ""
+//
+// The functions are:
+//
+//	header(name)               the first value of a header, or ""
+//	headers(name)              all values of a header, as a list
+//	hasHeader(name)            true if the message has a header, even if it's empty
+//	lower(s), upper(s), trim(s)
+//	contains(s, sub), startsWith(s, prefix), endsWith(s, suffix)
+//	match(pattern, s)          the leftmost match of a regular expression
+//	matchGroup(pattern, s, g)  a capture group (by name or number) of the leftmost match
+//	replace(pattern, s, sub)   replaces matches of a regular expression
+//	split(s, sep), join(list, sep)
+//	len(s or list)
+//	format(time, layout)       formats a time using a Go layout string
+//	normalize(s)               replaces numbers, UUIDs, hashes, and times with placeholders
+//	stripNumbers(s), stripUUIDs(s), stripHashes(s), stripTimestamps(s)
+//
+// The operators are, from lowest to highest precedence:
+//
+//	c ? a : b                  a if c is truthy, otherwise b
+//	a || b                     a if it's truthy, otherwise b
+//	a && b                     b if a is truthy, otherwise a
+//	== != < <= > >=            comparison of strings or integers
+//	=~                         regular expression match (s =~ pattern)
+//	in                         list or substring membership
+//	+                          string concatenation or integer addition
+//	!                          logical negation
+//	a[i]                       list indexing
+//
+// Empty strings and lists, zero, and false are falsy; everything else is
+// truthy. The result of an expression is converted to a string: lists are
+// joined with commas, and times are formatted per RFC 3339.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// `Expr` is a compiled expression.
+type Expr struct {
+	Source string
+	root   exprNode
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+// The variables available to an expression, computed as needed.
+type exprEnv struct {
+	msg  *ReceivedMessage
+	body *string
+}
+
+// `CompileExpr` parses an expression.
+func CompileExpr(source string) (*Expr, error) {
+	tokens, err := tokenizeExpr(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	} else if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+	}
+	return &Expr{source, root}, nil
+}
+
+// `MustCompileExpr` is like `CompileExpr`, but panics if the expression can't
+// be parsed.
+func MustCompileExpr(source string) *Expr {
+	expr, err := CompileExpr(source)
+	if err != nil {
+		panic(fmt.Sprintf("failed to compile expression %#v: %s", source, err))
+	}
+	return expr
+}
+
+// Evaluates the expression for a message, and returns the result as a string.
+func (e *Expr) Eval(msg *ReceivedMessage) (string, error) {
+	value, err := e.root.eval(&exprEnv{msg: msg})
+	if err != nil {
+		return "", err
+	}
+	return exprString(value), nil
+}
+
+func GroupByScript(name string, source string) GroupBy {
+	expr := MustCompileExpr(source)
+	return func(r *ReceivedMessage) (string, error) {
+		result, err := expr.Eval(r)
+		if err != nil {
+			return result, fmt.Errorf("%s: %s", name, err)
+		}
+		return result, nil
+	}
+}
+
+func (env *exprEnv) variable(name string) (interface{}, error) {
+	switch name {
+	case "from":
+		return env.msg.Sender(), nil
+	case "to":
+		return env.msg.Recipients(), nil
+	case "subject":
+		return env.header("Subject"), nil
+	case "body":
+		return env.readBody()
+	case "received":
+		return env.msg.ReceivedAt, nil
+	case "client":
+		return env.msg.ClientAddr, nil
+	case "user":
+		return env.msg.AuthUser, nil
+	}
+	return nil, fmt.Errorf("unknown variable %s", name)
+}
+
+func (env *exprEnv) header(name string) string {
+	if env.msg.Parsed == nil {
+		return ""
+	}
+	return DecodeHeader(env.msg.Parsed.Header.Get(name))
+}
+
+// Reads the body from the message's raw contents, since reading it via
+// `ReadBody()` would consume it.
+func (env *exprEnv) readBody() (string, error) {
+	if env.body == nil {
+		parsed, err := mail.ReadMessage(bytes.NewBuffer(env.msg.Contents()))
+		if err != nil {
+			return "", err
+		}
+		body, err := TextBody(parsed.Header, parsed.Body)
+		if err != nil {
+			return "", err
+		}
+		env.body = &body
+	}
+	return *env.body, nil
+}
+
+func exprString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func exprTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return v != ""
+	case []string:
+		return len(v) > 0
+	case int:
+		return v != 0
+	case bool:
+		return v
+	case time.Time:
+		return !v.IsZero()
+	}
+	return value != nil
+}
+
+// Lexing.
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokString
+	tokInt
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%#v", t.text)
+}
+
+var exprOperators = []string{"==", "!=", "=~", "<=", ">=", "&&", "||", "<", ">", "+", "!", "?", ":", "(", ")", "[", "]", ","}
+
+func tokenizeExpr(source string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '"' || c == '`':
+			end := i + 1
+			for end < len(source) && source[end] != c {
+				if c == '"' && source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			text, err := strconv.Unquote(source[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %s", i, err)
+			}
+			tokens = append(tokens, exprToken{tokString, text, i})
+			i = end + 1
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(source) && source[end] >= '0' && source[end] <= '9' {
+				end++
+			}
+			tokens = append(tokens, exprToken{tokInt, source[i:end], i})
+			i = end
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			end := i
+			for end < len(source) && (source[end] == '_' || (source[end] >= 'a' && source[end] <= 'z') || (source[end] >= 'A' && source[end] <= 'Z') || (source[end] >= '0' && source[end] <= '9')) {
+				end++
+			}
+			tokens = append(tokens, exprToken{tokIdent, source[i:end], i})
+			i = end
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, exprToken{tokOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(tokens, exprToken{tokEOF, "", len(source)}), nil
+}
+
+// Parsing.
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	tok := p.peek()
+	if tok.kind == tokIdent && tok.text == "in" {
+		tok.kind = tokOp
+	}
+	for _, op := range ops {
+		if tok.kind == tokOp && tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if tok := p.next(); tok.kind != tokOp || tok.text != op {
+		return fmt.Errorf("expected %#v, found %s at offset %d", op, tok, tok.pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil || !p.isOp("?") {
+		return cond, err
+	}
+	p.next()
+
+	then, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	} else if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+
+	otherwise, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &exprConditional{cond, then, otherwise}, nil
+}
+
+// Binary operators by precedence, lowest first.
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "=~", "in"},
+	{"+"},
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(exprPrecedence[level]...) {
+		op := p.next().text
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{operand}, nil
+	}
+
+	node, err := p.parsePrimary()
+	for err == nil && p.isOp("[") {
+		p.next()
+		var index exprNode
+		if index, err = p.parseExpr(); err == nil {
+			err = p.expect("]")
+		}
+		node = &exprIndex{node, index}
+	}
+	return node, err
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return &exprLiteral{tok.text}, nil
+	case tokInt:
+		value, err := strconv.Atoi(tok.text)
+		return &exprLiteral{value}, err
+	case tokIdent:
+		if tok.text == "true" || tok.text == "false" {
+			return &exprLiteral{tok.text == "true"}, nil
+		} else if !p.isOp("(") {
+			return &exprVariable{tok.text}, nil
+		}
+
+		fn, ok := exprFunctions[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s at offset %d", tok.text, tok.pos)
+		}
+		p.next()
+		args := make([]exprNode, 0)
+		for !p.isOp(")") {
+			if len(args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		p.next()
+		if len(args) != fn.args {
+			return nil, fmt.Errorf("%s takes %d arguments, got %d", tok.text, fn.args, len(args))
+		}
+		return &exprCall{tok.text, fn, args}, nil
+	case tokOp:
+		if tok.text == "(" {
+			node, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+}
+
+// Evaluation.
+
+type exprLiteral struct {
+	value interface{}
+}
+
+func (n *exprLiteral) eval(env *exprEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+type exprVariable struct {
+	name string
+}
+
+func (n *exprVariable) eval(env *exprEnv) (interface{}, error) {
+	return env.variable(n.name)
+}
+
+type exprConditional struct {
+	cond, then, otherwise exprNode
+}
+
+func (n *exprConditional) eval(env *exprEnv) (interface{}, error) {
+	if cond, err := n.cond.eval(env); err != nil {
+		return nil, err
+	} else if exprTruthy(cond) {
+		return n.then.eval(env)
+	}
+	return n.otherwise.eval(env)
+}
+
+type exprNot struct {
+	operand exprNode
+}
+
+func (n *exprNot) eval(env *exprEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	return !exprTruthy(value), err
+}
+
+type exprIndex struct {
+	list, index exprNode
+}
+
+func (n *exprIndex) eval(env *exprEnv) (interface{}, error) {
+	list, err := n.list.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := list.([]string)
+	if !ok {
+		return nil, fmt.Errorf("can't index %T", list)
+	}
+	i, ok := index.(int)
+	if !ok {
+		return nil, fmt.Errorf("can't index with %T", index)
+	}
+	if i < 0 || i >= len(items) {
+		return "", nil
+	}
+	return items[i], nil
+}
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *exprBinary) eval(env *exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// The logical operators short-circuit.
+	switch {
+	case n.op == "||" && exprTruthy(left):
+		return left, nil
+	case n.op == "&&" && !exprTruthy(left):
+		return left, nil
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "||", "&&":
+		return right, nil
+	case "==":
+		return exprString(left) == exprString(right), nil
+	case "!=":
+		return exprString(left) != exprString(right), nil
+	case "=~":
+		re, err := regexp.Compile(exprString(right))
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(exprString(left)), nil
+	case "in":
+		if list, ok := right.([]string); ok {
+			for _, item := range list {
+				if item == exprString(left) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return strings.Contains(exprString(right), exprString(left)), nil
+	case "+":
+		leftInt, leftOk := left.(int)
+		rightInt, rightOk := right.(int)
+		if leftOk && rightOk {
+			return leftInt + rightInt, nil
+		}
+		return exprString(left) + exprString(right), nil
+	}
+
+	// The remaining operators are orderings.
+	var cmp int
+	leftInt, leftOk := left.(int)
+	rightInt, rightOk := right.(int)
+	if leftOk && rightOk {
+		cmp = leftInt - rightInt
+	} else {
+		cmp = strings.Compare(exprString(left), exprString(right))
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+type exprCall struct {
+	name string
+	fn   *exprFunction
+	args []exprNode
+}
+
+func (n *exprCall) eval(env *exprEnv) (interface{}, error) {
+	args := make([]interface{}, 0, len(n.args))
+	for _, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	result, err := n.fn.call(env, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.name, err)
+	}
+	return result, nil
+}
+
+type exprFunction struct {
+	args int
+	call func(env *exprEnv, args []interface{}) (interface{}, error)
+}
+
+// Wraps a function of strings as an `exprFunction`.
+func exprStringFunc(args int, fn func(args []string) (interface{}, error)) *exprFunction {
+	return &exprFunction{args, func(env *exprEnv, values []interface{}) (interface{}, error) {
+		strs := make([]string, 0, len(values))
+		for _, value := range values {
+			strs = append(strs, exprString(value))
+		}
+		return fn(strs)
+	}}
+}
+
+var exprFunctions = map[string]*exprFunction{
+	"header": &exprFunction{1, func(env *exprEnv, args []interface{}) (interface{}, error) {
+		return env.header(exprString(args[0])), nil
+	}},
+	"headers": &exprFunction{1, func(env *exprEnv, args []interface{}) (interface{}, error) {
+		if env.msg.Parsed == nil {
+			return []string{}, nil
+		}
+		values := env.msg.Parsed.Header[textproto.CanonicalMIMEHeaderKey(exprString(args[0]))]
+		decoded := make([]string, len(values))
+		for i, value := range values {
+			decoded[i] = DecodeHeader(value)
+		}
+		return decoded, nil
+	}},
+	"hasHeader": &exprFunction{1, func(env *exprEnv, args []interface{}) (interface{}, error) {
+		if env.msg.Parsed == nil {
+			return false, nil
+		}
+		_, ok := env.msg.Parsed.Header[textproto.CanonicalMIMEHeaderKey(exprString(args[0]))]
+		return ok, nil
+	}},
+	"lower": exprStringFunc(1, func(args []string) (interface{}, error) {
+		return strings.ToLower(args[0]), nil
+	}),
+	"upper": exprStringFunc(1, func(args []string) (interface{}, error) {
+		return strings.ToUpper(args[0]), nil
+	}),
+	"trim": exprStringFunc(1, func(args []string) (interface{}, error) {
+		return strings.TrimSpace(args[0]), nil
+	}),
+	"contains": exprStringFunc(2, func(args []string) (interface{}, error) {
+		return strings.Contains(args[0], args[1]), nil
+	}),
+	"startsWith": exprStringFunc(2, func(args []string) (interface{}, error) {
+		return strings.HasPrefix(args[0], args[1]), nil
+	}),
+	"endsWith": exprStringFunc(2, func(args []string) (interface{}, error) {
+		return strings.HasSuffix(args[0], args[1]), nil
+	}),
+	"match": exprStringFunc(2, func(args []string) (interface{}, error) {
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return re.FindString(args[1]), nil
+	}),
+	"matchGroup": exprStringFunc(3, func(args []string) (interface{}, error) {
+		return MatchGroup(args[0], args[1], args[2])
+	}),
+	"replace": exprStringFunc(3, func(args []string) (interface{}, error) {
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return re.ReplaceAllString(args[1], args[2]), nil
+	}),
+	"split": exprStringFunc(2, func(args []string) (interface{}, error) {
+		return strings.Split(args[0], args[1]), nil
+	}),
+	"join": &exprFunction{2, func(env *exprEnv, args []interface{}) (interface{}, error) {
+		list, ok := args[0].([]string)
+		if !ok {
+			return nil, fmt.Errorf("can't join %T", args[0])
+		}
+		return strings.Join(list, exprString(args[1])), nil
+	}},
+	"len": &exprFunction{1, func(env *exprEnv, args []interface{}) (interface{}, error) {
+		if list, ok := args[0].([]string); ok {
+			return len(list), nil
+		}
+		return len(exprString(args[0])), nil
+	}},
+	"format": &exprFunction{2, func(env *exprEnv, args []interface{}) (interface{}, error) {
+		t, ok := args[0].(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("can't format %T as a time", args[0])
+		}
+		return t.Format(exprString(args[1])), nil
+	}},
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExprEval(t *testing.T) {
+	msg := makeReceivedMessage(t, "From: app@example.com\r\nTo: test@example.com\r\nSubject: job 1234 failed\r\nX-Service: billing\r\nX-Tag: a\r\nX-Tag: b\r\n\r\nTraceback: KeyError\r\n")
+	msg.ReceivedAt = time.Date(2014, time.March, 1, 13, 0, 0, 0, time.UTC)
+	msg.ClientAddr = "10.0.0.1"
+	msg.AuthUser = "billing-svc"
+
+	tests := map[string]string{
+		`"literal"`:                                              "literal",
+		"`raw \\d`":                                              `raw \d`,
+		`subject`:                                                "job 1234 failed",
+		`header("x-service") + ": " + subject`:                   "billing: job 1234 failed",
+		`header("X-Missing") || from`:                            "app@example.com",
+		`replace("\\d+", subject, "N")`:                          "job N failed",
+		`match("[0-9]+", subject)`:                               "1234",
+		`subject =~ "fail" ? "failure" : "other"`:                "failure",
+		`!(subject =~ "fail") ? "failure" : "other"`:             "other",
+		`contains(body, "KeyError") && "key"`:                    "key",
+		`headers("X-Tag")`:                                       "a,b",
+		`join(headers("X-Tag"), "+")`:                            "a+b",
+		`headers("X-Tag")[1]`:                                    "b",
+		`headers("X-Tag")[5]`:                                    "",
+		`len(headers("X-Tag")) > 1`:                              "true",
+		`len(to) + 1`:                                            "2",
+		`"test@example.com" in to`:                               "true",
+		`"bill" in header("X-Service")`:                          "true",
+		`upper(split(subject, " ")[0])`:                          "JOB",
+		`format(received, "2006-01-02 15h")`:                     "2014-03-01 13h",
+		`received`:                                               "2014-03-01T13:00:00Z",
+		`lower(trim("  A  ")) == "a"`:                            "true",
+		`user || client`:                                         "billing-svc",
+		`client`:                                                 "10.0.0.1",
+		`startsWith(subject, "job") != endsWith(subject, "job")`: "true",
+	}
+
+	for source, expected := range tests {
+		expr, err := CompileExpr(source)
+		if err != nil {
+			t.Errorf("unexpected error compiling %s: %s", source, err)
+			continue
+		}
+		if result, err := expr.Eval(msg); err != nil {
+			t.Errorf("unexpected error evaluating %s: %s", source, err)
+		} else if result != expected {
+			t.Errorf("unexpected result for %s: %#v != %#v", source, result, expected)
+		}
+	}
+
+	// Reading the body in an expression shouldn't consume it.
+	if body, err := msg.ReadBody(); body != "Traceback: KeyError\r\n" || err != nil {
+		t.Errorf("unexpected body after evaluating expressions: %#v, %s", body, err)
+	}
+}
+
+func TestExprCompileErrors(t *testing.T) {
+	invalid := []string{
+		``,
+		`"unterminated`,
+		`subject +`,
+		`(subject`,
+		`subject subject`,
+		`unknown(subject)`,
+		`lower(subject, subject)`,
+		`subject ? "a"`,
+		`subject @ "a"`,
+	}
+	for _, source := range invalid {
+		if _, err := CompileExpr(source); err == nil {
+			t.Errorf("expected an error compiling %#v", source)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	msg := makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n")
+	invalid := []string{
+		`unknown`,
+		`subject[0]`,
+		`format(subject, "2006")`,
+		`match("(", subject)`,
+		`join(subject, ",")`,
+	}
+	for _, source := range invalid {
+		if _, err := MustCompileExpr(source).Eval(msg); err == nil {
+			t.Errorf("expected an error evaluating %#v", source)
+		}
+	}
+}
+
+func TestGroupByScriptConfig(t *testing.T) {
+	msg := makeReceivedMessage(t, "Subject: that test\r\nX-Batch: 100\r\n\r\ntest body\r\n")
+
+	batch := (&Config{BatchExpr: `header("X-Batch") + "/" + match("^(this|that)", subject)`, ExprLanguage: "expr"}).Batch()
+	if key, err := batch(msg); key != "100/that" || err != nil {
+		t.Errorf("expected message batch '100/that', got %#v, %s", key, err)
+	}
+}
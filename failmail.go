@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/mpapi/failmail/configure"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -29,7 +33,17 @@ func init() {
 func main() {
 	config := Defaults()
 
-	wroteConfig, err := configure.Parse(config, fmt.Sprintf(LOGO, VERSION))
+	// If the first argument names a tool, run that instead of the server.
+	args := os.Args
+	var command Command
+	if len(args) > 1 {
+		if cmd, ok := COMMANDS[args[1]]; ok {
+			command = cmd
+			args = append([]string{args[0]}, args[2:]...)
+		}
+	}
+
+	wroteConfig, err := configure.ParseArgs(config, fmt.Sprintf(LOGO, VERSION), args)
 	if err != nil {
 		log.Fatalf("Failed to read configuration: %s", err)
 	} else if wroteConfig {
@@ -40,52 +54,210 @@ func main() {
 		fmt.Fprintf(os.Stderr, "failmail %s\n", VERSION)
 		return
 	}
+
+	if err := config.CheckBuild(); err != nil {
+		log.Fatalf("Failed to read configuration: %s", err)
+	}
+
+	if command != nil {
+		if err := command(config, os.Stdout); err != nil {
+			log.Fatalf("%s failed: %s", os.Args[1], err)
+		}
+		return
+	}
+	if ShouldDaemonize(config) {
+		if pid, err := Daemonize(config.LogFile); err != nil {
+			log.Fatalf("failed to daemonize: %s", err)
+		} else {
+			log.Printf("running in the background with pid %d", pid)
+		}
+		return
+	}
+
+	if config.LogFile != "" {
+		logFile, err := OpenLogFile(config.LogFile)
+		if err != nil {
+			log.Fatalf("failed to open log file: %s", err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+		go logFile.ReopenOnHangup()
+	}
+
 	log.Printf("failmail %s, starting up", VERSION)
 
+	// Pick up the sockets passed on by the process this one was reloaded
+	// from, if any.
+	if err := InheritFds(config); err != nil {
+		log.Fatalf("failed to inherit sockets: %s", err)
+	}
+
+	// After a reload, the new process takes over the pidfile, so it's left
+	// in place.
+	reloaded := false
 	if config.Pidfile != "" {
-		writePidfile(config.Pidfile)
-		defer os.Remove(config.Pidfile)
+		writePidfile(config.Pidfile, config.ReloadedFrom)
+		defer func() {
+			if !reloaded {
+				os.Remove(config.Pidfile)
+			}
+		}()
 	}
 
 	signalListeners := make([]chan<- TerminationRequest, 0)
 	waitGroup := new(sync.WaitGroup)
 
-	reloadFd := uintptr(0)
+	// Cancelled by a second shutdown signal, to abandon in-flight sends and
+	// stop waiting on open connections.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloadFds := make([]uintptr, 0)
+	var reloadHttpFd uintptr
+
+	// Finishes once the receiver has stopped storing messages.
+	receiving := new(sync.WaitGroup)
+
+	// Components register their HTTP endpoints here.
+	httpServer := NewHTTPServer(config.BindHTTP)
+	httpServer.Fd = uintptr(config.HttpFd)
+
+	// The channels between components report how backed up they are here
+	// (except in minimal builds, where there's no HTTP server to report it).
+	var pipeline *Pipeline
+	if !MINIMAL {
+		pipeline = NewPipeline()
+	}
+
+	// When the receiver and sender run together, and no other instances share
+	// the store, the writer passes stored messages to the buffer directly.
+	var feed *StoreFeed
+	if config.Receiver && config.Sender && config.Lease == 0 {
+		feed = NewStoreFeed()
+	}
+
+	// The writer and the buffer share the audit log, if there is one.
+	audit, err := config.MakeAuditLog()
+	if err != nil {
+		log.Fatalf("failed to open audit log: %s", err)
+	}
+	defer audit.Close()
+	if audit != nil {
+		httpServer.Handle("/api/analytics", audit)
+	}
 
 	if config.Receiver {
-		listener, err := config.MakeReceiver()
+		listeners, err := config.MakeReceivers()
 		if err != nil {
 			log.Fatalf("failed to create listener: %s", err)
 		}
 
+		if credentials, ok := listeners[0].Auth.(*CredentialsFile); ok {
+			go credentials.ReloadOnHangup()
+		}
+
 		writer, err := config.MakeWriter()
 		if err != nil {
 			log.Fatalf("failed to create writer: %s", err)
 		}
+		readOnly := NewReadOnly(config.ReadOnly)
+		httpServer.Handle("/api/read-only", readOnly)
+		spool, err := config.MakeSpool(writer.Store)
+		if err != nil {
+			log.Fatalf("failed to create spool: %s", err)
+		}
+		for _, listener := range listeners {
+			listener.Limits = writer.Limits
+			listener.ReadOnly = readOnly
+			listener.Spool = spool
+		}
+		writer.Feed = feed
+		writer.Audit = audit
+		if writer.Duplicates != nil {
+			httpServer.Handle("/api/duplicates", writer.Duplicates)
+		}
 
-		// A channel for incoming messages. The listener sends on the channel, and
+		// A channel for incoming messages. The listeners send on the channel, and
 		// receives are added to a MessageBuffer in the channel consumer below.
 		received := make(chan *StorageRequest, 64)
+		backlog := pipeline.Watch("received", func() (int, int) { return len(received), cap(received) })
 
+		// Messages submitted via HTTP and entries read from the journal are
+		// merged with those from the listener.
+		sources := make([]<-chan *StorageRequest, 0)
+		if config.SubmitApi {
+			submitter, err := config.MakeSubmitter()
+			if err != nil {
+				log.Fatalf("failed to create submitter: %s", err)
+			}
+			submitter.ReadOnly = readOnly
+			httpServer.Handle("/api/messages", submitter)
+			httpServer.Handle("/api/submit", submitter)
+
+			submitDone := make(chan TerminationRequest, 1)
+			signalListeners = append(signalListeners, submitDone)
+			go submitter.Run(submitDone)
+			sources = append(sources, submitter.Received())
+		}
+
+		if journal, err := config.MakeJournalReader(); err != nil {
+			log.Fatalf("failed to create journal reader: %s", err)
+		} else if journal != nil {
+			journalDone := make(chan TerminationRequest, 1)
+			signalListeners = append(signalListeners, journalDone)
+			go func() {
+				if err := journal.Run(journalDone); err != nil {
+					log.Printf("journal reader failed: %s", err)
+				} else {
+					log.Printf("journal reader: done")
+				}
+			}()
+			sources = append(sources, journal.Received())
+		}
+
+		// With no other sources, the listeners send to the writer directly.
+		// Otherwise, their messages are merged with the others.
+		listened := received
+		if len(sources) > 0 {
+			listened = make(chan *StorageRequest, 64)
+			sources = append(sources, listened)
+			go MergeStorageRequests(received, sources...)
+		}
+
+		// Start a goroutine for receiving incoming messages on each socket.
+		// Listeners on other addresses can be added and removed through the
+		// API, with the same settings.
+		set := NewListenerSet(ctx, listened, config.ShutdownTimeout)
+		template := *listeners[0]
+		template.Backlog = backlog
+		set.Template = &template
+		set.Socket = config.SocketFor
+		httpServer.Handle("/api/listeners", set)
+		for _, listener := range listeners {
+			listener.Backlog = backlog
+			if err := set.Start(listener.Socket.Addr().String(), listener); err != nil {
+				log.Fatalf("failed to start listener: %s", err)
+			}
+		}
+
+		// Stop all of the listeners, including any that were added, when
+		// signalled, and pass their sockets on if reloading.
 		done := make(chan TerminationRequest, 1)
 		signalListeners = append(signalListeners, done)
-
-		// Start a goroutine for receiving incoming meSsages.
 		waitGroup.Add(1)
+		receiving.Add(1)
 		go func() {
 			defer waitGroup.Done()
-			reloadFd, err = listener.Listen(received, done, config.ShutdownTimeout)
-			if err != nil {
-				log.Printf("receiver failed to shut down cleanly: %s", err)
-			} else {
-				log.Printf("receiver: done")
-			}
+			defer receiving.Done()
+			reloadFds = set.Shutdown(<-done)
 		}()
 
 		// Start a goroutine for storing received messages.
 		waitGroup.Add(1)
+		receiving.Add(1)
 		go func() {
 			defer waitGroup.Done()
+			defer receiving.Done()
 			if err := writer.Run(received); err != nil {
 				log.Printf("writer failed to shut down cleanly: %s", err)
 			} else {
@@ -101,63 +273,120 @@ func main() {
 		if err != nil {
 			log.Fatalf("failed to create buffer: %s", err)
 		}
+		buffer.Feed = feed
+		buffer.Audit = audit
+		httpServer.HandleBuffer(buffer)
 
 		sender, err := config.MakeSender()
 		if err != nil {
 			log.Fatalf("failed to create sender: %s", err)
 		}
-
-		go ListenHTTP(config.BindHTTP, buffer)
+		buffer.Failures = sender.Failures
+		deadLetters := &DeadLetters{Sender: sender}
+		httpServer.Handle("/api/dead-letters", deadLetters)
+		httpServer.Handle("/api/dead-letters/", deadLetters)
 
 		// A channel for outgoing messages.
 		outgoing := make(chan *SendRequest, 64)
+		buffer.Pipeline = pipeline
+		buffer.Outgoing = pipeline.Watch("outgoing", func() (int, int) { return len(outgoing), cap(outgoing) })
 
+		// When draining, the buffer waits for the receiver to store the
+		// messages it's still receiving, so that they're summarized too.
 		done := make(chan TerminationRequest, 1)
-		signalListeners = append(signalListeners, done)
+		signalled := make(chan TerminationRequest, 1)
+		signalListeners = append(signalListeners, signalled)
+		go func() {
+			req := <-signalled
+			if req == Drain {
+				receiving.Wait()
+			}
+			done <- req
+		}()
+
+		// Start a goroutine for keeping track of the relay's size limit.
+		go buffer.RelaySize.Run(ctx)
 
 		// Start a goroutine for summarizing messages in the store.
 		waitGroup.Add(1)
 		go func() {
 			defer waitGroup.Done()
-			buffer.Run(config.Poll, outgoing, done)
+			buffer.Run(ctx, config.Poll, outgoing, done)
 			log.Printf("summarizer: done")
 		}()
 
-		// Start a goroutine for sending summarized messages.
-		waitGroup.Add(1)
-		go func() {
-			defer waitGroup.Done()
-			sender.Run(outgoing)
-			log.Printf("sender: done")
-		}()
+		// Start goroutines for sending summarized messages, one for each
+		// batch that may be flushed at once.
+		for i := 0; i < config.Workers; i++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				sender.Run(ctx, outgoing)
+				log.Printf("sender: done")
+			}()
+		}
 	}
 
 	if !config.Receiver && !config.Sender {
 		log.Fatalf("must specify --receiver and/or --sender")
 	}
 
+	// The HTTP server starts if any component has endpoints for it to serve
+	// (which minimal builds never do).
+	if httpServer.Serves() {
+		done := make(chan TerminationRequest, 1)
+		signalListeners = append(signalListeners, done)
+
+		// Start a goroutine for serving HTTP, which finishes the requests it's
+		// handling before shutting down.
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			fd, err := httpServer.Listen(done, config.ShutdownTimeout)
+			reloadHttpFd = fd
+			if err != nil {
+				log.Printf("HTTP server failed: %s", err)
+			} else {
+				log.Printf("HTTP server: done")
+			}
+		}()
+	}
+
 	// Handle signals for reloading/shutdown, then wait for the
 	// message-handling goroutines to finish.
-	shouldReload := HandleSignals(signalListeners)
+	shouldReload := HandleSignals(signalListeners, cancel)
 	waitGroup.Wait()
 
 	// Reload if necessary.
-	if err := TryReload(shouldReload, reloadFd); err != nil {
+	fds := make([]ReloadFd, 0, len(reloadFds)+1)
+	for _, fd := range reloadFds {
+		fds = append(fds, ReloadFd{"smtp", fd})
+	}
+	if reloadHttpFd != 0 {
+		fds = append(fds, ReloadFd{"http", reloadHttpFd})
+	}
+	if err := TryReload(shouldReload, fds); err != nil {
 		log.Fatalf("failed to reload: %s", err)
 	}
+	reloaded = shouldReload
 }
 
-func writePidfile(pidfile string) {
-	if _, err := os.Stat(pidfile); err != nil && !os.IsNotExist(err) {
+// Writes the pidfile, unless it already exists. If this process was reloaded
+// from another (`reloadedFrom`), it takes over that process's pidfile instead.
+func writePidfile(pidfile string, reloadedFrom int) {
+	if contents, err := ioutil.ReadFile(pidfile); err != nil && !os.IsNotExist(err) {
 		log.Fatalf("could not write pidfile %s: %v", pidfile, err)
-	} else if err == nil {
+	} else if err == nil && (reloadedFrom == 0 || strings.TrimSpace(string(contents)) != strconv.Itoa(reloadedFrom)) {
 		log.Fatalf("pidfile %s already exists", pidfile)
 	}
 
-	if file, err := os.Create(pidfile); err == nil {
-		fmt.Fprintf(file, "%d\n", os.Getpid())
-		defer file.Close()
-	} else {
+	// Replace the file by renaming it, so that it always exists while it's
+	// handed over.
+	tmp := fmt.Sprintf("%s.%d", pidfile, os.Getpid())
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		log.Fatalf("could not write pidfile %s: %s", pidfile, err)
+	} else if err := os.Rename(tmp, pidfile); err != nil {
+		os.Remove(tmp)
 		log.Fatalf("could not write pidfile %s: %s", pidfile, err)
 	}
 }
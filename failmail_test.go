@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -29,15 +30,25 @@ func TestBatchConfig(t *testing.T) {
 func TestGroupConfig(t *testing.T) {
 	msg := makeReceivedMessage(t, "Subject: that test\r\nX-Batch: 100\r\n\r\ntest body\r\n")
 
-	group := (&Config{GroupExpr: `{{match "^(this|that)" (.Header.Get "Subject")}}`}).Group()
+	group, _ := (&Config{GroupExpr: `{{match "^(this|that)" (.Header.Get "Subject")}}`}).Group()
 	if key, err := group(msg); key != "that" || err != nil {
 		t.Errorf("expected message group 'that', got %#v, %s", key, err)
 	}
 
-	group = (&Config{GroupExpr: `{{replace "^(this|that)" (.Header.Get "Subject") "*"}}`}).Group()
+	group, _ = (&Config{GroupExpr: `{{replace "^(this|that)" (.Header.Get "Subject") "*"}}`}).Group()
 	if key, err := group(msg); key != "* test" || err != nil {
 		t.Errorf("expected message group '* test', got %#v, %s", key, err)
 	}
+
+	// A bad --group-keys is an error, rather than falling back to --group-expr.
+	config := Defaults()
+	config.GroupKeys = "host"
+	if _, err := config.Group(); err == nil {
+		t.Errorf("expected an error for an invalid --group-keys")
+	}
+	if _, err := config.MakeWriter(); err == nil {
+		t.Errorf("expected an error making a writer with an invalid --group-keys")
+	}
 }
 
 type TestUpstream struct {
@@ -58,7 +69,7 @@ func TestWritePidfile(t *testing.T) {
 	defer cleanup()
 
 	pidfile := path.Join(testDir, "test.pid")
-	writePidfile(pidfile)
+	writePidfile(pidfile, 0)
 	if _, err := os.Stat(pidfile); err != nil && os.IsNotExist(err) {
 		t.Errorf("no pidfile found at %s", pidfile)
 	} else if err != nil && !os.IsNotExist(err) {
@@ -66,6 +77,23 @@ func TestWritePidfile(t *testing.T) {
 	}
 }
 
+func TestWritePidfileReloaded(t *testing.T) {
+	testDir, cleanup := makeTestDir(t)
+	defer cleanup()
+
+	// The reloaded process takes over the pidfile of the one it was reloaded
+	// from.
+	pidfile := path.Join(testDir, "test.pid")
+	ioutil.WriteFile(pidfile, []byte("12345\n"), 0644)
+	writePidfile(pidfile, 12345)
+	if contents, err := ioutil.ReadFile(pidfile); err != nil || string(contents) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("expected the pidfile to be taken over: %#v, %s", string(contents), err)
+	}
+	if files, _ := ioutil.ReadDir(testDir); len(files) != 1 {
+		t.Errorf("expected only the pidfile to be left: %d files", len(files))
+	}
+}
+
 func makeTestDir(t *testing.T) (string, func()) {
 	tmp, err := ioutil.TempDir("", "")
 	if err != nil {
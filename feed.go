@@ -0,0 +1,47 @@
+// Incremental ingestion of stored messages. When the receiver and the sender
+// run in the same process, the writer can hand each message it stores
+// straight to the buffer, so that the buffer doesn't have to scan the whole
+// store for new messages on every flush.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// `StoreFeed` passes messages from the writer that stored them to the buffer
+// that summarizes them. It never blocks the writer: messages queue up until
+// the buffer takes them on its next flush.
+type StoreFeed struct {
+	pending []*StoredMessage
+	lock    sync.Mutex
+}
+
+func NewStoreFeed() *StoreFeed {
+	return &StoreFeed{pending: make([]*StoredMessage, 0)}
+}
+
+// Records that a message was stored. A nil `StoreFeed` ignores it.
+func (f *StoreFeed) Stored(id MessageId, now time.Time, msg *ReceivedMessage) {
+	if f == nil {
+		return
+	}
+
+	// Counting and sampling can change a message after it's stored, so the
+	// buffer gets its own copy.
+	copied := *msg
+	copied.ReceivedAt = now
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pending = append(f.pending, &StoredMessage{id, now, &copied})
+}
+
+// Returns the messages stored since the last call, oldest first.
+func (f *StoreFeed) Take() []*StoredMessage {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := f.pending
+	f.pending = make([]*StoredMessage, 0)
+	return result
+}
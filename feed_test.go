@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStoreFeedTake(t *testing.T) {
+	feed := NewStoreFeed()
+	msg := makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n")
+	feed.Stored(MessageId(1), time.Unix(1393650000, 0), msg)
+
+	taken := feed.Take()
+	if len(taken) != 1 || taken[0].Id != MessageId(1) {
+		t.Fatalf("unexpected messages from the feed: %v", taken)
+	} else if taken[0].ReceivedMessage == msg {
+		t.Errorf("expected the feed to copy the message")
+	}
+	if taken := feed.Take(); len(taken) != 0 {
+		t.Errorf("expected the feed to be empty: %v", taken)
+	}
+
+	// A nil feed ignores stored messages.
+	var none *StoreFeed
+	none.Stored(MessageId(2), time.Unix(1393650000, 0), msg)
+}
+
+func TestFlushFromFeed(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Feed = NewStoreFeed()
+	writer := &MessageWriter{Store: buf.Store, Feed: buf.Feed}
+	outgoing := make(chan *SendRequest, 64)
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	at := func(offset int64) time.Time { return time.Unix(1393650000+offset, 0) }
+	write := func(subject string) {
+		received := make(chan *StorageRequest, 1)
+		errors := make(chan error, 1)
+		received <- &StorageRequest{makeReceivedMessage(t, "To: test@example.com\r\nSubject: "+subject+"\r\n\r\nbody\r\n"), errors}
+		close(received)
+		writer.Run(received)
+		if err := <-errors; err != nil {
+			t.Fatalf("unexpected error storing message: %s", err)
+		}
+	}
+
+	// The first flush scans the store, even for messages that are also fed.
+	write("first")
+	buf.Flush(context.Background(), at(1), outgoing, false)
+	if count := len(buf.messages); count != 1 {
+		t.Fatalf("expected the first flush to scan the store: %d != 1", count)
+	}
+
+	// Later flushes only use the feed.
+	write("second")
+	buf.Store.Add(at(2), makeReceivedMessage(t, "To: test@example.com\r\nSubject: unfed\r\n\r\nbody\r\n"))
+	buf.Flush(context.Background(), at(3), outgoing, false)
+	if count := len(buf.messages); count != 2 {
+		t.Fatalf("expected only fed messages after the first flush: %d != 2", count)
+	}
+	for key, msgs := range buf.messages {
+		if len(msgs) != 1 {
+			t.Errorf("expected one message with key %s: %d", key, len(msgs))
+		}
+	}
+}
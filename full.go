@@ -0,0 +1,84 @@
+//go:build !minimal
+// +build !minimal
+
+// The parts of the configuration for features that are left out of minimal
+// builds (see minimal.go).
+package main
+
+import (
+	"fmt"
+)
+
+// Not a minimal build.
+const MINIMAL = false
+
+// Wraps `upstream` with the upstreams that file summaries as issues, post
+// them to chat, and publish them, if any of them are configured.
+func (c *Config) integrationUpstreams(upstream Upstream) (Upstream, error) {
+	if tracker, err := c.Tracker(); err != nil {
+		return upstream, err
+	} else if tracker != nil {
+		upstream = &IssueUpstream{tracker, upstream}
+	}
+
+	if c.ChatWebhook != "" {
+		if c.ChatFormat != CHAT_TEAMS && c.ChatFormat != CHAT_GOOGLE_CHAT {
+			return upstream, fmt.Errorf("--chat-format must be teams or google-chat")
+		}
+		upstream = &ChatUpstream{c.ChatFormat, c.ChatWebhook, c.HookTimeout, upstream}
+	}
+
+	if publisher, err := c.Publisher(); err != nil {
+		return upstream, err
+	} else if publisher != nil {
+		upstream = &PublishUpstream{publisher, c.PublishRaw, upstream}
+	}
+	return upstream, nil
+}
+
+// Returns the issue tracker to open issues for summaries in, or nil if
+// --issue-tracker isn't given.
+func (c *Config) Tracker() (IssueTracker, error) {
+	if c.IssueTracker == "" {
+		return nil, nil
+	} else if c.IssueProject == "" {
+		return nil, fmt.Errorf("--issue-tracker requires --issue-project")
+	}
+
+	switch c.IssueTracker {
+	case ISSUES_GITHUB:
+		api := c.IssueApi
+		if api == "" {
+			api = GITHUB_API
+		}
+		return &GitHubTracker{api, c.IssueProject, c.IssueToken, c.HookTimeout}, nil
+	case ISSUES_JIRA:
+		if c.IssueApi == "" {
+			return nil, fmt.Errorf("--issue-tracker jira requires --issue-api")
+		}
+		return &JiraTracker{c.IssueApi, c.IssueProject, c.IssueType, c.IssueUser, c.IssueToken, c.HookTimeout}, nil
+	}
+	return nil, fmt.Errorf("--issue-tracker must be github or jira")
+}
+
+// Returns the publisher to publish summaries with, or nil if --publish-to
+// isn't given.
+func (c *Config) Publisher() (Publisher, error) {
+	if c.PublishTo == "" {
+		return nil, nil
+	} else if c.PublishUrl == "" {
+		return nil, fmt.Errorf("--publish-to requires --publish-url")
+	}
+
+	switch c.PublishTo {
+	case PUBLISH_SQS:
+		if publisher, err := NewSQSPublisher(c.PublishUrl, c.HookTimeout); err != nil {
+			return nil, err
+		} else {
+			return publisher, nil
+		}
+	case PUBLISH_KAFKA:
+		return &KafkaPublisher{c.PublishUrl, c.HookTimeout}, nil
+	}
+	return nil, fmt.Errorf("--publish-to must be sqs or kafka")
+}
@@ -0,0 +1,35 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"testing"
+)
+
+func TestConfigTracker(t *testing.T) {
+	config := Defaults()
+	if tracker, err := config.Tracker(); err != nil || tracker != nil {
+		t.Errorf("expected no tracker by default, got %#v, %s", tracker, err)
+	}
+
+	config.IssueTracker = "github"
+	if _, err := config.Tracker(); err == nil {
+		t.Errorf("expected an error without --issue-project")
+	}
+	config.IssueProject = "example/app"
+	if tracker, err := config.Tracker(); err != nil {
+		t.Errorf("unexpected error getting tracker: %s", err)
+	} else if github, ok := tracker.(*GitHubTracker); !ok || github.API != GITHUB_API {
+		t.Errorf("unexpected tracker: %#v", tracker)
+	}
+
+	config.IssueTracker = "jira"
+	if _, err := config.Tracker(); err == nil {
+		t.Errorf("expected an error for jira without --issue-api")
+	}
+	config.IssueTracker = "trac"
+	if _, err := config.Tracker(); err == nil {
+		t.Errorf("expected an error for an unknown tracker")
+	}
+}
@@ -0,0 +1,88 @@
+// Composite group keys. Rather than concatenating several values into one
+// `--group-expr`, `--group-keys` groups messages by several named
+// expressions at once, and each message's values are available to the
+// summary template by name.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// `GroupKeys` groups messages by a tuple of named expressions.
+type GroupKeys struct {
+	Names []string
+	exprs []GroupBy
+}
+
+// Parses semicolon-separated name=expr components, compiling each expression
+// with `compile`.
+func ParseGroupKeys(keys string, compile func(name string, expr string) GroupBy) (*GroupKeys, error) {
+	result := &GroupKeys{Names: make([]string, 0), exprs: make([]GroupBy, 0)}
+	seen := make(map[string]bool, 0)
+	for _, key := range strings.Split(keys, ";") {
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+
+		i := strings.Index(key, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("group key %#v must be of the form name=expr", key)
+		}
+		name := strings.TrimSpace(key[:i])
+		if name == "" || seen[name] {
+			return nil, fmt.Errorf("group key %#v must have a unique name", key)
+		}
+		seen[name] = true
+		result.Names = append(result.Names, name)
+		result.exprs = append(result.exprs, compile(name, strings.TrimSpace(key[i+1:])))
+	}
+	if len(result.Names) == 0 {
+		return nil, fmt.Errorf("expected at least one name=expr group key")
+	}
+	return result, nil
+}
+
+// Returns a `GroupBy` whose keys encode the values of all of the expressions
+// for a message, so that messages are grouped together only if they have the
+// same values for all of them.
+func (k *GroupKeys) GroupBy() GroupBy {
+	return func(r *ReceivedMessage) (string, error) {
+		values := make([]string, 0, len(k.exprs))
+		for i, expr := range k.exprs {
+			value, err := expr(r)
+			if err != nil {
+				return "", fmt.Errorf("%s: %s", k.Names[i], err)
+			}
+			values = append(values, value)
+		}
+		encoded, err := json.Marshal(values)
+		return string(encoded), err
+	}
+}
+
+// Returns the values encoded in a key returned by `GroupBy`, by name, or nil
+// if it isn't such a key.
+func (k *GroupKeys) Split(key string) map[string]string {
+	values := make([]string, 0, len(k.Names))
+	if err := json.Unmarshal([]byte(key), &values); err != nil || len(values) != len(k.Names) {
+		return nil
+	}
+	result := make(map[string]string, len(values))
+	for i, name := range k.Names {
+		result[name] = values[i]
+	}
+	return result
+}
+
+// Sets `Keys` on each unique message from its group key. A nil `GroupKeys`
+// leaves them alone.
+func (k *GroupKeys) Annotate(uniques []*UniqueMessage) {
+	if k == nil {
+		return
+	}
+	for _, unique := range uniques {
+		unique.Keys = k.Split(unique.Template)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGroupKeys(t *testing.T) {
+	keys, err := ParseGroupKeys(` host={{match "db[0-9]+" (.Header.Get "Subject")}}; retried={{.Has "X-Retry"}} ;`, GroupByExpr)
+	if err != nil {
+		t.Fatalf("unexpected error parsing group keys: %s", err)
+	}
+	if !reflect.DeepEqual(keys.Names, []string{"host", "retried"}) {
+		t.Errorf("unexpected names %v", keys.Names)
+	}
+
+	for _, invalid := range []string{"", "host", "=x", "a=x;a=y"} {
+		if _, err := ParseGroupKeys(invalid, GroupByExpr); err == nil {
+			t.Errorf("expected an error parsing %#v", invalid)
+		}
+	}
+}
+
+func TestGroupKeys(t *testing.T) {
+	keys, _ := ParseGroupKeys(`host={{match "db[0-9]+" (.Header.Get "Subject")}};retried={{.Has "X-Retry"}}`, GroupByExpr)
+
+	msg1 := makeReceivedMessage(t, "Subject: db1 is down\r\n\r\ntest")
+	msg2 := makeReceivedMessage(t, "Subject: db1 is slow\r\n\r\ntest")
+	msg3 := makeReceivedMessage(t, "Subject: db1 is down\r\nX-Retry:\r\n\r\ntest")
+	msg4 := makeReceivedMessage(t, "Subject: db2 is down\r\n\r\ntest")
+
+	uniques, err := Compact(keys.GroupBy(), makeStoredMessages(msg1, msg2, msg3, msg4), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Compact(): %s", err)
+	}
+	keys.Annotate(uniques)
+
+	expected := []map[string]string{
+		{"host": "db1", "retried": "false"},
+		{"host": "db1", "retried": "true"},
+		{"host": "db2", "retried": "false"},
+	}
+	if len(uniques) != len(expected) {
+		t.Fatalf("expected %d groups, got %d", len(expected), len(uniques))
+	}
+	for i, unique := range uniques {
+		if !reflect.DeepEqual(unique.Keys, expected[i]) {
+			t.Errorf("expected keys %v for group %d, got %v", expected[i], i, unique.Keys)
+		}
+	}
+	if uniques[0].Count != 2 {
+		t.Errorf("expected messages with the same keys to be grouped together, got %d", uniques[0].Count)
+	}
+
+	if split := keys.Split("not a composite key"); split != nil {
+		t.Errorf("expected no keys from a plain key, got %v", split)
+	}
+	var none *GroupKeys
+	none.Annotate(uniques)
+}
+
+func TestGroupKeysScript(t *testing.T) {
+	keys, err := ParseGroupKeys(`service=header("X-Service");retried=hasHeader("X-Retry")`, GroupByScript)
+	if err != nil {
+		t.Fatalf("unexpected error parsing group keys: %s", err)
+	}
+	msg := makeReceivedMessage(t, "X-Service: billing\r\nX-Retry: 2\r\n\r\ntest")
+	key, err := keys.GroupBy()(msg)
+	if err != nil {
+		t.Fatalf("unexpected error from GroupBy(): %s", err)
+	}
+	if split := keys.Split(key); !reflect.DeepEqual(split, map[string]string{"service": "billing", "retried": "true"}) {
+		t.Errorf("unexpected keys %v", split)
+	}
+}
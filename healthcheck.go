@@ -0,0 +1,74 @@
+// Health checks for containers. `failmail healthcheck` checks that a running
+// failmail (configured with the same flags) is answering: the receiver with an
+// SMTP NOOP on each of its addresses, and the HTTP server with a request to
+// `/api/health`. It exits with an error if either doesn't answer, so it can be
+// used for a Docker HEALTHCHECK or a Kubernetes exec probe in an image that
+// has nothing but failmail in it.
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// How long each check waits for an answer.
+const HEALTHCHECK_TIMEOUT = 5 * time.Second
+
+// `HealthcheckCommand` checks the receiver (with `--receiver`) and the HTTP
+// server (with `--sender` or `--submit-api`), and returns an error if any of
+// them doesn't answer.
+func HealthcheckCommand(config *Config, out io.Writer) error {
+	if !config.Receiver && !config.Sender {
+		return fmt.Errorf("must specify --receiver and/or --sender")
+	}
+
+	if config.Receiver {
+		for _, addr := range SplitAddresses(config.BindAddr) {
+			if err := checkSMTP(addr, config.Ssl); err != nil {
+				return fmt.Errorf("receiver on %s: %s", addr, err)
+			}
+			fmt.Fprintf(out, "receiver on %s: ok\n", addr)
+		}
+	}
+
+	// Minimal builds don't have an HTTP server to check.
+	if !MINIMAL && (config.Sender || (config.Receiver && config.SubmitApi)) {
+		if err := checkHTTP(config.BindHTTP); err != nil {
+			return fmt.Errorf("HTTP server on %s: %s", config.BindHTTP, err)
+		}
+		fmt.Fprintf(out, "HTTP server on %s: ok\n", config.BindHTTP)
+	}
+	return nil
+}
+
+// Connects to the SMTP server at `addr` and sends a NOOP.
+func checkSMTP(addr string, ssl bool) error {
+	conn, err := net.DialTimeout("tcp", addr, HEALTHCHECK_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(HEALTHCHECK_TIMEOUT))
+
+	// The check only needs an answer, not to trust the certificate, which
+	// needn't match the address the server is bound to.
+	if ssl {
+		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Noop(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,29 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Answers requests to `/api/health` on the HTTP server.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"Status": "ok"})
+}
+
+// Requests `/api/health` from the HTTP server at `addr`.
+func checkHTTP(addr string) error {
+	client := &http.Client{Timeout: HEALTHCHECK_TIMEOUT}
+	resp, err := client.Get(fmt.Sprintf("http://%s/api/health", addr))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
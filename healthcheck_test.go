@@ -0,0 +1,58 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthcheckCommand(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10046")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	listener := &Listener{Socket: socket}
+	listenerDone := make(chan TerminationRequest, 1)
+	go listener.Listen(context.Background(), make(chan *StorageRequest, 1), listenerDone, time.Second)
+	defer func() { listenerDone <- GracefulShutdown }()
+
+	server := NewHTTPServer("localhost:10047")
+	serverDone := make(chan TerminationRequest, 1)
+	go server.Listen(serverDone, time.Second)
+	defer func() { serverDone <- GracefulShutdown }()
+
+	config := Defaults()
+	config.Receiver = true
+	config.Sender = true
+	config.BindAddr = "localhost:10046"
+	config.BindHTTP = "localhost:10047"
+
+	// The HTTP server may take a moment to start listening.
+	out := new(bytes.Buffer)
+	for i := 0; i < 50; i++ {
+		out.Reset()
+		if err = HealthcheckCommand(config, out); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("unexpected error checking health: %s", err)
+	} else if !strings.Contains(out.String(), "receiver on localhost:10046: ok") || !strings.Contains(out.String(), "HTTP server on localhost:10047: ok") {
+		t.Errorf("unexpected output: %#v", out.String())
+	}
+
+	config.BindAddr = "localhost:10048"
+	if err := HealthcheckCommand(config, new(bytes.Buffer)); err == nil {
+		t.Errorf("expected an error checking a receiver that isn't running")
+	}
+
+	if err := HealthcheckCommand(Defaults(), new(bytes.Buffer)); err == nil {
+		t.Errorf("expected an error without --receiver or --sender")
+	}
+}
@@ -0,0 +1,78 @@
+// Periodic "all quiet" messages, so that recipients can tell the difference
+// between there being no errors and failmail being down.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// `Heartbeat` counts the messages received during each `Interval`, and
+// generates an "all quiet" message for intervals in which there were none.
+type Heartbeat struct {
+	Interval time.Duration
+	From     string
+	To       []string
+	start    time.Time
+	received int
+}
+
+// Records that messages were received.
+func (h *Heartbeat) Received(count int) {
+	if h != nil {
+		h.received += count
+	}
+}
+
+// Starts a new interval at `now`, e.g. after taking the lease on the store.
+func (h *Heartbeat) Reset(now time.Time) {
+	if h != nil {
+		h.start = now
+		h.received = 0
+	}
+}
+
+// Returns an "all quiet" message if the current interval is over and no
+// messages were received during it, or nil otherwise. A new interval starts
+// whenever the current one is over.
+func (h *Heartbeat) Check(now time.Time) OutgoingMessage {
+	if h == nil {
+		return nil
+	} else if h.start.IsZero() {
+		h.Reset(now)
+		return nil
+	} else if now.Sub(h.start) < h.Interval {
+		return nil
+	}
+
+	quiet := h.received == 0
+	h.Reset(now)
+	if !quiet {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", h.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(h.To, ", "))
+	fmt.Fprintf(buf, "Subject: [failmail] all quiet: 0 messages in the last %s\r\n", shortDuration(h.Interval))
+	fmt.Fprintf(buf, "Date: %s\r\n", now.Format(time.RFC822))
+	fmt.Fprintf(buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(buf, "\r\n")
+	fmt.Fprintf(buf, "failmail is running, and received no messages in the last %s.\r\n", shortDuration(h.Interval))
+	return &message{h.From, h.To, buf.Bytes()}
+}
+
+// Formats a duration without trailing zero units, e.g. "24h" instead of
+// "24h0m0s".
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
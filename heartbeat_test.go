@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	start := time.Unix(1393650000, 0)
+	heartbeat := &Heartbeat{Interval: 24 * time.Hour, From: "failmail@example.com", To: []string{"ops@example.com"}}
+
+	if msg := heartbeat.Check(start); msg != nil {
+		t.Errorf("unexpected heartbeat at the start: %s", msg.Contents())
+	}
+
+	heartbeat.Received(3)
+	if msg := heartbeat.Check(start.Add(24 * time.Hour)); msg != nil {
+		t.Errorf("unexpected heartbeat after an interval with messages: %s", msg.Contents())
+	}
+
+	if msg := heartbeat.Check(start.Add(47 * time.Hour)); msg != nil {
+		t.Errorf("unexpected heartbeat before the interval is over: %s", msg.Contents())
+	}
+
+	msg := heartbeat.Check(start.Add(48 * time.Hour))
+	if msg == nil {
+		t.Fatalf("expected a heartbeat after a quiet interval")
+	}
+	if to := msg.Recipients(); len(to) != 1 || to[0] != "ops@example.com" {
+		t.Errorf("unexpected heartbeat recipients: %v", to)
+	}
+	if contents := string(msg.Contents()); !strings.Contains(contents, "Subject: [failmail] all quiet: 0 messages in the last 24h\r\n") {
+		t.Errorf("unexpected heartbeat contents: %s", contents)
+	}
+}
+
+func TestShortDuration(t *testing.T) {
+	for d, expected := range map[time.Duration]string{24 * time.Hour: "24h", 90 * time.Minute: "1h30m", 5 * time.Minute: "5m", 30 * time.Second: "30s"} {
+		if s := shortDuration(d); s != expected {
+			t.Errorf("unexpected short duration for %s: %s", d, s)
+		}
+	}
+}
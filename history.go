@@ -0,0 +1,191 @@
+// History of summaries, for noticing flapping errors. For each batch, failmail
+// remembers which groups of messages appeared in its last few summaries, so
+// that a summary can say that an error "appeared in 5 of the last 6
+// summaries", rather than each summary reporting it as if for the first time.
+// It also remembers when each group was first seen, so that errors that have
+// never been seen before stand out as new.
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Groups that haven't appeared in a summary for this long are forgotten, so
+// they're new again if they come back.
+const HISTORY_RETENTION = 90 * 24 * time.Hour
+
+// When a group of messages first and last appeared in a summary.
+type GroupHistory struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// `History` records the groups in the last `Length` summaries sent for each
+// batch and recipient, by fingerprint. If `Path` is set, it's kept in that
+// file, so that it survives restarts. It's safe to use from multiple
+// goroutines.
+type History struct {
+	Path   string `json:"-"`
+	Length int    `json:"-"`
+
+	// The fingerprints of the groups in each of the batch's summaries, oldest
+	// first.
+	Batches map[string][][]string
+
+	// The number of messages in each group in the batch's last summary, by
+	// fingerprint.
+	Counts map[string]map[string]int
+
+	// When each group appeared in any batch's summaries, by fingerprint.
+	Groups map[string]*GroupHistory
+	lock   sync.Mutex
+}
+
+// Loads the history from `path`, or starts an empty one if the file doesn't
+// exist yet.
+func LoadHistory(path string, length int) (*History, error) {
+	h := &History{Path: path, Length: length, Batches: make(map[string][][]string, 0), Counts: make(map[string]map[string]int, 0), Groups: make(map[string]*GroupHistory, 0)}
+	if path == "" {
+		return h, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, err
+	}
+	if h.Groups == nil {
+		h.Groups = make(map[string]*GroupHistory, 0)
+	}
+	if h.Counts == nil {
+		h.Counts = make(map[string]map[string]int, 0)
+	}
+	return h, nil
+}
+
+// Returns a fingerprint for the group of a unique message.
+func Fingerprint(unique *UniqueMessage) string {
+	return FingerprintKey(unique.Template)
+}
+
+// Returns a fingerprint for a group key (the result of `--group-expr`).
+func FingerprintKey(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return hex.EncodeToString(hash[:8])
+}
+
+func historyKey(key RecipientKey) string {
+	return key.Key + "\x00" + key.Recipient
+}
+
+// Sets `Seen` and `Summaries` on each unique message: how many of the
+// batch's last summaries, including the one being sent, it appeared in. Also
+// sets `FirstSeen`, marks messages in groups that have never appeared in a
+// summary before as `New`, and sets `Previous` to the number of messages in
+// the group in the batch's last summary. A nil `History` leaves them unset.
+func (h *History) Annotate(key RecipientKey, uniques []*UniqueMessage) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	summaries := h.Batches[historyKey(key)]
+	counts, hasPrevious := h.Counts[historyKey(key)]
+	for _, unique := range uniques {
+		fingerprint := Fingerprint(unique)
+		unique.Previous, unique.HasPrevious = counts[fingerprint], hasPrevious
+		if group, ok := h.Groups[fingerprint]; ok {
+			unique.FirstSeen = group.FirstSeen
+		} else {
+			unique.FirstSeen, unique.New = nowGetter(), true
+		}
+
+		unique.Seen, unique.Summaries = 1, len(summaries)+1
+		for _, fingerprints := range summaries {
+			for _, f := range fingerprints {
+				if f == fingerprint {
+					unique.Seen += 1
+					break
+				}
+			}
+		}
+	}
+}
+
+// Records the groups in a summary that was sent for the batch, forgetting
+// the oldest summary if there are more than `Length - 1` earlier ones (so
+// that, with the next summary, there are `Length`).
+func (h *History) Record(key RecipientKey, uniques []*UniqueMessage) error {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := nowGetter()
+	fingerprints := make([]string, 0, len(uniques))
+	counts := make(map[string]int, len(uniques))
+	for _, unique := range uniques {
+		fingerprint := Fingerprint(unique)
+		fingerprints = append(fingerprints, fingerprint)
+		counts[fingerprint] += unique.Count
+		if group, ok := h.Groups[fingerprint]; ok {
+			group.LastSeen = now
+		} else {
+			h.Groups[fingerprint] = &GroupHistory{now, now}
+		}
+	}
+	for fingerprint, group := range h.Groups {
+		if now.Sub(group.LastSeen) > HISTORY_RETENTION {
+			delete(h.Groups, fingerprint)
+		}
+	}
+
+	hk := historyKey(key)
+	summaries := append(h.Batches[hk], fingerprints)
+	if keep := h.Length - 1; len(summaries) > keep && keep >= 0 {
+		summaries = summaries[len(summaries)-keep:]
+	}
+	h.Batches[hk] = summaries
+	h.Counts[hk] = counts
+	return h.save()
+}
+
+// Writes the history to its file, if it has one, replacing the file only once
+// the new one is complete.
+func (h *History) save() error {
+	if h.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(h.Path), ".history")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), h.Path)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeUniques(templates ...string) []*UniqueMessage {
+	uniques := make([]*UniqueMessage, 0, len(templates))
+	for _, template := range templates {
+		uniques = append(uniques, &UniqueMessage{Template: template})
+	}
+	return uniques
+}
+
+func TestHistoryAnnotate(t *testing.T) {
+	history, _ := LoadHistory("", 3)
+	key := RecipientKey{"batch", "test@example.com"}
+
+	for _, templates := range [][]string{{"a", "b"}, {"a"}, {"a", "c"}} {
+		history.Record(key, makeUniques(templates...))
+	}
+
+	uniques := makeUniques("a", "b", "d")
+	history.Annotate(key, uniques)
+
+	// Only the last two summaries are remembered, to make three with this one.
+	expected := map[string]int{"a": 3, "b": 1, "d": 1}
+	for _, unique := range uniques {
+		if unique.Seen != expected[unique.Template] || unique.Summaries != 3 {
+			t.Errorf("unexpected history for %s: %d of %d", unique.Template, unique.Seen, unique.Summaries)
+		}
+	}
+
+	other := makeUniques("a")
+	history.Annotate(RecipientKey{"batch", "other@example.com"}, other)
+	if other[0].Seen != 1 || other[0].Summaries != 1 {
+		t.Errorf("expected no history for another recipient: %d of %d", other[0].Seen, other[0].Summaries)
+	}
+}
+
+func TestHistoryPersists(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatalf("unable to create a test directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	file := path.Join(tmp, "history.json")
+	key := RecipientKey{"batch", "test@example.com"}
+	history, err := LoadHistory(file, 10)
+	if err != nil {
+		t.Fatalf("unexpected error loading a new history: %s", err)
+	}
+	if err := history.Record(key, makeUniques("a")); err != nil {
+		t.Fatalf("unexpected error recording history: %s", err)
+	}
+
+	loaded, err := LoadHistory(file, 10)
+	if err != nil {
+		t.Fatalf("unexpected error loading history: %s", err)
+	}
+	uniques := makeUniques("a")
+	loaded.Annotate(key, uniques)
+	if uniques[0].Seen != 2 || uniques[0].Summaries != 2 {
+		t.Errorf("expected history to survive reloading: %d of %d", uniques[0].Seen, uniques[0].Summaries)
+	}
+}
+
+func TestHistoryNil(t *testing.T) {
+	var history *History
+	uniques := makeUniques("a")
+	history.Annotate(RecipientKey{"batch", "test@example.com"}, uniques)
+	if err := history.Record(RecipientKey{"batch", "test@example.com"}, uniques); err != nil || uniques[0].Seen != 0 {
+		t.Errorf("expected a nil history to do nothing: %s, %d", err, uniques[0].Seen)
+	}
+}
+
+func TestSummaryShowsHistory(t *testing.T) {
+	summary := makeSummaryMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\nbody\r\n")
+	summary.UniqueMessages[0].Seen = 5
+	summary.UniqueMessages[0].Summaries = 6
+	if contents := string(summary.Contents()); !strings.Contains(contents, "Appeared in 5 of the last 6 summaries\r\n") {
+		t.Errorf("expected the summary to note the group's history: %s", contents)
+	}
+}
+
+func TestHistoryFirstSeen(t *testing.T) {
+	history, _ := LoadHistory("", 10)
+	key := RecipientKey{"batch", "test@example.com"}
+
+	first := time.Unix(1393650000, 0)
+	unpatch := patchTime(first)
+	uniques := makeUniques("a")
+	history.Annotate(key, uniques)
+	if !uniques[0].New || !uniques[0].FirstSeen.Equal(first) {
+		t.Errorf("expected a group never seen before to be new: %v, %s", uniques[0].New, uniques[0].FirstSeen)
+	}
+	history.Record(key, uniques)
+	unpatch()
+
+	defer patchTime(first.Add(time.Hour))()
+	uniques = makeUniques("a", "b")
+	history.Annotate(RecipientKey{"other", "test@example.com"}, uniques)
+	if uniques[0].New || !uniques[0].FirstSeen.Equal(first) {
+		t.Errorf("expected a group seen in any batch not to be new: %v, %s", uniques[0].New, uniques[0].FirstSeen)
+	}
+	if !uniques[1].New {
+		t.Errorf("expected a group never seen before to be new")
+	}
+}
+
+func TestHistoryForgetsOldGroups(t *testing.T) {
+	history, _ := LoadHistory("", 10)
+	key := RecipientKey{"batch", "test@example.com"}
+
+	start := time.Unix(1393650000, 0)
+	unpatch := patchTime(start)
+	history.Record(key, makeUniques("a"))
+	unpatch()
+
+	defer patchTime(start.Add(HISTORY_RETENTION + time.Hour))()
+	history.Record(key, makeUniques("b"))
+	uniques := makeUniques("a")
+	history.Annotate(key, uniques)
+	if !uniques[0].New {
+		t.Errorf("expected a group not seen for a long time to be new again")
+	}
+}
+
+func TestSummaryMarksNew(t *testing.T) {
+	summary := makeSummaryMessage(t, "To: test@example.com\r\nSubject: one\r\n\r\nbody\r\n", "To: test@example.com\r\nSubject: two\r\n\r\nbody\r\n")
+	summary.UniqueMessages[0].New = true
+	summary.UniqueMessages[0].FirstSeen = time.Unix(1393650000, 0)
+	summary.UniqueMessages[1].FirstSeen = time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	contents := string(summary.Contents())
+	if !strings.Contains(contents, "- NEW: Message group 1 of 2") {
+		t.Errorf("expected the new group to be marked: %s", contents)
+	}
+	if !strings.Contains(contents, "- Message group 2 of 2") || !strings.Contains(contents, "First seen Sat, 01 Mar 2014 00:00:00 +0000\r\n") {
+		t.Errorf("expected the known group to give when it was first seen: %s", contents)
+	}
+}
+
+func TestHistoryPrevious(t *testing.T) {
+	history, _ := LoadHistory("", 10)
+	key := RecipientKey{"batch", "test@example.com"}
+
+	uniques := makeUniques("a")
+	history.Annotate(key, uniques)
+	if uniques[0].HasPrevious {
+		t.Errorf("expected no previous summary to compare with")
+	}
+
+	uniques[0].Count = 3
+	history.Record(key, uniques)
+
+	uniques = makeUniques("a", "b")
+	history.Annotate(key, uniques)
+	if !uniques[0].HasPrevious || uniques[0].Previous != 3 {
+		t.Errorf("expected the group's count in the previous summary: %d", uniques[0].Previous)
+	}
+	if !uniques[1].HasPrevious || uniques[1].Previous != 0 {
+		t.Errorf("expected a group missing from the previous summary to have had none: %d", uniques[1].Previous)
+	}
+}
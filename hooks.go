@@ -0,0 +1,272 @@
+// Support for site-specific policy via external hooks.
+//
+// A hook is either an HTTP(S) URL or a shell command. At each hook point,
+// failmail describes the message (or batch of messages) as JSON, and either
+// POSTs it to the URL or writes it to the command's stdin. The response body
+// or the command's stdout is read as a JSON `HookVerdict` (an empty response
+// leaves the message alone). If a hook fails, failmail logs the failure and
+// carries on as if there were no hook, so that a broken hook can't cause
+// messages to be lost.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	HOOK_ON_RECEIVE = "on-receive"
+	HOOK_PRE_FLUSH  = "pre-flush"
+	HOOK_PRE_SEND   = "pre-send"
+)
+
+// `Hook` is an external command or HTTP endpoint called at a hook point.
+type Hook struct {
+	Name    string
+	Target  string
+	Timeout time.Duration
+}
+
+// `HookVerdict` is the response from a hook, telling failmail what to do with
+// the message or batch.
+type HookVerdict struct {
+	// If true, the message (or batch) is discarded.
+	Drop bool
+
+	// Headers to set on the message, replacing any existing headers with the
+	// same names. Headers with empty values are removed.
+	Headers map[string]string
+
+	// If non-empty, the recipients to send the message (or batch) to instead.
+	To []string
+}
+
+// `HookMessage` is the JSON description of a message given to a hook.
+type HookMessage struct {
+	From    string
+	To      []string
+	Headers mail.Header
+	Body    string
+}
+
+func NewHookMessage(from string, to []string, data []byte) (*HookMessage, error) {
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(parsed.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &HookMessage{from, to, parsed.Header, string(body)}, nil
+}
+
+// `HookBatch` is the JSON description of a batch of messages given to a
+// pre-flush hook.
+type HookBatch struct {
+	Key       string
+	Recipient string
+	Messages  []*HookMessage
+}
+
+// Calls the hook with the JSON encoding of `payload`, and returns its verdict.
+// A nil `Hook` always returns an empty verdict.
+func (h *Hook) Call(payload interface{}) (*HookVerdict, error) {
+	verdict := new(HookVerdict)
+	if h == nil {
+		return verdict, nil
+	}
+
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return verdict, err
+	}
+
+	var output []byte
+	if isHookURL(h.Target) {
+		output, err = h.post(input)
+	} else {
+		output, err = h.run(input)
+	}
+	if err != nil {
+		return verdict, fmt.Errorf("%s hook failed: %s", h.Name, err)
+	}
+
+	if len(bytes.TrimSpace(output)) == 0 {
+		return verdict, nil
+	}
+	if err := json.Unmarshal(output, verdict); err != nil {
+		return new(HookVerdict), fmt.Errorf("%s hook returned an invalid verdict: %s", h.Name, err)
+	}
+	return verdict, nil
+}
+
+func (h *Hook) run(input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Target)
+	cmd.Stdin = bytes.NewBuffer(input)
+	cmd.Env = append(os.Environ(), "FAILMAIL_HOOK="+h.Name)
+	return cmd.Output()
+}
+
+// Calls the hook for a single message, and applies the verdict. Returns nil
+// if the message should be dropped.
+func (h *Hook) Apply(from string, to []string, data []byte) (*message, error) {
+	msg := &message{from, to, data}
+	if h == nil {
+		return msg, nil
+	}
+
+	payload, err := NewHookMessage(from, to, data)
+	if err != nil {
+		return msg, err
+	}
+
+	verdict, err := h.Call(payload)
+	if err != nil {
+		return msg, err
+	} else if verdict.Drop {
+		return nil, nil
+	}
+
+	if len(verdict.To) > 0 {
+		msg.To = verdict.To
+	}
+	msg.Data = SetHeaders(msg.Data, verdict.Headers)
+	return msg, nil
+}
+
+// `SetHeaders` returns a copy of the message `data` with the given headers
+// set, replacing existing headers of the same name (case-insensitively). A
+// header with an empty value is removed.
+func SetHeaders(data []byte, headers map[string]string) []byte {
+	if len(headers) == 0 {
+		return data
+	}
+
+	text := string(data)
+	head, body := text, ""
+	if i := strings.Index(text, "\r\n\r\n"); i >= 0 {
+		head, body = text[:i+2], text[i+2:]
+	}
+
+	replace := make(map[string]bool, len(headers))
+	for name, _ := range headers {
+		replace[strings.ToLower(name)] = true
+	}
+
+	buf := new(bytes.Buffer)
+	skipping := false
+	for _, line := range strings.SplitAfter(head, "\r\n") {
+		if line == "" {
+			continue
+		}
+		// Continuation lines belong to the previous header.
+		if line[0] != ' ' && line[0] != '\t' {
+			name := strings.ToLower(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+			skipping = replace[name]
+		}
+		if !skipping {
+			buf.WriteString(line)
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name, _ := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value := headers[name]; value != "" && !strings.ContainsAny(name+value, "\r\n") {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+		}
+	}
+
+	if body == "" {
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString(body)
+	return buf.Bytes()
+}
+
+// Calls the hook for a received message, and applies the verdict, returning
+// nil if the message should be dropped. If the hook fails, the message is
+// returned unchanged.
+func (h *Hook) ApplyReceived(msg *ReceivedMessage) *ReceivedMessage {
+	applied, err := h.Apply(msg.Sender(), msg.Recipients(), msg.Contents())
+	if err != nil {
+		log.Printf("warning: %s", err)
+		return msg
+	} else if applied == nil {
+		log.Printf("%s hook dropped message with subject %#v", h.Name, msg.Parsed.Header.Get("Subject"))
+		return nil
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(applied.Data))
+	if err != nil {
+		log.Printf("warning: couldn't parse message from %s hook: %s", h.Name, err)
+		return msg
+	}
+	msg.Data = applied.Data
+	msg.Parsed = parsed
+	msg.RedirectedTo = applied.To
+	return msg
+}
+
+// Calls the hook for a batch of messages due to be summarized, and returns
+// its verdict. If the hook fails, an empty verdict is returned.
+func (h *Hook) ApplyBatch(key RecipientKey, msgs []*StoredMessage) *HookVerdict {
+	batch := &HookBatch{key.Key, key.Recipient, make([]*HookMessage, 0, len(msgs))}
+	for _, msg := range msgs {
+		if hookMsg, err := NewHookMessage(msg.Sender(), msg.Recipients(), msg.Contents()); err == nil {
+			batch.Messages = append(batch.Messages, hookMsg)
+		}
+	}
+
+	verdict, err := h.Call(batch)
+	if err != nil {
+		log.Printf("warning: %s", err)
+	}
+	return verdict
+}
+
+// `HookUpstream` calls a pre-send hook on each message before passing it to
+// another `Upstream`.
+type HookUpstream struct {
+	Hook     *Hook
+	Upstream Upstream
+}
+
+func (u *HookUpstream) Send(m OutgoingMessage) error {
+	return u.SendContext(context.Background(), m)
+}
+
+func (u *HookUpstream) SendContext(ctx context.Context, m OutgoingMessage) error {
+	msg, err := u.Hook.Apply(m.Sender(), m.Recipients(), m.Contents())
+	if err != nil {
+		log.Printf("warning: %s", err)
+	} else if msg == nil {
+		log.Printf("%s hook dropped message to %v", u.Hook.Name, m.Recipients())
+		return nil
+	} else {
+		m = msg
+	}
+	return sendContext(ctx, u.Upstream, m)
+}
+
+// Returns true if a hook's target is a URL to POST to, rather than a command.
+func isHookURL(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
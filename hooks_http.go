@@ -0,0 +1,25 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+func (h *Hook) post(input []byte) ([]byte, error) {
+	client := &http.Client{Timeout: h.Timeout}
+	resp, err := client.Post(h.Target, "application/json", bytes.NewBuffer(input))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
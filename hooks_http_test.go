@@ -0,0 +1,35 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHookHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		batch := new(HookBatch)
+		if err := json.NewDecoder(r.Body).Decode(batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if batch.Key == "drop" && len(batch.Messages) == 1 {
+			fmt.Fprintf(w, `{"Drop": true}`)
+		}
+	}))
+	defer server.Close()
+
+	hook := &Hook{HOOK_PRE_FLUSH, server.URL, time.Second}
+	msgs := makeStoredMessages(makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n"))
+
+	if verdict := hook.ApplyBatch(RecipientKey{"drop", "test@example.com"}, msgs); !verdict.Drop {
+		t.Errorf("expected the batch to be dropped")
+	}
+	if verdict := hook.ApplyBatch(RecipientKey{"keep", "test@example.com"}, msgs); verdict.Drop {
+		t.Errorf("expected the batch to be kept")
+	}
+}
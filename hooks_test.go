@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSetHeaders(t *testing.T) {
+	data := []byte("Subject: test\r\nX-Long: a\r\n b\r\nTo: test@example.com\r\n\r\nbody\r\n")
+
+	result := SetHeaders(data, map[string]string{"x-long": "c", "To": "", "X-New": "d"})
+	expected := "Subject: test\r\nX-New: d\r\nx-long: c\r\n\r\nbody\r\n"
+	if string(result) != expected {
+		t.Errorf("unexpected result from SetHeaders(): %#v", string(result))
+	}
+
+	if result := SetHeaders(data, nil); string(result) != string(data) {
+		t.Errorf("expected no change from SetHeaders() without headers: %#v", string(result))
+	}
+
+	if result := SetHeaders([]byte("Subject: test\r\n"), map[string]string{"X-New": "d"}); string(result) != "Subject: test\r\nX-New: d\r\n\r\n" {
+		t.Errorf("unexpected result from SetHeaders() without a body: %#v", string(result))
+	}
+}
+
+func TestHookCommand(t *testing.T) {
+	hook := &Hook{HOOK_PRE_SEND, `grep -q '"Subject":\["test"\]' && echo '{"To": ["other@example.com"], "Headers": {"X-Hooked": "'$FAILMAIL_HOOK'"}}'`, time.Second}
+
+	msg, err := hook.Apply("test@example.com", []string{"test@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatalf("unexpected error from Apply(): %s", err)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "other@example.com" {
+		t.Errorf("expected the message to be rerouted: %v", msg.To)
+	}
+	if string(msg.Data) != "Subject: test\r\nX-Hooked: pre-send\r\n\r\nbody\r\n" {
+		t.Errorf("expected a header to be added: %#v", string(msg.Data))
+	}
+}
+
+func TestHookCommandNoOutput(t *testing.T) {
+	hook := &Hook{HOOK_PRE_SEND, `cat >/dev/null`, time.Second}
+	if verdict, err := hook.Call(map[string]string{}); err != nil || verdict.Drop || verdict.To != nil {
+		t.Errorf("expected an empty verdict: %#v, %s", verdict, err)
+	}
+}
+
+func TestHookCommandFailure(t *testing.T) {
+	hook := &Hook{HOOK_PRE_SEND, `exit 1`, time.Second}
+	if _, err := hook.Call(map[string]string{}); err == nil {
+		t.Errorf("expected an error from a failing hook")
+	}
+
+	hook = &Hook{HOOK_PRE_SEND, `echo nonsense`, time.Second}
+	if _, err := hook.Call(map[string]string{}); err == nil {
+		t.Errorf("expected an error from a hook with invalid output")
+	}
+
+	hook = &Hook{HOOK_PRE_SEND, `exec sleep 1`, 10 * time.Millisecond}
+	if _, err := hook.Call(map[string]string{}); err == nil {
+		t.Errorf("expected an error from a hook that times out")
+	}
+}
+
+func TestMessageWriterHook(t *testing.T) {
+	store := NewMemoryStore()
+	writer := &MessageWriter{Store: store, Hook: &Hook{HOOK_ON_RECEIVE, `grep -q drop && echo '{"Drop": true}'`, time.Second}}
+
+	received := make(chan *StorageRequest, 2)
+	errors := make(chan error, 2)
+	received <- &StorageRequest{makeReceivedMessage(t, "Subject: drop\r\n\r\nbody\r\n"), errors}
+	received <- &StorageRequest{makeReceivedMessage(t, "Subject: keep\r\n\r\nbody\r\n"), errors}
+	close(received)
+
+	writer.Run(received)
+	if err := <-errors; err != nil {
+		t.Errorf("expected dropped message to be acknowledged: %s", err)
+	}
+
+	if msgs, _ := store.MessagesNewerThan(time.Time{}); len(msgs) != 1 {
+		t.Errorf("expected one message to be stored, got %d", len(msgs))
+	} else if subject := msgs[0].Parsed.Header.Get("Subject"); subject != "keep" {
+		t.Errorf("unexpected message stored: %s", subject)
+	}
+}
+
+func TestHookUpstream(t *testing.T) {
+	upstream := &TestUpstream{}
+	hooked := &HookUpstream{&Hook{HOOK_PRE_SEND, `grep -q drop && echo '{"Drop": true}'`, time.Second}, upstream}
+
+	if err := hooked.Send(&message{"test@example.com", []string{"test@example.com"}, []byte("Subject: drop\r\n\r\n")}); err != nil {
+		t.Errorf("unexpected error sending dropped message: %s", err)
+	}
+	if err := hooked.Send(&message{"test@example.com", []string{"test@example.com"}, []byte("Subject: keep\r\n\r\n")}); err != nil {
+		t.Errorf("unexpected error sending message: %s", err)
+	}
+	if count := len(upstream.Sends); count != 1 {
+		t.Errorf("expected one message to be sent, got %d", count)
+	}
+}
+
+func TestFlushPreFlushHook(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Hook = &Hook{HOOK_PRE_FLUSH, `grep -q '"Key":"drop"' && echo '{"Drop": true}' || echo '{"To": ["other@example.com"]}'`, time.Second}
+
+	outgoing := make(chan *SendRequest, 64)
+	summaries := make([]*SummaryMessage, 0)
+	go func() {
+		for req := range outgoing {
+			summaries = append(summaries, req.Message.(*SummaryMessage))
+			req.SendErrors <- nil
+		}
+	}()
+
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: drop\r\n\r\ntest 1"))
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: keep\r\n\r\ntest 2"))
+	buf.Flush(context.Background(), nowGetter(), outgoing, true)
+	close(outgoing)
+
+	if count := len(summaries); count != 1 {
+		t.Fatalf("expected one summary, got %d", count)
+	}
+	if to := summaries[0].To; len(to) != 1 || to[0] != "other@example.com" {
+		t.Errorf("expected the summary to be rerouted: %v", to)
+	}
+	if msgs, _ := buf.Store.MessagesNewerThan(time.Time{}); len(msgs) != 0 {
+		t.Errorf("expected both messages to be removed from the store, found %d", len(msgs))
+	}
+}
@@ -1,14 +1,51 @@
+//go:build !minimal
+// +build !minimal
+
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
-func ListenHTTP(bind string, buffer *MessageBuffer) {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// `HTTPServer` serves failmail's HTTP endpoints from its own mux. Components
+// register their handlers with `Handle()`, and since the server is itself an
+// `http.Handler`, tests can exercise the endpoints without listening.
+type HTTPServer struct {
+	Bind string
+	Fd   uintptr // if non-zero, serve on this inherited socket instead of binding to `Bind`
+	mux  *http.ServeMux
+
+	serves bool // true once a handler other than `/api/health` is registered
+}
+
+func NewHTTPServer(bind string) *HTTPServer {
+	server := &HTTPServer{Bind: bind, mux: http.NewServeMux()}
+	server.mux.Handle("/api/health", http.HandlerFunc(serveHealth))
+	return server
+}
+
+// Registers the handler for requests whose paths match `pattern`, as for
+// `http.ServeMux`.
+func (s *HTTPServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+	s.serves = true
+}
+
+// Returns true if any component has registered an endpoint, so that the
+// server has more to serve than `/api/health`.
+func (s *HTTPServer) Serves() bool {
+	return s.serves
+}
+
+// Registers handlers for reporting stats for `buffer`, handling its silences,
+// and looking up its receipts.
+func (s *HTTPServer) HandleBuffer(buffer *MessageBuffer) {
+	s.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if stats, err := json.Marshal(buffer.Stats()); err == nil {
 			fmt.Fprintf(w, "%s\n", stats)
 		} else {
@@ -16,7 +53,65 @@ func ListenHTTP(bind string, buffer *MessageBuffer) {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "{}\n")
 		}
-	})
-	log.Printf("listening: %s\n", bind)
-	http.ListenAndServe(bind, nil)
+	}))
+	if buffer.Silences != nil {
+		s.Handle("/api/silence", buffer.Silences)
+	}
+	if buffer.Receipts != nil {
+		s.Handle("/api/receipts", buffer.Receipts)
+	}
+}
+
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Serves HTTP on `Bind` (or the socket `Fd`) until a `TerminationRequest`
+// arrives on `done`, then stops accepting connections, and waits up to
+// `timeout` for requests in progress to finish. On reload, returns a file
+// descriptor for the socket to pass to the new process, as for `Listener`.
+func (s *HTTPServer) Listen(done <-chan TerminationRequest, timeout time.Duration) (uintptr, error) {
+	socket, err := s.socket()
+	if err != nil {
+		return 0, err
+	}
+
+	server := &http.Server{Handler: s}
+	served := make(chan error, 1)
+	go func() {
+		log.Printf("listening: %s\n", socket)
+		served <- server.Serve(socket)
+	}()
+
+	var req TerminationRequest
+	select {
+	case err := <-served:
+		return 0, err
+	case req = <-done:
+	}
+
+	newFd := 0
+	if req == Reload {
+		if newFd, err = reloadFd(socket); err != nil {
+			return 0, err
+		}
+	}
+
+	log.Printf("waiting %s for HTTP requests to finish", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return 0, err
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		return 0, err
+	}
+	return uintptr(newFd), nil
+}
+
+func (s *HTTPServer) socket() (ServerSocket, error) {
+	if s.Fd != 0 {
+		return NewFileServerSocket(s.Fd)
+	}
+	return NewTCPServerSocket(s.Bind)
 }
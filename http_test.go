@@ -0,0 +1,139 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPServerHandle(t *testing.T) {
+	server := NewHTTPServer("")
+	server.Handle("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("test"))
+	}))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "test" {
+		t.Errorf("unexpected response from registered handler: %d %#v", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 without a handler: %d", w.Code)
+	}
+}
+
+func TestHTTPServerServes(t *testing.T) {
+	server := NewHTTPServer("")
+	if server.Serves() {
+		t.Errorf("expected nothing to serve besides /api/health")
+	}
+
+	// A receiver without a sender (or --submit-api) still has endpoints.
+	server.Handle("/api/read-only", NewReadOnly(true))
+	if !server.Serves() {
+		t.Fatalf("expected /api/read-only to be served in receiver mode")
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/api/read-only", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"ReadOnly":true}` {
+		t.Errorf("unexpected response from /api/read-only: %d %#v", w.Code, w.Body.String())
+	}
+}
+
+func TestHTTPServerHandleBuffer(t *testing.T) {
+	server := NewHTTPServer("")
+	server.HandleBuffer(makeMessageBuffer())
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ActiveBatches":0`) {
+		t.Errorf("unexpected stats response: %d %#v", w.Code, w.Body.String())
+	}
+}
+
+func TestHTTPServerDrains(t *testing.T) {
+	server := NewHTTPServer("localhost:10035")
+	started := make(chan bool, 1)
+	server.Handle("/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+
+	done := make(chan TerminationRequest, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		_, err := server.Listen(done, time.Second)
+		stopped <- err
+	}()
+
+	bodies := make(chan string, 1)
+	go func() {
+		for i := 0; i < 500; i++ {
+			if resp, err := http.Get("http://localhost:10035/slow"); err == nil {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				bodies <- string(body)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		bodies <- ""
+	}()
+
+	<-started
+	done <- GracefulShutdown
+	if err := <-stopped; err != nil {
+		t.Errorf("unexpected error shutting down: %s", err)
+	}
+	if body := <-bodies; body != "done" {
+		t.Errorf("expected the request in progress to finish: %#v", body)
+	}
+
+	if _, err := http.Get("http://localhost:10035/slow"); err == nil {
+		t.Errorf("expected the server to stop accepting connections")
+	}
+}
+
+func TestHTTPServerReload(t *testing.T) {
+	server := NewHTTPServer("localhost:10045")
+	server.Handle("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("test"))
+	}))
+
+	done := make(chan TerminationRequest, 1)
+	done <- Reload
+	fd, err := server.Listen(done, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %s", err)
+	} else if fd <= 0 {
+		t.Fatalf("unexpected file descriptor returned from Listen(): %d", fd)
+	}
+
+	// A new server can serve on the same socket.
+	reloaded := NewHTTPServer("")
+	reloaded.Fd = fd
+	reloaded.Handle("/test", server.mux)
+	done = make(chan TerminationRequest, 1)
+	go reloaded.Listen(done, time.Second)
+	defer func() { done <- GracefulShutdown }()
+
+	if resp, err := http.Get("http://localhost:10045/test"); err != nil {
+		t.Errorf("expected the reloaded server to accept connections: %s", err)
+	} else {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "test" {
+			t.Errorf("unexpected response from the reloaded server: %#v", string(body))
+		}
+	}
+}
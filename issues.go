@@ -0,0 +1,267 @@
+//go:build !minimal
+// +build !minimal
+
+// Issue tracker integration, which turns summaries into tracked tickets. For
+// each summary it sends, failmail opens an issue for the summary's batch (or,
+// if there's already an open issue for the batch, comments on it), so that
+// errors that keep coming back end up on somebody's list rather than in
+// everybody's inbox.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ISSUES_GITHUB = "github"
+	ISSUES_JIRA   = "jira"
+
+	GITHUB_API = "https://api.github.com"
+
+	// Issue trackers limit the length of titles, so longer subjects are cut
+	// short.
+	MAX_ISSUE_TITLE = 255
+)
+
+// `IssueTracker` is the interface for opening and commenting on issues. Each
+// issue failmail opens is labeled, so that it can be found again while it's
+// open.
+type IssueTracker interface {
+	// Returns the id of an open issue with the label, or "" if there isn't
+	// one.
+	Find(label string) (string, error)
+
+	// Opens a new issue with the label.
+	Open(label string, title string, body string) error
+
+	// Adds a comment to an issue.
+	Comment(id string, body string) error
+}
+
+// Returns the label for issues about a batch. Batch keys can contain
+// characters that trackers don't allow in labels, so the label is based on a
+// hash of the key.
+func IssueLabel(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return "failmail-" + hex.EncodeToString(hash[:8])
+}
+
+// `IssueUpstream` passes each message to another `Upstream`, then opens or
+// comments on an issue for the batch summarized by each message it sent.
+// Messages without an `X-Failmail-Batch-Key` header (e.g. messages relayed
+// without being summarized) are only passed on.
+type IssueUpstream struct {
+	Tracker  IssueTracker
+	Upstream Upstream
+}
+
+func (u *IssueUpstream) Send(m OutgoingMessage) error {
+	return u.SendContext(context.Background(), m)
+}
+
+func (u *IssueUpstream) SendContext(ctx context.Context, m OutgoingMessage) error {
+	if err := sendContext(ctx, u.Upstream, m); err != nil {
+		return err
+	}
+
+	// The summary has been sent, so a tracker that's down is only logged:
+	// failing the send would send the summary again.
+	if err := u.file(m); err != nil {
+		log.Printf("warning: couldn't update issue tracker: %s", err)
+	}
+	return nil
+}
+
+func (u *IssueUpstream) file(m OutgoingMessage) error {
+	summary, err := ReadSentSummary(m)
+	if err != nil || summary == nil {
+		return err
+	}
+
+	label := IssueLabel(summary.Key)
+	id, err := u.Tracker.Find(label)
+	if err != nil {
+		return err
+	} else if id != "" {
+		log.Printf("commenting on issue %s for batch %#v", id, summary.Key)
+		return u.Tracker.Comment(id, summary.Body)
+	}
+
+	title := strings.TrimSpace(summary.Subject)
+	if title == "" {
+		title = fmt.Sprintf("failmail: %s", summary.Key)
+	}
+	log.Printf("opening issue for batch %#v", summary.Key)
+	return u.Tracker.Open(label, issueTitle(title), summary.Body)
+}
+
+// Cuts a title short if it's too long for an issue tracker.
+func issueTitle(title string) string {
+	runes := []rune(title)
+	if len(runes) <= MAX_ISSUE_TITLE {
+		return title
+	}
+	return string(runes[:MAX_ISSUE_TITLE-3]) + "..."
+}
+
+// Makes a request to a JSON API, with a JSON body (if `payload` isn't nil),
+// and decodes the JSON response into `result` (if it isn't nil). The body is
+// sent as `application/json` unless the request has another `Content-Type`.
+func callJSON(req *http.Request, timeout time.Duration, payload interface{}, result interface{}) error {
+	if payload != nil {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		req.ContentLength = int64(len(body))
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL.Path, resp.Status)
+	} else if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// `GitHubTracker` opens issues in a GitHub repository.
+type GitHubTracker struct {
+	API     string // the base URL of the API, e.g. https://api.github.com
+	Repo    string // the repository, as owner/name
+	Token   string
+	Timeout time.Duration
+}
+
+func (t *GitHubTracker) request(method string, path string) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(t.API, "/")+"/repos/"+t.Repo+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	return req, nil
+}
+
+func (t *GitHubTracker) Find(label string) (string, error) {
+	query := url.Values{"state": {"open"}, "labels": {label}, "per_page": {"1"}}
+	req, err := t.request("GET", "/issues?"+query.Encode())
+	if err != nil {
+		return "", err
+	}
+
+	issues := make([]struct{ Number int }, 0)
+	if err := callJSON(req, t.Timeout, nil, &issues); err != nil {
+		return "", err
+	} else if len(issues) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("%d", issues[0].Number), nil
+}
+
+func (t *GitHubTracker) Open(label string, title string, body string) error {
+	req, err := t.request("POST", "/issues")
+	if err != nil {
+		return err
+	}
+	payload := map[string]interface{}{"title": title, "body": body, "labels": []string{label}}
+	return callJSON(req, t.Timeout, payload, nil)
+}
+
+func (t *GitHubTracker) Comment(id string, body string) error {
+	req, err := t.request("POST", "/issues/"+id+"/comments")
+	if err != nil {
+		return err
+	}
+	return callJSON(req, t.Timeout, map[string]string{"body": body}, nil)
+}
+
+// `JiraTracker` opens issues in a Jira project.
+type JiraTracker struct {
+	URL       string // the base URL of the Jira site
+	Project   string // the project key
+	IssueType string
+	User      string // if empty, `Token` is sent as a bearer token
+	Token     string
+	Timeout   time.Duration
+}
+
+func (t *JiraTracker) request(method string, path string) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(t.URL, "/")+"/rest/api/2"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.User != "" {
+		req.SetBasicAuth(t.User, t.Token)
+	} else if t.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	return req, nil
+}
+
+func (t *JiraTracker) Find(label string) (string, error) {
+	jql := fmt.Sprintf(`project = "%s" AND labels = "%s" AND statusCategory != Done`, t.Project, label)
+	query := url.Values{"jql": {jql}, "maxResults": {"1"}, "fields": {"key"}}
+	req, err := t.request("GET", "/search?"+query.Encode())
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Issues []struct{ Key string }
+	}
+	if err := callJSON(req, t.Timeout, nil, &result); err != nil {
+		return "", err
+	} else if len(result.Issues) == 0 {
+		return "", nil
+	}
+	return result.Issues[0].Key, nil
+}
+
+func (t *JiraTracker) Open(label string, title string, body string) error {
+	req, err := t.request("POST", "/issue")
+	if err != nil {
+		return err
+	}
+	payload := map[string]interface{}{
+		"fields": map[string]interface{}{
+			"project":     map[string]string{"key": t.Project},
+			"issuetype":   map[string]string{"name": t.IssueType},
+			"summary":     title,
+			"description": body,
+			"labels":      []string{label},
+		},
+	}
+	return callJSON(req, t.Timeout, payload, nil)
+}
+
+func (t *JiraTracker) Comment(id string, body string) error {
+	req, err := t.request("POST", "/issue/"+url.PathEscape(id)+"/comment")
+	if err != nil {
+		return err
+	}
+	return callJSON(req, t.Timeout, map[string]string{"body": body}, nil)
+}
@@ -0,0 +1,199 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake of the parts of the GitHub issues API that `GitHubTracker` uses.
+type fakeGitHub struct {
+	issues   map[int]map[string]interface{}
+	comments map[int][]string
+	lock     sync.Mutex
+}
+
+func newFakeGitHub() *fakeGitHub {
+	return &fakeGitHub{make(map[int]map[string]interface{}, 0), make(map[int][]string, 0), sync.Mutex{}}
+}
+
+func (g *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body := make(map[string]interface{}, 0)
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/repos/example/app/issues":
+		found := make([]map[string]int, 0)
+		for number, issue := range g.issues {
+			if issue["labels"].([]interface{})[0] == r.URL.Query().Get("labels") {
+				found = append(found, map[string]int{"number": number})
+			}
+		}
+		json.NewEncoder(w).Encode(found)
+	case r.Method == "POST" && r.URL.Path == "/repos/example/app/issues":
+		g.issues[len(g.issues)+1] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "POST" && r.URL.Path == "/repos/example/app/issues/1/comments":
+		g.comments[1] = append(g.comments[1], body["body"].(string))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestIssueLabel(t *testing.T) {
+	if label := IssueLabel("db"); label != IssueLabel("db") || !strings.HasPrefix(label, "failmail-") || len(label) != 25 {
+		t.Errorf("unexpected label for batch: %s", label)
+	}
+	if IssueLabel("db") == IssueLabel("web") {
+		t.Errorf("expected different labels for different batches")
+	}
+}
+
+func TestIssueUpstreamGitHub(t *testing.T) {
+	github := newFakeGitHub()
+	server := httptest.NewServer(github)
+	defer server.Close()
+
+	relay := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	upstream := &IssueUpstream{&GitHubTracker{server.URL, "example/app", "secret", time.Second}, relay}
+
+	summary := makeSummaryMessage(t, "Subject: error in db\r\n\r\ntimeout\r\n")
+	summary.Key = "db"
+	for i := 0; i < 3; i++ {
+		if err := upstream.Send(summary); err != nil {
+			t.Fatalf("unexpected error sending summary: %s", err)
+		}
+	}
+
+	if count := len(relay.Sends); count != 3 {
+		t.Errorf("expected 3 summaries to be sent, got %d", count)
+	}
+	if count := len(github.issues); count != 1 {
+		t.Fatalf("expected one issue to be opened, got %d", count)
+	}
+	issue := github.issues[1]
+	if issue["title"] != "test" || !strings.Contains(issue["body"].(string), "timeout") {
+		t.Errorf("unexpected issue: %#v", issue)
+	} else if labels := issue["labels"].([]interface{}); labels[0] != IssueLabel("db") {
+		t.Errorf("unexpected issue labels: %v", labels)
+	}
+	if count := len(github.comments[1]); count != 2 {
+		t.Errorf("expected two comments on the issue, got %d", count)
+	}
+}
+
+func TestIssueUpstreamSkipsUnsummarized(t *testing.T) {
+	github := newFakeGitHub()
+	server := httptest.NewServer(github)
+	defer server.Close()
+
+	relay := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	upstream := &IssueUpstream{&GitHubTracker{server.URL, "example/app", "secret", time.Second}, relay}
+
+	msg := &message{"test@example.com", []string{"ops@example.com"}, []byte("Subject: relayed\r\n\r\nbody\r\n")}
+	if err := upstream.Send(msg); err != nil {
+		t.Fatalf("unexpected error sending message: %s", err)
+	}
+	if len(relay.Sends) != 1 || len(github.issues) != 0 {
+		t.Errorf("expected the message to be relayed without opening an issue")
+	}
+}
+
+func TestIssueUpstreamErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	tracker := &GitHubTracker{server.URL, "example/app", "secret", time.Second}
+
+	// A failing tracker doesn't fail the send, since the summary was sent.
+	relay := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	summary := makeSummaryMessage(t, "Subject: error in db\r\n\r\ntimeout\r\n")
+	if err := (&IssueUpstream{tracker, relay}).Send(summary); err != nil {
+		t.Errorf("unexpected error when the tracker fails: %s", err)
+	} else if len(relay.Sends) != 1 {
+		t.Errorf("expected the summary to be sent")
+	}
+
+	// A failing send doesn't update the tracker.
+	failing := &TestUpstream{make([]OutgoingMessage, 0), errors.New("fail")}
+	if err := (&IssueUpstream{tracker, failing}).Send(summary); err == nil {
+		t.Errorf("expected an error when the send fails")
+	}
+}
+
+func TestJiraTracker(t *testing.T) {
+	requests := make([]string, 0)
+	bodies := make([]map[string]interface{}, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "failmail" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		body := make(map[string]interface{}, 0)
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+
+		if r.URL.Path == "/rest/api/2/search" {
+			if !strings.Contains(r.URL.Query().Get("jql"), `labels = "failmail-1"`) {
+				w.Write([]byte(`{"issues": []}`))
+			} else {
+				w.Write([]byte(`{"issues": [{"key": "OPS-7"}]}`))
+			}
+		}
+	}))
+	defer server.Close()
+
+	tracker := &JiraTracker{server.URL, "OPS", "Bug", "failmail", "secret", time.Second}
+	if id, err := tracker.Find("failmail-1"); err != nil || id != "OPS-7" {
+		t.Errorf("unexpected result finding issue: %#v, %s", id, err)
+	}
+	if id, err := tracker.Find("failmail-2"); err != nil || id != "" {
+		t.Errorf("unexpected result finding missing issue: %#v, %s", id, err)
+	}
+	if err := tracker.Open("failmail-2", "error in db", "timeout"); err != nil {
+		t.Errorf("unexpected error opening issue: %s", err)
+	}
+	if err := tracker.Comment("OPS-7", "timeout again"); err != nil {
+		t.Errorf("unexpected error commenting on issue: %s", err)
+	}
+
+	expected := []string{"GET /rest/api/2/search", "GET /rest/api/2/search", "POST /rest/api/2/issue", "POST /rest/api/2/issue/OPS-7/comment"}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	fields := bodies[2]["fields"].(map[string]interface{})
+	if fields["summary"] != "error in db" || fields["project"].(map[string]interface{})["key"] != "OPS" {
+		t.Errorf("unexpected fields for new issue: %#v", fields)
+	}
+	if bodies[3]["body"] != "timeout again" {
+		t.Errorf("unexpected comment: %#v", bodies[3])
+	}
+}
+
+func TestIssueTitle(t *testing.T) {
+	if title := issueTitle("short"); title != "short" {
+		t.Errorf("unexpected title: %s", title)
+	}
+	if title := issueTitle(strings.Repeat("é", 300)); len([]rune(title)) != MAX_ISSUE_TITLE || !strings.HasSuffix(title, "...") {
+		t.Errorf("expected long title to be cut short, got %d characters", len([]rune(title)))
+	}
+}
@@ -0,0 +1,257 @@
+// Ingestion of systemd journal entries, which turns failmail into a digest of
+// a host's errors as well as of the mail sent to it. A `JournalReader` follows
+// the journal with `journalctl`, converts each entry into a message, and puts
+// the entries that match a filter expression on a channel for storage, the
+// same way a `Listener` does for messages received via SMTP.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest journal line `JournalReader` accepts (journald itself cuts
+// messages off at 48KiB by default).
+const MAX_JOURNAL_LINE = 1024 * 1024
+
+// Syslog priority names, as used in journal entries' `PRIORITY` field.
+var JOURNAL_PRIORITIES = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Returns the `journalctl` command line for following the journal as JSON.
+// With `cursorFile`, reading resumes where it left off the last time; without
+// it, only new entries are read. `priority` (e.g. "err") and `matches` (e.g.
+// "_SYSTEMD_UNIT=nginx.service") narrow down the entries read.
+func JournalCommand(cursorFile string, priority string, matches []string) []string {
+	command := []string{"journalctl", "--follow", "--output=json", "--all"}
+	if cursorFile != "" {
+		command = append(command, "--cursor-file="+cursorFile)
+	} else {
+		command = append(command, "--lines=0")
+	}
+	if priority != "" {
+		command = append(command, "--priority="+priority)
+	}
+	return append(command, matches...)
+}
+
+// `JournalEntry` is an entry from the journal, as output by `journalctl
+// --output=json`.
+type JournalEntry map[string]json.RawMessage
+
+// Returns the value of a field. Fields that journalctl outputs as arrays of
+// bytes (because they aren't valid UTF-8) are decoded; fields that appear
+// more than once in the entry are joined with newlines.
+func (e JournalEntry) Get(field string) string {
+	raw, ok := e[field]
+	if !ok {
+		return ""
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value
+	}
+	var data []byte
+	var ints []int
+	if err := json.Unmarshal(raw, &ints); err == nil {
+		for _, i := range ints {
+			data = append(data, byte(i))
+		}
+		return string(data)
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err == nil {
+		return strings.Join(values, "\n")
+	}
+	return ""
+}
+
+// Returns the name of the program that logged the entry.
+func (e JournalEntry) Identifier() string {
+	for _, field := range []string{"SYSLOG_IDENTIFIER", "_SYSTEMD_UNIT", "_COMM"} {
+		if value := e.Get(field); value != "" {
+			return value
+		}
+	}
+	return "journal"
+}
+
+// Returns the time the entry was logged, or the current time if it's unknown.
+func (e JournalEntry) Time() time.Time {
+	if usec, err := strconv.ParseInt(e.Get("__REALTIME_TIMESTAMP"), 10, 64); err == nil {
+		return time.Unix(0, usec*int64(time.Microsecond))
+	}
+	return nowGetter()
+}
+
+// Builds a `ReceivedMessage` from the entry, as if it had been received via
+// SMTP. The subject is the program's name and the first line of the entry's
+// message, and the body is the whole message followed by the entry's other
+// fields. Useful fields are also given as `X-Journal-*` headers, for use in
+// expressions.
+func (e JournalEntry) Message(from string, to []string) (*ReceivedMessage, error) {
+	text := e.Get("MESSAGE")
+	firstLine := strings.TrimSpace(strings.SplitN(text, "\n", 2)[0])
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", headerValue(fmt.Sprintf("[%s] %s", e.Identifier(), firstLine)))
+	fmt.Fprintf(buf, "Date: %s\r\n", e.Time().Format(time.RFC1123Z))
+
+	headers := map[string]string{
+		"X-Journal-Identifier": e.Identifier(),
+		"X-Journal-Unit":       e.Get("_SYSTEMD_UNIT"),
+		"X-Journal-Priority":   e.Get("PRIORITY"),
+		"X-Journal-Hostname":   e.Get("_HOSTNAME"),
+	}
+	if priority, err := strconv.Atoi(e.Get("PRIORITY")); err == nil && priority >= 0 && priority < len(JOURNAL_PRIORITIES) {
+		headers["X-Journal-Priority-Name"] = JOURNAL_PRIORITIES[priority]
+	}
+	names := make([]string, 0, len(headers))
+	for name, _ := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if headers[name] != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, headerValue(headers[name]))
+		}
+	}
+	fmt.Fprintf(buf, "\r\n")
+
+	buf.Write(normalizeNewlines(strings.TrimRight(text, "\n") + "\n\n"))
+	fields := make([]string, 0, len(e))
+	for field, _ := range e {
+		if field != "MESSAGE" && !strings.HasPrefix(field, "__") {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		value := strings.Replace(e.Get(field), "\n", " ", -1)
+		fmt.Fprintf(buf, "%s=%s\r\n", field, value)
+	}
+
+	data := buf.Bytes()
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	return &ReceivedMessage{message: &message{from, to, data}, Parsed: parsed}, nil
+}
+
+// `JournalReader` follows the journal, and puts the entries that match
+// `Filter` on a channel for storage.
+type JournalReader struct {
+	Command  []string
+	From     string
+	To       []string
+	Filter   GroupBy // if non-nil, entries for which this is empty or "false" are skipped
+	received chan *StorageRequest
+}
+
+func NewJournalReader(command []string, from string, to []string, filter GroupBy) *JournalReader {
+	return &JournalReader{command, from, to, filter, make(chan *StorageRequest, 0)}
+}
+
+// Returns the channel that journal entries are put on. It's closed when the
+// reader shuts down.
+func (j *JournalReader) Received() <-chan *StorageRequest {
+	return j.received
+}
+
+// Follows the journal until a shutdown/reload request arrives on `done` (or
+// the command exits), then closes the channel returned by `Received()`.
+func (j *JournalReader) Run(done <-chan TerminationRequest) error {
+	defer close(j.received)
+
+	cmd := exec.Command(j.Command[0], j.Command[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("reading journal: %s", strings.Join(j.Command, " "))
+
+	finished := make(chan error, 1)
+	stopped := false
+	lock := new(sync.Mutex)
+	go func() {
+		err := j.read(stdout)
+		waitErr := cmd.Wait()
+		lock.Lock()
+		defer lock.Unlock()
+		if err == nil && !stopped {
+			err = waitErr
+		}
+		finished <- err
+	}()
+
+	select {
+	case err := <-finished:
+		return err
+	case <-done:
+	}
+
+	lock.Lock()
+	stopped = true
+	cmd.Process.Kill()
+	lock.Unlock()
+	return <-finished
+}
+
+// Reads journal entries, one JSON object per line, until `input` runs out.
+func (j *JournalReader) read(input io.Reader) error {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_JOURNAL_LINE)
+	for scanner.Scan() {
+		entry := make(JournalEntry, 0)
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("warning: couldn't parse journal entry: %s", err)
+			continue
+		}
+		msg, err := entry.Message(j.From, j.To)
+		if err != nil {
+			log.Printf("warning: couldn't convert journal entry: %s", err)
+			continue
+		}
+		if !j.matches(msg) {
+			continue
+		}
+
+		errors := make(chan error, 0)
+		j.received <- &StorageRequest{msg, errors}
+		if err := <-errors; err != nil {
+			log.Printf("couldn't store journal entry: %s", err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Returns true if the message matches the filter. Messages that can't be
+// checked are kept, so that they aren't lost.
+func (j *JournalReader) matches(msg *ReceivedMessage) bool {
+	if j.Filter == nil {
+		return true
+	}
+	result, err := j.Filter(msg)
+	if err != nil {
+		log.Printf("warning: error filtering journal entry, keeping it: %s", err)
+		return true
+	}
+	return IsTrue(result)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_JOURNAL_ENTRY = `{"__REALTIME_TIMESTAMP": "1393650000000000", "__CURSOR": "s=1", "MESSAGE": "upstream timed out\nwhile reading", ` +
+	`"PRIORITY": "3", "SYSLOG_IDENTIFIER": "nginx", "_SYSTEMD_UNIT": "nginx.service", "_HOSTNAME": "web1"}`
+
+func makeJournalEntry(t *testing.T, data string) JournalEntry {
+	entry := make(JournalEntry, 0)
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		t.Fatalf("invalid journal entry: %s", err)
+	}
+	return entry
+}
+
+func TestJournalCommand(t *testing.T) {
+	command := strings.Join(JournalCommand("", "err", []string{"_SYSTEMD_UNIT=nginx.service"}), " ")
+	if command != "journalctl --follow --output=json --all --lines=0 --priority=err _SYSTEMD_UNIT=nginx.service" {
+		t.Errorf("unexpected command: %s", command)
+	}
+	command = strings.Join(JournalCommand("/tmp/cursor", "", nil), " ")
+	if command != "journalctl --follow --output=json --all --cursor-file=/tmp/cursor" {
+		t.Errorf("unexpected command with a cursor file: %s", command)
+	}
+}
+
+func TestJournalEntryGet(t *testing.T) {
+	entry := makeJournalEntry(t, `{"A": "text", "B": [104, 105], "C": ["one", "two"], "D": 1}`)
+	for field, expected := range map[string]string{"A": "text", "B": "hi", "C": "one\ntwo", "D": "", "E": ""} {
+		if value := entry.Get(field); value != expected {
+			t.Errorf("unexpected value for %s: %#v", field, value)
+		}
+	}
+}
+
+func TestJournalEntryMessage(t *testing.T) {
+	msg, err := makeJournalEntry(t, TEST_JOURNAL_ENTRY).Message("failmail@example.com", []string{"ops@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error converting entry: %s", err)
+	}
+
+	headers := msg.Parsed.Header
+	if subject := headers.Get("Subject"); subject != "[nginx] upstream timed out" {
+		t.Errorf("unexpected subject: %s", subject)
+	}
+	if date, err := headers.Date(); err != nil || !date.Equal(time.Date(2014, 3, 1, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected date: %s %s", date, err)
+	}
+	if headers.Get("X-Journal-Unit") != "nginx.service" || headers.Get("X-Journal-Priority-Name") != "err" {
+		t.Errorf("unexpected journal headers: %v", headers)
+	}
+	if msg.Sender() != "failmail@example.com" || msg.Recipients()[0] != "ops@example.com" {
+		t.Errorf("unexpected envelope: %s %v", msg.Sender(), msg.Recipients())
+	}
+
+	body, err := msg.ReadBody()
+	if err != nil {
+		t.Fatalf("unexpected error reading body: %s", err)
+	}
+	if !strings.HasPrefix(body, "upstream timed out\r\nwhile reading\r\n\r\n") || !strings.Contains(body, "_HOSTNAME=web1\r\n") {
+		t.Errorf("unexpected body: %#v", body)
+	} else if strings.Contains(body, "__CURSOR") {
+		t.Errorf("expected internal fields to be left out of the body: %#v", body)
+	}
+}
+
+func TestJournalReader(t *testing.T) {
+	other := `{"MESSAGE": "started", "PRIORITY": "6", "SYSLOG_IDENTIFIER": "systemd"}`
+	script := "printf '%s\\n' 'not json' '" + TEST_JOURNAL_ENTRY + "' '" + other + "'"
+	filter := GroupByExpr("journal-filter", `{{if eq (.Header.Get "X-Journal-Priority-Name") "err"}}true{{end}}`)
+	reader := NewJournalReader([]string{"/bin/sh", "-c", script}, "failmail@example.com", []string{"ops@example.com"}, filter)
+
+	subjects := make(chan string, 2)
+	go func() {
+		for req := range reader.Received() {
+			subjects <- req.Message.Parsed.Header.Get("Subject")
+			req.StorageErrors <- nil
+		}
+		close(subjects)
+	}()
+
+	if err := reader.Run(make(chan TerminationRequest, 0)); err != nil {
+		t.Fatalf("unexpected error reading journal: %s", err)
+	}
+	if subject := <-subjects; subject != "[nginx] upstream timed out" {
+		t.Errorf("unexpected subject: %s", subject)
+	}
+	if subject, ok := <-subjects; ok {
+		t.Errorf("expected the other entry to be filtered out, got %s", subject)
+	}
+}
+
+func TestJournalReaderShutdown(t *testing.T) {
+	reader := NewJournalReader([]string{"/bin/sh", "-c", "exec sleep 10"}, "failmail@example.com", []string{"ops@example.com"}, nil)
+	done := make(chan TerminationRequest, 1)
+	done <- GracefulShutdown
+
+	start := time.Now()
+	if err := reader.Run(done); err != nil {
+		t.Errorf("unexpected error shutting down: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the journal reader to stop promptly, took %s", elapsed)
+	}
+	if _, ok := <-reader.Received(); ok {
+		t.Errorf("expected the reader's channel to be closed")
+	}
+}
@@ -0,0 +1,180 @@
+// Support for sharing a store between several failmail processes.
+//
+// Any number of receivers can write to a shared store (e.g. a maildir on a
+// network filesystem), but only one sender should summarize from it at a
+// time. Senders coordinate using a lease recorded in the store: the holder of
+// an unexpired lease summarizes and sends, and renews the lease on every poll.
+// If the holder stops renewing it (e.g. because it crashed), another sender
+// takes over once the lease expires.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// `Leaser` is implemented by stores that can record a lease.
+type Leaser interface {
+	// Takes or renews the lease for `holder` until `expires`, returning true
+	// if successful, or false if another holder has an unexpired lease.
+	TryLease(holder string, now time.Time, expires time.Time) (bool, error)
+
+	// Gives up the lease, if it's held by `holder`.
+	ReleaseLease(holder string) error
+}
+
+// `Lease` tracks whether this process holds the lease on a store.
+type Lease struct {
+	Store    Leaser
+	Holder   string
+	Duration time.Duration
+	held     bool
+}
+
+func NewLease(store MessageStore, duration time.Duration) (*Lease, error) {
+	leaser, ok := store.(Leaser)
+	if !ok {
+		return nil, fmt.Errorf("store does not support leases")
+	}
+
+	host, err := hostGetter()
+	if err != nil {
+		host = "localhost"
+	}
+	return &Lease{Store: leaser, Holder: fmt.Sprintf("%s:%d", host, pidGetter()), Duration: duration}, nil
+}
+
+// Takes or renews the lease, and returns true if it's held.
+func (l *Lease) Hold(now time.Time) bool {
+	held, err := l.Store.TryLease(l.Holder, now, now.Add(l.Duration))
+	if err != nil {
+		log.Printf("warning: error taking lease: %s", err)
+		held = false
+	}
+
+	if held && !l.held {
+		log.Printf("took lease as %s", l.Holder)
+	} else if !held && l.held {
+		log.Printf("lost lease")
+	}
+	l.held = held
+	return held
+}
+
+// Gives up the lease, if it's held, so that another process can take over
+// without waiting for it to expire.
+func (l *Lease) Release() error {
+	if !l.held {
+		return nil
+	}
+	l.held = false
+	return l.Store.ReleaseLease(l.Holder)
+}
+
+// The contents of the lease file in a `DiskStore`.
+type DiskLease struct {
+	Holder  string
+	Expires time.Time
+}
+
+func (s *DiskStore) leasePath() string {
+	return path.Join(s.Maildir.Path, ".lease")
+}
+
+func (s *DiskStore) leaseLockPath() string {
+	return path.Join(s.Maildir.Path, ".lease.lock")
+}
+
+// Takes the lock that's held while taking or renewing the lease, returning
+// the locked file, or nil if another process holds the lock. The lock is an
+// exclusive `flock` on a file that's never removed, so there's no stale lock
+// to take over: it's released when the file is closed, or when the process
+// holding it exits (e.g. because it crashed).
+func (s *DiskStore) lockLease() (*os.File, error) {
+	file, err := os.OpenFile(s.leaseLockPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, nil
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *DiskStore) readLease() (*DiskLease, error) {
+	lease := new(DiskLease)
+	if bytes, err := ioutil.ReadFile(s.leasePath()); os.IsNotExist(err) {
+		return lease, nil
+	} else if err != nil {
+		return lease, err
+	} else {
+		return lease, json.Unmarshal(bytes, lease)
+	}
+}
+
+func (s *DiskStore) TryLease(holder string, now time.Time, expires time.Time) (bool, error) {
+	lock, err := s.lockLease()
+	if err != nil {
+		return false, err
+	} else if lock == nil {
+		// Another process is taking or renewing the lease, but it can't take
+		// it from an unexpired holder.
+		current, err := s.readLease()
+		return err == nil && current.Holder == holder && now.Before(current.Expires), err
+	}
+	defer lock.Close()
+
+	current, err := s.readLease()
+	if err != nil {
+		return false, err
+	}
+	if current.Holder != holder && current.Holder != "" && now.Before(current.Expires) {
+		return false, nil
+	}
+
+	// Write the lease to a temporary file and move it into place, so that
+	// other processes never see a partially-written lease.
+	bytes, err := json.Marshal(&DiskLease{holder, expires})
+	if err != nil {
+		return false, err
+	}
+	host, err := hostGetter()
+	if err != nil {
+		host = "localhost"
+	}
+	tmpPath := path.Join(s.Maildir.Path, string(MAILDIR_TMP), fmt.Sprintf("lease.%s.%d", host, pidGetter()))
+	if err := ioutil.WriteFile(tmpPath, bytes, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpPath, s.leasePath()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *DiskStore) ReleaseLease(holder string) error {
+	// If another process is taking or renewing the lease, it's left to
+	// expire.
+	lock, err := s.lockLease()
+	if err != nil || lock == nil {
+		return err
+	}
+	defer lock.Close()
+
+	if current, err := s.readLease(); err != nil {
+		return err
+	} else if current.Holder != holder {
+		return nil
+	}
+	return os.Remove(s.leasePath())
+}
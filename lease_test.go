@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskStoreLease(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	store, _ := NewDiskStore(maildir)
+	now := time.Unix(1393650000, 0)
+
+	if held, err := store.TryLease("a", now, now.Add(time.Minute)); !held || err != nil {
+		t.Errorf("expected to take an unheld lease: %v, %s", held, err)
+	}
+	if held, err := store.TryLease("b", now.Add(30*time.Second), now.Add(90*time.Second)); held || err != nil {
+		t.Errorf("expected not to take a lease held by another: %v, %s", held, err)
+	}
+	if held, err := store.TryLease("a", now.Add(30*time.Second), now.Add(90*time.Second)); !held || err != nil {
+		t.Errorf("expected to renew a lease: %v, %s", held, err)
+	}
+	if held, err := store.TryLease("b", now.Add(91*time.Second), now.Add(150*time.Second)); !held || err != nil {
+		t.Errorf("expected to take an expired lease: %v, %s", held, err)
+	}
+
+	if err := store.ReleaseLease("a"); err != nil {
+		t.Errorf("unexpected error releasing a lease held by another: %s", err)
+	}
+	if held, _ := store.TryLease("a", now.Add(92*time.Second), now.Add(150*time.Second)); held {
+		t.Errorf("expected releasing another's lease to have no effect")
+	}
+	if err := store.ReleaseLease("b"); err != nil {
+		t.Errorf("unexpected error releasing a lease: %s", err)
+	}
+	if held, _ := store.TryLease("a", now.Add(93*time.Second), now.Add(150*time.Second)); !held {
+		t.Errorf("expected to take a released lease")
+	}
+
+	if msgs, err := store.MessagesNewerThan(time.Time{}); err != nil || len(msgs) != 0 {
+		t.Errorf("expected the lease not to appear as a message: %v, %s", msgs, err)
+	}
+}
+
+func TestDiskStoreLeaseConcurrent(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	store, _ := NewDiskStore(maildir)
+	now := time.Unix(1393650000, 0)
+
+	// Each round, several senders try to take the lease once the last one
+	// expires, and no more than one of them can succeed.
+	for round := 0; round < 20; round++ {
+		at := now.Add(time.Duration(round) * time.Minute)
+		held := make(chan bool, 4)
+		wg := new(sync.WaitGroup)
+		for sender := 0; sender < 4; sender++ {
+			wg.Add(1)
+			go func(holder string) {
+				defer wg.Done()
+				ok, err := store.TryLease(holder, at, at.Add(time.Minute-time.Second))
+				if err != nil {
+					t.Errorf("unexpected error taking lease: %s", err)
+				}
+				held <- ok
+			}(fmt.Sprintf("%d.%d", round, sender))
+		}
+		wg.Wait()
+		close(held)
+
+		holders := 0
+		for ok := range held {
+			if ok {
+				holders += 1
+			}
+		}
+		if holders > 1 {
+			t.Fatalf("round %d: expected at most one holder of the lease, got %d", round, holders)
+		}
+	}
+}
+
+func TestDiskStoreLeaseLocked(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	store, _ := NewDiskStore(maildir)
+	now := time.Unix(1393650000, 0)
+	store.TryLease("a", now, now.Add(time.Minute))
+
+	// While another process is changing the lease, the holder keeps it,
+	// and nobody else can take it.
+	lock, err := store.lockLease()
+	if err != nil || lock == nil {
+		t.Fatalf("couldn't take lock: %v, %s", lock, err)
+	}
+	if held, err := store.TryLease("a", now.Add(30*time.Second), now.Add(90*time.Second)); !held || err != nil {
+		t.Errorf("expected the holder to keep an unexpired lease: %v, %s", held, err)
+	}
+	if held, err := store.TryLease("b", now.Add(2*time.Minute), now.Add(3*time.Minute)); held || err != nil {
+		t.Errorf("expected not to take a lease while it's locked: %v, %s", held, err)
+	}
+
+	// Once the process holding the lock closes it (or exits), the lock file
+	// stays, but it can be locked again.
+	lock.Close()
+	if held, err := store.TryLease("b", now.Add(2*time.Minute), now.Add(3*time.Minute)); !held || err != nil {
+		t.Errorf("expected to take an expired lease once it's unlocked: %v, %s", held, err)
+	}
+	if _, err := os.Stat(store.leaseLockPath()); err != nil {
+		t.Errorf("expected the lock file to be left in place: %s", err)
+	}
+}
+
+func TestDiskStoreLeaseStaleLock(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	store, _ := NewDiskStore(maildir)
+	now := time.Unix(1393650000, 0)
+
+	// A lock file left behind by a holder that crashed, long ago.
+	if err := ioutil.WriteFile(store.leaseLockPath(), nil, 0644); err != nil {
+		t.Fatalf("couldn't create lock file: %s", err)
+	}
+	stale := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(store.leaseLockPath(), stale, stale); err != nil {
+		t.Fatalf("couldn't age lock file: %s", err)
+	}
+
+	// Two senders race to take the expired lease, and exactly one does.
+	for round := 0; round < 20; round++ {
+		at := now.Add(time.Duration(round) * time.Minute)
+		held := make(chan bool, 2)
+		start := make(chan bool)
+		wg := new(sync.WaitGroup)
+		for _, holder := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(holder string) {
+				defer wg.Done()
+				<-start
+				ok, err := store.TryLease(fmt.Sprintf("%s.%d", holder, round), at, at.Add(time.Minute-time.Second))
+				if err != nil {
+					t.Errorf("unexpected error taking lease: %s", err)
+				}
+				held <- ok
+			}(holder)
+		}
+		close(start)
+		wg.Wait()
+		close(held)
+
+		holders := 0
+		for ok := range held {
+			if ok {
+				holders += 1
+			}
+		}
+		if holders != 1 {
+			t.Fatalf("round %d: expected exactly one holder of the lease, got %d", round, holders)
+		}
+	}
+}
+
+func TestNewLeaseUnsupportedStore(t *testing.T) {
+	if _, err := NewLease(NewMemoryStore(), time.Minute); err == nil {
+		t.Errorf("expected an error creating a lease on a memory store")
+	}
+}
+
+func TestMessageBufferWithoutLease(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	store, _ := NewDiskStore(maildir)
+	now := time.Unix(1393650000, 0)
+	store.TryLease("other", now, now.Add(time.Minute))
+
+	buf := makeMessageBuffer()
+	buf.Store = store
+	buf.Lease = &Lease{Store: store, Holder: "test", Duration: time.Minute}
+	buf.Add(RecipientKey{"key", "test@example.com"}, makeStoredMessages(makeReceivedMessage(t, "Subject: test\r\n\r\ntest\r\n"))[0])
+	buf.lastFlush = now
+
+	if buf.holdLease(now.Add(time.Second)) {
+		t.Errorf("expected not to hold the lease")
+	} else if len(buf.messages) != 0 || !buf.lastFlush.IsZero() {
+		t.Errorf("expected buffer to be reset without the lease")
+	}
+
+	if !buf.holdLease(now.Add(2 * time.Minute)) {
+		t.Errorf("expected to hold the expired lease")
+	}
+}
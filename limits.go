@@ -0,0 +1,242 @@
+// Backpressure for receivers: when the store holds too much (or the disk
+// under it is full), new messages are refused with a temporary failure, so
+// that clients hold on to them and retry, rather than failmail accepting
+// messages it can't keep.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The error returned when a message isn't stored because the store is full.
+var ErrStoreFull = fmt.Errorf("message store is full, try again later")
+
+// Returns true if the error means that the store is full, including when the
+// disk under it is out of space.
+func IsStoreFull(err error) bool {
+	return err == ErrStoreFull || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// `Sizer` is implemented by stores that can report how much they hold.
+type Sizer interface {
+	// Returns the number of messages in the store, and their total size in
+	// bytes.
+	Size() (int, int, error)
+}
+
+// `StoreLimits` decides whether a store is full. Since measuring a store can
+// be expensive, the result is reused for `CheckEvery`.
+type StoreLimits struct {
+	Store       Sizer
+	MaxMessages int // if positive, the most messages the store may hold
+	MaxBytes    int // if positive, the most bytes the store may hold
+	CheckEvery  time.Duration
+
+	checked time.Time
+	full    bool
+	lock    sync.Mutex
+}
+
+func NewStoreLimits(store MessageStore, maxMessages int, maxBytes int) (*StoreLimits, error) {
+	if maxMessages <= 0 && maxBytes <= 0 {
+		return nil, nil
+	}
+	sizer, ok := store.(Sizer)
+	if !ok {
+		return nil, fmt.Errorf("store does not support size limits")
+	}
+	return &StoreLimits{Store: sizer, MaxMessages: maxMessages, MaxBytes: maxBytes, CheckEvery: time.Second}, nil
+}
+
+// Returns true if the store is at or over one of its limits. A nil
+// `StoreLimits` is never full.
+func (l *StoreLimits) Full() bool {
+	if l == nil {
+		return false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := nowGetter()
+	if !l.checked.IsZero() && now.Sub(l.checked) < l.CheckEvery {
+		return l.full
+	}
+	l.checked = now
+
+	messages, bytes, err := l.Store.Size()
+	if err != nil {
+		log.Printf("warning: couldn't measure store: %s", err)
+		return l.full
+	}
+
+	full := (l.MaxMessages > 0 && messages >= l.MaxMessages) || (l.MaxBytes > 0 && bytes >= l.MaxBytes)
+	if full && !l.full {
+		log.Printf("store is full (%d messages, %d bytes), refusing new messages", messages, bytes)
+	} else if !full && l.full {
+		log.Printf("store is no longer full (%d messages, %d bytes), accepting new messages", messages, bytes)
+	}
+	l.full = full
+	return full
+}
+
+// The response sent to clients that connect while the receiver has as many
+// connections open as it allows.
+var TOO_BUSY_RESPONSE = Response{421, "Too many connections, try again later", "4.3.2"}
+
+// `ConnectionLimit` limits the connections open at once across all of a
+// receiver's listeners, so that a storm of connections can't swamp the writer
+// and the summarizer. A nil limit doesn't limit anything.
+type ConnectionLimit struct {
+	Max  int
+	open int
+	lock sync.Mutex
+}
+
+func NewConnectionLimit(max int) *ConnectionLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &ConnectionLimit{Max: max}
+}
+
+// Counts a new connection, and returns true, if fewer than `Max` are open.
+// Otherwise, returns false, and the connection should be refused.
+func (c *ConnectionLimit) Acquire() bool {
+	if c == nil {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.open >= c.Max {
+		return false
+	}
+	c.open += 1
+	return true
+}
+
+// Counts a connection (for which `Acquire()` returned true) as closed.
+func (c *ConnectionLimit) Release() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.open -= 1
+}
+
+// Returns the number of connections open.
+func (c *ConnectionLimit) Open() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.open
+}
+
+// The response sent to clients that connect after sending more messages than
+// their rate limit allows.
+var RATE_LIMITED_RESPONSE = Response{421, "Too many messages from your address, try again later", "4.7.0"}
+
+// `RateLimit` limits how fast each client (by IP address) can send messages,
+// with a token bucket per client: each message takes a token, and each
+// bucket holds up to `Burst` tokens and refills at `Rate` tokens per second.
+// A misbehaving host is refused once its bucket is empty, while other hosts
+// can keep sending. A nil limit doesn't limit anything.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	lock    sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimit(rate float64, burst int) *RateLimit {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimit{Rate: rate, Burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// Takes a token from the client's bucket and returns true, if there's one to
+// take. Otherwise, returns false, and the client's message should be refused.
+func (r *RateLimit) Allow(client string) bool {
+	if r == nil {
+		return true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	bucket := r.refill(client)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+
+// Returns true if the client's bucket is empty, without taking a token.
+func (r *RateLimit) Limited(client string) bool {
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.refill(client).tokens < 1
+}
+
+// Returns the client's bucket, topped up with the tokens it's earned since it
+// was last used. Must be called with the lock held.
+func (r *RateLimit) refill(client string) *tokenBucket {
+	now := nowGetter()
+	r.sweep(now)
+
+	bucket, ok := r.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(r.Burst), updated: now}
+		r.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(float64(r.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*r.Rate)
+	bucket.updated = now
+	return bucket
+}
+
+// Forgets the buckets that have had time to fill up again, since they're no
+// different from new ones. Checks at most once per refill time, so that
+// clients that have gone away don't pile up. Must be called with the lock
+// held.
+func (r *RateLimit) sweep(now time.Time) {
+	refillTime := time.Duration(float64(r.Burst) / r.Rate * float64(time.Second))
+	if now.Sub(r.swept) < refillTime {
+		return
+	}
+	r.swept = now
+	for client, bucket := range r.buckets {
+		if now.Sub(bucket.updated) >= refillTime {
+			delete(r.buckets, client)
+		}
+	}
+}
+
+// Returns the number of clients the limit is keeping track of.
+func (r *RateLimit) Clients() int {
+	if r == nil {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.buckets)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"net/textproto"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStoreLimits(t *testing.T) {
+	defer patchTime(time.Unix(1393650000, 0))()
+
+	store := NewMemoryStore()
+	limits, err := NewStoreLimits(store, 2, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating limits: %s", err)
+	}
+	limits.CheckEvery = 0
+
+	store.Add(nowGetter(), makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n"))
+	if limits.Full() {
+		t.Errorf("expected the store not to be full")
+	}
+
+	store.Add(nowGetter(), makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n"))
+	if !limits.Full() {
+		t.Errorf("expected the store to be full")
+	}
+
+	store.Remove(MessageId(0))
+	if limits.Full() {
+		t.Errorf("expected the store not to be full after draining")
+	}
+
+	if limits, err := NewStoreLimits(store, 0, 10); err != nil || limits == nil || !limits.Full() {
+		t.Errorf("expected the store to be over the byte limit: %v, %s", limits, err)
+	}
+	if limits, err := NewStoreLimits(store, 0, 0); err != nil || limits != nil || limits.Full() {
+		t.Errorf("expected no limits: %v, %s", limits, err)
+	}
+}
+
+func TestIsStoreFull(t *testing.T) {
+	if !IsStoreFull(ErrStoreFull) {
+		t.Errorf("expected ErrStoreFull to mean the store is full")
+	}
+	if !IsStoreFull(&os.PathError{Op: "write", Path: "test", Err: syscall.ENOSPC}) {
+		t.Errorf("expected ENOSPC to mean the store is full")
+	}
+	if IsStoreFull(&os.PathError{Op: "write", Path: "test", Err: syscall.EACCES}) {
+		t.Errorf("expected other errors not to mean the store is full")
+	}
+}
+
+func TestSessionStoreFull(t *testing.T) {
+	s := new(Session)
+	s.Start(nil, UNENCRYPTED)
+	s.full = func() bool { return true }
+
+	parser := SMTPParser()
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Code != 452 {
+		t.Errorf("MAIL should get a 452 response when the store is full: %d", resp.Code)
+	}
+}
+
+func TestMessageWriterStoreFull(t *testing.T) {
+	store := NewMemoryStore()
+	limits, _ := NewStoreLimits(store, 1, 0)
+	writer := &MessageWriter{Store: store, Limits: limits}
+
+	received := make(chan *StorageRequest, 2)
+	errors := make(chan error, 2)
+	received <- &StorageRequest{makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n"), errors}
+	received <- &StorageRequest{makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n"), errors}
+	close(received)
+	limits.CheckEvery = 0
+	writer.Run(received)
+
+	if err := <-errors; err != nil {
+		t.Errorf("unexpected error storing the first message: %s", err)
+	}
+	if err := <-errors; err != ErrStoreFull {
+		t.Errorf("expected the second message to be refused: %v", err)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	limit := NewConnectionLimit(2)
+	if !limit.Acquire() || !limit.Acquire() || limit.Acquire() {
+		t.Errorf("expected connections to be refused only past the limit")
+	}
+	limit.Release()
+	if !limit.Acquire() || limit.Open() != 2 {
+		t.Errorf("expected a released connection to make room: %d open", limit.Open())
+	}
+
+	var none *ConnectionLimit
+	if NewConnectionLimit(0) != nil || !none.Acquire() || none.Open() != 0 {
+		t.Errorf("expected no limit not to limit anything")
+	}
+	none.Release()
+}
+
+func TestListenerMaxConnections(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10049")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	listener := &Listener{Socket: socket, MaxConns: NewConnectionLimit(1)}
+	done := make(chan TerminationRequest, 1)
+	go listener.Listen(context.Background(), make(chan *StorageRequest, 1), done, time.Second)
+	defer func() { done <- GracefulShutdown }()
+
+	first, err := textproto.Dial("tcp", "localhost:10049")
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer first.Close()
+	if _, _, err := first.ReadCodeLine(220); err != nil {
+		t.Errorf("expected the first connection to be accepted: %s", err)
+	}
+
+	// While the first connection is open, another is refused.
+	second, err := textproto.Dial("tcp", "localhost:10049")
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer second.Close()
+	if _, _, err := second.ReadCodeLine(421); err != nil {
+		t.Errorf("expected the second connection to be refused: %s", err)
+	}
+
+	// Once the first connection closes, there's room again.
+	sendAndExpect(first, t, "QUIT", 221)
+	for i := 0; i < 50 && listener.MaxConns.Open() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, err := textproto.Dial("tcp", "localhost:10049")
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer third.Close()
+	if _, _, err := third.ReadCodeLine(220); err != nil {
+		t.Errorf("expected a connection to be accepted once there was room: %s", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	defer patchTime(time.Unix(1393650000, 0))()
+
+	limit := NewRateLimit(2, 3)
+	for i := 0; i < 3; i++ {
+		if !limit.Allow("10.0.0.1") {
+			t.Errorf("expected message %d of the burst to be allowed", i)
+		}
+	}
+	if limit.Allow("10.0.0.1") || !limit.Limited("10.0.0.1") {
+		t.Errorf("expected messages past the burst to be refused")
+	}
+	if !limit.Allow("10.0.0.2") || limit.Limited("10.0.0.2") {
+		t.Errorf("expected other clients not to be limited")
+	}
+
+	// Half a second earns one message, at two per second.
+	patchTime(time.Unix(1393650000, 500*int64(time.Millisecond)))
+	if !limit.Allow("10.0.0.1") || limit.Allow("10.0.0.1") {
+		t.Errorf("expected the bucket to refill at the rate")
+	}
+
+	// Once they've had time to fill up again, buckets are forgotten.
+	patchTime(time.Unix(1393650010, 0))
+	if limit.Limited("10.0.0.1") || limit.Clients() != 1 {
+		t.Errorf("expected the old buckets to be swept: %d clients", limit.Clients())
+	}
+
+	var none *RateLimit
+	if NewRateLimit(0, 10) != nil || !none.Allow("10.0.0.1") || none.Limited("10.0.0.1") {
+		t.Errorf("expected no limit not to limit anything")
+	}
+}
+
+func TestSessionRateLimited(t *testing.T) {
+	s := new(Session)
+	s.Start(nil, UNENCRYPTED)
+	s.client = "10.0.0.1"
+	s.rate = NewRateLimit(1, 1)
+
+	parser := SMTPParser()
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Code != 250 {
+		t.Errorf("MAIL should be accepted within the rate limit: %d", resp.Code)
+	}
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Code != 450 {
+		t.Errorf("MAIL should get a 450 response over the rate limit: %d", resp.Code)
+	}
+}
+
+func TestListenerRateLimited(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10050")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	listener := &Listener{Socket: socket, Rate: NewRateLimit(0.001, 1)}
+	done := make(chan TerminationRequest, 1)
+	go listener.Listen(context.Background(), make(chan *StorageRequest, 1), done, time.Second)
+	defer func() { done <- GracefulShutdown }()
+
+	first, err := textproto.Dial("tcp", "localhost:10050")
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer first.Close()
+	if _, _, err := first.ReadCodeLine(220); err != nil {
+		t.Errorf("expected the first connection to be accepted: %s", err)
+	}
+	sendAndExpect(first, t, "MAIL FROM:<test@example.com>", 250)
+	sendAndExpect(first, t, "MAIL FROM:<test@example.com>", 450)
+
+	// Once the client is over its limit, its connections are refused.
+	second, err := textproto.Dial("tcp", "localhost:10050")
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer second.Close()
+	if _, _, err := second.ReadCodeLine(421); err != nil {
+		t.Errorf("expected the second connection to be refused: %s", err)
+	}
+}
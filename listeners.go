@@ -0,0 +1,192 @@
+// Listeners that can be added and removed while failmail is running. The
+// receiver's listeners (one for each `--bind-addr`) run in a `ListenerSet`,
+// and `/api/listeners` on the HTTP server starts listening on new addresses
+// and stops listening on old ones, e.g. to move the receiver to a new port
+// without restarting it.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// `ListenerSet` runs a group of listeners that put the messages they receive
+// on the same channel.
+type ListenerSet struct {
+	// The settings for listeners added with `Add()`, which are copies of it
+	// with their own sockets.
+	Template *Listener
+
+	// Opens the socket for a listener added with `Add()`.
+	Socket func(addr string) (ServerSocket, error)
+
+	ShutdownTimeout time.Duration
+
+	ctx       context.Context
+	received  chan<- *StorageRequest
+	running   map[string]*runningListener
+	order     []string // addresses of the running listeners, in the order they were started
+	receiving sync.WaitGroup
+	stopped   bool
+	lock      sync.Mutex
+}
+
+type runningListener struct {
+	listener *Listener
+	done     chan TerminationRequest
+	finished chan uintptr // receives the listener's fd for reloading when it's done
+}
+
+// Returns an empty set of listeners that put messages on `received`, which is
+// closed once the set is shut down. Cancelling `ctx` cancels the listeners.
+func NewListenerSet(ctx context.Context, received chan<- *StorageRequest, shutdownTimeout time.Duration) *ListenerSet {
+	return &ListenerSet{
+		ShutdownTimeout: shutdownTimeout,
+		ctx:             ctx,
+		received:        received,
+		running:         make(map[string]*runningListener, 0),
+		order:           make([]string, 0),
+	}
+}
+
+// Starts running `listener`, which can be stopped by removing `addr`.
+func (s *ListenerSet) Start(addr string, listener *Listener) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return fmt.Errorf("the receiver is shutting down")
+	} else if _, ok := s.running[addr]; ok {
+		return fmt.Errorf("already listening on %s", addr)
+	}
+
+	// Each listener closes its own channel when it's done, so its messages
+	// are passed on to the shared one.
+	listened := make(chan *StorageRequest, 0)
+	s.receiving.Add(1)
+	go func() {
+		defer s.receiving.Done()
+		for req := range listened {
+			s.received <- req
+		}
+	}()
+
+	running := &runningListener{listener, make(chan TerminationRequest, 1), make(chan uintptr, 1)}
+	go func() {
+		fd, err := listener.Listen(s.ctx, listened, running.done, s.ShutdownTimeout)
+		if err != nil {
+			log.Printf("receiver on %s failed to shut down cleanly: %s", addr, err)
+		} else {
+			log.Printf("receiver on %s: done", addr)
+		}
+		running.finished <- fd
+	}()
+
+	s.running[addr] = running
+	s.order = append(s.order, addr)
+	return nil
+}
+
+// Starts listening on a new address, with the settings of `Template`.
+func (s *ListenerSet) Add(addr string) error {
+	if s.Template == nil || s.Socket == nil {
+		return fmt.Errorf("listeners can't be added")
+	}
+
+	s.lock.Lock()
+	_, ok := s.running[addr]
+	s.lock.Unlock()
+	if ok {
+		return fmt.Errorf("already listening on %s", addr)
+	}
+
+	socket, err := s.Socket(addr)
+	if err != nil {
+		return err
+	}
+	listener := *s.Template
+	listener.Socket = socket
+	listener.conns = 0
+	if err := s.Start(addr, &listener); err != nil {
+		socket.Close()
+		return err
+	}
+	log.Printf("added listener on %s", addr)
+	return nil
+}
+
+// Stops listening on an address, after waiting (up to `ShutdownTimeout`) for
+// its open connections to finish. The address can be given as it was added,
+// or as the socket's local address (e.g. "127.0.0.1:2525").
+func (s *ListenerSet) Remove(addr string) error {
+	s.lock.Lock()
+	key, running := s.find(addr)
+	if running == nil {
+		s.lock.Unlock()
+		return fmt.Errorf("not listening on %s", addr)
+	}
+	delete(s.running, key)
+	for i, a := range s.order {
+		if a == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	running.done <- GracefulShutdown
+	<-running.finished
+	log.Printf("removed listener on %s", key)
+	return nil
+}
+
+func (s *ListenerSet) find(addr string) (string, *runningListener) {
+	if running, ok := s.running[addr]; ok {
+		return addr, running
+	}
+	for key, running := range s.running {
+		if local := running.listener.Socket.Addr(); local != nil && local.String() == addr {
+			return key, running
+		}
+	}
+	return "", nil
+}
+
+// Returns the addresses being listened on, sorted.
+func (s *ListenerSet) Addrs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	addrs := append([]string{}, s.order...)
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Passes a shutdown or reload request to all of the listeners, waits for them
+// to finish, and closes the channel they put messages on. Returns their fds
+// for reloading, in the order they were started.
+func (s *ListenerSet) Shutdown(req TerminationRequest) []uintptr {
+	s.lock.Lock()
+	s.stopped = true
+	stopping := make([]*runningListener, 0, len(s.order))
+	for _, addr := range s.order {
+		stopping = append(stopping, s.running[addr])
+	}
+	s.running = make(map[string]*runningListener, 0)
+	s.order = make([]string, 0)
+	s.lock.Unlock()
+
+	for _, running := range stopping {
+		running.done <- req
+	}
+	fds := make([]uintptr, 0, len(stopping))
+	for _, running := range stopping {
+		fds = append(fds, <-running.finished)
+	}
+
+	s.receiving.Wait()
+	close(s.received)
+	return fds
+}
@@ -0,0 +1,51 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// The body of requests to `/api/listeners`.
+type ListenerRequest struct {
+	Addr string
+}
+
+// Lists the addresses being listened on (GET), starts listening on a new one
+// (POST), or stops listening on one (DELETE).
+func (s *ListenerSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, s.Addrs())
+		return
+	case "POST", "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("must be a GET, POST, or DELETE"))
+		return
+	}
+
+	req := new(ListenerRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	} else if req.Addr == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Addr is required"))
+		return
+	}
+
+	var err error
+	if r.Method == "POST" {
+		err = s.Add(req.Addr)
+	} else {
+		err = s.Remove(req.Addr)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, s.Addrs())
+}
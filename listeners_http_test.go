@@ -0,0 +1,49 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListenerSetHTTP(t *testing.T) {
+	received := make(chan *StorageRequest, 1)
+	set := NewListenerSet(context.Background(), received, time.Second)
+	set.Template = &Listener{}
+	set.Socket = func(addr string) (ServerSocket, error) { return NewTCPServerSocket(addr) }
+	defer set.Shutdown(GracefulShutdown)
+
+	request := func(method string, body string) (int, []string) {
+		w := httptest.NewRecorder()
+		set.ServeHTTP(w, httptest.NewRequest(method, "/api/listeners", bytes.NewBufferString(body)))
+		addrs := make([]string, 0)
+		json.NewDecoder(w.Body).Decode(&addrs)
+		return w.Code, addrs
+	}
+
+	if code, addrs := request("POST", `{"Addr": "localhost:10044"}`); code != 200 || !reflect.DeepEqual(addrs, []string{"localhost:10044"}) {
+		t.Errorf("unexpected response adding a listener: %d %v", code, addrs)
+	}
+	if code, _ := request("POST", `{"Addr": "localhost:10044"}`); code != 409 {
+		t.Errorf("expected a conflict adding a listener twice: %d", code)
+	}
+	if code, addrs := request("GET", ""); code != 200 || len(addrs) != 1 {
+		t.Errorf("unexpected response listing listeners: %d %v", code, addrs)
+	}
+	if code, addrs := request("DELETE", `{"Addr": "localhost:10044"}`); code != 200 || len(addrs) != 0 {
+		t.Errorf("unexpected response removing a listener: %d %v", code, addrs)
+	}
+	if code, _ := request("DELETE", `{}`); code != 400 {
+		t.Errorf("expected a bad request without an address: %d", code)
+	}
+	if code, _ := request("PUT", ""); code != 405 {
+		t.Errorf("expected PUT not to be allowed: %d", code)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+func TestListenerSet(t *testing.T) {
+	received := make(chan *StorageRequest, 1)
+	set := NewListenerSet(context.Background(), received, time.Second)
+	set.Template = &Listener{}
+	set.Socket = func(addr string) (ServerSocket, error) { return NewTCPServerSocket(addr) }
+
+	if err := set.Add("localhost:10043"); err != nil {
+		t.Fatalf("unexpected error adding a listener: %s", err)
+	}
+	if err := set.Add("localhost:10043"); err == nil {
+		t.Errorf("expected an error adding a listener on the same address")
+	}
+
+	go func() {
+		req := <-received
+		req.StorageErrors <- nil
+	}()
+	msg := []byte("Subject: test\r\n\r\ntest\r\n")
+	if err := smtp.SendMail("localhost:10043", nil, "test@example.com", []string{"test@example.com"}, msg); err != nil {
+		t.Errorf("expected the added listener to receive messages: %s", err)
+	}
+
+	if err := set.Remove("127.0.0.1:10043"); err != nil {
+		t.Errorf("expected to remove a listener by its local address: %s", err)
+	}
+	if err := set.Remove("localhost:10043"); err == nil {
+		t.Errorf("expected an error removing a listener that was already removed")
+	}
+	if err := smtp.SendMail("localhost:10043", nil, "test@example.com", []string{"test@example.com"}, msg); err == nil {
+		t.Errorf("expected the removed listener to stop accepting connections")
+	}
+
+	if fds := set.Shutdown(GracefulShutdown); len(fds) != 0 {
+		t.Errorf("expected no fds from an empty set: %v", fds)
+	}
+	if _, ok := <-received; ok {
+		t.Errorf("expected the channel to be closed on shutdown")
+	}
+	if err := set.Add("localhost:10043"); err == nil {
+		t.Errorf("expected an error adding a listener after shutdown")
+	}
+}
@@ -0,0 +1,184 @@
+// Localized wording for summaries. The built-in summary format (everything
+// but the messages themselves) is written in the language selected with
+// `--locale`, from a catalog of its phrases in each supported language.
+// Summaries rendered with `--template` are worded however the template says.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// `Locale` is the wording of summaries in one language: each phrase, by id,
+// as a format string for each of the language's plural forms (or just one,
+// for phrases that don't depend on a count).
+type Locale struct {
+	Name     string
+	plural   func(count int) int // the index of the plural form for a count
+	messages map[string][]string
+}
+
+// Returns the phrase with the given id, formatted with `args`. A nil locale is
+// English.
+func (l *Locale) Text(id string, args ...interface{}) string {
+	return l.Plural(id, 0, args...)
+}
+
+// Returns the phrase with the given id, in the plural form for `count`,
+// formatted with `args`. A nil locale is English.
+func (l *Locale) Plural(id string, count int, args ...interface{}) string {
+	if l == nil {
+		l = ENGLISH
+	}
+	forms, ok := l.messages[id]
+	if !ok {
+		forms = ENGLISH.messages[id]
+	}
+
+	form := 0
+	if len(forms) > 1 {
+		form = l.plural(count)
+	}
+	return fmt.Sprintf(forms[form], args...)
+}
+
+// Returns the locale with the given name (e.g. "de"), or an error if there's
+// no catalog for it.
+func FindLocale(name string) (*Locale, error) {
+	if locale, ok := LOCALES[name]; ok {
+		return locale, nil
+	}
+	return nil, fmt.Errorf("--locale must be one of: %s", strings.Join(LocaleNames(), ", "))
+}
+
+// Returns the names of the supported locales, in order.
+func LocaleNames() []string {
+	names := make([]string, 0, len(LOCALES))
+	for name := range LOCALES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Plural forms for languages with a singular for 1, and a plural for
+// everything else (including 0).
+func oneOrOther(count int) int {
+	if count == 1 {
+		return 0
+	}
+	return 1
+}
+
+// Plural forms for languages, like French, that use the singular for 0 too.
+func zeroOrOneOrOther(count int) int {
+	if count <= 1 {
+		return 0
+	}
+	return 1
+}
+
+var ENGLISH = &Locale{"en", oneOrOther, map[string][]string{
+	"instances":        {"%d instance", "%d instances"},
+	"messages":         {"%d message", "%d messages"},
+	"subject":          {"[failmail] %s: %s"},
+	"subject.multiple": {"[failmail] %s of %s"},
+	"urgent":           {"[URGENT] "},
+	"new":              {"NEW: "},
+	"group":            {"Message group %d of %d: %d instance", "Message group %d of %d: %d instances"},
+	"range":            {"From %s to %s"},
+	"severity":         {"Severity: %s"},
+	"first-seen":       {"First seen %s"},
+	"appeared":         {"Appeared in %d of the last %d summary", "Appeared in %d of the last %d summaries"},
+	"original-to":      {"Originally addressed to %s"},
+	"message":          {"Subject: %#v\r\nBody:\r\n%s"},
+	"totals":           {"Total messages: %d\r\nUnique messages: %d"},
+	"times":            {"Oldest message: %s\r\nNewest message: %s"},
+	"silenced":         {"%d message suppressed while silenced", "%d messages suppressed while silenced"},
+	"suppressed":       {"Suppressed %d additional summary (rate limited)", "Suppressed %d additional summaries (rate limited)"},
+	"top-count":        {"Most frequent:"},
+	"top-entry":        {"%d. %s: %#v (group %d)"},
+	"top-growth":       {"Fastest growing since the last summary:"},
+	"top-growth-entry": {"%d. +%d (from %d to %d): %#v (group %d)"},
+}}
+
+var GERMAN = &Locale{"de", oneOrOther, map[string][]string{
+	"instances":        {"%d Vorkommen", "%d Vorkommen"},
+	"messages":         {"%d Nachricht", "%d Nachrichten"},
+	"subject":          {"[failmail] %s: %s"},
+	"subject.multiple": {"[failmail] %s von %s"},
+	"urgent":           {"[DRINGEND] "},
+	"new":              {"NEU: "},
+	"group":            {"Nachrichtengruppe %d von %d: %d Vorkommen", "Nachrichtengruppe %d von %d: %d Vorkommen"},
+	"range":            {"Von %s bis %s"},
+	"severity":         {"Schweregrad: %s"},
+	"first-seen":       {"Zuerst gesehen %s"},
+	"appeared":         {"In %d der letzten %d Zusammenfassung aufgetreten", "In %d der letzten %d Zusammenfassungen aufgetreten"},
+	"original-to":      {"Ursprünglich adressiert an %s"},
+	"message":          {"Betreff: %#v\r\nInhalt:\r\n%s"},
+	"totals":           {"Nachrichten insgesamt: %d\r\nVerschiedene Nachrichten: %d"},
+	"times":            {"Älteste Nachricht: %s\r\nNeueste Nachricht: %s"},
+	"silenced":         {"%d Nachricht während der Stummschaltung unterdrückt", "%d Nachrichten während der Stummschaltung unterdrückt"},
+	"suppressed":       {"%d weitere Zusammenfassung unterdrückt (Ratenbegrenzung)", "%d weitere Zusammenfassungen unterdrückt (Ratenbegrenzung)"},
+	"top-count":        {"Am häufigsten:"},
+	"top-entry":        {"%d. %s: %#v (Gruppe %d)"},
+	"top-growth":       {"Am stärksten gewachsen seit der letzten Zusammenfassung:"},
+	"top-growth-entry": {"%d. +%d (von %d auf %d): %#v (Gruppe %d)"},
+}}
+
+var SPANISH = &Locale{"es", oneOrOther, map[string][]string{
+	"instances":        {"%d ocurrencia", "%d ocurrencias"},
+	"messages":         {"%d mensaje", "%d mensajes"},
+	"subject":          {"[failmail] %s: %s"},
+	"subject.multiple": {"[failmail] %s de %s"},
+	"urgent":           {"[URGENTE] "},
+	"new":              {"NUEVO: "},
+	"group":            {"Grupo de mensajes %d de %d: %d ocurrencia", "Grupo de mensajes %d de %d: %d ocurrencias"},
+	"range":            {"Desde %s hasta %s"},
+	"severity":         {"Gravedad: %s"},
+	"first-seen":       {"Visto por primera vez %s"},
+	"appeared":         {"Apareció en %d del último %d resumen", "Apareció en %d de los últimos %d resúmenes"},
+	"original-to":      {"Dirigido originalmente a %s"},
+	"message":          {"Asunto: %#v\r\nCuerpo:\r\n%s"},
+	"totals":           {"Total de mensajes: %d\r\nMensajes distintos: %d"},
+	"times":            {"Mensaje más antiguo: %s\r\nMensaje más reciente: %s"},
+	"silenced":         {"%d mensaje suprimido durante el silencio", "%d mensajes suprimidos durante el silencio"},
+	"suppressed":       {"Se suprimió %d resumen adicional (límite de frecuencia)", "Se suprimieron %d resúmenes adicionales (límite de frecuencia)"},
+	"top-count":        {"Más frecuentes:"},
+	"top-entry":        {"%d. %s: %#v (grupo %d)"},
+	"top-growth":       {"Mayor crecimiento desde el último resumen:"},
+	"top-growth-entry": {"%d. +%d (de %d a %d): %#v (grupo %d)"},
+}}
+
+var FRENCH = &Locale{"fr", zeroOrOneOrOther, map[string][]string{
+	"instances":        {"%d occurrence", "%d occurrences"},
+	"messages":         {"%d message", "%d messages"},
+	"subject":          {"[failmail] %s : %s"},
+	"subject.multiple": {"[failmail] %s de %s"},
+	"urgent":           {"[URGENT] "},
+	"new":              {"NOUVEAU : "},
+	"group":            {"Groupe de messages %d sur %d : %d occurrence", "Groupe de messages %d sur %d : %d occurrences"},
+	"range":            {"Du %s au %s"},
+	"severity":         {"Gravité : %s"},
+	"first-seen":       {"Vu pour la première fois le %s"},
+	"appeared":         {"Apparu dans %d du dernier %d résumé", "Apparu dans %d des %d derniers résumés"},
+	"original-to":      {"Adressé à l'origine à %s"},
+	"message":          {"Objet : %#v\r\nCorps :\r\n%s"},
+	"totals":           {"Total des messages : %d\r\nMessages distincts : %d"},
+	"times":            {"Message le plus ancien : %s\r\nMessage le plus récent : %s"},
+	"silenced":         {"%d message supprimé pendant la mise en sourdine", "%d messages supprimés pendant la mise en sourdine"},
+	"suppressed":       {"%d résumé supplémentaire supprimé (limite de débit)", "%d résumés supplémentaires supprimés (limite de débit)"},
+	"top-count":        {"Les plus fréquents :"},
+	"top-entry":        {"%d. %s : %#v (groupe %d)"},
+	"top-growth":       {"Plus forte hausse depuis le dernier résumé :"},
+	"top-growth-entry": {"%d. +%d (de %d à %d) : %#v (groupe %d)"},
+}}
+
+// The supported locales, by the name `--locale` selects them with.
+var LOCALES = map[string]*Locale{
+	"de": GERMAN,
+	"en": ENGLISH,
+	"es": SPANISH,
+	"fr": FRENCH,
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalePlural(t *testing.T) {
+	var english *Locale
+	if text := english.Plural("instances", 1, 1); text != "1 instance" {
+		t.Errorf("unexpected singular: %s", text)
+	}
+	if text := english.Plural("instances", 0, 0); text != "0 instances" {
+		t.Errorf("unexpected plural for 0: %s", text)
+	}
+	if text := FRENCH.Plural("instances", 0, 0); text != "0 occurrence" {
+		t.Errorf("unexpected French for 0: %s", text)
+	}
+	if text := GERMAN.Plural("messages", 2, 2); text != "2 Nachrichten" {
+		t.Errorf("unexpected German plural: %s", text)
+	}
+}
+
+func TestLocaleCatalogs(t *testing.T) {
+	for name, locale := range LOCALES {
+		if locale.Name != name {
+			t.Errorf("locale %s is named %s", name, locale.Name)
+		}
+		for id, forms := range ENGLISH.messages {
+			if len(locale.messages[id]) != len(forms) {
+				t.Errorf("expected %d forms of %s in locale %s, got %d", len(forms), id, name, len(locale.messages[id]))
+			}
+		}
+	}
+}
+
+func TestFindLocale(t *testing.T) {
+	if locale, err := FindLocale("de"); err != nil || locale != GERMAN {
+		t.Errorf("unexpected locale for de: %v, %s", locale, err)
+	}
+	if _, err := FindLocale("xx"); err == nil || err.Error() != "--locale must be one of: de, en, es, fr" {
+		t.Errorf("unexpected error for an unknown locale: %v", err)
+	}
+}
+
+func TestSummarizeLocale(t *testing.T) {
+	defer patchTime(time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC))()
+	msg1 := makeReceivedMessage(t, "Date: Tue, 01 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest body 1\r\n")
+	msg2 := makeReceivedMessage(t, "Date: Wed, 02 Jul 2014 12:34:56 -0400\r\nSubject: test 2\r\n\r\ntest body 2\r\n")
+
+	summarized, err := Summarize(GroupByExpr("group", `{{.Header.Get "Subject"}}`), "failmail@example.com", "test@example.com", makeStoredMessages(msg1, msg2), nil, GERMAN)
+	if err != nil {
+		t.Fatalf("unexpected error in Summarize(): %s", err)
+	}
+	summarized.Silenced = 1
+	summarized.MarkUrgent()
+	if summarized.Subject != "[DRINGEND] [failmail] 2 Vorkommen von 2 Nachrichten" {
+		t.Errorf("unexpected subject from Summarize(): %s", summarized.Subject)
+	}
+
+	contents := string(summarized.Contents())
+	for _, expected := range []string{
+		"Nachrichten insgesamt: 2\r\nVerschiedene Nachrichten: 2\r\n",
+		"1 Nachricht während der Stummschaltung unterdrückt\r\n",
+		"- Nachrichtengruppe 1 von 2: 1 Vorkommen\r\n",
+		"Betreff: \"test\"\r\nInhalt:\r\ntest body 1\r\n",
+	} {
+		if !strings.Contains(contents, expected) {
+			t.Errorf("expected %#v in the summary: %s", expected, contents)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Detection of mail loops, e.g. when a summary is sent to an address that
+// forwards back to failmail.
+package main
+
+import (
+	"log"
+)
+
+const (
+	LOOPS_REJECT     = "reject"
+	LOOPS_QUARANTINE = "quarantine"
+
+	// The batch key used for quarantined looping messages.
+	LOOP_KEY = "mail-loop"
+)
+
+// `LoopDetector` decides whether a received message appears to be looping
+// back through failmail.
+type LoopDetector struct {
+	MaxReceived int    // messages with more Received headers than this are loops
+	From        string // the address failmail sends summaries from
+	Quarantine  bool   // if true, looping messages are stored, otherwise rejected
+	AlertTo     string // quarantined messages are sent here instead of their recipients
+}
+
+// Returns true if the message appears to be a loop: either it has passed
+// through too many servers, or it was sent by failmail itself.
+func (d *LoopDetector) IsLooping(msg *ReceivedMessage) bool {
+	if d == nil {
+		return false
+	}
+
+	if msg.Parsed != nil {
+		if d.MaxReceived > 0 && len(msg.Parsed.Header["Received"]) > d.MaxReceived {
+			return true
+		}
+		if d.isOwnAddress(msg.Parsed.Header.Get("From")) {
+			return true
+		}
+	}
+	return d.isOwnAddress(msg.Sender())
+}
+
+func (d *LoopDetector) isOwnAddress(addr string) bool {
+	return addr != "" && d.From != "" && NormalizeAddress(addr) == NormalizeAddress(d.From)
+}
+
+// Checks a received message for a loop. Returns false if the message should
+// be rejected; quarantined messages are redirected to the alert address.
+func (d *LoopDetector) Check(msg *ReceivedMessage) bool {
+	if !d.IsLooping(msg) {
+		return true
+	}
+
+	subject := ""
+	if msg.Parsed != nil {
+		subject = msg.Parsed.Header.Get("Subject")
+	}
+
+	if !d.Quarantine {
+		log.Printf("rejecting looping message with subject %#v", subject)
+		return false
+	}
+	log.Printf("quarantining looping message with subject %#v", subject)
+	msg.RedirectedTo = []string{d.AlertTo}
+	return true
+}
+
+// `GroupByLoop` puts looping messages into a batch of their own, and batches
+// all other messages using `batch`.
+func GroupByLoop(detector *LoopDetector, batch GroupBy) GroupBy {
+	return func(r *ReceivedMessage) (string, error) {
+		if detector.IsLooping(r) {
+			return LOOP_KEY, nil
+		}
+		return batch(r)
+	}
+}
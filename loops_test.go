@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLoopDetectorIsLooping(t *testing.T) {
+	detector := &LoopDetector{MaxReceived: 2, From: "failmail@example.com"}
+
+	if msg := makeReceivedMessage(t, "From: test@example.com\r\nReceived: a\r\nReceived: b\r\nSubject: test\r\n\r\nbody\r\n"); detector.IsLooping(msg) {
+		t.Errorf("expected message with few Received headers not to loop")
+	}
+	if msg := makeReceivedMessage(t, "From: test@example.com\r\nReceived: a\r\nReceived: b\r\nReceived: c\r\nSubject: test\r\n\r\nbody\r\n"); !detector.IsLooping(msg) {
+		t.Errorf("expected message with many Received headers to loop")
+	}
+	if msg := makeReceivedMessage(t, "From: Failmail <FAILMAIL@example.com>\r\nSubject: test\r\n\r\nbody\r\n"); !detector.IsLooping(msg) {
+		t.Errorf("expected message from failmail to loop")
+	}
+
+	var nilDetector *LoopDetector
+	if msg := makeReceivedMessage(t, "From: failmail@example.com\r\nSubject: test\r\n\r\nbody\r\n"); nilDetector.IsLooping(msg) {
+		t.Errorf("expected a nil detector not to detect loops")
+	}
+}
+
+func TestLoopDetectorCheck(t *testing.T) {
+	detector := &LoopDetector{From: "failmail@example.com"}
+	if detector.Check(makeReceivedMessage(t, "From: failmail@example.com\r\nSubject: test\r\n\r\nbody\r\n")) {
+		t.Errorf("expected a looping message to be rejected")
+	}
+
+	detector = &LoopDetector{From: "failmail@example.com", Quarantine: true, AlertTo: "ops@example.com"}
+	msg := makeReceivedMessage(t, "From: failmail@example.com\r\nSubject: test\r\n\r\nbody\r\n")
+	if !detector.Check(msg) {
+		t.Errorf("expected a looping message to be quarantined")
+	} else if to := msg.Recipients(); len(to) != 1 || to[0] != "ops@example.com" {
+		t.Errorf("expected a quarantined message to be redirected: %v", to)
+	}
+}
+
+func TestGroupByLoop(t *testing.T) {
+	batch := GroupByLoop(&LoopDetector{From: "failmail@example.com"}, GroupByExpr("batch", `{{.Header.Get "Subject"}}`))
+
+	if key, err := batch(makeReceivedMessage(t, "From: test@example.com\r\nSubject: test\r\n\r\nbody\r\n")); key != "test" || err != nil {
+		t.Errorf("unexpected key for a normal message: %#v, %s", key, err)
+	}
+	if key, err := batch(makeReceivedMessage(t, "From: failmail@example.com\r\nSubject: test\r\n\r\nbody\r\n")); key != LOOP_KEY || err != nil {
+		t.Errorf("unexpected key for a looping message: %#v, %s", key, err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
+	"time"
 )
 
 // `Maildir` reads, writes, and lists data in a Maildir directory tree. It
@@ -13,7 +15,16 @@ import (
 type Maildir struct {
 	Path string
 
+	// If true, files and their directories are synced to disk before writes
+	// return, so that written messages survive a crash or power loss.
+	Durable bool
+
+	// If non-nil, tells the time for the names of new messages, instead of
+	// the system clock.
+	Clock Clock
+
 	messageCounter int
+	lock           sync.Mutex
 }
 
 // `MaildirSubdir` is the type of the names of a Maildir's subdirectories.
@@ -43,27 +54,111 @@ func (m *Maildir) NextUniqueName() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.messageCounter++
-	return fmt.Sprintf("%d.%d_%d.%s", nowGetter().Unix(), pidGetter(), m.messageCounter, host), nil
+	return fmt.Sprintf("%d.%d_%d.%s", clockOr(m.Clock).Now().Unix(), pidGetter(), m.messageCounter, host), nil
 }
 
 // Writes a new message to the Maildir, and returns the name (without parent
 // directory) of the file it wrote along with any errors. The file is written
 // to `MAILDIR_TMP` and moved to `MAILDIR_CUR`, as the specification requires.
 func (m *Maildir) Write(bytes []byte) (string, error) {
+	return m.write(bytes, m.Durable)
+}
+
+func (m *Maildir) write(bytes []byte, syncDir bool) (string, error) {
 	name, err := m.NextUniqueName()
 	if err != nil {
 		return "", err
 	}
 
+	curName := name + ":2,S"
+	return curName, m.writeFile(curName, MAILDIR_CUR, bytes, time.Time{}, syncDir)
+}
+
+// Moves a complete file from `MAILDIR_TMP` (e.g. message data spooled there
+// by a receiver) to `MAILDIR_CUR` as a new message, and returns its name.
+func (m *Maildir) commit(tmpName string, syncDir bool) (string, error) {
+	if path.Dir(tmpName) != path.Join(m.Path, string(MAILDIR_TMP)) {
+		return "", fmt.Errorf("%s is not in the maildir's %s directory", tmpName, MAILDIR_TMP)
+	}
+
+	name, err := m.NextUniqueName()
+	if err != nil {
+		return "", err
+	}
+
+	curName := name + ":2,S"
+	if err := os.Rename(tmpName, m.path(curName, MAILDIR_CUR)); err != nil {
+		return "", err
+	}
+	if syncDir {
+		return curName, m.SyncDir(MAILDIR_CUR)
+	}
+	return curName, nil
+}
+
+// Writes a file named `name` to the subdirectory of the Maildir, by writing
+// it to `MAILDIR_TMP` and renaming it, so that readers never see a partially
+// written file. If `modTime` is non-zero, it's set as the file's access and
+// modification time before the file is moved into place.
+func (m *Maildir) WriteFile(name string, subdir MaildirSubdir, bytes []byte, modTime time.Time) error {
+	return m.writeFile(name, subdir, bytes, modTime, m.Durable)
+}
+
+// Writes a file like `WriteFile()`, but only syncs the subdirectory if
+// `syncDir` is true, so that callers writing many files can sync it once.
+func (m *Maildir) writeFile(name string, subdir MaildirSubdir, bytes []byte, modTime time.Time, syncDir bool) error {
 	tmpName := m.path(name, MAILDIR_TMP)
-	curName := m.path(name+":2,S", MAILDIR_CUR)
+	if err := m.writeTmp(tmpName, bytes); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if !modTime.IsZero() {
+		if err := os.Chtimes(tmpName, modTime, modTime); err != nil {
+			os.Remove(tmpName)
+			return err
+		}
+	}
 
-	if err = ioutil.WriteFile(tmpName, bytes, 0644); err != nil {
-		return curName, err
+	if err := os.Rename(tmpName, m.path(name, subdir)); err != nil {
+		return err
+	}
+	if syncDir {
+		return m.SyncDir(subdir)
 	}
+	return nil
+}
 
-	return path.Base(curName), os.Rename(tmpName, curName)
+// Syncs a subdirectory of the Maildir to disk, so that the files renamed into
+// it are durable.
+func (m *Maildir) SyncDir(subdir MaildirSubdir) error {
+	file, err := os.Open(path.Join(m.Path, string(subdir)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (m *Maildir) writeTmp(tmpName string, bytes []byte) error {
+	file, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(bytes); err != nil {
+		file.Close()
+		return err
+	}
+	if m.Durable {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
 }
 
 // Returns the path (including the root of the Maildir) of a file named `name`
@@ -179,3 +179,39 @@ func makeTestMaildir(t *testing.T) (*Maildir, func()) {
 
 	return m, func() { os.RemoveAll(tmp) }
 }
+
+func TestWriteDurable(t *testing.T) {
+	m, cleanup := makeTestMaildir(t)
+	defer cleanup()
+	m.Durable = true
+
+	defer patchHost("test", nil)()
+	defer patchTime(time.Unix(1393650000, 0))()
+	defer patchPid(1000)()
+
+	if name, err := m.Write([]byte("test mail")); err != nil {
+		t.Errorf("couldn't write to maildir: %s", err)
+	} else if data, err := m.ReadBytes(name, MAILDIR_CUR); err != nil {
+		t.Errorf("couldn't read message: %s", err)
+	} else if string(data) != "test mail" {
+		t.Errorf("unexpected contents: %s", data)
+	} else if entries, err := ioutil.ReadDir(path.Join(m.Path, "tmp")); err != nil {
+		t.Fatalf("couldn't get entries for maildir: %s", err)
+	} else if len(entries) != 0 {
+		t.Errorf("expected no entries in tmp, found %d", len(entries))
+	}
+}
+
+func TestWriteFileModTime(t *testing.T) {
+	m, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	modTime := time.Unix(1393650000, 0)
+	if err := m.WriteFile("test", MAILDIR_CUR, []byte("data"), modTime); err != nil {
+		t.Fatalf("couldn't write file: %s", err)
+	} else if info, err := os.Stat(path.Join(m.Path, "cur", "test")); err != nil {
+		t.Fatalf("couldn't stat file: %s", err)
+	} else if !info.ModTime().Equal(modTime) {
+		t.Errorf("unexpected mod time: %s", info.ModTime())
+	}
+}
@@ -0,0 +1,135 @@
+// Machine-readable manifests of summaries, for automation (e.g. a bot that
+// opens a ticket for each new group) that would otherwise have to parse the
+// summaries' prose. With `--summary-manifest`, each summary is sent as a
+// multipart message: the summary as rendered, and a small JSON attachment
+// listing its groups, with their fingerprints, counts, and message ids.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// The file name of the manifest attached to summaries.
+const MANIFEST_FILENAME = "failmail-manifest.json"
+
+// `Manifest` describes a summary (or one part of a split summary).
+type Manifest struct {
+	Summary string `json:",omitempty"` // the summary's id, as in its X-Failmail-Summary-Id header
+	Key     string
+	Date    time.Time
+	Total   int // the number of messages in all of the groups
+	Groups  []*ManifestGroup
+}
+
+// `ManifestGroup` describes one group of messages in a summary.
+type ManifestGroup struct {
+	Fingerprint string // identifies the group across summaries, as in `--history`
+	Subject     string
+	Count       int
+	Severity    string      `json:",omitempty"`
+	Ids         []MessageId // the ids of the group's messages in the store
+	MessageIds  []string    `json:",omitempty"` // the groups' messages' Message-ID headers
+}
+
+// Returns the manifest for a summary.
+func NewManifest(s *SummaryMessage) *Manifest {
+	manifest := &Manifest{Summary: s.Id, Key: s.Key, Date: s.Date, Groups: make([]*ManifestGroup, 0, len(s.UniqueMessages))}
+	for _, unique := range s.UniqueMessages {
+		manifest.Total += unique.Count
+		manifest.Groups = append(manifest.Groups, &ManifestGroup{
+			Fingerprint: Fingerprint(unique),
+			Subject:     unique.Subject,
+			Count:       unique.Count,
+			Severity:    unique.Severity,
+			Ids:         unique.Ids,
+			MessageIds:  unique.MessageIds,
+		})
+	}
+	return manifest
+}
+
+// `ManifestRenderer` renders summaries with `Renderer`, and attaches their
+// manifests.
+type ManifestRenderer struct {
+	Renderer SummaryRenderer
+}
+
+func (r *ManifestRenderer) Render(s *SummaryMessage) OutgoingMessage {
+	rendered := r.Renderer.Render(s)
+	manifest, err := json.Marshal(NewManifest(s))
+	if err != nil {
+		log.Printf("warning: couldn't serialize summary manifest: %s", err)
+		return rendered
+	}
+	contents, err := attachManifest(rendered.Contents(), manifest)
+	if err != nil {
+		log.Printf("warning: couldn't attach summary manifest: %s", err)
+		return rendered
+	}
+	return &message{rendered.Sender(), rendered.Recipients(), contents}
+}
+
+// Returns the message `data` as a multipart/mixed message, with its body (in
+// its own content type) as the first part, and `manifest` as an attachment.
+func attachManifest(data []byte, manifest []byte) ([]byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	text := string(data)
+	body := ""
+	if i := strings.Index(text, "\r\n\r\n"); i >= 0 {
+		body = text[i+4:]
+	}
+
+	buf := new(bytes.Buffer)
+	parts := multipart.NewWriter(buf)
+
+	header := textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}}
+	if contentType := msg.Header.Get("Content-Type"); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if encoding := msg.Header.Get("Content-Transfer-Encoding"); encoding != "" {
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+	part, err := parts.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte(body))
+
+	part, err = parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {fmt.Sprintf("application/json; name=%#v", MANIFEST_FILENAME)},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%#v", MANIFEST_FILENAME)},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(manifest)
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(part, "%s\r\n", encoded)
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"MIME-Version":              "1.0",
+		"Content-Type":              fmt.Sprintf("multipart/mixed; boundary=%s", parts.Boundary()),
+		"Content-Transfer-Encoding": "",
+	}
+	head := SetHeaders([]byte(text[:len(text)-len(body)]), headers)
+	return append(head, buf.Bytes()...), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// Returns the parts of a rendered summary with a manifest, and the manifest.
+func readManifest(t *testing.T, rendered OutgoingMessage) ([]*multipart.Part, []string, *Manifest) {
+	msg, err := mail.ReadMessage(bytes.NewReader(rendered.Contents()))
+	if err != nil {
+		t.Fatalf("invalid summary: %s", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || msg.Header.Get("MIME-Version") != "1.0" {
+		t.Fatalf("expected a multipart summary: %#v", msg.Header)
+	}
+
+	parts, bodies := make([]*multipart.Part, 0), make([]string, 0)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		parts, bodies = append(parts, part), append(bodies, string(body))
+	}
+	if len(parts) != 2 {
+		t.Fatalf("expected the summary and its manifest, got %d parts", len(parts))
+	}
+
+	manifest := new(Manifest)
+	data, err := decodeTransfer(parts[1].Header.Get("Content-Transfer-Encoding"), []byte(bodies[1]))
+	if err != nil {
+		t.Fatalf("couldn't decode manifest: %s", err)
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		t.Fatalf("invalid manifest %#v: %s", string(data), err)
+	}
+	return parts, bodies, manifest
+}
+
+func TestManifestRenderer(t *testing.T) {
+	summary := makeSummaryMessage(t,
+		"Message-Id: <1@app.example.com>\r\nSubject: one\r\n\r\nbody\r\n",
+		"Message-Id: <2@app.example.com>\r\nSubject: one\r\n\r\nbody\r\n",
+		"Subject: two\r\n\r\nbody\r\n",
+	)
+	summary.Id = "3f2a9c0d1e7b4a65"
+	summary.Key = "db"
+
+	rendered := (&ManifestRenderer{&NoRenderer{}}).Render(summary)
+	parts, bodies, manifest := readManifest(t, rendered)
+
+	if parts[0].Header.Get("Content-Type") != "text/plain; charset=utf-8" || !strings.HasPrefix(bodies[0], "--- Failmail ---\r\n") {
+		t.Errorf("expected the summary as the first part: %#v, %#v", parts[0].Header, bodies[0])
+	}
+	if parts[1].FileName() != MANIFEST_FILENAME || !strings.HasPrefix(parts[1].Header.Get("Content-Type"), "application/json") {
+		t.Errorf("expected the manifest as an attachment: %#v", parts[1].Header)
+	}
+
+	if manifest.Summary != "3f2a9c0d1e7b4a65" || manifest.Key != "db" || manifest.Total != 3 || len(manifest.Groups) != 2 {
+		t.Fatalf("unexpected manifest: %#v", manifest)
+	}
+	one := manifest.Groups[0]
+	if one.Subject != "one" || one.Count != 2 || one.Fingerprint != Fingerprint(summary.UniqueMessages[0]) {
+		t.Errorf("unexpected manifest group: %#v", one)
+	}
+	if len(one.Ids) != 2 || strings.Join(one.MessageIds, ",") != "<1@app.example.com>,<2@app.example.com>" {
+		t.Errorf("expected the group's message ids: %#v, %#v", one.Ids, one.MessageIds)
+	}
+	if two := manifest.Groups[1]; len(two.Ids) != 1 || len(two.MessageIds) != 0 {
+		t.Errorf("expected the group's message ids: %#v, %#v", two.Ids, two.MessageIds)
+	}
+
+	// The summary's text is still found by readers that skip attachments.
+	msg, _ := mail.ReadMessage(bytes.NewReader(rendered.Contents()))
+	if text, err := TextBody(msg.Header, msg.Body); err != nil || text != bodies[0] {
+		t.Errorf("expected the summary's text to be its first part: %#v, %v", text, err)
+	}
+}
+
+func TestManifestRendererKeepsContentType(t *testing.T) {
+	tmpl := template.Must(template.New("summary").Parse("From: {{.From}}\nContent-Type: text/html; charset=utf-8\nX-Batch: {{.Key}}\n\n<p>{{len .UniqueMessages}} groups</p>\n"))
+	summary := makeSummaryMessage(t, "Subject: one\r\n\r\nbody\r\n")
+	summary.Key = "db"
+	rendered := (&ManifestRenderer{&TemplateRenderer{tmpl}}).Render(summary)
+
+	parts, bodies, manifest := readManifest(t, rendered)
+	if parts[0].Header.Get("Content-Type") != "text/html; charset=utf-8" || bodies[0] != "<p>1 groups</p>\r\n" {
+		t.Errorf("expected the template's content type and body in the first part: %#v, %#v", parts[0].Header, bodies[0])
+	}
+	if !strings.Contains(string(rendered.Contents()), "X-Batch: db\r\n") || len(manifest.Groups) != 1 {
+		t.Errorf("expected the template's other headers to be kept: %s", rendered.Contents())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Matches body lines that need quoting in mboxrd format: "From " preceded by
+// any number of ">".
+var mboxFromLine = regexp.MustCompile(`^>*From `)
+
+// `WriteMbox` writes messages to `w` in mboxrd format. Lines in the messages
+// are converted from CRLF to LF line endings, as is customary for mbox files.
+func WriteMbox(w io.Writer, msgs []*StoredMessage) error {
+	writer := bufio.NewWriter(w)
+	for _, msg := range msgs {
+		sender := msg.Sender()
+		if sender == "" {
+			sender = "MAILER-DAEMON"
+		}
+		fmt.Fprintf(writer, "From %s %s\n", sender, msg.Received.UTC().Format(time.ANSIC))
+
+		data := strings.Replace(string(msg.Contents()), "\r\n", "\n", -1)
+		for _, line := range strings.SplitAfter(data, "\n") {
+			if mboxFromLine.MatchString(line) {
+				writer.WriteString(">")
+			}
+			writer.WriteString(line)
+		}
+		if !strings.HasSuffix(data, "\n") {
+			writer.WriteString("\n")
+		}
+		if _, err := writer.WriteString("\n"); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// `ReadMbox` reads the messages in an mboxrd-format file. The envelope sender
+// of each message comes from its "From " separator line, and the envelope
+// recipients from its To and Cc headers. Line endings are normalized to CRLF,
+// as if the messages were received via SMTP.
+func ReadMbox(r io.Reader) ([]*ReceivedMessage, error) {
+	reader := bufio.NewReader(r)
+	result := make([]*ReceivedMessage, 0)
+
+	var sender string
+	var data *bytes.Buffer
+	finish := func() error {
+		if data == nil {
+			return nil
+		}
+		// Drop the blank line that separates messages.
+		contents := strings.TrimSuffix(data.String(), "\n")
+		msg, err := parseMboxMessage(sender, normalizeNewlines(contents))
+		if err != nil {
+			return err
+		}
+		result = append(result, msg)
+		return nil
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return result, err
+		}
+
+		if strings.HasPrefix(line, "From ") {
+			if err := finish(); err != nil {
+				return result, err
+			}
+			sender = ""
+			if fields := strings.Fields(line); len(fields) > 1 {
+				sender = fields[1]
+			}
+			data = new(bytes.Buffer)
+		} else if data != nil {
+			if mboxFromLine.MatchString(line) {
+				line = line[1:]
+			}
+			data.WriteString(line)
+		} else if strings.TrimSpace(line) != "" {
+			return result, fmt.Errorf("mbox data doesn't start with a From line")
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return result, finish()
+}
+
+func parseMboxMessage(sender string, data []byte) (*ReceivedMessage, error) {
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if sender == "MAILER-DAEMON" {
+		sender = ""
+	}
+	to := HeaderRecipients(parsed.Header)
+	return &ReceivedMessage{message: &message{sender, to, data}, Parsed: parsed}, nil
+}
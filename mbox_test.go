@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWriteMbox(t *testing.T) {
+	msgs := makeStoredMessages(
+		makeReceivedMessage(t, "From: test@example.com\r\nTo: test2@example.com\r\nSubject: test\r\n\r\nFrom here\r\n>From there\r\n"),
+		makeReceivedMessage(t, "Subject: test 2\r\n\r\nbody\r\n"))
+	msgs[0].Received = time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC)
+	msgs[1].Received = time.Date(2014, time.March, 1, 0, 0, 1, 0, time.UTC)
+
+	buf := new(bytes.Buffer)
+	if err := WriteMbox(buf, msgs); err != nil {
+		t.Fatalf("unexpected error from WriteMbox(): %s", err)
+	}
+
+	expected := "From test@example.com Sat Mar  1 00:00:00 2014\n" +
+		"From: test@example.com\nTo: test2@example.com\nSubject: test\n\n>From here\n>>From there\n\n" +
+		"From MAILER-DAEMON Sat Mar  1 00:00:01 2014\n" +
+		"Subject: test 2\n\nbody\n\n"
+	if mbox := buf.String(); mbox != expected {
+		t.Errorf("unexpected mbox contents: %#v", mbox)
+	}
+}
+
+func TestReadMbox(t *testing.T) {
+	mbox := "From sender@example.com Sat Mar  1 00:00:00 2014\n" +
+		"To: test@example.com\nCc: Test <test2@example.com>\nSubject: test\n\n>From here\n>>From there\n\n" +
+		"From MAILER-DAEMON Sat Mar  1 00:00:01 2014\n" +
+		"Subject: test 2\n\nbody\n"
+
+	msgs, err := ReadMbox(bytes.NewBufferString(mbox))
+	if err != nil {
+		t.Fatalf("unexpected error from ReadMbox(): %s", err)
+	} else if count := len(msgs); count != 2 {
+		t.Fatalf("expected 2 messages from ReadMbox(), got %d", count)
+	}
+
+	if from := msgs[0].Sender(); from != "sender@example.com" {
+		t.Errorf("unexpected envelope sender: %s", from)
+	}
+	if to := msgs[0].Recipients(); len(to) != 2 || to[0] != "test@example.com" || to[1] != "test2@example.com" {
+		t.Errorf("unexpected envelope recipients: %v", to)
+	}
+	if body, err := msgs[0].ReadBody(); body != "From here\r\n>From there\r\n" || err != nil {
+		t.Errorf("unexpected body: %#v, %s", body, err)
+	}
+
+	if from := msgs[1].Sender(); from != "" {
+		t.Errorf("unexpected envelope sender: %s", from)
+	}
+	if subject := msgs[1].Parsed.Header.Get("Subject"); subject != "test 2" {
+		t.Errorf("unexpected subject: %s", subject)
+	}
+}
+
+func TestReadMboxInvalid(t *testing.T) {
+	if _, err := ReadMbox(bytes.NewBufferString("Subject: test\n\nbody\n")); err == nil {
+		t.Errorf("expected an error reading an mbox without a From line")
+	}
+}
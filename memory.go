@@ -0,0 +1,101 @@
+// Accounting for message data held in memory by the receiver. Each SMTP
+// session holds the DATA of the message it's receiving until it's stored, so
+// with `--max-memory`, the sessions share a budget, and a session whose
+// message would go over it is refused with a temporary error (452), for the
+// client to try again once other messages have been stored.
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Returned by writes that would go over a `MemoryBudget`.
+var ErrMemoryBudget = errors.New("memory budget exhausted")
+
+// `MemoryBudget` limits the bytes of message data held in memory by all of a
+// listener's sessions at once. A nil budget doesn't limit anything.
+type MemoryBudget struct {
+	Limit int64
+
+	used int64 // the bytes held by all sessions
+	peak int64 // the most bytes held at once
+	lock sync.Mutex
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &MemoryBudget{Limit: limit}
+}
+
+// Takes `n` bytes from the budget, and returns true, if that doesn't go over
+// the limit. Otherwise, nothing is taken, and it returns false.
+func (m *MemoryBudget) Reserve(n int) bool {
+	if m == nil {
+		return true
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.used+int64(n) > m.Limit {
+		return false
+	}
+	m.used += int64(n)
+	if m.used > m.peak {
+		m.peak = m.used
+	}
+	return true
+}
+
+// Returns `n` bytes to the budget.
+func (m *MemoryBudget) Release(n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.used -= int64(n)
+}
+
+// Returns true if no more data can be held in memory.
+func (m *MemoryBudget) Full() bool {
+	if m == nil {
+		return false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used >= m.Limit
+}
+
+// Returns the bytes held now, and the most held at once.
+func (m *MemoryBudget) Used() (int64, int64) {
+	if m == nil {
+		return 0, 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used, m.peak
+}
+
+// `budgetWriter` writes to `w`, counting the bytes written against a
+// session's share of its memory budget. Once a write would go over the
+// budget, it and all later writes fail with `ErrMemoryBudget`.
+type budgetWriter struct {
+	w       io.Writer
+	session *Session
+	err     error
+}
+
+func (b *budgetWriter) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if !b.session.memory.Reserve(len(p)) {
+		b.err = ErrMemoryBudget
+		return 0, b.err
+	}
+	b.session.buffered += len(p)
+	return b.w.Write(p)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(10)
+	if !budget.Reserve(6) || budget.Reserve(5) || !budget.Reserve(4) {
+		t.Errorf("expected reservations to be refused only past the limit")
+	}
+	if !budget.Full() {
+		t.Errorf("expected the budget to be full")
+	}
+	budget.Release(6)
+	if used, peak := budget.Used(); used != 4 || peak != 10 {
+		t.Errorf("unexpected usage: %d (peak %d)", used, peak)
+	}
+
+	var none *MemoryBudget
+	if NewMemoryBudget(0) != nil || !none.Reserve(1000) || none.Full() {
+		t.Errorf("expected no budget not to limit anything")
+	}
+	none.Release(1000)
+}
+
+func TestReadDataMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(40)
+
+	// The first session's message is held until it's stored.
+	first := makeDataSession(t, 0)
+	first.memory = budget
+	if resp, msg := first.ReadData(bytes.NewBufferString("Subject: test\r\n\r\ntest\r\n.\r\n")); msg == nil {
+		t.Fatalf("expected the message to fit the budget: %d", resp.Code)
+	} else if used, _ := budget.Used(); used != 23 || first.buffered != 23 {
+		t.Errorf("expected the message to be counted against the budget: %d, %d", used, first.buffered)
+	}
+
+	// A message that would go over the budget is refused, and its data
+	// doesn't count against the budget.
+	second := makeDataSession(t, 0)
+	second.memory = budget
+	if resp, msg := second.ReadData(bytes.NewBufferString("Subject: test\r\n\r\na longer message\r\n.\r\n")); resp.Code != 452 || msg != nil {
+		t.Errorf("expected a 452 for a message over the budget: %d", resp.Code)
+	} else if used, _ := budget.Used(); used != 23 || second.buffered != 0 {
+		t.Errorf("expected the refused message not to count against the budget: %d, %d", used, second.buffered)
+	}
+
+	// Once the budget is used up, DATA is refused outright.
+	budget.Reserve(17)
+	parser := SMTPParser()
+	second.Advance(parser("MAIL FROM:<test@example.com>\r\n"))
+	second.Advance(parser("RCPT TO:<test@example.com>\r\n"))
+	if resp := second.Advance(parser("DATA\r\n")); resp.Code != 452 {
+		t.Errorf("expected DATA to get a 452 response while the budget is used up: %d", resp.Code)
+	}
+	budget.Release(17)
+
+	first.ReleaseMemory()
+	if used, _ := budget.Used(); used != 0 {
+		t.Errorf("expected the stored message's data to be released: %d", used)
+	}
+	second.Advance(parser("MAIL FROM:<test@example.com>\r\n"))
+	second.Advance(parser("RCPT TO:<test@example.com>\r\n"))
+	if resp := second.Advance(parser("DATA\r\n")); resp.Code != 354 {
+		t.Errorf("expected DATA to be accepted once memory was released: %d", resp.Code)
+	}
+}
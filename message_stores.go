@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"container/heap"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"log"
 	"net/mail"
-	"os"
 	"sort"
 	"time"
 )
@@ -39,6 +39,13 @@ type MessageStore interface {
 	MessagesNewerThan(time.Time) ([]*StoredMessage, error)
 }
 
+// `BatchAdder` is implemented by stores that can add several messages at
+// once more cheaply than adding them one at a time (e.g. in one transaction).
+type BatchAdder interface {
+	// Adds the messages, and returns a `MessageId` and an error for each.
+	AddBatch(time.Time, []*ReceivedMessage) ([]MessageId, []error)
+}
+
 // `DiskStore` is a `MessageStore` implementation backed by a Maildir on disk.
 // It stores metadata (SMTP envelope, receive time) in files in a non-standard
 // `.meta` subdirectory of the maildir.
@@ -52,6 +59,9 @@ type DiskMetadata struct {
 	EnvelopeFrom string
 	EnvelopeTo   []string
 	RedirectedTo []string
+	Count        int    `json:",omitempty"`
+	ClientAddr   string `json:",omitempty"`
+	AuthUser     string `json:",omitempty"`
 }
 
 // `NewDiskStore` creates a new `DiskStore` using `maildir` to back it.
@@ -60,15 +70,56 @@ func NewDiskStore(maildir *Maildir) (*DiskStore, error) {
 }
 
 func (s *DiskStore) Add(now time.Time, msg *ReceivedMessage) (MessageId, error) {
-	// Write the contents to the maildir.
-	name, err := s.Maildir.Write(msg.Contents())
+	return s.add(now, msg, s.Maildir.Durable)
+}
+
+// Adds several messages, syncing the maildir's subdirectories once for all of
+// them (if the maildir is durable), rather than once for each message.
+func (s *DiskStore) AddBatch(now time.Time, msgs []*ReceivedMessage) ([]MessageId, []error) {
+	ids := make([]MessageId, len(msgs))
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		ids[i], errs[i] = s.add(now, msg, false)
+	}
+
+	if !s.Maildir.Durable {
+		return ids, errs
+	}
+
+	err := s.Maildir.SyncDir(MAILDIR_CUR)
+	if err == nil {
+		err = s.Maildir.SyncDir(MAILDIR_META)
+	}
+	if err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return ids, errs
+}
+
+func (s *DiskStore) add(now time.Time, msg *ReceivedMessage, syncDirs bool) (MessageId, error) {
+	// Write the contents to the maildir, or move them there if they were
+	// spooled to its tmp subdirectory.
+	var name string
+	var err error
+	if msg.Spooled != "" && msg.Data == nil {
+		if name, err = s.Maildir.commit(msg.Spooled, syncDirs); err == nil {
+			msg.Spooled = s.Maildir.path(name, MAILDIR_CUR)
+		}
+	} else {
+		name, err = s.Maildir.write(msg.Contents(), syncDirs)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// Write the metadata last.
-	meta := &DiskMetadata{msg.Sender(), msg.Recipients(), msg.RedirectedTo}
-	return MessageId(name), s.writeMetadata(name, now, meta)
+	// Write the metadata last. The envelope recipients are the ones the
+	// client gave, so that redirected messages can be traced back to them.
+	meta := &DiskMetadata{msg.Sender(), msg.To, msg.RedirectedTo, msg.Count, msg.ClientAddr, msg.AuthUser}
+	return MessageId(name), s.writeMetadata(name, now, meta, syncDirs)
 }
 
 func (s *DiskStore) Remove(id MessageId) error {
@@ -95,7 +146,7 @@ func (s *DiskStore) MessagesNewerThan(t time.Time) ([]*StoredMessage, error) {
 		if info.ModTime().Before(t) || info.IsDir() {
 			continue
 		}
-		if msg, err := s.readMessage(info.Name()); err != nil {
+		if msg, err := s.readMessage(info.Name(), info.ModTime()); err != nil {
 			return result, err
 		} else {
 			result = append(result, &StoredMessage{info.Name(), info.ModTime(), msg})
@@ -105,6 +156,24 @@ func (s *DiskStore) MessagesNewerThan(t time.Time) ([]*StoredMessage, error) {
 	return result, nil
 }
 
+// Returns the number of messages in the store, and the total size of their
+// contents.
+func (s *DiskStore) Size() (int, int, error) {
+	files, err := s.Maildir.List(MAILDIR_CUR)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count, size := 0, 0
+	for _, info := range files {
+		if !info.IsDir() {
+			count += 1
+			size += int(info.Size())
+		}
+	}
+	return count, size, nil
+}
+
 // Reads the metadata file corresponding to the message with contents in
 // `name`.
 func (s *DiskStore) readMetadata(name string) (*DiskMetadata, error) {
@@ -118,21 +187,18 @@ func (s *DiskStore) readMetadata(name string) (*DiskMetadata, error) {
 	}
 }
 
-// Writes the metadata to a file in the metadata subdirectory, and sets is mod
-// time to the message receive time.
-func (s *DiskStore) writeMetadata(name string, now time.Time, metadata *DiskMetadata) error {
-	metadataPath := s.Maildir.path(name, MAILDIR_META)
+// Writes the metadata to a file in the metadata subdirectory, and sets its mod
+// time to the message receive time. The file is moved into place once it's
+// complete, since its presence marks the message as stored.
+func (s *DiskStore) writeMetadata(name string, now time.Time, metadata *DiskMetadata, syncDir bool) error {
 	if bytes, err := json.Marshal(metadata); err != nil {
 		return err
-	} else if err := ioutil.WriteFile(metadataPath, bytes, 0644); err != nil {
-		return err
-	} else if err := os.Chtimes(metadataPath, now, now); err != nil {
-		return err
+	} else {
+		return s.Maildir.writeFile(name, MAILDIR_META, bytes, now, syncDir)
 	}
-	return nil
 }
 
-func (s *DiskStore) readMessage(name string) (*ReceivedMessage, error) {
+func (s *DiskStore) readMessage(name string, received time.Time) (*ReceivedMessage, error) {
 	metadata, err := s.readMetadata(name)
 	if err != nil {
 		return nil, err
@@ -150,13 +216,17 @@ func (s *DiskStore) readMessage(name string) (*ReceivedMessage, error) {
 	}
 
 	return &ReceivedMessage{
-		&message{
+		message: &message{
 			From: metadata.EnvelopeFrom,
 			To:   metadata.EnvelopeTo,
 			Data: data,
 		},
-		msg,
-		metadata.RedirectedTo,
+		Parsed:       msg,
+		RedirectedTo: metadata.RedirectedTo,
+		ReceivedAt:   received,
+		Count:        metadata.Count,
+		ClientAddr:   metadata.ClientAddr,
+		AuthUser:     metadata.AuthUser,
 	}, nil
 }
 
@@ -190,6 +260,7 @@ func NewMemoryStore() *MemoryStore {
 }
 
 func (s *MemoryStore) Add(now time.Time, msg *ReceivedMessage) (MessageId, error) {
+	msg.ReceivedAt = now
 	m := &StoredMessage{MessageId(s.counter), now, msg}
 	s.counter += 1
 	heap.Push(s.messages, m)
@@ -200,10 +271,18 @@ func (s *MemoryStore) Remove(id MessageId) error {
 	for i, m := range *s.messages {
 		if m.Id == id {
 			heap.Remove(s.messages, i)
-			break
+			return nil
 		}
 	}
-	return nil
+	return fmt.Errorf("no message with id %v", id)
+}
+
+func (s *MemoryStore) Size() (int, int, error) {
+	size := 0
+	for _, m := range *s.messages {
+		size += len(m.Contents())
+	}
+	return len(*s.messages), size, nil
 }
 
 func (s *MemoryStore) MessagesNewerThan(t time.Time) ([]*StoredMessage, error) {
@@ -218,17 +297,159 @@ func (s *MemoryStore) MessagesNewerThan(t time.Time) ([]*StoredMessage, error) {
 }
 
 type MessageWriter struct {
-	Store MessageStore
+	Store             MessageStore
+	Hook              *Hook         // if non-nil, called on each message before storing it
+	DropAutoGenerated bool          // if true, auto-generated messages aren't stored
+	Counter           *Counter      // if non-nil, stores high-volume batches by count
+	Sampler           *Sampler      // if non-nil, stores only a sample of some groups
+	Limits            *StoreLimits  // if non-nil, refuses messages when the store is full
+	MaxBatch          int           // if greater than 1, the most waiting requests to store at once
+	Feed              *StoreFeed    // if non-nil, stored messages are passed to the buffer
+	Relay             *Relay        // if non-nil, messages it doesn't match are relayed instead of stored
+	Audit             *AuditLog     // if non-nil, records each message stored, relayed, or dropped
+	Duplicates        *Duplicates   // if non-nil, messages with recently stored Message-IDs are dropped
+	ContentDedup      *ContentDedup // if non-nil, identical messages are stored once, with a count
+	Clock             Clock         // if non-nil, tells the time messages are stored instead of the system clock
 }
 
 func (w *MessageWriter) Run(received <-chan *StorageRequest) error {
 	for req := range received {
-		_, err := w.Store.Add(nowGetter(), req.Message)
-		req.StorageErrors <- err
+		w.write(append([]*StorageRequest{req}, w.waiting(received)...))
 	}
 	return nil
 }
 
+// Returns up to `MaxBatch - 1` more requests that are already waiting, without
+// blocking for new ones.
+func (w *MessageWriter) waiting(received <-chan *StorageRequest) []*StorageRequest {
+	result := make([]*StorageRequest, 0)
+	for len(result) < w.MaxBatch-1 {
+		select {
+		case req, ok := <-received:
+			if !ok {
+				return result
+			}
+			result = append(result, req)
+		default:
+			return result
+		}
+	}
+	return result
+}
+
+// Stores the messages in the requests, and answers each request with its
+// error. If the store is a `BatchAdder`, messages that don't need to be
+// counted or sampled are added to it together.
+func (w *MessageWriter) write(reqs []*StorageRequest) {
+	now := clockOr(w.Clock).Now()
+	batcher, canBatch := w.Store.(BatchAdder)
+
+	batched := make([]*StorageRequest, 0, len(reqs))
+	msgs := make([]*ReceivedMessage, 0, len(reqs))
+	for _, req := range reqs {
+		msg := req.Message
+
+		// Spooled messages can only be moved into the store as they are.
+		if msg.Spooled != "" && (w.Hook != nil || !w.plain(msg)) {
+			if err := msg.Unspool(); err != nil {
+				msg.Discard()
+				req.StorageErrors <- err
+				continue
+			}
+		}
+
+		// Duplicates are checked (and remembered) as they were received, in
+		// case the hook changes their Message-IDs.
+		if w.Duplicates.IsDuplicate(req.Message, now) {
+			msg.Discard()
+			msg = nil
+		}
+		if msg != nil && w.Hook != nil {
+			msg = w.Hook.ApplyReceived(msg)
+		}
+		if msg != nil && w.DropAutoGenerated && dropAutoGenerated(msg) {
+			msg.Discard()
+			msg = nil
+		}
+
+		// Relayed messages are acknowledged once the upstream accepts them.
+		if msg != nil && w.Relay != nil && !w.Relay.Matches(msg) {
+			err := w.Relay.Send(msg)
+			if err == nil {
+				w.Duplicates.Remember(req.Message, now)
+				w.audit(AUDIT_RELAYED, nil, msg)
+			}
+			msg.Discard()
+			req.StorageErrors <- err
+			continue
+		}
+
+		// Dropped messages are acknowledged as if they were stored.
+		switch {
+		case msg == nil:
+			w.audit(AUDIT_DROPPED, nil, req.Message)
+			req.StorageErrors <- nil
+		case w.Limits.Full():
+			msg.Discard()
+			req.StorageErrors <- ErrStoreFull
+		case canBatch && len(reqs) > 1 && w.plain(msg):
+			batched = append(batched, req)
+			msgs = append(msgs, msg)
+		default:
+			id, err := w.add(now, msg)
+			if err == nil {
+				w.Feed.Stored(id, now, msg)
+				w.Duplicates.Remember(req.Message, now)
+				w.audit(AUDIT_STORED, id, msg)
+			} else {
+				msg.Discard()
+			}
+			req.StorageErrors <- err
+		}
+	}
+
+	if len(msgs) > 0 {
+		ids, errs := batcher.AddBatch(now, msgs)
+		for i, req := range batched {
+			if errs[i] == nil {
+				w.Feed.Stored(ids[i], now, msgs[i])
+				w.Duplicates.Remember(req.Message, now)
+				w.audit(AUDIT_STORED, ids[i], msgs[i])
+			} else {
+				msgs[i].Discard()
+			}
+			req.StorageErrors <- errs[i]
+		}
+	}
+}
+
+func (w *MessageWriter) audit(event string, id MessageId, msg *ReceivedMessage) {
+	if err := w.Audit.Received(event, id, msg); err != nil {
+		log.Printf("warning: couldn't write to audit log: %s", err)
+	}
+}
+
+// Returns true if the message is added to the store as is, rather than by
+// content, by count, or by sampling.
+func (w *MessageWriter) plain(msg *ReceivedMessage) bool {
+	return w.ContentDedup == nil && w.Sampler == nil && (w.Counter == nil || !w.Counter.Counts(msg))
+}
+
+// Adds a message to the store, by content, by count, or by sampling if
+// configured.
+func (w *MessageWriter) add(now time.Time, msg *ReceivedMessage) (MessageId, error) {
+	switch {
+	case w.ContentDedup != nil:
+		return w.ContentDedup.Add(w.Store, now, msg)
+	case w.Counter != nil && w.Counter.Counts(msg):
+		return w.Counter.Add(w.Store, now, msg)
+	case w.Sampler != nil:
+		return w.Sampler.Add(w.Store, now, msg)
+	default:
+		return w.Store.Add(now, msg)
+	}
+}
+
 // `StorageRequest` instructs a store to write an incoming message, and gives
 // the requester the opportunity to block on/check for an error response.
 type StorageRequest struct {
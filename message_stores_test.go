@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 	"time"
 )
@@ -15,6 +16,8 @@ func TestDiskStore(t *testing.T) {
 	}
 
 	msg := makeReceivedMessage(t, "From: test@example.com\r\nTo: test@example.com\r\nSubject: test\r\n\r\ntest\r\n")
+	msg.ClientAddr = "10.0.0.1"
+	msg.AuthUser = "testuser"
 	now := time.Unix(1393650000, 0)
 	if _, err := ds.Add(now, msg); err != nil {
 		t.Errorf("failed to add message to store: %s", err)
@@ -35,5 +38,120 @@ func TestDiskStore(t *testing.T) {
 		t.Errorf("error on DiskStore.MessagesNewerThan(): %s", err)
 	} else if count := len(msgs); count != 1 {
 		t.Errorf("expected 1 message restored in new disk store, found %d", count)
+	} else if msgs[0].ClientAddr != "10.0.0.1" || msgs[0].AuthUser != "testuser" {
+		t.Errorf("expected client details restored in new disk store: %#v", msgs[0].ReceivedMessage)
+	}
+}
+
+func TestDiskStoreRedirected(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+	ds, _ := NewDiskStore(maildir)
+
+	msg := makeReceivedMessage(t, "From: test@example.com\r\nSubject: test\r\n\r\ntest\r\n")
+	msg.To = []string{"alice@example.com"}
+	msg.RedirectedTo = []string{"qa@example.com"}
+	if _, err := ds.Add(time.Unix(1393650000, 0), msg); err != nil {
+		t.Fatalf("failed to add message to store: %s", err)
+	}
+
+	msgs, err := ds.MessagesNewerThan(time.Time{})
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 message in the store, got %d (%v)", len(msgs), err)
+	}
+	if !reflect.DeepEqual(msgs[0].To, []string{"alice@example.com"}) || !reflect.DeepEqual(msgs[0].Recipients(), []string{"qa@example.com"}) {
+		t.Errorf("expected the original and redirected recipients to be kept, got %v and %v", msgs[0].To, msgs[0].Recipients())
+	}
+}
+
+func TestDiskStoreCount(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	ds, _ := NewDiskStore(maildir)
+	msg := makeReceivedMessage(t, "From: test@example.com\r\nTo: test@example.com\r\nSubject: test\r\n\r\ntest\r\n")
+	msg.Count = 3
+	if _, err := ds.Add(time.Unix(1393650000, 0), msg); err != nil {
+		t.Fatalf("failed to add message to store: %s", err)
+	}
+
+	if msgs, err := ds.MessagesNewerThan(time.Time{}); err != nil || len(msgs) != 1 {
+		t.Fatalf("unexpected messages in store: %v, %s", msgs, err)
+	} else if count := msgs[0].Instances(); count != 3 {
+		t.Errorf("expected the count to be stored: %d", count)
+	}
+}
+
+func TestMemoryStoreRemoveMissing(t *testing.T) {
+	if err := NewMemoryStore().Remove(MessageId(0)); err == nil {
+		t.Errorf("expected an error removing a missing message")
+	}
+}
+
+func TestDiskStoreAddBatch(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+	maildir.Durable = true
+
+	ds, _ := NewDiskStore(maildir)
+	msgs := []*ReceivedMessage{
+		makeReceivedMessage(t, "Subject: test 1\r\n\r\ntest\r\n"),
+		makeReceivedMessage(t, "Subject: test 2\r\n\r\ntest\r\n"),
+	}
+	ids, errs := ds.AddBatch(time.Unix(1393650000, 0), msgs)
+	if len(ids) != 2 || len(errs) != 2 {
+		t.Fatalf("expected an id and error for each message: %v, %v", ids, errs)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("failed to add message %d to store: %s", i, err)
+		}
+	}
+
+	if stored, err := ds.MessagesNewerThan(time.Time{}); err != nil {
+		t.Errorf("error on DiskStore.MessagesNewerThan(): %s", err)
+	} else if count := len(stored); count != 2 {
+		t.Errorf("expected 2 messages in the store, found %d", count)
+	}
+}
+
+// Records the size of each batch added to a `MemoryStore`.
+type batchingStore struct {
+	*MemoryStore
+	batches []int
+}
+
+func (s *batchingStore) AddBatch(now time.Time, msgs []*ReceivedMessage) ([]MessageId, []error) {
+	s.batches = append(s.batches, len(msgs))
+	ids := make([]MessageId, len(msgs))
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		ids[i], errs[i] = s.MemoryStore.Add(now, msg)
+	}
+	return ids, errs
+}
+
+func TestMessageWriterBatch(t *testing.T) {
+	store := &batchingStore{MemoryStore: NewMemoryStore()}
+	writer := &MessageWriter{Store: store, MaxBatch: 2}
+
+	received := make(chan *StorageRequest, 3)
+	errors := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		received <- &StorageRequest{makeReceivedMessage(t, "Subject: test\r\n\r\nbody\r\n"), errors}
+	}
+	close(received)
+	writer.Run(received)
+
+	for i := 0; i < 3; i++ {
+		if err := <-errors; err != nil {
+			t.Errorf("unexpected error storing message %d: %s", i, err)
+		}
+	}
+	if len(store.batches) != 1 || store.batches[0] != 2 {
+		t.Errorf("expected one batch of 2 messages: %v", store.batches)
+	}
+	if count, _, _ := store.Size(); count != 3 {
+		t.Errorf("expected 3 messages in the store, found %d", count)
 	}
 }
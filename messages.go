@@ -2,12 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/mail"
+	"net/textproto"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -48,6 +56,72 @@ type ReceivedMessage struct {
 	*message
 	Parsed       *mail.Message
 	RedirectedTo []string
+	ReceivedAt   time.Time // set by the store, for use in expressions
+	Count        int       // if more than 1, the number of messages this one stands in for
+	Spooled      string    // if non-empty, the file holding the contents, instead of Data
+	ClientAddr   string    // the IP address of the client that sent the message, if known
+	AuthUser     string    // the user the client authenticated as, if any
+
+	body    *string // the text of the body, once `ReadBody()` has read it
+	bodyErr error
+}
+
+// Returns the contents of the message, reading them from its spool file if
+// they aren't held in memory.
+func (r *ReceivedMessage) Contents() []byte {
+	if r.Spooled == "" || r.Data != nil {
+		return r.Data
+	}
+	data, err := ioutil.ReadFile(r.Spooled)
+	if err != nil {
+		log.Printf("warning: couldn't read spooled message: %s", err)
+	}
+	return data
+}
+
+// Returns the size of the contents of the message in bytes, without reading
+// them from its spool file.
+func (r *ReceivedMessage) Size() int {
+	if r.Spooled == "" || r.Data != nil {
+		return len(r.Data)
+	}
+	if info, err := os.Stat(r.Spooled); err == nil {
+		return int(info.Size())
+	}
+	return 0
+}
+
+// Removes the spool file of a message that won't be stored.
+func (r *ReceivedMessage) Discard() {
+	if r.Spooled != "" {
+		os.Remove(r.Spooled)
+		r.Spooled = ""
+	}
+}
+
+// Reads the contents of a spooled message into memory, and removes its spool
+// file, e.g. so that they can be changed before storing the message.
+func (r *ReceivedMessage) Unspool() error {
+	if r.Spooled == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.Spooled)
+	if err != nil {
+		return err
+	}
+	os.Remove(r.Spooled)
+	r.Data = data
+	r.Spooled = ""
+	return nil
+}
+
+// Returns the number of received messages this message represents, which is
+// more than one for messages stored by a `Counter`.
+func (r *ReceivedMessage) Instances() int {
+	if r.Count > 1 {
+		return r.Count
+	}
+	return 1
 }
 
 func (r *ReceivedMessage) Recipients() []string {
@@ -58,13 +132,30 @@ func (r *ReceivedMessage) Recipients() []string {
 	}
 }
 
+// Returns the readable text of the message's body (see `TextBody()`). This
+// consumes the parsed body, so the text is kept for later calls.
 func (r *ReceivedMessage) ReadBody() (string, error) {
+	if r.body == nil {
+		body, err := r.readBody()
+		r.body, r.bodyErr = &body, err
+	}
+	return *r.body, r.bodyErr
+}
+
+func (r *ReceivedMessage) readBody() (string, error) {
+	if r.Spooled != "" && r.Data == nil {
+		// Only the headers of spooled messages are parsed when they're read.
+		if parsed, err := mail.ReadMessage(bytes.NewBuffer(r.Contents())); err == nil {
+			r.Parsed = parsed
+		}
+	}
+
 	if r.Parsed == nil {
 		return "[no message body]", nil
-	} else if body, err := ioutil.ReadAll(r.Parsed.Body); err != nil {
+	} else if body, err := TextBody(r.Parsed.Header, r.Parsed.Body); err != nil {
 		return "[unreadable message body]", err
 	} else {
-		return string(body), nil
+		return body, nil
 	}
 }
 
@@ -78,18 +169,99 @@ func (r *ReceivedMessage) DisplayDate(def string) string {
 
 // A `UniqueMessage` is the result of compacting similar `ReceivedMessage`s.
 type UniqueMessage struct {
-	Start    time.Time
+	Start    time.Time // the earliest and latest times of the messages, as chosen by `MessageDates`
 	End      time.Time
 	Body     string
 	Subject  string
 	Template string
 	Count    int
+	Severity string // the most severe of the messages' severities (e.g. "err"), if there's a `Severities`
+
+	// The values of the components of the group key, by name, if messages
+	// are grouped by `GroupKeys`.
+	Keys map[string]string
+
+	// The recipients the messages were originally addressed to, if they were
+	// redirected (e.g. by --rewrite-src), in the order first seen.
+	OriginalTo []string
+
+	// The ids of the messages in the store, and their Message-ID headers (for
+	// those that have them).
+	Ids        []MessageId
+	MessageIds []string
+
+	// The number of the batch's recent summaries (including this one) that
+	// this group appeared in, out of `Summaries`, if there's a `History`.
+	Seen      int
+	Summaries int
+
+	// When this group first appeared in a summary, and whether that's now,
+	// if there's a `History`.
+	FirstSeen time.Time
+	New       bool
+
+	// The number of messages in this group in the batch's previous summary,
+	// if there's a `History` and it knows of one.
+	Previous    int
+	HasPrevious bool
+
+	// The earliest and latest of the messages' Date headers, and of the
+	// times they were received, whichever `Start` and `End` are based on.
+	DateStart     time.Time
+	DateEnd       time.Time
+	ReceivedStart time.Time
+	ReceivedEnd   time.Time
+}
+
+const (
+	DATE_HEADER   = "header"
+	DATE_RECEIVED = "received"
+)
+
+// `MessageDates` chooses the time each message is considered to have been
+// sent, for the ranges in summaries. With `DATE_HEADER`, that's the message's
+// Date header, unless it's missing, or is off from the time the message was
+// received by more than `MaxSkew` (if positive), in which case it's the
+// receive time. With `DATE_RECEIVED`, it's always the receive time.
+type MessageDates struct {
+	Source  string
+	MaxSkew time.Duration
+}
+
+// Returns the time for a message. A nil `MessageDates` always uses the Date
+// header, and returns a zero time if it's missing, as does a message with no
+// receive time.
+func (d *MessageDates) Date(msg *StoredMessage) time.Time {
+	date, err := msg.Parsed.Header.Date()
+	switch {
+	case d == nil || msg.Received.IsZero():
+		return date
+	case d.Source == DATE_RECEIVED || err != nil:
+		return msg.Received
+	case d.MaxSkew > 0 && (date.Sub(msg.Received) > d.MaxSkew || msg.Received.Sub(date) > d.MaxSkew):
+		return msg.Received
+	}
+	return date
+}
+
+// Widens the range from `start` to `end` to include `t`, unless `t` is zero.
+func widen(start *time.Time, end *time.Time, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if start.IsZero() || t.Before(*start) {
+		*start = t
+	}
+	if end.IsZero() || t.After(*end) {
+		*end = t
+	}
 }
 
 // `Compact` returns a `UniqueMessage` for each distinct key among the received
 // messages, using the regular expression `sanitize` to create a representative
-// template body for the `UniqueMessage`.
-func Compact(group GroupBy, stored []*StoredMessage) ([]*UniqueMessage, error) {
+// template body for the `UniqueMessage`. The time of each message is chosen
+// by `dates`.
+func Compact(group GroupBy, stored []*StoredMessage, dates *MessageDates) ([]*UniqueMessage, error) {
 	uniques := make(map[string]*UniqueMessage)
 	result := make([]*UniqueMessage, 0)
 	for _, msg := range stored {
@@ -105,26 +277,53 @@ func Compact(group GroupBy, stored []*StoredMessage) ([]*UniqueMessage, error) {
 		}
 		unique := uniques[key]
 
+		widen(&unique.Start, &unique.End, dates.Date(msg))
 		if date, err := msg.Parsed.Header.Date(); err == nil {
-			if unique.Start.IsZero() || date.Before(unique.Start) {
-				unique.Start = date
-			}
-			if unique.End.IsZero() || date.After(unique.End) {
-				unique.End = date
-			}
+			widen(&unique.DateStart, &unique.DateEnd, date)
 		}
+		widen(&unique.ReceivedStart, &unique.ReceivedEnd, msg.Received)
 		body, err := msg.ReadBody()
 		if err != nil {
 			return result, err
 		}
 
 		unique.Body = body
-		unique.Subject = msg.Parsed.Header.Get("subject")
-		unique.Count += 1
+		unique.Subject = DecodeHeader(msg.Parsed.Header.Get("subject"))
+		unique.Count += msg.Instances()
+		unique.OriginalTo = appendOriginalTo(unique.OriginalTo, msg.ReceivedMessage)
+		unique.Ids = append(unique.Ids, msg.Id)
+		if messageId := msg.Parsed.Header.Get("Message-Id"); messageId != "" {
+			unique.MessageIds = append(unique.MessageIds, messageId)
+		}
 	}
 	return result, nil
 }
 
+// Appends the recipients a message was originally addressed to, if it was
+// redirected to others, to `originals`, skipping any already present.
+func appendOriginalTo(originals []string, msg *ReceivedMessage) []string {
+	if len(msg.RedirectedTo) == 0 {
+		return originals
+	}
+	redirected := make(map[string]bool, len(msg.RedirectedTo))
+	for _, addr := range msg.RedirectedTo {
+		redirected[addr] = true
+	}
+	for _, addr := range msg.To {
+		if redirected[addr] {
+			continue
+		}
+		found := false
+		for _, original := range originals {
+			found = found || original == addr
+		}
+		if !found {
+			originals = append(originals, addr)
+		}
+	}
+	return originals
+}
+
 // A `SummaryMessage` is the result of rolling together several
 // `UniqueMessage`s.
 type SummaryMessage struct {
@@ -132,8 +331,15 @@ type SummaryMessage struct {
 	To             []string
 	Subject        string
 	Date           time.Time
+	Key            string // the key of the batch being summarized
+	Id             string // if non-empty, identifies the summary in the audit log
 	StoredMessages []*StoredMessage
 	UniqueMessages []*UniqueMessage
+	Suppressed     int     // the number of earlier summaries held back by rate limiting
+	Silenced       int     // the number of messages received while the batch was silenced
+	Urgent         bool    // if true, the summary is marked as high priority
+	Locale         *Locale // the language of the summary's wording (nil for English)
+	TopOffenders   int     // if positive, the most groups to rank by count and by growth at the head of the summary
 }
 
 func (s *SummaryMessage) Sender() string {
@@ -153,11 +359,124 @@ func (s *SummaryMessage) Headers() string {
 func (s *SummaryMessage) writeHeaders(buf *bytes.Buffer) {
 	fmt.Fprintf(buf, "From: %s\r\n", s.From)
 	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(s.To, ", "))
-	fmt.Fprintf(buf, "Subject: %s\r\n", s.Subject)
+	fmt.Fprintf(buf, "Subject: %s\r\n", headerValue(s.Subject))
 	fmt.Fprintf(buf, "Date: %s\r\n", s.Date.Format(time.RFC822))
+	buf.WriteString(s.FailmailHeaders())
 	fmt.Fprintf(buf, "\r\n")
 }
 
+// Returns the `X-Failmail-*` headers describing the summary (and, for urgent
+// summaries, the headers that mark them as high priority), so that
+// downstream filters don't have to parse the body. Templates can include
+// them with `{{.FailmailHeaders}}`.
+func (s *SummaryMessage) FailmailHeaders() string {
+	stats := s.Stats()
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "X-Failmail-Batch-Key: %s\r\n", headerValue(s.Key))
+	fmt.Fprintf(buf, "X-Failmail-Count: %d\r\n", stats.TotalMessages)
+	fmt.Fprintf(buf, "X-Failmail-First: %s\r\n", stats.FirstMessageTime.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "X-Failmail-Last: %s\r\n", stats.LastMessageTime.Format(time.RFC1123Z))
+	if s.Id != "" {
+		fmt.Fprintf(buf, "X-Failmail-Summary-Id: %s\r\n", s.Id)
+	}
+	if s.Urgent {
+		fmt.Fprintf(buf, "X-Priority: 1\r\nImportance: high\r\n")
+	}
+	return buf.String()
+}
+
+// Marks the summary as urgent, with high priority headers and a marker at the
+// start of its subject.
+func (s *SummaryMessage) MarkUrgent() {
+	if !s.Urgent {
+		s.Urgent = true
+		s.Subject = s.Locale.Text("urgent") + s.Subject
+	}
+}
+
+// Makes a string safe to use as a header value, replacing newlines and
+// encoding it if it isn't ASCII.
+func headerValue(value string) string {
+	value = strings.Join(strings.Fields(value), " ")
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// Decodes the RFC 2047 encoded-words (e.g. `=?UTF-8?B?...?=`) in a header
+// value, so that the same text groups the same however it was encoded.
+// Values that can't be decoded are returned as they are.
+func DecodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: headerCharsetReader}
+
+// Converts encoded-words in the charsets `charsetDecoder` knows about, beyond
+// the UTF-8, US-ASCII, and ISO-8859-1 that the decoder handles itself.
+func headerCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	decode := charsetDecoder(charset)
+	if decode == nil {
+		return nil, fmt.Errorf("unhandled charset: %s", charset)
+	}
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(decode(data)), nil
+}
+
+// Returns a copy of `header` with every value decoded with `DecodeHeader`.
+func DecodeHeaders(header mail.Header) mail.Header {
+	decoded := make(mail.Header, len(header))
+	for key, values := range header {
+		decoded[key] = make([]string, len(values))
+		for i, value := range values {
+			decoded[key][i] = DecodeHeader(value)
+		}
+	}
+	return decoded
+}
+
+// `SentSummary` describes a rendered summary, as read back from its headers,
+// for upstreams that pass summaries on somewhere other than email.
+type SentSummary struct {
+	Key     string
+	Subject string
+	Count   int
+	First   time.Time
+	Last    time.Time
+	Body    string
+}
+
+// Reads the `X-Failmail-*` headers of a message. Returns nil if the message
+// isn't a summary (e.g. it was relayed without being summarized, or rendered
+// by a template without `{{.FailmailHeaders}}`).
+func ReadSentSummary(m OutgoingMessage) (*SentSummary, error) {
+	msg, err := NewHookMessage(m.Sender(), m.Recipients(), m.Contents())
+	if err != nil {
+		return nil, err
+	}
+	keys, ok := msg.Headers["X-Failmail-Batch-Key"]
+	if !ok || len(keys) == 0 {
+		return nil, nil
+	}
+
+	decode := func(value string) string {
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+			return decoded
+		}
+		return value
+	}
+	summary := &SentSummary{Key: decode(keys[0]), Subject: decode(msg.Headers.Get("Subject")), Body: msg.Body}
+	fmt.Sscanf(msg.Headers.Get("X-Failmail-Count"), "%d", &summary.Count)
+	summary.First, _ = time.Parse(time.RFC1123Z, msg.Headers.Get("X-Failmail-First"))
+	summary.Last, _ = time.Parse(time.RFC1123Z, msg.Headers.Get("X-Failmail-Last"))
+	return summary, nil
+}
+
 type SummaryStats struct {
 	TotalMessages    int
 	FirstMessageTime time.Time
@@ -189,22 +508,48 @@ func (s *SummaryMessage) Contents() []byte {
 
 	body := new(bytes.Buffer)
 	for i, unique := range s.UniqueMessages {
-		fmt.Fprintf(body, "\r\n- Message group %d of %d: %d instances\r\n", i+1, len(s.UniqueMessages), unique.Count)
-		fmt.Fprintf(body, "  From %s to %s\r\n\r\n", unique.Start.Format(time.RFC1123Z), unique.End.Format(time.RFC1123Z))
-		fmt.Fprintf(body, "Subject: %#v\r\nBody:\r\n%s\r\n", unique.Subject, unique.Body)
+		marker := ""
+		if unique.New {
+			marker = s.Locale.Text("new")
+		}
+		fmt.Fprintf(body, "\r\n- %s%s\r\n", marker, s.Locale.Plural("group", unique.Count, i+1, len(s.UniqueMessages), unique.Count))
+		fmt.Fprintf(body, "  %s\r\n", s.Locale.Text("range", unique.Start.Format(time.RFC1123Z), unique.End.Format(time.RFC1123Z)))
+		if unique.Severity != "" {
+			fmt.Fprintf(body, "  %s\r\n", s.Locale.Text("severity", unique.Severity))
+		}
+		if !unique.New && !unique.FirstSeen.IsZero() {
+			fmt.Fprintf(body, "  %s\r\n", s.Locale.Text("first-seen", unique.FirstSeen.Format(time.RFC1123Z)))
+		}
+		if unique.Seen > 1 {
+			fmt.Fprintf(body, "  %s\r\n", s.Locale.Plural("appeared", unique.Summaries, unique.Seen, unique.Summaries))
+		}
+		if len(unique.OriginalTo) > 0 {
+			fmt.Fprintf(body, "  %s\r\n", s.Locale.Text("original-to", strings.Join(unique.OriginalTo, ", ")))
+		}
+		fmt.Fprintf(body, "\r\n")
+		fmt.Fprintf(body, "%s\r\n", s.Locale.Text("message", unique.Subject, unique.Body))
 
 	}
 
 	fmt.Fprintf(buf, "--- Failmail ---\r\n")
-	fmt.Fprintf(buf, "Total messages: %d\r\nUnique messages: %d\r\n", stats.TotalMessages, len(s.UniqueMessages))
-	fmt.Fprintf(buf, "Oldest message: %s\r\nNewest message: %s\r\n", stats.FirstMessageTime.Format(time.RFC1123Z), stats.LastMessageTime.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "%s\r\n", s.Locale.Text("totals", stats.TotalMessages, len(s.UniqueMessages)))
+	fmt.Fprintf(buf, "%s\r\n", s.Locale.Text("times", stats.FirstMessageTime.Format(time.RFC1123Z), stats.LastMessageTime.Format(time.RFC1123Z)))
+	if s.Silenced > 0 {
+		fmt.Fprintf(buf, "%s\r\n", s.Locale.Plural("silenced", s.Silenced, s.Silenced))
+	}
+	if s.Suppressed > 0 {
+		fmt.Fprintf(buf, "%s\r\n", s.Locale.Plural("suppressed", s.Suppressed, s.Suppressed))
+	}
+	s.writeTopOffenders(buf)
 	fmt.Fprintf(buf, "%s", body.Bytes())
 	return buf.Bytes()
 }
 
-func Summarize(group GroupBy, from string, to string, stored []*StoredMessage) (*SummaryMessage, error) {
-	result := &SummaryMessage{}
-	uniques, err := Compact(group, stored)
+// Summarizes messages, grouping them with `group`, in the language of
+// `locale` (or in English, if it's nil).
+func Summarize(group GroupBy, from string, to string, stored []*StoredMessage, dates *MessageDates, locale *Locale) (*SummaryMessage, error) {
+	result := &SummaryMessage{Locale: locale}
+	uniques, err := Compact(group, stored, dates)
 	if err != nil {
 		return result, err
 	}
@@ -213,12 +558,17 @@ func Summarize(group GroupBy, from string, to string, stored []*StoredMessage) (
 	result.To = []string{to}
 	result.Date = nowGetter()
 
-	instances := Plural(len(stored), "instance", "instances")
+	total := 0
+	for _, msg := range stored {
+		total += msg.Instances()
+	}
+
+	instances := locale.Plural("instances", total, total)
 	if len(uniques) == 1 {
-		result.Subject = fmt.Sprintf("[failmail] %s: %s", instances, uniques[0].Subject)
+		result.Subject = locale.Text("subject", instances, uniques[0].Subject)
 	} else {
-		messages := Plural(len(uniques), "message", "messages")
-		result.Subject = fmt.Sprintf("[failmail] %s of %s", instances, messages)
+		messages := locale.Plural("messages", len(uniques), len(uniques))
+		result.Subject = locale.Text("subject.multiple", instances, messages)
 	}
 
 	result.StoredMessages = stored
@@ -227,14 +577,59 @@ func Summarize(group GroupBy, from string, to string, stored []*StoredMessage) (
 }
 
 type MessageBuffer struct {
-	SoftLimit time.Duration
-	HardLimit time.Duration
-	Batch     GroupBy // determines how messages are split into summary emails
-	Group     GroupBy // determines how messages are grouped within summary emails
-	From      string
-	Store     MessageStore
-	Renderer  SummaryRenderer
-	lastFlush time.Time
+	SoftLimit  time.Duration
+	HardLimit  time.Duration
+	Batch      GroupBy       // determines how messages are split into summary emails
+	Group      GroupBy       // determines how messages are grouped within summary emails
+	GroupKeys  *GroupKeys    // if non-nil, the composite keys that `Group` groups messages by
+	Bcc        []string      // added to the envelope recipients (but not the headers) of every summary
+	Dates      *MessageDates // determines the time of each message, for the ranges in summaries
+	Locale     *Locale       // the language of summaries' wording (nil for English)
+	From       string
+	Sender     string // if non-empty, the envelope sender of summaries, instead of `From`
+	Verp       bool   // if true, summaries' envelope senders identify their batches, ids, and recipients
+	Store      MessageStore
+	Renderer   SummaryRenderer
+	Headers    *SummaryHeaders    // if non-nil, added to every summary after it's rendered
+	Lease      *Lease             // if non-nil, only flush while holding the lease on the store
+	Hook       *Hook              // if non-nil, called on each batch before summarizing it
+	MaxPerHour int                // if positive, the most summaries to send per batch per hour
+	Silences   *Silences          // if non-nil, batch keys that shouldn't be flushed for now
+	Watchdog   *Watchdog          // if non-nil, notices when messages stop arriving
+	Heartbeat  *Heartbeat         // if non-nil, sends "all quiet" messages periodically
+	Feed       *StoreFeed         // if non-nil, the source of new messages, instead of the store
+	Workers    int                // the most batches to summarize and send at once
+	Tenants    map[string]*Tenant // settings for recipients in some domains, by domain
+	Wakeup     <-chan bool        // if non-nil, checks the store on each receive, as well as on every poll
+	MaxSize    int                // if positive, summaries larger than this many bytes are split into parts
+	RelaySize  *RelaySize         // if non-nil, summaries are also split (or truncated) to fit the relay's size limit
+	UrgentAt   int                // if positive, summaries of at least this many messages are marked urgent
+	Offenders  int                // if positive, the most groups to rank at the head of each summary
+	Severities *Severities        // if non-nil, determines the severity of each group, and sorts them by it
+	Manifest   bool               // if true, a JSON manifest of each summary is attached to it
+	History    *History           // if non-nil, notes how often each group appeared in recent summaries
+	Audit      *AuditLog          // if non-nil, records each summary sent
+	Receipts   *Receipts          // if non-nil, records which messages were in each summary sent
+	DrainFor   time.Duration      // when draining, the longest to wait for batches to come due
+	FlushTick  time.Duration      // if shorter than the poll frequency, checks for due batches this often between polls
+	Pipeline   *Pipeline          // if non-nil, reported with the buffer's stats
+	Failures   *SendFailures      // if non-nil, reported with the buffer's stats
+	Outgoing   *ChannelMonitor    // if non-nil, records how long handing summaries to the senders waits
+	MaxPoll    time.Duration      // if longer than the poll frequency, polls back off up to this long while the store is idle
+	Clock      Clock              // if non-nil, tells the time and waits instead of the system clock
+	lastFlush  time.Time
+	pollEvery  time.Duration      // the poll frequency `Run` was called with
+	idlePolls  int                // the number of polls in a row that found nothing to do
+	lastSent   time.Time          // when a summary was last sent successfully
+	lastError  error              // the error from the last failed send, if any
+	lastFail   time.Time          // when a summary last failed to send
+	scanned    map[MessageId]bool // messages found by the last scan of the store
+
+	// Only the goroutine running `Run` changes the batches and the unexported
+	// fields above. It holds `lock` while it changes the ones that `Stats()`
+	// reports, so that other goroutines (e.g. serving stats over HTTP) can
+	// look at them while it flushes.
+	lock sync.RWMutex
 	*batches
 }
 
@@ -242,6 +637,16 @@ type batches struct {
 	first    map[RecipientKey]time.Time
 	last     map[RecipientKey]time.Time
 	messages map[RecipientKey][]*StoredMessage
+
+	// For rate limiting: the times summaries were sent in the last hour, the
+	// number of summaries held back since the last one was sent, and the
+	// number of messages in the batch when it was last held back.
+	sent       map[RecipientKey][]time.Time
+	suppressed map[RecipientKey]int
+	deferred   map[RecipientKey]int
+
+	// The number of messages added to the batch while it was silenced.
+	silenced map[RecipientKey]int
 }
 
 func NewBatches() *batches {
@@ -249,6 +654,10 @@ func NewBatches() *batches {
 		make(map[RecipientKey]time.Time, 0),
 		make(map[RecipientKey]time.Time, 0),
 		make(map[RecipientKey][]*StoredMessage, 0),
+		make(map[RecipientKey][]time.Time, 0),
+		make(map[RecipientKey]int, 0),
+		make(map[RecipientKey]int, 0),
+		make(map[RecipientKey]int, 0),
 	}
 }
 
@@ -265,84 +674,347 @@ func (b *batches) Remove(key RecipientKey) {
 	delete(b.messages, key)
 	delete(b.first, key)
 	delete(b.last, key)
+	delete(b.suppressed, key)
+	delete(b.deferred, key)
+	delete(b.silenced, key)
+}
+
+// Records that a summary was sent for the batch at `now`.
+func (b *batches) recordSend(now time.Time, key RecipientKey) {
+	b.sent[key] = append(b.sent[key], now)
+}
+
+// Returns the number of summaries sent for the batch in the hour before
+// `now`, forgetting about any older sends.
+func (b *batches) sentInLastHour(now time.Time, key RecipientKey) int {
+	recent := make([]time.Time, 0, len(b.sent[key]))
+	for _, t := range b.sent[key] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(b.sent, key)
+	} else {
+		b.sent[key] = recent
+	}
+	return len(recent)
+}
+
+// Returns the settings for summarizing messages for the recipient: those for
+// the recipient's domain, if it has its own, or the buffer's.
+func (b *MessageBuffer) tenant(recipient string) *Tenant {
+	if tenant, ok := b.Tenants[AddressDomain(recipient)]; ok {
+		return tenant
+	}
+	return &Tenant{b.Batch, b.SoftLimit, b.HardLimit, b.Renderer}
 }
 
 func (b *MessageBuffer) NeedsFlush(now time.Time, key RecipientKey) bool {
-	return !(now.Sub(b.first[key]) < b.HardLimit && now.Sub(b.last[key]) < b.SoftLimit)
+	tenant := b.tenant(key.Recipient)
+	return !(now.Sub(b.first[key]) < tenant.HardLimit && now.Sub(b.last[key]) < tenant.SoftLimit)
+}
+
+// Returns the time at which the batch with the given key will be due to be
+// flushed, if no more messages arrive for it.
+func (b *MessageBuffer) NextFlush(key RecipientKey) time.Time {
+	tenant := b.tenant(key.Recipient)
+	hard := b.first[key].Add(tenant.HardLimit)
+	soft := b.last[key].Add(tenant.SoftLimit)
+	if hard.Before(soft) {
+		return hard
+	}
+	return soft
 }
 
-// Periodically calls Flush, and handles shutdown/reload requests.
-func (b *MessageBuffer) Run(pollFrequency time.Duration, outgoing chan<- *SendRequest, done <-chan TerminationRequest) {
-	tick := time.Tick(pollFrequency)
+// Returns the time, from `Clock` if it's set.
+func (b *MessageBuffer) now() time.Time {
+	return clockOr(b.Clock).Now()
+}
+
+// Periodically calls Flush, and handles shutdown/reload requests. Cancelling
+// `ctx` abandons any sends in progress, and shuts down without flushing, so
+// that unsent batches stay in the store.
+func (b *MessageBuffer) Run(ctx context.Context, pollFrequency time.Duration, outgoing chan<- *SendRequest, done <-chan TerminationRequest) {
+	b.lock.Lock()
+	b.pollEvery = pollFrequency
+	b.lock.Unlock()
+	clock := clockOr(b.Clock)
+	poll := newTicker(clock, pollFrequency)
+
+	// Without a separate flush tick, batches are only checked on each poll.
+	var flush *ticker
+	var flushTick <-chan time.Time
+	if every := b.flushEvery(); every != pollFrequency {
+		flush = newTicker(clock, every)
+		flushTick = flush.C
+	}
+
 	for {
 		select {
-		case now := <-tick:
-			err := b.Flush(now, outgoing, false)
-			if err != nil {
-				log.Printf("warning: failed to flush: %s", err)
-			}
+		case now := <-poll.C:
+			poll.Next()
+			b.poll(ctx, now, outgoing)
+			poll.Adjust(b.pollInterval())
+		case now := <-flushTick:
+			flush.Next()
+			b.tick(ctx, now, outgoing)
+		case <-b.Wakeup:
+			b.poll(ctx, b.now(), outgoing)
+			poll.Adjust(b.pollInterval())
 		case req := <-done:
-			if req == GracefulShutdown {
-				log.Printf("cleaning up")
-				err := b.Flush(nowGetter(), outgoing, true)
-				if err != nil {
-					log.Printf("warning: failed to flush: %s", err)
-				}
-				close(outgoing)
+			if req == Drain {
+				b.drain(ctx, outgoing)
+			}
+			if req == GracefulShutdown || req == Drain {
+				b.shutdown(ctx, outgoing)
 				return
 			}
+		case <-ctx.Done():
+			log.Printf("cancelled: leaving unsent batches in the store")
+			b.shutdown(ctx, outgoing)
+			return
+		}
+	}
+}
+
+// Returns how long to wait before the next poll: the poll frequency, doubled
+// for each poll in a row that found no messages (up to `MaxPoll`), so that an
+// idle buffer doesn't keep listing an empty store.
+func (b *MessageBuffer) pollInterval() time.Duration {
+	interval := b.pollEvery
+	for i := 0; i < b.idlePolls && interval < b.MaxPoll; i++ {
+		interval *= 2
+	}
+	if interval > b.MaxPoll && b.MaxPoll > b.pollEvery {
+		interval = b.MaxPoll
+	}
+	return interval
+}
+
+// Returns how often `Run` checks for due batches: every `FlushTick`, if it's
+// set and shorter than the poll frequency, or on every poll otherwise.
+func (b *MessageBuffer) flushEvery() time.Duration {
+	if b.FlushTick > 0 && b.FlushTick < b.pollEvery {
+		return b.FlushTick
+	}
+	return b.pollEvery
+}
+
+// Keeps flushing batches as they come due (respecting rate limits and
+// silences) until none are left, or until `DrainFor` has passed.
+func (b *MessageBuffer) drain(ctx context.Context, outgoing chan<- *SendRequest) {
+	log.Printf("draining: waiting up to %s for batches to be sent", b.DrainFor)
+	clock := clockOr(b.Clock)
+	deadline := clock.After(b.DrainFor)
+	tick := newTicker(clock, b.flushEvery())
+	for {
+		b.poll(ctx, b.now(), outgoing)
+		if len(b.messages) == 0 {
+			log.Printf("drained all batches")
+			return
+		}
+
+		select {
+		case <-tick.C:
+			tick.Next()
+		case <-b.Wakeup:
+		case <-deadline:
+			log.Printf("gave up draining with %s left", Plural(len(b.messages), "batch", "batches"))
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sends any batches that are left, regardless of whether they're due (unless
+// `ctx` has been cancelled), and closes `outgoing`.
+func (b *MessageBuffer) shutdown(ctx context.Context, outgoing chan<- *SendRequest) {
+	log.Printf("cleaning up")
+	if now := b.now(); ctx.Err() == nil && b.holdLease(now) {
+		err := b.Flush(ctx, now, outgoing, true)
+		if err != nil {
+			log.Printf("warning: failed to flush: %s", err)
+		}
+	}
+	if b.Lease != nil {
+		if err := b.Lease.Release(); err != nil {
+			log.Printf("warning: failed to release lease: %s", err)
 		}
 	}
+	close(outgoing)
 }
 
-func (b *MessageBuffer) Flush(now time.Time, outgoing chan<- *SendRequest, force bool) error {
+// Checks the store for new messages, and flushes any batches that are due.
+func (b *MessageBuffer) poll(ctx context.Context, now time.Time, outgoing chan<- *SendRequest) {
+	if !b.holdLease(now) {
+		return
+	}
+	if err := b.Flush(ctx, now, outgoing, false); err != nil {
+		log.Printf("warning: failed to flush: %s", err)
+	}
+}
+
+// Flushes any batches that are due, without checking the store for new
+// messages.
+func (b *MessageBuffer) tick(ctx context.Context, now time.Time, outgoing chan<- *SendRequest) {
+	if !b.holdLease(now) {
+		return
+	}
+	b.flushDue(ctx, now, outgoing, false)
+}
+
+// Returns true if this buffer should flush, i.e. if it doesn't need a lease,
+// or if it holds one. When it doesn't hold the lease, another process is
+// handling the messages in the store, so the buffer forgets about them until
+// it gets the lease back.
+func (b *MessageBuffer) holdLease(now time.Time) bool {
+	if b.Lease == nil || b.Lease.Hold(now) {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.batches = NewBatches()
+	b.Watchdog.Reset()
+	b.Heartbeat.Reset(time.Time{})
+	b.lastFlush = time.Time{}
+	return false
+}
+
+// Batches any new messages in the store, and sends the batches that are due
+// (or all of them, if `force` is set). Once `ctx` is cancelled, no more
+// batches are sent, and the ones that weren't are kept.
+func (b *MessageBuffer) Flush(ctx context.Context, now time.Time, outgoing chan<- *SendRequest, force bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.collect(now); err != nil {
+		return err
+	}
+	b.flushDue(ctx, now, outgoing, force)
+	return nil
+}
+
+// Adds messages stored since the last check of the store to their batches.
+func (b *MessageBuffer) collect(now time.Time) error {
 	// Get messages newer than the last flush.
-	stored, err := b.Store.MessagesNewerThan(b.lastFlush)
+	stored, err := b.newMessages()
 	if err != nil {
 		return err
 	}
 
-	for _, s := range stored {
-		key, err := b.Batch(s.ReceivedMessage)
-		if err != nil {
-			log.Printf("warning: error batching message with id %s: %s", s.Id, err)
-			continue
-		}
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
+	b.Heartbeat.Received(len(stored))
+	for _, s := range stored {
+		// Recipients in domains with their own settings may batch the message
+		// differently, so it's batched separately for each recipient.
 		for _, to := range s.Recipients() {
-			recipKey := RecipientKey{key, NormalizeAddress(to)}
+			recipient := NormalizeAddress(to)
+			key, err := b.tenant(recipient).Batch(s.ReceivedMessage)
+			if err != nil {
+				log.Printf("warning: error batching message with id %s: %s", s.Id, err)
+				continue
+			}
+
+			b.Watchdog.Heard(key, s.Received, []string{to})
+
+			recipKey := RecipientKey{key, recipient}
 			b.Add(recipKey, s)
+			if b.Silences.IsSilenced(key, now) {
+				b.silenced[recipKey] += 1
+			}
 		}
 	}
 
+	if len(stored) == 0 && len(b.messages) == 0 {
+		b.idlePolls += 1
+	} else {
+		b.idlePolls = 0
+	}
+	b.lastFlush = now
+	return nil
+}
+
+// Summarizes and sends the batches that are due (or all of them, if `force`
+// is set), and removes the messages that were sent from the store.
+func (b *MessageBuffer) flushDue(ctx context.Context, now time.Time, outgoing chan<- *SendRequest, force bool) {
 	toRemove := make(map[MessageId]bool, 0)
 	toKeep := make(map[MessageId]bool, 0)
 
-	// Summarize message groups that are due to be sent.
+	// Find the message groups that are due to be sent.
+	b.lock.Lock()
+	due := make([]RecipientKey, 0)
 	for key, msgs := range b.messages {
 		if force || b.NeedsFlush(now, key) {
-			summary, err := Summarize(b.Group, b.From, key.Recipient, msgs)
-			if err != nil {
-				log.Printf("warning: error summarizing messages with key %s: %s", key, err)
+			// Silenced batches are kept (in the store, too) until the silence
+			// is lifted or expires.
+			if b.Silences.IsSilenced(key.Key, now) {
+				continue
+			}
+			if !force && b.rateLimited(now, key, len(msgs)) {
+				continue
+			}
+			due = append(due, key)
+		}
+	}
+	// A message with several recipients is in several batches, which may be
+	// summarized at once, so each message's body is read here, while the
+	// lock is held, rather than by whichever batch gets to it first.
+	for _, key := range due {
+		for _, msg := range b.messages[key] {
+			msg.ReadBody()
+		}
+	}
+	b.lock.Unlock()
+
+	// Summarize and send them. Since this only reads the batches, it doesn't
+	// hold the lock, so that `Stats()` isn't held up by slow sends.
+	results := b.flushAll(ctx, due, outgoing)
+
+	b.lock.Lock()
+	for _, result := range results {
+		msgs := b.messages[result.key]
+		switch {
+		case result.dropped:
+			for _, msg := range msgs {
+				toRemove[msg.Id] = true
 			}
+			b.Remove(result.key)
+		case result.err != nil:
+			b.lastError = result.err
+			b.lastFail = now
 
-			sendErrors := make(chan error, 0)
-			outgoing <- &SendRequest{b.Renderer.Render(summary), sendErrors}
-			if err := <-sendErrors; err != nil {
-				// If we failed to send, make sure we keep the messages.
-				for _, msg := range msgs {
-					toKeep[msg.Id] = true
-				}
-			} else {
-				// If we sent successfully, get rid of the messages.
-				for _, msg := range msgs {
-					toRemove[msg.Id] = true
-				}
-				b.Remove(key)
+			// If we failed to send, make sure we keep the messages.
+			for _, msg := range msgs {
+				toKeep[msg.Id] = true
 			}
+		default:
+			b.lastSent = now
+			b.recordSend(now, result.key)
+
+			// If we sent successfully, get rid of the messages.
+			for _, msg := range msgs {
+				toRemove[msg.Id] = true
+			}
+			b.Remove(result.key)
+		}
+	}
+	b.lock.Unlock()
+
+	// Let recipients know if messages have stopped arriving.
+	for key, notification := range b.Watchdog.Check(now) {
+		if err := b.sendAndWait(ctx, outgoing, notification); err == nil {
+			b.Watchdog.Notified(key)
 		}
 	}
 
+	if heartbeat := b.Heartbeat.Check(now); heartbeat != nil {
+		b.sendAndWait(ctx, outgoing, heartbeat)
+	}
+
 	// Remove any that were summarized.
 	for id, _ := range toRemove {
 		// Skip those we explicitly need to keep.
@@ -353,9 +1025,204 @@ func (b *MessageBuffer) Flush(now time.Time, outgoing chan<- *SendRequest, force
 			log.Printf("warning: error remove message with id %s: %s", id, err)
 		}
 	}
+}
 
-	b.lastFlush = now
-	return nil
+// The outcome of summarizing and sending a batch.
+type flushed struct {
+	key     RecipientKey
+	dropped bool  // if true, a hook dropped the batch instead of summarizing it
+	err     error // the error from sending the summary, if any
+}
+
+// Summarizes and sends the batches with the given keys. The batches are
+// split among up to `Workers` goroutines, so that a slow hook or send doesn't
+// hold up the rest.
+func (b *MessageBuffer) flushAll(ctx context.Context, keys []RecipientKey, outgoing chan<- *SendRequest) []*flushed {
+	workers := b.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]*flushed, len(keys))
+	wg := new(sync.WaitGroup)
+	for shard := 0; shard < workers && shard < len(keys); shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			for i := shard; i < len(keys); i += workers {
+				results[i] = b.flushBatch(ctx, keys[i], outgoing)
+			}
+		}(shard)
+	}
+	wg.Wait()
+	return results
+}
+
+// Summarizes and sends one batch. This only reads the buffer's state, so that
+// it's safe to call for several batches at once.
+func (b *MessageBuffer) flushBatch(ctx context.Context, key RecipientKey, outgoing chan<- *SendRequest) *flushed {
+	if err := ctx.Err(); err != nil {
+		return &flushed{key: key, err: err}
+	}
+	msgs := b.messages[key]
+
+	var to []string
+	if b.Hook != nil {
+		verdict := b.Hook.ApplyBatch(key, msgs)
+		if verdict.Drop {
+			log.Printf("%s hook dropped batch with key %s", b.Hook.Name, key)
+			return &flushed{key: key, dropped: true}
+		}
+		to = verdict.To
+	}
+
+	summary, err := Summarize(b.Group, b.From, key.Recipient, msgs, b.Dates, b.Locale)
+	if err != nil {
+		log.Printf("warning: error summarizing messages with key %s: %s", key, err)
+	}
+	if len(to) > 0 {
+		summary.To = to
+	}
+	summary.Date = b.now()
+	summary.Key = key.Key
+	summary.Suppressed = b.suppressed[key]
+	summary.Silenced = b.silenced[key]
+	summary.TopOffenders = b.Offenders
+	if b.UrgentAt > 0 && summary.Stats().TotalMessages >= b.UrgentAt {
+		summary.MarkUrgent()
+	}
+	b.GroupKeys.Annotate(summary.UniqueMessages)
+	b.Severities.Annotate(b.Group, summary)
+	b.History.Annotate(key, summary.UniqueMessages)
+	if b.Audit != nil || b.Receipts != nil || b.Verp || b.Manifest {
+		summary.Id = NewSummaryId()
+	}
+	sender := b.Sender
+	if b.Verp {
+		if sender == "" {
+			sender = b.From
+		}
+		sender = VerpSender(sender, key.Key, summary.Id, key.Recipient)
+	}
+
+	// If one part of a split summary fails to send, the batch is kept, and
+	// all of its parts are sent again on the next flush.
+	renderer := b.tenant(key.Recipient).Renderer
+	if b.Manifest {
+		renderer = &ManifestRenderer{renderer}
+	}
+	parts := RenderParts(renderer, summary, b.MaxSize, b.RelaySize.MaxSummarySize())
+	for _, part := range parts {
+		if err := b.sendAndWait(ctx, outgoing, withEnvelope(b.Headers.Apply(part, summary), sender, b.Bcc)); err != nil {
+			return &flushed{key: key, err: err}
+		}
+	}
+	if err := b.Audit.Sent(summary, len(parts)); err != nil {
+		log.Printf("warning: couldn't write to audit log: %s", err)
+	}
+	if err := b.Receipts.Record(summary); err != nil {
+		log.Printf("warning: couldn't record receipt: %s", err)
+	}
+	if err := b.History.Record(key, summary.UniqueMessages); err != nil {
+		log.Printf("warning: couldn't record summary history: %s", err)
+	}
+	return &flushed{key: key}
+}
+
+// Puts `m` on `outgoing`, and waits for the result of sending it, or until
+// `ctx` is cancelled.
+func (b *MessageBuffer) sendAndWait(ctx context.Context, outgoing chan<- *SendRequest, m OutgoingMessage) error {
+	// The channel is buffered so that the sender doesn't block reporting an
+	// error that nobody's waiting for anymore.
+	sendErrors := make(chan error, 1)
+	start := time.Now()
+	select {
+	case outgoing <- &SendRequest{m, sendErrors}:
+		b.Outgoing.Sent(start)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-sendErrors:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns `m` with its envelope sender replaced by `sender` (if it's not
+// empty), and `bcc` added to its envelope recipients, leaving its headers
+// alone. Addresses in `bcc` that are already recipients are skipped.
+func withEnvelope(m OutgoingMessage, sender string, bcc []string) OutgoingMessage {
+	if sender == "" && len(bcc) == 0 {
+		return m
+	} else if sender == "" {
+		sender = m.Sender()
+	}
+	to := append([]string{}, m.Recipients()...)
+	for _, addr := range bcc {
+		found := false
+		for _, recipient := range to {
+			found = found || NormalizeAddress(recipient) == NormalizeAddress(addr)
+		}
+		if !found {
+			to = append(to, addr)
+		}
+	}
+	return &message{sender, to, m.Contents()}
+}
+
+// Returns the messages stored since the last flush. Without a feed, these are
+// found by scanning the store. With one, the store is only scanned on the
+// first flush (for messages stored before the feed started); after that, the
+// messages come from the feed.
+func (b *MessageBuffer) newMessages() ([]*StoredMessage, error) {
+	if b.Feed == nil {
+		return b.Store.MessagesNewerThan(b.lastFlush)
+	}
+
+	if b.lastFlush.IsZero() {
+		// Anything already fed is also in the store. Messages stored during
+		// the scan may be in both, so remember which ones the scan found.
+		b.Feed.Take()
+		stored, err := b.Store.MessagesNewerThan(b.lastFlush)
+		b.scanned = make(map[MessageId]bool, len(stored))
+		for _, s := range stored {
+			b.scanned[s.Id] = true
+		}
+		return stored, err
+	}
+
+	fed := b.Feed.Take()
+	result := make([]*StoredMessage, 0, len(fed))
+	for _, s := range fed {
+		if !b.scanned[s.Id] {
+			result = append(result, s)
+		}
+	}
+	b.scanned = nil
+	return result, nil
+}
+
+// Returns true if a summary for the batch with the given key shouldn't be sent
+// yet because too many have been sent in the last hour. The batch keeps its
+// messages, so they're included in the next summary that is sent, and each
+// summary held back this way is counted so that it can be noted there.
+func (b *MessageBuffer) rateLimited(now time.Time, key RecipientKey, count int) bool {
+	if b.MaxPerHour <= 0 || b.sentInLastHour(now, key) < b.MaxPerHour {
+		return false
+	}
+
+	// Only count a held-back summary if new messages have arrived since the
+	// last one, and restart the batch's timers as if it had been sent.
+	if count > b.deferred[key] {
+		log.Printf("holding back summary for %s: %s in the last hour", key, Plural(len(b.sent[key]), "summary", "summaries"))
+		b.suppressed[key] += 1
+		b.deferred[key] = count
+		b.first[key] = now
+		b.last[key] = now
+	}
+	return true
 }
 
 func NormalizeAddress(email string) string {
@@ -366,11 +1233,29 @@ func NormalizeAddress(email string) string {
 	return strings.ToLower(addr.Address)
 }
 
+// `HeaderRecipients` returns the addresses in the To and Cc headers, for use
+// as envelope recipients when a message's envelope isn't known.
+func HeaderRecipients(header mail.Header) []string {
+	result := make([]string, 0)
+	for _, name := range []string{"To", "Cc"} {
+		if addrs, err := header.AddressList(name); err == nil {
+			for _, addr := range addrs {
+				result = append(result, addr.Address)
+			}
+		}
+	}
+	return result
+}
+
 func (b *MessageBuffer) Stats() *BufferStats {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
 	uniqueMessages := 0
 	allMessages := 0
-	now := nowGetter()
+	now := b.now()
 	var lastReceived time.Time
+	batches := make([]*BatchStats, 0, len(b.messages))
 	for key, msgs := range b.messages {
 		if !b.NeedsFlush(now, key) {
 			allMessages += len(msgs)
@@ -379,8 +1264,36 @@ func (b *MessageBuffer) Stats() *BufferStats {
 		if lastReceived.Before(b.last[key]) {
 			lastReceived = b.last[key]
 		}
+		batches = append(batches, &BatchStats{
+			Key:           key.Key,
+			Recipient:     key.Recipient,
+			Messages:      len(msgs),
+			FirstReceived: b.first[key],
+			LastReceived:  b.last[key],
+			NextFlush:     b.NextFlush(key),
+		})
+	}
+	sort.Sort(byNextFlush(batches))
+
+	stats := &BufferStats{
+		ActiveBatches:  uniqueMessages,
+		ActiveMessages: allMessages,
+		LastReceived:   lastReceived,
+		LastSent:       b.lastSent,
+		LastFailed:     b.lastFail,
+		Pipeline:       b.Pipeline.Stats(),
+		RelaySize:      b.RelaySize.Stats(),
+		SendFailures:   b.Failures.Stats(),
+		PollEvery:      b.pollInterval().String(),
+		FlushEvery:     b.flushEvery().String(),
+		WaitPeriod:     b.SoftLimit.String(),
+		MaxWait:        b.HardLimit.String(),
+		Batches:        batches,
 	}
-	return &BufferStats{uniqueMessages, allMessages, lastReceived}
+	if b.lastError != nil {
+		stats.LastSendError = b.lastError.Error()
+	}
+	return stats
 }
 
 type RecipientKey struct {
@@ -392,8 +1305,36 @@ type BufferStats struct {
 	ActiveBatches  int
 	ActiveMessages int
 	LastReceived   time.Time
+	LastSent       time.Time // when a summary was last sent successfully
+	LastFailed     time.Time // when a summary last failed to send
+	LastSendError  string    // the error from the last failed send
+	PollEvery      string    // how often the store is checked for new messages (for now, if backing off)
+	FlushEvery     string    // how often batches are checked to see if they're due
+	WaitPeriod     string    // how long a batch waits for more messages
+	MaxWait        string    // the longest a batch waits after its first message
+	Pipeline       *PipelineStats
+	RelaySize      *RelaySizeStats
+	SendFailures   *SendFailures
+	Batches        []*BatchStats
 }
 
+// `BatchStats` describes a single batch of messages waiting to be summarized.
+type BatchStats struct {
+	Key           string
+	Recipient     string
+	Messages      int
+	FirstReceived time.Time
+	LastReceived  time.Time
+	NextFlush     time.Time // when the batch is due to be summarized
+}
+
+// Sorts `BatchStats` so that the batches due soonest come first.
+type byNextFlush []*BatchStats
+
+func (b byNextFlush) Len() int           { return len(b) }
+func (b byNextFlush) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byNextFlush) Less(i, j int) bool { return b[i].NextFlush.Before(b[j].NextFlush) }
+
 func Plural(count int, singular string, plural string) string {
 	var word string
 	if count == 1 {
@@ -416,6 +1357,61 @@ func DefaultFromAddress(name string) string {
 
 type GroupBy func(*ReceivedMessage) (string, error)
 
+// `GroupContext` is what `GroupByExpr` templates are evaluated against: the
+// parsed message (so `.Header` and `.Body` work as before, though header
+// values are decoded), along with the envelope and details of how the message was received.
+type GroupContext struct {
+	*mail.Message
+	Header     mail.Header // the message's header, with encoded-words decoded
+	From       string
+	To         []string
+	Received   time.Time
+	ClientAddr string
+	AuthUser   string
+}
+
+func NewGroupContext(r *ReceivedMessage) *GroupContext {
+	group := &GroupContext{r.Parsed, nil, r.Sender(), r.Recipients(), r.ReceivedAt, r.ClientAddr, r.AuthUser}
+	if r.Parsed != nil {
+		group.Header = DecodeHeaders(r.Parsed.Header)
+	}
+	return group
+}
+
+// Returns true if the message has the header `name`, even if it's empty.
+func (c *GroupContext) Has(name string) bool {
+	if c.Message == nil {
+		return false
+	}
+	_, ok := c.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	return ok
+}
+
+// Returns the capture group `group` (a name, or a number, with 0 being the
+// whole match) of the leftmost match of the regular expression `pat` in
+// `text`, or "" if there's no match or the group didn't participate in it.
+func MatchGroup(pat string, text string, group string) (string, error) {
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return "", err
+	}
+
+	index := re.SubexpIndex(group)
+	if index < 0 {
+		if n, err := strconv.Atoi(group); err == nil && n >= 0 && n <= re.NumSubexp() {
+			index = n
+		} else {
+			return "", fmt.Errorf("%#v has no capture group %#v", pat, group)
+		}
+	}
+
+	match := re.FindStringSubmatch(text)
+	if match == nil {
+		return "", nil
+	}
+	return match[index], nil
+}
+
 func GroupByExpr(name string, expr string) GroupBy {
 	funcMap := make(map[string]interface{})
 	funcMap["match"] = func(pat string, text string) (string, error) {
@@ -426,12 +1422,18 @@ func GroupByExpr(name string, expr string) GroupBy {
 		re, err := regexp.Compile(pat)
 		return re.ReplaceAllString(text, sub), err
 	}
+	funcMap["matchGroup"] = func(pat string, text string, group interface{}) (string, error) {
+		return MatchGroup(pat, text, fmt.Sprint(group))
+	}
+	for name, normalizer := range NORMALIZERS {
+		funcMap[name] = normalizer
+	}
 
 	tmpl := template.Must(template.New(name).Funcs(funcMap).Parse(expr))
 
 	return func(r *ReceivedMessage) (string, error) {
 		buf := new(bytes.Buffer)
-		err := tmpl.Execute(buf, r.Parsed)
+		err := tmpl.Execute(buf, NewGroupContext(r))
 		return buf.String(), err
 	}
 }
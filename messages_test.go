@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net/mail"
 	"reflect"
+	"strings"
 	"testing"
 	"text/template"
 	"time"
@@ -20,8 +23,8 @@ func TestReceivedMessageReadBody(t *testing.T) {
 	if body, err := msg.ReadBody(); body != "test body\r\n" || err != nil {
 		t.Errorf("unexpected message body: %s, %s", body, err)
 	}
-	if body, err := msg.ReadBody(); body != "" || err != nil {
-		t.Errorf("unexpected message body on 2nd call: %s, %s", body, err)
+	if body, err := msg.ReadBody(); body != "test body\r\n" || err != nil {
+		t.Errorf("expected the same message body on 2nd call: %s, %s", body, err)
 	}
 }
 
@@ -73,7 +76,7 @@ func TestReceivedMessageOutgoing(t *testing.T) {
 func TestCompact(t *testing.T) {
 	msg1 := makeReceivedMessage(t, "From: test@example.com\r\nTo: test2@example.com\r\nDate: Tue, 01 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest body 1\r\n")
 	msg2 := makeReceivedMessage(t, "From: test@example.com\r\nTo: test2@example.com\r\nDate: Wed, 02 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest body 2\r\n")
-	uniques, err := Compact(GroupByExpr("batch", `{{.Header.Get "Subject"}}`), makeStoredMessages(msg1, msg2))
+	uniques, err := Compact(GroupByExpr("batch", `{{.Header.Get "Subject"}}`), makeStoredMessages(msg1, msg2), nil)
 	if err != nil {
 		t.Errorf("unexpected error in Compact(): %s", err)
 	} else if count := len(uniques); count != 1 {
@@ -98,12 +101,76 @@ func TestCompact(t *testing.T) {
 	}
 }
 
+func TestMessageDates(t *testing.T) {
+	received := time.Date(2014, 7, 1, 16, 40, 0, 0, time.UTC)
+	dated := &StoredMessage{0, received, makeReceivedMessage(t, "Date: Tue, 01 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest\r\n")}
+	skewed := &StoredMessage{1, received, makeReceivedMessage(t, "Date: Tue, 01 Jul 2003 12:34:56 -0400\r\nSubject: test\r\n\r\ntest\r\n")}
+	undated := &StoredMessage{2, received, makeReceivedMessage(t, "Subject: test\r\n\r\ntest\r\n")}
+	header, _ := dated.Parsed.Header.Date()
+	skewedHeader, _ := skewed.Parsed.Header.Date()
+
+	tests := []struct {
+		Dates    *MessageDates
+		Message  *StoredMessage
+		Expected time.Time
+	}{
+		{nil, dated, header},
+		{nil, undated, time.Time{}},
+		{&MessageDates{DATE_HEADER, 0}, skewed, skewedHeader},
+		{&MessageDates{DATE_HEADER, 0}, undated, received},
+		{&MessageDates{DATE_HEADER, time.Hour}, dated, header},
+		{&MessageDates{DATE_HEADER, time.Hour}, skewed, received},
+		{&MessageDates{DATE_RECEIVED, 0}, dated, received},
+	}
+	for i, test := range tests {
+		if date := test.Dates.Date(test.Message); !date.Equal(test.Expected) {
+			t.Errorf("test %d: expected %s, got %s", i, test.Expected, date)
+		}
+	}
+}
+
+func TestCompactMIME(t *testing.T) {
+	msg := makeReceivedMessage(t, "Subject: test\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\ndGVzdCBib2R5\r\n--b\r\nContent-Type: text/html\r\n\r\n<p>test body</p>\r\n--b--\r\n")
+	uniques, err := Compact(GroupByExpr("batch", `{{.Header.Get "Subject"}}`), makeStoredMessages(msg), nil)
+	if err != nil || len(uniques) != 1 {
+		t.Fatalf("expected one unique message from Compact(), got %d (%v)", len(uniques), err)
+	}
+	if body := uniques[0].Body; body != "test body" {
+		t.Errorf("expected the decoded text part as the body: %#v", body)
+	}
+}
+
+func TestCompactDates(t *testing.T) {
+	received := time.Date(2014, 7, 1, 16, 40, 0, 0, time.UTC)
+	stored := []*StoredMessage{
+		&StoredMessage{0, received, makeReceivedMessage(t, "Date: Tue, 01 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest\r\n")},
+		&StoredMessage{1, received.Add(time.Minute), makeReceivedMessage(t, "Date: Tue, 01 Jul 2003 12:34:56 -0400\r\nSubject: test\r\n\r\ntest\r\n")},
+	}
+	uniques, err := Compact(GroupByExpr("batch", `{{.Header.Get "Subject"}}`), stored, &MessageDates{DATE_HEADER, time.Hour})
+	if err != nil || len(uniques) != 1 {
+		t.Fatalf("expected one unique message from Compact(), got %d (%v)", len(uniques), err)
+	}
+
+	unique := uniques[0]
+	if start := unique.Start.Format(time.RFC1123Z); start != "Tue, 01 Jul 2014 12:34:56 -0400" {
+		t.Errorf("unexpected range start from Compact(): %s", start)
+	} else if !unique.End.Equal(received.Add(time.Minute)) {
+		t.Errorf("expected the skewed Date header to be replaced, got %s", unique.End)
+	}
+	if start := unique.DateStart.Format(time.RFC1123Z); start != "Tue, 01 Jul 2003 12:34:56 -0400" {
+		t.Errorf("expected the Date header range to include the skewed date, got %s", start)
+	}
+	if !unique.ReceivedStart.Equal(received) || !unique.ReceivedEnd.Equal(received.Add(time.Minute)) {
+		t.Errorf("unexpected receive time range: %s to %s", unique.ReceivedStart, unique.ReceivedEnd)
+	}
+}
+
 func TestSummarize(t *testing.T) {
 	defer patchTime(time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC))()
 	msg1 := makeReceivedMessage(t, "From: test@example.com\r\nTo: test2@example.com\r\nDate: Tue, 01 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest body 1\r\n")
 	msg2 := makeReceivedMessage(t, "From: test@example.com\r\nTo: test3@example.com\r\nDate: Wed, 02 Jul 2014 12:34:56 -0400\r\nSubject: test 2\r\n\r\ntest body 2\r\n")
 
-	summarized, err := Summarize(GroupByExpr("group", `{{.Header.Get "Subject"}}`), "failmail@example.com", "test2@example.com", makeStoredMessages(msg1, msg2))
+	summarized, err := Summarize(GroupByExpr("group", `{{.Header.Get "Subject"}}`), "failmail@example.com", "test2@example.com", makeStoredMessages(msg1, msg2), nil, nil)
 
 	if err != nil {
 		t.Errorf("unexpected error in Summarize(): %s", err)
@@ -116,11 +183,50 @@ func TestSummarize(t *testing.T) {
 	if summarized.Subject != "[failmail] 2 instances of 2 messages" {
 		t.Errorf("unexpected subject from Summarize(): %s", summarized.Subject)
 	}
-	if headers := summarized.Headers(); headers != "From: failmail@example.com\r\nTo: test2@example.com\r\nSubject: [failmail] 2 instances of 2 messages\r\nDate: 01 Mar 14 00:00 UTC\r\n\r\n" {
+	if headers := summarized.Headers(); headers != "From: failmail@example.com\r\nTo: test2@example.com\r\nSubject: [failmail] 2 instances of 2 messages\r\nDate: 01 Mar 14 00:00 UTC\r\nX-Failmail-Batch-Key: \r\nX-Failmail-Count: 2\r\nX-Failmail-First: Tue, 01 Jul 2014 12:34:56 -0400\r\nX-Failmail-Last: Wed, 02 Jul 2014 12:34:56 -0400\r\n\r\n" {
 		t.Errorf("unexpected headers from Summarize(): %s", headers)
 	}
 }
 
+func TestCompactEncodedSubjects(t *testing.T) {
+	msg1 := makeReceivedMessage(t, "Subject: =?UTF-8?B?ZMOpasOgIHZ1?=\r\n\r\ntest\r\n")
+	msg2 := makeReceivedMessage(t, "Subject: =?utf-8?q?d=C3=A9j=C3=A0_vu?=\r\n\r\ntest\r\n")
+	msg3 := makeReceivedMessage(t, "Subject: =?windows-1252?q?d=E9j=E0_vu?=\r\n\r\ntest\r\n")
+	uniques, err := Compact(GroupByExpr("batch", `{{.Header.Get "Subject"}}`), makeStoredMessages(msg1, msg2, msg3), nil)
+	if err != nil || len(uniques) != 1 {
+		t.Fatalf("expected one unique message from Compact(), got %d (%v)", len(uniques), err)
+	}
+	if unique := uniques[0]; unique.Subject != "déjà vu" || unique.Count != 3 {
+		t.Errorf("unexpected subject or count from Compact(): %#v, %d", unique.Subject, unique.Count)
+	}
+
+	sjis := makeReceivedMessage(t, "Subject: =?Shift_JIS?B?g2aDQoNYg04=?=\r\n\r\ntest\r\n")
+	uniques, err = Compact(GroupByExpr("batch", `{{.Header.Get "Subject"}}`), makeStoredMessages(sjis), nil)
+	if err != nil || len(uniques) != 1 || uniques[0].Subject != "ディスク" {
+		t.Errorf("expected a Shift_JIS subject to be decoded: %#v (%v)", uniques, err)
+	}
+}
+
+func TestSummaryEncodedSubject(t *testing.T) {
+	defer patchTime(time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC))()
+	msg := makeReceivedMessage(t, "Date: Tue, 01 Jul 2014 12:34:56 -0400\r\nSubject: =?UTF-8?B?ZMOpasOgIHZ1?=\r\n\r\ntest\r\n")
+	summarized, err := Summarize(GroupByExpr("group", `{{.Header.Get "Subject"}}`), "failmail@example.com", "test2@example.com", makeStoredMessages(msg), nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error in Summarize(): %s", err)
+	}
+	if summarized.Subject != "[failmail] 1 instance: déjà vu" {
+		t.Errorf("unexpected subject from Summarize(): %s", summarized.Subject)
+	}
+
+	header := "Subject: =?utf-8?q?[failmail]_1_instance:_d=C3=A9j=C3=A0_vu?=\r\n"
+	if headers := summarized.Headers(); !strings.Contains(headers, header) {
+		t.Errorf("expected an encoded subject in the headers: %s", headers)
+	}
+	if sent, err := ReadSentSummary(summarized); err != nil || sent.Subject != summarized.Subject {
+		t.Errorf("expected the subject to be decoded when read back: %#v (%v)", sent, err)
+	}
+}
+
 func makeMessageBuffer() *MessageBuffer {
 	return &MessageBuffer{
 		SoftLimit: 5 * time.Second,
@@ -150,7 +256,7 @@ func TestMessageBuffer(t *testing.T) {
 		}
 	}()
 
-	buf.Flush(nowGetter(), outgoing, false)
+	buf.Flush(context.Background(), nowGetter(), outgoing, false)
 	if count := len(summaries); count != 0 {
 		t.Errorf("unexpected summaries from flush: %d != 0", count)
 	} else if count := buf.Stats().ActiveBatches; count != 1 {
@@ -160,7 +266,7 @@ func TestMessageBuffer(t *testing.T) {
 
 	unpatch = patchTime(time.Unix(1393650005, 0))
 	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest 2"))
-	buf.Flush(nowGetter(), outgoing, false)
+	buf.Flush(context.Background(), nowGetter(), outgoing, false)
 	if count := len(summaries); count != 0 {
 		t.Errorf("unexpected summaries from flush: %d != 0", count)
 	} else if count := buf.Stats().ActiveBatches; count != 1 {
@@ -171,14 +277,14 @@ func TestMessageBuffer(t *testing.T) {
 	unpatch()
 
 	unpatch = patchTime(time.Unix(1393650008, 0))
-	buf.Flush(nowGetter(), outgoing, false)
+	buf.Flush(context.Background(), nowGetter(), outgoing, false)
 	if count := len(summaries); count != 0 {
 		t.Errorf("unexpected summaries from flush: %d != 0", count)
 	}
 	unpatch()
 
 	unpatch = patchTime(time.Unix(1393650009, 0))
-	buf.Flush(nowGetter(), outgoing, false)
+	buf.Flush(context.Background(), nowGetter(), outgoing, false)
 	if count := len(summaries); count != 1 {
 		t.Errorf("unexpected summaries from flush: %d != 1", count)
 	}
@@ -222,7 +328,7 @@ func TestFlushForce(t *testing.T) {
 	unpatch := patchTime(time.Unix(1393650000, 0))
 	defer unpatch()
 	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest 1"))
-	buf.Flush(nowGetter(), outgoing, false)
+	buf.Flush(context.Background(), nowGetter(), outgoing, false)
 	if count := len(summaries); count != 0 {
 		t.Errorf("unexpected summaries from flush: %d != 0", count)
 	} else if count := buf.Stats().ActiveBatches; count != 1 {
@@ -231,18 +337,219 @@ func TestFlushForce(t *testing.T) {
 	unpatch()
 
 	unpatch = patchTime(time.Unix(1393650004, 0))
-	buf.Flush(nowGetter(), outgoing, false)
+	buf.Flush(context.Background(), nowGetter(), outgoing, false)
 	if count := len(summaries); count != 0 {
 		t.Errorf("unexpected summaries from flush: %d != 0", count)
 	}
 
-	buf.Flush(nowGetter(), outgoing, true)
+	buf.Flush(context.Background(), nowGetter(), outgoing, true)
 	if count := len(summaries); count != 1 {
 		t.Errorf("unexpected summaries from flush: %d != 1", count)
 	}
 	unpatch()
 }
 
+func TestFlushWorkers(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Workers = 3
+	outgoing := make(chan *SendRequest, 64)
+
+	// Only answer once all three summaries are waiting to be sent, which
+	// can't happen unless they're sent at once.
+	go func() {
+		reqs := make([]*SendRequest, 0)
+		for req := range outgoing {
+			reqs = append(reqs, req)
+			if len(reqs) == 3 {
+				for _, req := range reqs {
+					req.SendErrors <- nil
+				}
+			}
+		}
+	}()
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	for _, subject := range []string{"one", "two", "three"} {
+		buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: "+subject+"\r\n\r\ntest"))
+	}
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- buf.Flush(context.Background(), nowGetter(), outgoing, true) }()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Errorf("unexpected error from flush: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the summaries to be sent at once")
+	}
+
+	if count := buf.Stats().ActiveBatches; count != 0 {
+		t.Errorf("expected all batches to be flushed: %d", count)
+	}
+}
+
+// Run with -race: batches for each of a message's recipients share the
+// message, and are summarized at once.
+func TestFlushWorkersSharedMessage(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Workers = 4
+	outgoing := make(chan *SendRequest, 64)
+
+	received := make(chan *SummaryMessage, 4)
+	go func() {
+		for req := range outgoing {
+			received <- req.Message.(*SummaryMessage)
+			req.SendErrors <- nil
+		}
+	}()
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	recipients := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}
+	msg := makeReceivedMessage(t, "To: "+strings.Join(recipients, ", ")+"\r\nSubject: test\r\n\r\nshared body")
+	msg.To = recipients
+	buf.Store.Add(nowGetter(), msg)
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, true); err != nil {
+		t.Fatalf("unexpected error from flush: %s", err)
+	}
+
+	if count := len(received); count != len(recipients) {
+		t.Fatalf("unexpected summaries from flush: %d != %d", count, len(recipients))
+	}
+	for range recipients {
+		summary := <-received
+		if body := summary.UniqueMessages[0].Body; body != "shared body" {
+			t.Errorf("unexpected body in summary to %s: %#v", summary.To, body)
+		}
+	}
+}
+
+func TestFlushRateLimited(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.MaxPerHour = 1
+	outgoing := make(chan *SendRequest, 64)
+
+	summaries := make([]*SummaryMessage, 0)
+	go func() {
+		for req := range outgoing {
+			summaries = append(summaries, req.Message.(*SummaryMessage))
+			req.SendErrors <- nil
+		}
+	}()
+
+	at := func(offset int64) time.Time { return time.Unix(1393650000+offset, 0) }
+	add := func(offset int64) {
+		buf.Store.Add(at(offset), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	}
+
+	add(0)
+	buf.Flush(context.Background(), at(5), outgoing, false)
+	if count := len(summaries); count != 1 {
+		t.Fatalf("unexpected summaries from flush: %d != 1", count)
+	}
+
+	add(10)
+	buf.Flush(context.Background(), at(15), outgoing, false)
+	buf.Flush(context.Background(), at(20), outgoing, false)
+	add(25)
+	buf.Flush(context.Background(), at(30), outgoing, false)
+	if count := len(summaries); count != 1 {
+		t.Fatalf("expected summaries to be held back: %d != 1", count)
+	}
+
+	buf.Flush(context.Background(), at(3606), outgoing, false)
+	if count := len(summaries); count != 2 {
+		t.Fatalf("expected a summary after the rate limit window: %d != 2", count)
+	}
+	summary := summaries[1]
+	if count := len(summary.StoredMessages); count != 2 {
+		t.Errorf("expected held back messages in the summary: %d != 2", count)
+	}
+	if summary.Suppressed != 2 {
+		t.Errorf("unexpected suppressed summary count: %d", summary.Suppressed)
+	}
+	if !strings.Contains(string(summary.Contents()), "Suppressed 2 additional summaries") {
+		t.Errorf("expected a note about suppressed summaries: %s", summary.Contents())
+	}
+}
+
+func TestMessageBufferStats(t *testing.T) {
+	buf := makeMessageBuffer()
+	outgoing := make(chan *SendRequest, 64)
+
+	sendErrors := make(chan error, 2)
+	sendErrors <- fmt.Errorf("send failed")
+	sendErrors <- nil
+	go func() {
+		for req := range outgoing {
+			req.SendErrors <- <-sendErrors
+		}
+	}()
+
+	unpatch := patchTime(time.Unix(1393650000, 0))
+	defer unpatch()
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest 1"))
+	buf.Flush(context.Background(), nowGetter(), outgoing, false)
+
+	stats := buf.Stats()
+	if count := len(stats.Batches); count != 1 {
+		t.Fatalf("unexpected batch stats count: %d", count)
+	}
+	batch := stats.Batches[0]
+	if batch.Key != "test" || batch.Recipient != "test@example.com" || batch.Messages != 1 {
+		t.Errorf("unexpected batch stats: %#v", batch)
+	}
+	if next := batch.NextFlush; !next.Equal(time.Unix(1393650005, 0)) {
+		t.Errorf("unexpected next flush time: %s", next)
+	}
+
+	buf.Flush(context.Background(), nowGetter(), outgoing, true)
+	stats = buf.Stats()
+	if stats.LastSendError != "send failed" || !stats.LastFailed.Equal(nowGetter()) || !stats.LastSent.IsZero() {
+		t.Errorf("unexpected stats after a failed send: %#v", stats)
+	}
+
+	buf.Flush(context.Background(), nowGetter(), outgoing, true)
+	stats = buf.Stats()
+	if !stats.LastSent.Equal(nowGetter()) || len(stats.Batches) != 0 {
+		t.Errorf("unexpected stats after a successful send: %#v", stats)
+	}
+}
+
+// Stats are served over HTTP while the buffer flushes, so this is mostly
+// useful with -race.
+func TestMessageBufferStatsWhileFlushing(t *testing.T) {
+	buf := makeMessageBuffer()
+	outgoing := make(chan *SendRequest, 64)
+	go func() {
+		for req := range outgoing {
+			req.SendErrors <- nil
+		}
+	}()
+	defer close(outgoing)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			buf.Store.Add(nowGetter(), makeReceivedMessage(t, fmt.Sprintf("To: test@example.com\r\nSubject: test %d\r\n\r\ntest", i%5)))
+			buf.Flush(context.Background(), nowGetter(), outgoing, i%10 == 0)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			if stats := buf.Stats(); stats.ActiveBatches != 5 {
+				t.Errorf("unexpected stats after flushing: %#v", stats)
+			}
+			return
+		default:
+			buf.Stats()
+		}
+	}
+}
+
 func TestDefaultFromAddress(t *testing.T) {
 	defer patchHost("example.com", nil)()
 
@@ -290,7 +597,7 @@ func TestTemplateRenderer(t *testing.T) {
 	msg1 := makeReceivedMessage(t, "From: test@example.com\r\nTo: test2@example.com\r\nDate: Tue, 01 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest body 1\r\n")
 	msg2 := makeReceivedMessage(t, "From: test@example.com\r\nTo: test3@example.com\r\nDate: Wed, 02 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest body 2\r\n")
 
-	summarized, err := Summarize(GroupByExpr("group", `{{.Header.Get "Subject"}}`), "failmail@example.com", "test2@example.com", makeStoredMessages(msg1, msg2))
+	summarized, err := Summarize(GroupByExpr("group", `{{.Header.Get "Subject"}}`), "failmail@example.com", "test2@example.com", makeStoredMessages(msg1, msg2), nil, nil)
 	if err != nil {
 		t.Errorf("unexpected error in Summarize(): %s", err)
 	}
@@ -310,3 +617,364 @@ func makeStoredMessages(msgs ...*ReceivedMessage) []*StoredMessage {
 	}
 	return stored
 }
+
+func TestGroupByExprEnvelope(t *testing.T) {
+	msg := makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest\r\n")
+	msg.From = "app@example.com"
+	msg.AuthUser = "billing-svc"
+	msg.ClientAddr = "10.0.0.1"
+
+	batch := GroupByExpr("batch", `{{.AuthUser}}/{{.ClientAddr}}/{{.From}}/{{index .To 0}}/{{.Header.Get "Subject"}}`)
+	if key, err := batch(msg); err != nil {
+		t.Errorf("unexpected error from GroupByExpr: %s", err)
+	} else if key != "billing-svc/10.0.0.1/app@example.com/test@example.com/test" {
+		t.Errorf("unexpected key from GroupByExpr: %#v", key)
+	}
+}
+
+func TestSummarizeOriginalTo(t *testing.T) {
+	msg1 := makeReceivedMessage(t, "Subject: test\r\n\r\ntest 1")
+	msg1.To = []string{"alice@example.com", "qa@example.com"}
+	msg1.RedirectedTo = []string{"qa@example.com"}
+	msg2 := makeReceivedMessage(t, "Subject: test\r\n\r\ntest 2")
+	msg2.To = []string{"bob@example.com", "alice@example.com"}
+	msg2.RedirectedTo = []string{"qa@example.com"}
+	msg3 := makeReceivedMessage(t, "Subject: other\r\n\r\ntest 3")
+	msg3.To = []string{"qa@example.com"}
+
+	summary, err := Summarize(GroupByExpr("group", `{{.Header.Get "Subject"}}`), "failmail@example.com", "qa@example.com", makeStoredMessages(msg1, msg2, msg3), nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Summarize(): %s", err)
+	}
+	if originals := summary.UniqueMessages[0].OriginalTo; !reflect.DeepEqual(originals, []string{"alice@example.com", "bob@example.com"}) {
+		t.Errorf("unexpected original recipients %v", originals)
+	}
+	if originals := summary.UniqueMessages[1].OriginalTo; len(originals) != 0 {
+		t.Errorf("expected no original recipients for messages that weren't redirected, got %v", originals)
+	}
+
+	contents := string(summary.Contents())
+	if !strings.Contains(contents, "  Originally addressed to alice@example.com, bob@example.com\r\n") {
+		t.Errorf("expected the original recipients in the summary:\n%s", contents)
+	} else if strings.Count(contents, "Originally addressed to") != 1 {
+		t.Errorf("expected the original recipients only for redirected messages:\n%s", contents)
+	}
+}
+
+func TestGroupByExprMatchGroup(t *testing.T) {
+	msg := makeReceivedMessage(t, "Subject: disk full on host=db3.example.com (93%)\r\n\r\ntest\r\n")
+
+	cases := map[string]string{
+		`{{matchGroup "host=(?P<host>[\\w.]+)" (.Header.Get "Subject") "host"}}`: "db3.example.com",
+		`{{matchGroup "host=(\\w+)\\.(\\w+)" (.Header.Get "Subject") 2}}`:        "example",
+		`{{matchGroup "host=(\\w+)" (.Header.Get "Subject") 0}}`:                 "host=db3",
+		`{{matchGroup "port=(\\d+)" (.Header.Get "Subject") 1}}`:                 "",
+	}
+	for expr, expected := range cases {
+		if key, err := GroupByExpr("batch", expr)(msg); err != nil {
+			t.Errorf("unexpected error from %s: %s", expr, err)
+		} else if key != expected {
+			t.Errorf("expected %s to be %#v, got %#v", expr, expected, key)
+		}
+	}
+
+	if _, err := GroupByExpr("batch", `{{matchGroup "host=(\\w+)" (.Header.Get "Subject") "name"}}`)(msg); err == nil {
+		t.Errorf("expected an error for a capture group that doesn't exist")
+	}
+	if key, err := GroupByScript("batch", "matchGroup(`host=(?P<host>\\w+)`, subject, \"host\")")(msg); err != nil || key != "db3" {
+		t.Errorf("unexpected result from matchGroup expression: %#v, %v", key, err)
+	}
+}
+
+func TestFailmailHeaders(t *testing.T) {
+	defer patchTime(time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC))()
+	msg := makeReceivedMessage(t, "From: test@example.com\r\nTo: test2@example.com\r\nDate: Tue, 01 Jul 2014 12:34:56 -0400\r\nSubject: test\r\n\r\ntest body\r\n")
+	msg.Count = 3
+
+	summarized, err := Summarize(GroupByExpr("group", `{{.Header.Get "Subject"}}`), "failmail@example.com", "test2@example.com", makeStoredMessages(msg), nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error in Summarize(): %s", err)
+	}
+	summarized.Key = "caf\u00e9\r\nerrors"
+
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(summarized.Contents()))
+	if err != nil {
+		t.Fatalf("unexpected error parsing summary: %s", err)
+	}
+	expected := map[string]string{
+		"X-Failmail-Batch-Key": "=?utf-8?q?caf=C3=A9_errors?=",
+		"X-Failmail-Count":     "3",
+		"X-Failmail-First":     "Tue, 01 Jul 2014 12:34:56 -0400",
+		"X-Failmail-Last":      "Tue, 01 Jul 2014 12:34:56 -0400",
+	}
+	for name, value := range expected {
+		if actual := parsed.Header.Get(name); actual != value {
+			t.Errorf("unexpected %s header: %#v != %#v", name, actual, value)
+		}
+	}
+}
+
+func TestMessageBufferWakeup(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.SoftLimit = 0
+	wakeup := make(chan bool, 1)
+	buf.Wakeup = wakeup
+
+	outgoing := make(chan *SendRequest, 1)
+	done := make(chan TerminationRequest, 1)
+	go buf.Run(context.Background(), time.Hour, outgoing, done)
+
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	wakeup <- true
+
+	select {
+	case req := <-outgoing:
+		req.SendErrors <- nil
+	case <-time.After(time.Second):
+		t.Fatalf("expected a summary to be sent without waiting for a poll")
+	}
+	done <- GracefulShutdown
+}
+
+func TestMessageBufferDrain(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.SoftLimit = 50 * time.Millisecond
+	buf.DrainFor = time.Minute
+
+	outgoing := make(chan *SendRequest, 1)
+	done := make(chan TerminationRequest, 1)
+	received := time.Now()
+	buf.Store.Add(received, makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	go buf.Run(context.Background(), 10*time.Millisecond, outgoing, done)
+	done <- Drain
+
+	select {
+	case req := <-outgoing:
+		if elapsed := time.Since(received); elapsed < buf.SoftLimit {
+			t.Errorf("expected the batch to be sent when due, not after %s", elapsed)
+		}
+		req.SendErrors <- nil
+	case <-time.After(time.Second):
+		t.Fatalf("expected a summary to be sent while draining")
+	}
+	select {
+	case _, ok := <-outgoing:
+		if ok {
+			t.Errorf("expected no more summaries after draining")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the buffer to finish once drained")
+	}
+}
+
+func TestMessageBufferDrainTimeout(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.SoftLimit = time.Hour
+	buf.HardLimit = time.Hour
+	buf.DrainFor = 20 * time.Millisecond
+
+	outgoing := make(chan *SendRequest, 1)
+	done := make(chan TerminationRequest, 1)
+	buf.Store.Add(time.Now(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	go buf.Run(context.Background(), 10*time.Millisecond, outgoing, done)
+	done <- Drain
+
+	select {
+	case req := <-outgoing:
+		req.SendErrors <- nil
+	case <-time.After(time.Second):
+		t.Fatalf("expected the summary to be sent once draining timed out")
+	}
+	select {
+	case _, ok := <-outgoing:
+		if ok {
+			t.Errorf("expected no more summaries after draining")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the buffer to finish after draining timed out")
+	}
+}
+
+func TestMessageBufferAdaptivePoll(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.pollEvery = time.Minute
+	buf.MaxPoll = 5 * time.Minute
+	outgoing := make(chan *SendRequest, 1)
+
+	expected := []time.Duration{2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, interval := range expected {
+		buf.Flush(context.Background(), nowGetter(), outgoing, false)
+		if actual := buf.pollInterval(); actual != interval {
+			t.Errorf("expected to wait %s after %d idle polls, got %s", interval, i+1, actual)
+		}
+	}
+
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	buf.Flush(context.Background(), nowGetter(), outgoing, false)
+	if actual := buf.pollInterval(); actual != time.Minute {
+		t.Errorf("expected to poll every minute again once messages arrived, got %s", actual)
+	}
+
+	buf.MaxPoll = 0
+	buf.idlePolls = 10
+	if actual := buf.pollInterval(); actual != time.Minute {
+		t.Errorf("expected not to back off without a maximum, got %s", actual)
+	}
+}
+
+func TestMessageBufferCancelled(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.SoftLimit = 0
+	wakeup := make(chan bool, 1)
+	buf.Wakeup = wakeup
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outgoing := make(chan *SendRequest, 1)
+	done := make(chan TerminationRequest, 1)
+	go buf.Run(ctx, time.Hour, outgoing, done)
+
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	wakeup <- true
+
+	// The send never finishes, so the buffer only stops waiting for it (and
+	// shuts down) once it's cancelled.
+	select {
+	case <-outgoing:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a summary to be sent")
+	}
+	cancel()
+
+	select {
+	case _, ok := <-outgoing:
+		if ok {
+			t.Errorf("expected no more summaries once cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the buffer to finish once cancelled")
+	}
+	if msgs, _ := buf.Store.MessagesNewerThan(time.Time{}); len(msgs) != 1 {
+		t.Errorf("expected the unsent message to be kept in the store, got %d", len(msgs))
+	}
+}
+
+func TestFlushBcc(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Bcc = []string{"archive@example.com", "Test@example.com"}
+	outgoing := make(chan *SendRequest, 64)
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+
+	sent := make(chan OutgoingMessage, 1)
+	go func() {
+		for req := range outgoing {
+			sent <- req.Message
+			req.SendErrors <- nil
+		}
+	}()
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, true); err != nil {
+		t.Errorf("unexpected error from flush: %s", err)
+	}
+	close(outgoing)
+
+	msg := <-sent
+	if to := msg.Recipients(); !reflect.DeepEqual(to, []string{"test@example.com", "archive@example.com"}) {
+		t.Errorf("expected the archive recipient to be added to the envelope once, got %v", to)
+	}
+	parsed, _ := mail.ReadMessage(bytes.NewBuffer(msg.Contents()))
+	if to := parsed.Header.Get("To"); to != "test@example.com" {
+		t.Errorf("expected the archive recipient not to be in the headers, got %#v", to)
+	}
+	if bcc := parsed.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("expected no Bcc header, got %#v", bcc)
+	}
+}
+
+func TestFlushEnvelopeSender(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Sender = "bounces@example.com"
+	outgoing := make(chan *SendRequest, 64)
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+
+	sent := make(chan OutgoingMessage, 1)
+	go func() {
+		for req := range outgoing {
+			sent <- req.Message
+			req.SendErrors <- nil
+		}
+	}()
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, true); err != nil {
+		t.Errorf("unexpected error from flush: %s", err)
+	}
+	close(outgoing)
+
+	msg := <-sent
+	if from := msg.Sender(); from != "bounces@example.com" {
+		t.Errorf("expected the envelope sender to be bounces@example.com, got %s", from)
+	}
+	parsed, _ := mail.ReadMessage(bytes.NewBuffer(msg.Contents()))
+	if from := parsed.Header.Get("From"); from != "test@example.com" {
+		t.Errorf("expected the From header to be unchanged, got %#v", from)
+	}
+	if to := msg.Recipients(); !reflect.DeepEqual(to, []string{"test@example.com"}) {
+		t.Errorf("expected the envelope recipients to be unchanged, got %v", to)
+	}
+}
+
+func TestFlushMarksUrgent(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.UrgentAt = 3
+	outgoing := make(chan *SendRequest, 64)
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	for i := 0; i < 3; i++ {
+		buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: big\r\n\r\ntest"))
+	}
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: small\r\n\r\ntest"))
+
+	subjects := make(chan map[string]string, 1)
+	go func() {
+		result := make(map[string]string, 0)
+		for req := range outgoing {
+			parsed, _ := mail.ReadMessage(bytes.NewBuffer(req.Message.Contents()))
+			result[parsed.Header.Get("Subject")] = parsed.Header.Get("Importance") + "/" + parsed.Header.Get("X-Priority")
+			req.SendErrors <- nil
+		}
+		subjects <- result
+	}()
+
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, true); err != nil {
+		t.Errorf("unexpected error from flush: %s", err)
+	}
+	close(outgoing)
+
+	expected := map[string]string{
+		"[URGENT] [failmail] 3 instances: big": "high/1",
+		"[failmail] 1 instance: small":         "/",
+	}
+	if result := <-subjects; !reflect.DeepEqual(result, expected) {
+		t.Errorf("unexpected summaries: %#v", result)
+	}
+}
+
+func TestReadSentSummary(t *testing.T) {
+	summary := makeSummaryMessage(t, "Subject: error in db\r\nDate: Sat, 01 Mar 2014 05:00:00 +0000\r\n\r\ntimeout\r\n")
+	summary.Key = "db ✓"
+	sent, err := ReadSentSummary(summary)
+	if err != nil {
+		t.Fatalf("unexpected error reading summary: %s", err)
+	}
+	if sent.Key != "db ✓" || sent.Subject != "test" || sent.Count != 1 || !strings.Contains(sent.Body, "timeout") {
+		t.Errorf("unexpected summary: %#v", sent)
+	} else if !sent.First.Equal(time.Date(2014, 3, 1, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected first message time: %s", sent.First)
+	}
+
+	relayed := &message{"test@example.com", []string{"ops@example.com"}, []byte("Subject: relayed\r\n\r\nbody\r\n")}
+	if sent, err := ReadSentSummary(relayed); err != nil || sent != nil {
+		t.Errorf("expected nothing for a message that isn't a summary, got %#v, %s", sent, err)
+	}
+}
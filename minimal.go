@@ -0,0 +1,65 @@
+//go:build minimal
+// +build minimal
+
+// Minimal builds, for tiny embedded deployments, leave out everything that
+// talks HTTP: the HTTP server (with its stats and APIs), `--submit-api`, URL
+// hooks, and the upstreams and alerts that call webhooks (`--issue-tracker`,
+// `--chat-webhook`, `--publish-to`, and `--alert-webhook`). Build them with
+// `go build -tags minimal`. Giving any of the options for those features is
+// an error (see `Config.CheckBuild()`).
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Set in minimal builds.
+const MINIMAL = true
+
+// Returned by the stubs for features left out of minimal builds.
+var ErrNotIncluded = errors.New("not included in minimal builds")
+
+// `HTTPServer` stands in for the HTTP server, which doesn't serve anything in
+// minimal builds.
+type HTTPServer struct {
+	Bind string
+	Fd   uintptr
+}
+
+func NewHTTPServer(bind string) *HTTPServer {
+	return &HTTPServer{Bind: bind}
+}
+
+func (s *HTTPServer) Handle(pattern string, handler interface{}) {
+}
+
+func (s *HTTPServer) HandleBuffer(buffer *MessageBuffer) {
+}
+
+func (s *HTTPServer) Serves() bool {
+	return false
+}
+
+// Returns right away, since there's nothing to serve.
+func (s *HTTPServer) Listen(done <-chan TerminationRequest, timeout time.Duration) (uintptr, error) {
+	log.Printf("the HTTP server is %s", ErrNotIncluded)
+	return 0, nil
+}
+
+func (c *Config) integrationUpstreams(upstream Upstream) (Upstream, error) {
+	return upstream, nil
+}
+
+func (a *WebhookAlerter) Alert(failed OutgoingMessage, sendErr error) error {
+	return ErrNotIncluded
+}
+
+func (h *Hook) post(input []byte) ([]byte, error) {
+	return nil, ErrNotIncluded
+}
+
+func checkHTTP(addr string) error {
+	return ErrNotIncluded
+}
@@ -0,0 +1,50 @@
+//go:build minimal
+// +build minimal
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckBuildMinimal(t *testing.T) {
+	if err := Defaults().CheckBuild(); err != nil {
+		t.Errorf("unexpected error checking the defaults: %s", err)
+	}
+
+	config := Defaults()
+	config.PreSendHook = "./check-summary"
+	if err := config.CheckBuild(); err != nil {
+		t.Errorf("unexpected error checking a command hook: %s", err)
+	}
+
+	config.PreSendHook = "http://localhost:8080/check"
+	if err := config.CheckBuild(); err == nil {
+		t.Errorf("expected an error for a URL hook")
+	}
+
+	config = Defaults()
+	config.SubmitApi = true
+	if err := config.CheckBuild(); err == nil {
+		t.Errorf("expected an error for --submit-api")
+	}
+
+	config = Defaults()
+	config.ChatWebhook = "https://chat.example.com/hook"
+	if err := config.CheckBuild(); err == nil {
+		t.Errorf("expected an error for --chat-webhook")
+	}
+}
+
+func TestHTTPServerMinimal(t *testing.T) {
+	server := NewHTTPServer("localhost:10050")
+	server.Handle("/api/read-only", NewReadOnly(false))
+	if server.Serves() {
+		t.Errorf("expected the HTTP server to have nothing to serve")
+	}
+	done := make(chan TerminationRequest, 1)
+	if fd, err := server.Listen(done, time.Second); err != nil || fd != 0 {
+		t.Errorf("expected the HTTP server to return right away, got %d, %s", fd, err)
+	}
+}
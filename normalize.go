@@ -0,0 +1,88 @@
+// Normalizers for grouping messages whose subjects differ only in the details
+// that change from one occurrence of a problem to the next, such as job
+// numbers, UUIDs, commit hashes, and timestamps. They're available as
+// functions in `--batch-expr` and `--group-expr` (as templates or as
+// expressions), so that e.g. `{{normalize (.Header.Get "Subject")}}` groups
+// "job 1234 failed" and "job 9876 failed" together.
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The placeholders that normalized text is replaced with.
+const (
+	NORMALIZED_NUMBER = "N"
+	NORMALIZED_UUID   = "UUID"
+	NORMALIZED_HASH   = "HASH"
+	NORMALIZED_TIME   = "TIME"
+)
+
+var (
+	// Dates and times, like "2014-03-01", "2014-03-01T12:34:56Z",
+	// "2014/03/01 12:34:56.789 +0000", or "12:34:56".
+	timestampPattern = regexp.MustCompile(`\b\d{4}[-/]\d{2}[-/]\d{2}(?:[T ]\d{1,2}:\d{2}(?::\d{2}(?:[.,]\d+)?)?(?:Z|\s?[+-]\d{2}:?\d{2})?)?\b|\b\d{1,2}:\d{2}:\d{2}(?:[.,]\d+)?\b`)
+
+	uuidPattern = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+
+	// Hex numbers prefixed with 0x, and runs of at least seven hex digits
+	// (the length of an abbreviated git hash). Unprefixed runs are only
+	// hashes if they have both digits and letters, so that words like
+	// "defaced" are left alone, and long numbers are left to `StripNumbers`.
+	hashPattern = regexp.MustCompile(`(?i)\b(?:0x[0-9a-f]+|[0-9a-f]{7,})\b`)
+
+	numberPattern = regexp.MustCompile(`\d+(?:\.\d+)*`)
+)
+
+// Replaces dates and times with `NORMALIZED_TIME`.
+func StripTimestamps(text string) string {
+	return timestampPattern.ReplaceAllString(text, NORMALIZED_TIME)
+}
+
+// Replaces UUIDs with `NORMALIZED_UUID`.
+func StripUUIDs(text string) string {
+	return uuidPattern.ReplaceAllString(text, NORMALIZED_UUID)
+}
+
+// Replaces hex hashes and addresses with `NORMALIZED_HASH`.
+func StripHashes(text string) string {
+	return hashPattern.ReplaceAllStringFunc(text, func(hash string) string {
+		lower := strings.ToLower(hash)
+		if strings.HasPrefix(lower, "0x") || (strings.ContainsAny(lower, "0123456789") && strings.ContainsAny(lower, "abcdef")) {
+			return NORMALIZED_HASH
+		}
+		return hash
+	})
+}
+
+// Replaces numbers (including dotted ones, like version numbers and IP
+// addresses) with `NORMALIZED_NUMBER`.
+func StripNumbers(text string) string {
+	return numberPattern.ReplaceAllString(text, NORMALIZED_NUMBER)
+}
+
+// Applies all of the normalizers, from the most specific to the least, so
+// that e.g. the digits of a UUID aren't replaced as numbers first.
+func Normalize(text string) string {
+	return StripNumbers(StripHashes(StripUUIDs(StripTimestamps(text))))
+}
+
+// The normalizers, by the name of the function that calls them in batch and
+// group expressions.
+var NORMALIZERS = map[string]func(string) string{
+	"normalize":       Normalize,
+	"stripNumbers":    StripNumbers,
+	"stripUUIDs":      StripUUIDs,
+	"stripHashes":     StripHashes,
+	"stripTimestamps": StripTimestamps,
+}
+
+func init() {
+	for name, normalizer := range NORMALIZERS {
+		normalizer := normalizer
+		exprFunctions[name] = exprStringFunc(1, func(args []string) (interface{}, error) {
+			return normalizer(args[0]), nil
+		})
+	}
+}
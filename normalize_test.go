@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := map[string]string{
+		"job 1234 failed": "job N failed",
+		"job 9876 failed": "job N failed",
+		"request 123e4567-e89b-12d3-a456-426614174000 failed":   "request UUID failed",
+		"build of a1b2c3d broke":                                "build of HASH broke",
+		"segfault at 0x7fff":                                    "segfault at HASH",
+		"decaffed cafe is defaced":                              "decaffed cafe is defaced",
+		"backup at 2014-03-01T12:34:56Z failed":                 "backup at TIME failed",
+		"backup at 2014/03/01 12:34:56.789 +0000 failed":        "backup at TIME failed",
+		"cron 03:00:00 took 5s":                                 "cron TIME took Ns",
+		"disk 93% full on 10.0.0.12 (v1.2.3)":                   "disk N% full on N (vN)",
+		"user 42 saw 123e4567-e89b-12d3-a456-426614174000 at 1": "user N saw UUID at N",
+	}
+	for text, expected := range cases {
+		if actual := Normalize(text); actual != expected {
+			t.Errorf("expected Normalize(%#v) to be %#v, got %#v", text, expected, actual)
+		}
+	}
+
+	if actual := StripNumbers("job 1234 at 12:00:00"); actual != "job N at N:N:N" {
+		t.Errorf("unexpected result from StripNumbers(): %#v", actual)
+	}
+	if actual := StripTimestamps("job 1234 at 12:00:00"); actual != "job 1234 at TIME" {
+		t.Errorf("unexpected result from StripTimestamps(): %#v", actual)
+	}
+}
+
+func TestNormalizeInExpressions(t *testing.T) {
+	msg := makeReceivedMessage(t, "Subject: job 1234 failed on a1b2c3d\r\n\r\ntest")
+
+	key, err := GroupByExpr("group", `{{normalize (.Header.Get "Subject")}}`)(msg)
+	if err != nil || key != "job N failed on HASH" {
+		t.Errorf("unexpected result from normalize template: %#v, %v", key, err)
+	}
+
+	key, err = GroupByExpr("group", `{{stripNumbers (.Header.Get "Subject")}}`)(msg)
+	if err != nil || key != "job N failed on aNbNcNd" {
+		t.Errorf("unexpected result from stripNumbers template: %#v, %v", key, err)
+	}
+
+	if key, err := GroupByScript("group", `normalize(subject)`)(msg); err != nil || key != "job N failed on HASH" {
+		t.Errorf("unexpected result from normalize expression: %#v, %v", key, err)
+	}
+}
@@ -0,0 +1,78 @@
+// Top offenders, so that readers of a long summary see the worst problems
+// first. With `--top-offenders`, the head of each summary ranks its groups
+// by how many messages they have, and (with `--history`) by how much they've
+// grown since the batch's previous summary.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Returns how many more messages the group has than it had in the batch's
+// previous summary (which is all of them, if it wasn't in that summary).
+func (u *UniqueMessage) Growth() int {
+	return u.Count - u.Previous
+}
+
+// Returns the summary's `TopOffenders` groups with the most messages, most
+// first. There are none if the summary has fewer than two groups, since
+// there's nothing to rank.
+func (s *SummaryMessage) TopByCount() []*UniqueMessage {
+	return s.top(func(u *UniqueMessage) bool { return true }, func(u *UniqueMessage) int { return u.Count })
+}
+
+// Returns the summary's `TopOffenders` groups that grew the most since the
+// batch's previous summary, most first. Groups that didn't grow aren't
+// included, and there are none if there's no previous summary to compare
+// with.
+func (s *SummaryMessage) TopByGrowth() []*UniqueMessage {
+	return s.top(func(u *UniqueMessage) bool { return u.HasPrevious && u.Growth() > 0 }, (*UniqueMessage).Growth)
+}
+
+func (s *SummaryMessage) top(include func(*UniqueMessage) bool, rank func(*UniqueMessage) int) []*UniqueMessage {
+	if s.TopOffenders <= 0 || len(s.UniqueMessages) < 2 {
+		return nil
+	}
+
+	top := make([]*UniqueMessage, 0, len(s.UniqueMessages))
+	for _, unique := range s.UniqueMessages {
+		if include(unique) {
+			top = append(top, unique)
+		}
+	}
+	// Ties keep the order of the groups in the summary.
+	sort.SliceStable(top, func(i, j int) bool { return rank(top[i]) > rank(top[j]) })
+	if len(top) > s.TopOffenders {
+		top = top[:s.TopOffenders]
+	}
+	return top
+}
+
+// Writes the top offenders sections of the built-in summary format,
+// referring to each group by its number in the summary.
+func (s *SummaryMessage) writeTopOffenders(buf *bytes.Buffer) {
+	byCount, byGrowth := s.TopByCount(), s.TopByGrowth()
+	if len(byCount) == 0 {
+		return
+	}
+
+	numbers := make(map[*UniqueMessage]int, len(s.UniqueMessages))
+	for i, unique := range s.UniqueMessages {
+		numbers[unique] = i + 1
+	}
+
+	fmt.Fprintf(buf, "\r\n%s\r\n", s.Locale.Text("top-count"))
+	for i, unique := range byCount {
+		instances := s.Locale.Plural("instances", unique.Count, unique.Count)
+		fmt.Fprintf(buf, "  %s\r\n", s.Locale.Text("top-entry", i+1, instances, unique.Subject, numbers[unique]))
+	}
+	if len(byGrowth) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "\r\n%s\r\n", s.Locale.Text("top-growth"))
+	for i, unique := range byGrowth {
+		fmt.Fprintf(buf, "  %s\r\n", s.Locale.Text("top-growth-entry", i+1, unique.Growth(), unique.Previous, unique.Count, unique.Subject, numbers[unique]))
+	}
+}
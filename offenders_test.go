@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func makeOffendersSummary(t *testing.T) *SummaryMessage {
+	summary := makeSummaryMessage(t,
+		"To: test@example.com\r\nSubject: one\r\n\r\nbody\r\n",
+		"To: test@example.com\r\nSubject: two\r\n\r\nbody\r\n",
+		"To: test@example.com\r\nSubject: three\r\n\r\nbody\r\n",
+	)
+	for i, count := range []int{2, 10, 5} {
+		summary.UniqueMessages[i].Count = count
+	}
+	summary.TopOffenders = 2
+	return summary
+}
+
+func subjects(uniques []*UniqueMessage) string {
+	names := make([]string, 0, len(uniques))
+	for _, unique := range uniques {
+		names = append(names, unique.Subject)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestTopByCount(t *testing.T) {
+	summary := makeOffendersSummary(t)
+	if top := subjects(summary.TopByCount()); top != "two,three" {
+		t.Errorf("unexpected top offenders by count: %s", top)
+	}
+
+	summary.TopOffenders = 0
+	if top := summary.TopByCount(); len(top) != 0 {
+		t.Errorf("expected no top offenders when disabled: %s", subjects(top))
+	}
+
+	summary.TopOffenders = 2
+	summary.UniqueMessages = summary.UniqueMessages[:1]
+	if top := summary.TopByCount(); len(top) != 0 {
+		t.Errorf("expected no top offenders with one group: %s", subjects(top))
+	}
+}
+
+func TestTopByGrowth(t *testing.T) {
+	summary := makeOffendersSummary(t)
+	if top := summary.TopByGrowth(); len(top) != 0 {
+		t.Errorf("expected no growth without a previous summary: %s", subjects(top))
+	}
+
+	for i, previous := range []int{1, 12, 0} {
+		summary.UniqueMessages[i].Previous = previous
+		summary.UniqueMessages[i].HasPrevious = true
+	}
+	if top := subjects(summary.TopByGrowth()); top != "three,one" {
+		t.Errorf("unexpected top offenders by growth: %s", top)
+	}
+}
+
+func TestSummaryShowsTopOffenders(t *testing.T) {
+	summary := makeOffendersSummary(t)
+	for i, previous := range []int{0, 12, 1} {
+		summary.UniqueMessages[i].Previous = previous
+		summary.UniqueMessages[i].HasPrevious = true
+	}
+
+	contents := string(summary.Contents())
+	expected := "\r\nMost frequent:\r\n" +
+		"  1. 10 instances: \"two\" (group 2)\r\n" +
+		"  2. 5 instances: \"three\" (group 3)\r\n" +
+		"\r\nFastest growing since the last summary:\r\n" +
+		"  1. +4 (from 1 to 5): \"three\" (group 3)\r\n" +
+		"  2. +2 (from 0 to 2): \"one\" (group 1)\r\n"
+	if !strings.Contains(contents, expected) {
+		t.Errorf("expected the summary to rank its top offenders: %s", contents)
+	}
+	if strings.Index(contents, "Most frequent:") > strings.Index(contents, "Message group 1 of 3") {
+		t.Errorf("expected the top offenders before the groups: %s", contents)
+	}
+
+	summary.TopOffenders = 0
+	if contents := string(summary.Contents()); strings.Contains(contents, "Most frequent:") {
+		t.Errorf("expected no top offenders when disabled: %s", contents)
+	}
+}
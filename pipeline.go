@@ -0,0 +1,110 @@
+// Backpressure metrics for the channels between failmail's goroutines. The
+// listener hands messages to the writer on one channel, and the buffer hands
+// summaries to the senders on another. When a consumer falls behind, its
+// channel fills up and the producer blocks, so the channels' depths and how
+// long sends on them wait show capacity problems before they delay messages.
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// `Pipeline` watches the channels between goroutines, by name.
+type Pipeline struct {
+	channels []*ChannelMonitor
+	lock     sync.Mutex
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{channels: make([]*ChannelMonitor, 0)}
+}
+
+// Starts watching a channel. `size` returns its length and capacity, e.g.
+// `func() (int, int) { return len(ch), cap(ch) }`.
+func (p *Pipeline) Watch(name string, size func() (int, int)) *ChannelMonitor {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	monitor := &ChannelMonitor{Name: name, size: size}
+	p.channels = append(p.channels, monitor)
+	return monitor
+}
+
+// Returns the number of goroutines and the state of each watched channel, or
+// nil if there's no pipeline.
+func (p *Pipeline) Stats() *PipelineStats {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats := &PipelineStats{
+		Goroutines: runtime.NumGoroutine(),
+		Channels:   make([]*ChannelStats, 0, len(p.channels)),
+	}
+	for _, monitor := range p.channels {
+		stats.Channels = append(stats.Channels, monitor.Stats())
+	}
+	return stats
+}
+
+// `ChannelMonitor` records how long sends on a channel wait for room. A nil
+// monitor records nothing.
+type ChannelMonitor struct {
+	Name       string
+	size       func() (int, int)
+	sends      int
+	blocked    time.Duration
+	maxBlocked time.Duration
+	lock       sync.Mutex
+}
+
+// Records a send on the channel that started at `start` (from `time.Now()`),
+// and finished now.
+func (m *ChannelMonitor) Sent(start time.Time) {
+	if m == nil {
+		return
+	}
+	waited := time.Since(start)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sends += 1
+	m.blocked += waited
+	if waited > m.maxBlocked {
+		m.maxBlocked = waited
+	}
+}
+
+func (m *ChannelMonitor) Stats() *ChannelStats {
+	depth, capacity := m.size()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return &ChannelStats{
+		Name:       m.Name,
+		Depth:      depth,
+		Capacity:   capacity,
+		Sends:      m.sends,
+		Blocked:    m.blocked.String(),
+		MaxBlocked: m.maxBlocked.String(),
+	}
+}
+
+// `PipelineStats` describes the goroutines and channels of a pipeline.
+type PipelineStats struct {
+	Goroutines int
+	Channels   []*ChannelStats
+}
+
+// `ChannelStats` describes how backed up a channel is.
+type ChannelStats struct {
+	Name       string
+	Depth      int    // the number of values waiting in the channel
+	Capacity   int    // the most values the channel holds before sends block
+	Sends      int    // the number of sends recorded
+	Blocked    string // the total time sends waited for room in the channel
+	MaxBlocked string // the longest a send waited
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	pipeline := NewPipeline()
+	ch := make(chan int, 4)
+	monitor := pipeline.Watch("test", func() (int, int) { return len(ch), cap(ch) })
+
+	ch <- 1
+	ch <- 2
+	monitor.Sent(time.Now().Add(-time.Second))
+	monitor.Sent(time.Now().Add(-3 * time.Second))
+
+	stats := pipeline.Stats()
+	if stats.Goroutines < 1 || len(stats.Channels) != 1 {
+		t.Fatalf("unexpected pipeline stats: %#v", stats)
+	}
+	channel := stats.Channels[0]
+	if channel.Name != "test" || channel.Depth != 2 || channel.Capacity != 4 || channel.Sends != 2 {
+		t.Errorf("unexpected channel stats: %#v", channel)
+	}
+	if blocked, _ := time.ParseDuration(channel.Blocked); blocked < 4*time.Second {
+		t.Errorf("expected the time sends were blocked to add up, got %s", channel.Blocked)
+	}
+	if blocked, _ := time.ParseDuration(channel.MaxBlocked); blocked < 3*time.Second || blocked >= 4*time.Second {
+		t.Errorf("expected the longest send to be recorded, got %s", channel.MaxBlocked)
+	}
+
+	var none *Pipeline
+	if none.Watch("test", nil) != nil || none.Stats() != nil {
+		t.Errorf("expected no pipeline to watch nothing")
+	}
+	none.Watch("test", nil).Sent(time.Now())
+}
+
+func TestMessageBufferPipelineStats(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Pipeline = NewPipeline()
+	outgoing := make(chan *SendRequest, 1)
+	buf.Outgoing = buf.Pipeline.Watch("outgoing", func() (int, int) { return len(outgoing), cap(outgoing) })
+
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	go func() {
+		req := <-outgoing
+		req.SendErrors <- nil
+	}()
+	buf.Flush(context.Background(), nowGetter(), outgoing, true)
+
+	stats := buf.Stats().Pipeline
+	if stats == nil || len(stats.Channels) != 1 || stats.Channels[0].Sends != 1 {
+		t.Errorf("expected the buffer's stats to include sends on the outgoing channel: %#v", stats)
+	}
+}
@@ -0,0 +1,268 @@
+//go:build !minimal
+// +build !minimal
+
+// Publishing summaries for machine consumers. Alongside sending each summary
+// by email, failmail can publish it as JSON to an Amazon SQS queue or a Kafka
+// topic, so that data pipelines can consume error aggregates without parsing
+// email. failmail talks to both over plain HTTP(S): to SQS via its query API,
+// and to Kafka via a Kafka REST Proxy.
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PUBLISH_SQS   = "sqs"
+	PUBLISH_KAFKA = "kafka"
+)
+
+// `Publisher` is the interface that wraps the method to publish a JSON
+// payload, with a key that consumers can partition or group by.
+type Publisher interface {
+	Publish(key string, payload []byte) error
+}
+
+// `PublishedSummary` is the JSON published for each summary.
+type PublishedSummary struct {
+	Type    string // always "summary"
+	Key     string
+	From    string
+	To      []string
+	Subject string
+	Count   int
+	First   time.Time
+	Last    time.Time
+	Body    string
+}
+
+// `PublishedMessage` is the JSON published for each message relayed without
+// being summarized, with `--publish-raw`.
+type PublishedMessage struct {
+	Type string // always "message"
+	*HookMessage
+}
+
+// `PublishUpstream` passes each message to another `Upstream`, then publishes
+// each summary it sent (and, if `Raw` is set, each other message it sent).
+type PublishUpstream struct {
+	Publisher Publisher
+	Raw       bool
+	Upstream  Upstream
+}
+
+func (u *PublishUpstream) Send(m OutgoingMessage) error {
+	return u.SendContext(context.Background(), m)
+}
+
+func (u *PublishUpstream) SendContext(ctx context.Context, m OutgoingMessage) error {
+	if err := sendContext(ctx, u.Upstream, m); err != nil {
+		return err
+	}
+
+	// As with issue trackers, failing the send here would only send the
+	// summary again.
+	if err := u.publish(m); err != nil {
+		log.Printf("warning: couldn't publish message: %s", err)
+	}
+	return nil
+}
+
+func (u *PublishUpstream) publish(m OutgoingMessage) error {
+	summary, err := ReadSentSummary(m)
+	if err != nil {
+		return err
+	}
+
+	var key string
+	var payload interface{}
+	if summary != nil {
+		key = summary.Key
+		payload = &PublishedSummary{"summary", summary.Key, m.Sender(), m.Recipients(), summary.Subject, summary.Count, summary.First, summary.Last, summary.Body}
+	} else if u.Raw {
+		msg, err := NewHookMessage(m.Sender(), m.Recipients(), m.Contents())
+		if err != nil {
+			return err
+		}
+		payload = &PublishedMessage{"message", msg}
+	} else {
+		return nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return u.Publisher.Publish(key, data)
+}
+
+// `KafkaPublisher` publishes to a Kafka topic via a Kafka REST Proxy (v2 API).
+type KafkaPublisher struct {
+	URL     string // the topic's URL, e.g. http://localhost:8082/topics/failmail
+	Timeout time.Duration
+}
+
+func (p *KafkaPublisher) Publish(key string, payload []byte) error {
+	records := map[string]interface{}{
+		"records": []map[string]interface{}{{"key": key, "value": json.RawMessage(payload)}},
+	}
+	req, err := http.NewRequest("POST", p.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	return callJSON(req, p.Timeout, records, nil)
+}
+
+// `SQSPublisher` sends messages to an Amazon SQS queue, signing its requests
+// with AWS Signature Version 4.
+type SQSPublisher struct {
+	QueueURL     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Timeout      time.Duration
+}
+
+// Returns an `SQSPublisher` for the queue, using AWS credentials from the
+// environment. The region comes from `AWS_REGION` if it's set, or else from
+// the queue's URL (e.g. https://sqs.us-east-1.amazonaws.com/123456789012/q).
+func NewSQSPublisher(queueURL string, timeout time.Duration) (*SQSPublisher, error) {
+	parsed, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, err
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if parts := strings.Split(parsed.Hostname(), "."); region == "" && len(parts) > 2 && parts[0] == "sqs" {
+		region = parts[1]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("can't tell the region of SQS queue %s (set AWS_REGION)", queueURL)
+	}
+
+	publisher := &SQSPublisher{
+		QueueURL:     queueURL,
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Timeout:      timeout,
+	}
+	if publisher.AccessKey == "" || publisher.SecretKey == "" {
+		return nil, fmt.Errorf("publishing to SQS requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return publisher, nil
+}
+
+func (p *SQSPublisher) Publish(key string, payload []byte) error {
+	form := url.Values{"Action": {"SendMessage"}, "Version": {"2012-11-05"}, "MessageBody": {string(payload)}}
+	if strings.HasSuffix(p.QueueURL, ".fifo") {
+		// FIFO queues keep the summaries of each batch in order.
+		if key == "" {
+			key = "failmail"
+		}
+		form.Set("MessageGroupId", key)
+		form.Set("MessageDeduplicationId", sha256Hex(payload))
+	}
+	body := form.Encode()
+
+	req, err := http.NewRequest("POST", p.QueueURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.SessionToken)
+	}
+	SignAWSv4(req, []byte(body), "sqs", p.Region, p.AccessKey, p.SecretKey, nowGetter())
+
+	client := &http.Client{Timeout: p.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("SQS returned unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Signs a request with AWS Signature Version 4, setting its `X-Amz-Date` and
+// `Authorization` headers. The host, the `Content-Type`, and any `X-Amz-*`
+// headers are signed.
+func SignAWSv4(req *http.Request, body []byte, service string, region string, accessKey string, secretKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name, _ := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonical))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,146 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type TestPublisher struct {
+	Keys     []string
+	Payloads []map[string]interface{}
+}
+
+func (p *TestPublisher) Publish(key string, payload []byte) error {
+	decoded := make(map[string]interface{}, 0)
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return err
+	}
+	p.Keys = append(p.Keys, key)
+	p.Payloads = append(p.Payloads, decoded)
+	return nil
+}
+
+func TestPublishUpstream(t *testing.T) {
+	publisher := new(TestPublisher)
+	relay := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	upstream := &PublishUpstream{publisher, false, relay}
+
+	summary := makeSummaryMessage(t, "Subject: error in db\r\n\r\ntimeout\r\n")
+	summary.Key = "db"
+	msg := &message{"test@example.com", []string{"ops@example.com"}, []byte("Subject: relayed\r\n\r\nbody\r\n")}
+	for _, m := range []OutgoingMessage{summary, msg} {
+		if err := upstream.Send(m); err != nil {
+			t.Fatalf("unexpected error sending message: %s", err)
+		}
+	}
+
+	if count := len(relay.Sends); count != 2 {
+		t.Errorf("expected both messages to be sent, got %d", count)
+	}
+	if len(publisher.Payloads) != 1 || publisher.Keys[0] != "db" {
+		t.Fatalf("expected only the summary to be published: %v", publisher.Keys)
+	}
+	published := publisher.Payloads[0]
+	if published["Type"] != "summary" || published["Key"] != "db" || published["Count"] != 1.0 {
+		t.Errorf("unexpected published summary: %#v", published)
+	}
+
+	upstream.Raw = true
+	if err := upstream.Send(msg); err != nil {
+		t.Fatalf("unexpected error sending message: %s", err)
+	}
+	if len(publisher.Payloads) != 2 || publisher.Payloads[1]["Type"] != "message" || publisher.Payloads[1]["Body"] != "body\r\n" {
+		t.Errorf("expected the relayed message to be published: %#v", publisher.Payloads)
+	}
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	publisher := &KafkaPublisher{server.URL + "/topics/failmail", time.Second}
+	if err := publisher.Publish("db", []byte(`{"Type":"summary"}`)); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+
+	req := <-requests
+	if req.URL.Path != "/topics/failmail" || req.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+		t.Errorf("unexpected request: %s %s", req.URL.Path, req.Header.Get("Content-Type"))
+	}
+	if body := string(<-bodies); body != `{"records":[{"key":"db","value":{"Type":"summary"}}]}` {
+		t.Errorf("unexpected records: %s", body)
+	}
+}
+
+func TestSQSPublisher(t *testing.T) {
+	forms := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		r.ParseForm()
+		forms <- r.PostForm
+	}))
+	defer server.Close()
+
+	publisher := &SQSPublisher{server.URL + "/123456789012/failmail.fifo", "us-east-1", "AKID", "secret", "", time.Second}
+	if err := publisher.Publish("db", []byte(`{"Type":"summary"}`)); err != nil {
+		t.Fatalf("unexpected error publishing: %s", err)
+	}
+	form := <-forms
+	if form.Get("Action") != "SendMessage" || form.Get("MessageBody") != `{"Type":"summary"}` || form.Get("MessageGroupId") != "db" {
+		t.Errorf("unexpected request: %v", form)
+	}
+}
+
+func TestNewSQSPublisher(t *testing.T) {
+	for _, name := range []string{"AWS_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	queue := "https://sqs.eu-west-2.amazonaws.com/123456789012/failmail"
+	if _, err := NewSQSPublisher(queue, time.Second); err == nil {
+		t.Errorf("expected an error without credentials")
+	}
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	if publisher, err := NewSQSPublisher(queue, time.Second); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if publisher.Region != "eu-west-2" {
+		t.Errorf("unexpected region: %s", publisher.Region)
+	}
+	if _, err := NewSQSPublisher("http://localhost:4566/000000000000/failmail", time.Second); err == nil {
+		t.Errorf("expected an error for a queue without a region")
+	}
+}
+
+// The "get-vanilla" case from the AWS Signature Version 4 test suite.
+func TestSignAWSv4(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	SignAWSv4(req, []byte{}, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", now)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("unexpected signature: %s", auth)
+	}
+}
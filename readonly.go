@@ -0,0 +1,48 @@
+// Read-only mode, for maintenance windows (e.g. while the store is being
+// moved or restored). The receiver still answers SMTP, but refuses messages
+// with a temporary error, so that clients queue them and try again later
+// rather than losing them.
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// The text of the responses to messages refused in read-only mode.
+const READ_ONLY_RESPONSE = "Not accepting messages during maintenance, try again later"
+
+// `ReadOnly` is a switch for read-only mode, which can be flipped while the
+// server is running. It's safe to use from multiple goroutines.
+type ReadOnly struct {
+	enabled bool
+	lock    sync.RWMutex
+}
+
+func NewReadOnly(enabled bool) *ReadOnly {
+	return &ReadOnly{enabled: enabled}
+}
+
+// Returns true if messages should be refused. A nil `ReadOnly` is never
+// enabled.
+func (r *ReadOnly) Enabled() bool {
+	if r == nil {
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.enabled
+}
+
+func (r *ReadOnly) Set(enabled bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if enabled != r.enabled {
+		if enabled {
+			log.Printf("entering read-only mode: refusing messages")
+		} else {
+			log.Printf("leaving read-only mode: accepting messages")
+		}
+	}
+	r.enabled = enabled
+}
@@ -0,0 +1,35 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// `ReadOnlyRequest` is the body of a POST to `/api/read-only`.
+type ReadOnlyRequest struct {
+	ReadOnly bool
+}
+
+// Serves `/api/read-only`: GET returns whether read-only mode is on, and POST
+// turns it on or off.
+func (r *ReadOnly) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writeJSON(w, &ReadOnlyRequest{r.Enabled()})
+	case "POST":
+		body := new(ReadOnlyRequest)
+		if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		r.Set(body.ReadOnly)
+		writeJSON(w, body)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("must be a GET or POST"))
+	}
+}
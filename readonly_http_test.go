@@ -0,0 +1,46 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyHTTP(t *testing.T) {
+	readOnly := NewReadOnly(false)
+	request := func(method string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		readOnly.ServeHTTP(w, httptest.NewRequest(method, "/api/read-only", strings.NewReader(body)))
+		return w
+	}
+
+	if w := request("POST", `{"ReadOnly": true}`); w.Code != http.StatusOK || !readOnly.Enabled() {
+		t.Errorf("expected read-only mode to be turned on: %d", w.Code)
+	}
+	if w := request("GET", ""); strings.TrimSpace(w.Body.String()) != `{"ReadOnly":true}` {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+	if w := request("POST", "nope"); w.Code != http.StatusBadRequest || !readOnly.Enabled() {
+		t.Errorf("expected an invalid request to be refused: %d", w.Code)
+	}
+	if w := request("DELETE", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected a 405 for DELETE: %d", w.Code)
+	}
+}
+
+func TestReadOnlySubmitter(t *testing.T) {
+	submitter := NewSubmitter(AddressRewriter{})
+	submitter.ReadOnly = NewReadOnly(true)
+
+	w := httptest.NewRecorder()
+	body := bytes.NewBufferString(`{"From": "app@example.com", "To": ["test@example.com"], "Subject": "error"}`)
+	submitter.ServeHTTP(w, httptest.NewRequest("POST", "/api/messages", body))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a 503 with Retry-After in read-only mode: %d %#v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReadOnlySession(t *testing.T) {
+	readOnly := NewReadOnly(true)
+	parser := SMTPParser()
+
+	s := new(Session)
+	s.Start(nil, UNENCRYPTED)
+	s.readOnly = readOnly.Enabled
+	s.Advance(parser("MAIL FROM:<test@example.com>\r\n"))
+	s.Advance(parser("RCPT TO:<test@example.com>\r\n"))
+	if resp := s.Advance(parser("DATA\r\n")); resp.Code != 452 || resp.Text != READ_ONLY_RESPONSE {
+		t.Errorf("expected DATA to get a 452 response in read-only mode: %d %s", resp.Code, resp.Text)
+	}
+
+	readOnly.Set(false)
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Code != 250 {
+		t.Errorf("expected the refused message to be forgotten: %d", resp.Code)
+	}
+	s.Advance(parser("RCPT TO:<test@example.com>\r\n"))
+	if resp := s.Advance(parser("DATA\r\n")); resp.Code != 354 {
+		t.Errorf("expected DATA to get a 354 response after leaving read-only mode: %d", resp.Code)
+	}
+
+	var none *ReadOnly
+	if none.Enabled() {
+		t.Errorf("expected a nil ReadOnly never to be enabled")
+	}
+}
@@ -0,0 +1,231 @@
+// Delivery receipts, for answering "did my error get reported?" For each
+// summary it sends, failmail records which stored messages were in it, so
+// that a message can be looked up (by its id in the store, or by its
+// Message-ID header) to find the summary that reported it, and when.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often `Receipts` discards expired receipts from its file.
+const RECEIPTS_PRUNE_INTERVAL = time.Hour
+
+// `ReceiptMessage` identifies a message that was included in a summary.
+type ReceiptMessage struct {
+	Id        MessageId // the id of the message in the store
+	MessageId string    `json:",omitempty"` // the message's Message-ID header
+	Subject   string    `json:",omitempty"`
+}
+
+// `Receipt` records that a summary was sent, and the messages in it.
+type Receipt struct {
+	Summary  string // the summary's id, as in its X-Failmail-Summary-Id header
+	Key      string
+	To       []string
+	Subject  string
+	Sent     time.Time
+	Messages []*ReceiptMessage
+}
+
+// Returns true if the receipt is for the summary with the id `id`, or
+// includes a message with the store id or Message-ID `id`.
+func (r *Receipt) Matches(id string) bool {
+	if r.Summary == id {
+		return true
+	}
+	bare := strings.Trim(id, "<>")
+	for _, msg := range r.Messages {
+		if fmt.Sprint(msg.Id) == id || (msg.MessageId != "" && strings.Trim(msg.MessageId, "<>") == bare) {
+			return true
+		}
+	}
+	return false
+}
+
+// `Receipts` keeps the receipts for the summaries sent in the last
+// `Retention`. If `Path` is set, they're appended to that file, one JSON
+// object per line, so that they survive restarts and can be looked up by
+// other processes sharing the store; otherwise, they're kept in memory. It's
+// safe to use from multiple goroutines.
+type Receipts struct {
+	Path      string
+	Retention time.Duration
+	receipts  []*Receipt // only used without `Path`
+	pruned    time.Time
+	lock      sync.Mutex
+}
+
+// Returns the receipts kept with a store: in a file in a `DiskStore`'s
+// maildir, or in memory for other stores.
+func NewReceipts(store MessageStore, retention time.Duration) (*Receipts, error) {
+	var path string
+	if disk, ok := store.(*DiskStore); ok {
+		path = disk.receiptsPath()
+	}
+	return LoadReceipts(path, retention)
+}
+
+// Returns the receipts kept in `path` (or in memory, if it's empty),
+// discarding any that have expired.
+func LoadReceipts(path string, retention time.Duration) (*Receipts, error) {
+	r := &Receipts{Path: path, Retention: retention, receipts: make([]*Receipt, 0)}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.prune(nowGetter()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *DiskStore) receiptsPath() string {
+	return path.Join(s.Maildir.Path, ".receipts")
+}
+
+// Reads the receipts from the file, skipping any lines that can't be parsed
+// (e.g. one left partly written by a crash).
+func (r *Receipts) read() ([]*Receipt, error) {
+	if r.Path == "" {
+		return r.receipts, nil
+	}
+
+	data, err := ioutil.ReadFile(r.Path)
+	if os.IsNotExist(err) {
+		return []*Receipt{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	receipts := make([]*Receipt, 0)
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		receipt := new(Receipt)
+		if err := json.Unmarshal(scanner.Bytes(), receipt); err == nil {
+			receipts = append(receipts, receipt)
+		}
+	}
+	return receipts, scanner.Err()
+}
+
+// Discards the receipts that expired before `now`. The file is rewritten to a
+// temporary file that's moved into place, so that readers never see it
+// partially written.
+func (r *Receipts) prune(now time.Time) error {
+	r.pruned = now
+	receipts, err := r.read()
+	if err != nil {
+		return err
+	}
+
+	kept := make([]*Receipt, 0, len(receipts))
+	for _, receipt := range receipts {
+		if now.Sub(receipt.Sent) < r.Retention {
+			kept = append(kept, receipt)
+		}
+	}
+	if r.Path == "" {
+		r.receipts = kept
+		return nil
+	} else if len(kept) == len(receipts) {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	for _, receipt := range kept {
+		line, err := json.Marshal(receipt)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	tmpPath := fmt.Sprintf("%s.%d", r.Path, pidGetter())
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, r.Path)
+}
+
+// Records a receipt for a summary that was sent. A nil `Receipts` ignores it.
+func (r *Receipts) Record(summary *SummaryMessage) error {
+	if r == nil {
+		return nil
+	}
+
+	now := nowGetter()
+	receipt := &Receipt{
+		Summary:  summary.Id,
+		Key:      summary.Key,
+		To:       summary.To,
+		Subject:  summary.Subject,
+		Sent:     now,
+		Messages: make([]*ReceiptMessage, 0, len(summary.StoredMessages)),
+	}
+	for _, stored := range summary.StoredMessages {
+		msg := &ReceiptMessage{Id: stored.Id}
+		if stored.ReceivedMessage != nil && stored.Parsed != nil {
+			msg.MessageId = stored.Parsed.Header.Get("Message-Id")
+			msg.Subject = stored.Parsed.Header.Get("Subject")
+		}
+		receipt.Messages = append(receipt.Messages, msg)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if now.Sub(r.pruned) >= RECEIPTS_PRUNE_INTERVAL {
+		if err := r.prune(now); err != nil {
+			return err
+		}
+	}
+
+	if r.Path == "" {
+		r.receipts = append(r.receipts, receipt)
+		return nil
+	}
+
+	line, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Returns the unexpired receipts for the summary with the id `id`, or for the
+// summaries that included a message with the store id or Message-ID `id`,
+// oldest first.
+func (r *Receipts) Find(id string) ([]*Receipt, error) {
+	r.lock.Lock()
+	receipts, err := r.read()
+	r.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	now := nowGetter()
+	found := make([]*Receipt, 0)
+	for _, receipt := range receipts {
+		if now.Sub(receipt.Sent) < r.Retention && receipt.Matches(id) {
+			found = append(found, receipt)
+		}
+	}
+	return found, nil
+}
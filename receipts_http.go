@@ -0,0 +1,35 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Serves `/api/receipts`: GET with an `id` query parameter (a summary id, a
+// message's id in the store, or its Message-ID) lists the matching receipts.
+func (r *Receipts) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("must be a GET"))
+		return
+	}
+
+	id := strings.TrimSpace(req.URL.Query().Get("id"))
+	if id == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("id is required"))
+		return
+	}
+
+	found, err := r.Find(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+	} else if len(found) == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no summary found for %s", id))
+	} else {
+		writeJSON(w, found)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestReceiptsFromFlush(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Receipts, _ = LoadReceipts("", time.Hour)
+	outgoing := make(chan *SendRequest, 64)
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nMessage-Id: <1@app.example.com>\r\nSubject: test\r\n\r\ntest"))
+
+	ids := make(chan string, 1)
+	go func() {
+		for req := range outgoing {
+			parsed, _ := mail.ReadMessage(bytes.NewBuffer(req.Message.Contents()))
+			ids <- parsed.Header.Get("X-Failmail-Summary-Id")
+			req.SendErrors <- nil
+		}
+	}()
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, true); err != nil {
+		t.Errorf("unexpected error from flush: %s", err)
+	}
+	close(outgoing)
+
+	id := <-ids
+	server := NewHTTPServer("")
+	server.HandleBuffer(buf)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/api/receipts?id=1@app.example.com", nil))
+	found := make([]*Receipt, 0)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a receipt for the message, got %d: %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &found); err != nil {
+		t.Fatalf("invalid response %#v: %s", w.Body.String(), err)
+	} else if id == "" || len(found) != 1 || found[0].Summary != id || len(found[0].Messages) != 1 {
+		t.Errorf("expected a receipt for summary %#v, got %#v", id, found)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/api/receipts?id=2@app.example.com", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unreported message, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/api/receipts", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without an id, got %d", w.Code)
+	}
+}
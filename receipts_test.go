@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiptsFind(t *testing.T) {
+	defer patchTime(time.Unix(1393650000, 0))()
+	receipts, err := LoadReceipts("", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error loading receipts: %s", err)
+	}
+
+	summary := makeSummaryMessage(t,
+		"Message-Id: <1@app.example.com>\r\nSubject: test\r\n\r\ntest\r\n",
+		"Message-Id: <2@app.example.com>\r\nSubject: test\r\n\r\ntest\r\n")
+	summary.Id = "abc123"
+	if err := receipts.Record(summary); err != nil {
+		t.Fatalf("unexpected error recording receipt: %s", err)
+	}
+
+	for _, id := range []string{"abc123", "1", "<2@app.example.com>", "2@app.example.com"} {
+		if found, err := receipts.Find(id); err != nil || len(found) != 1 || found[0].Summary != "abc123" {
+			t.Errorf("expected to find the receipt by %#v, got %#v (%v)", id, found, err)
+		}
+	}
+	if found, _ := receipts.Find("3@app.example.com"); len(found) != 0 {
+		t.Errorf("expected no receipt for an unknown message, got %#v", found)
+	}
+
+	defer patchTime(time.Unix(1393650000, 0).Add(2 * time.Hour))()
+	if found, _ := receipts.Find("abc123"); len(found) != 0 {
+		t.Errorf("expected expired receipts to be ignored, got %#v", found)
+	}
+}
+
+func TestReceiptsDiskStore(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+	store, err := NewDiskStore(maildir)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %s", err)
+	}
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	receipts, err := NewReceipts(store, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error loading receipts: %s", err)
+	}
+	old := makeSummaryMessage(t, "Subject: test\r\n\r\ntest\r\n")
+	old.Id = "old"
+	receipts.Record(old)
+
+	defer patchTime(time.Unix(1393650000, 0).Add(30 * time.Minute))()
+	recent := makeSummaryMessage(t, "Subject: test\r\n\r\ntest\r\n")
+	recent.Id = "recent"
+	receipts.Record(recent)
+
+	// Reloading after the first receipt expires keeps only the second.
+	defer patchTime(time.Unix(1393650000, 0).Add(80 * time.Minute))()
+	reloaded, err := NewReceipts(store, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error reloading receipts: %s", err)
+	}
+	if found, _ := reloaded.Find("0"); len(found) != 1 || found[0].Summary != "recent" {
+		t.Errorf("expected only the unexpired receipt after reloading, got %#v", found)
+	}
+	if all, err := reloaded.read(); err != nil || len(all) != 1 {
+		t.Errorf("expected the expired receipt to be pruned from the file, got %#v (%v)", all, err)
+	}
+}
@@ -0,0 +1,67 @@
+// Selective relaying, so that failmail can sit inline as a smart host:
+// messages that don't match a filter expression (e.g. mail that isn't about
+// errors, but was routed through failmail anyway) are relayed to the upstream
+// immediately and individually, instead of being batched.
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// The header added to relayed messages, giving the fingerprint of the group
+// they'd have been in, had they been summarized.
+const FINGERPRINT_HEADER = "X-Failmail-Fingerprint"
+
+// `Relay` decides which messages to batch, and relays the rest.
+type Relay struct {
+	Filter     GroupBy // if non-nil, messages for which this is empty or "false" are relayed
+	Upstream   Upstream
+	Severities *Severities // if non-nil, messages severe enough to pass through are relayed
+	Group      GroupBy     // if non-nil, relayed messages get a `FINGERPRINT_HEADER` for their group
+}
+
+// Returns true if the message matches the filter, and should be batched.
+// Messages that can't be checked are batched, so that they aren't lost.
+func (r *Relay) Matches(msg *ReceivedMessage) bool {
+	if r.Severities.PassesThrough(msg) {
+		return false
+	} else if r.Filter == nil {
+		return true
+	}
+	result, err := r.Filter(msg)
+	if err != nil {
+		log.Printf("warning: error filtering message, batching it: %s", err)
+		return true
+	}
+	return IsTrue(result)
+}
+
+// Returns true if the result of a filter expression selects a message: that
+// is, if it isn't empty or "false".
+func IsTrue(result string) bool {
+	result = strings.TrimSpace(result)
+	return result != "" && result != "false"
+}
+
+// Relays the message to the upstream as is, but for its fingerprint header.
+func (r *Relay) Send(msg *ReceivedMessage) error {
+	log.Printf("relaying message with subject %#v", msg.Parsed.Header.Get("Subject"))
+	return r.Upstream.Send(r.fingerprinted(msg))
+}
+
+// Returns the message with a header giving the fingerprint of its group (as
+// in summaries' manifests, and in `--history`), so that alerting systems
+// downstream can dedupe relayed messages consistently with summaries.
+func (r *Relay) fingerprinted(msg *ReceivedMessage) OutgoingMessage {
+	if r.Group == nil {
+		return msg
+	}
+	key, err := r.Group(msg)
+	if err != nil {
+		log.Printf("warning: error grouping message, relaying it without a fingerprint: %s", err)
+		return msg
+	}
+	headers := map[string]string{FINGERPRINT_HEADER: FingerprintKey(key)}
+	return &message{msg.Sender(), msg.Recipients(), SetHeaders(msg.Contents(), headers)}
+}
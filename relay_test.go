@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRelayMatches(t *testing.T) {
+	relay := &Relay{Filter: GroupByScript("filter", "subject =~ `error`")}
+	if !relay.Matches(makeReceivedMessage(t, "Subject: an error\r\n\r\nbody\r\n")) {
+		t.Errorf("expected a matching message to be batched")
+	}
+	if relay.Matches(makeReceivedMessage(t, "Subject: hello\r\n\r\nbody\r\n")) {
+		t.Errorf("expected a non-matching message to be relayed")
+	}
+
+	relay = &Relay{Filter: GroupByExpr("filter", `{{.Header.Get "X-Batch"}}`)}
+	if relay.Matches(makeReceivedMessage(t, "Subject: hello\r\n\r\nbody\r\n")) {
+		t.Errorf("expected an empty result to relay the message")
+	}
+}
+
+func TestMessageWriterRelays(t *testing.T) {
+	upstream := &TestUpstream{}
+	store := NewMemoryStore()
+	writer := &MessageWriter{Store: store, Relay: &Relay{Filter: GroupByScript("filter", "subject =~ `error`"), Upstream: upstream}}
+
+	received := make(chan *StorageRequest, 2)
+	errors := make(chan error, 2)
+	received <- &StorageRequest{makeReceivedMessage(t, "Subject: an error\r\n\r\nbody\r\n"), errors}
+	received <- &StorageRequest{makeReceivedMessage(t, "Subject: hello\r\n\r\nbody\r\n"), errors}
+	close(received)
+	writer.Run(received)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errors; err != nil {
+			t.Errorf("unexpected error for message %d: %s", i, err)
+		}
+	}
+	if count, _, _ := store.Size(); count != 1 {
+		t.Errorf("expected only the matching message to be stored: %d", count)
+	}
+	if len(upstream.Sends) != 1 {
+		t.Fatalf("expected the other message to be relayed: %d", len(upstream.Sends))
+	} else if data := string(upstream.Sends[0].Contents()); data != "Subject: hello\r\n\r\nbody\r\n" {
+		t.Errorf("expected the message to be relayed as is: %#v", data)
+	}
+}
+
+func TestRelayAddsFingerprint(t *testing.T) {
+	upstream := &TestUpstream{}
+	group := GroupByExpr("group", `{{.Header.Get "Subject"}}`)
+	relay := &Relay{Upstream: upstream, Group: group}
+
+	msg := makeReceivedMessage(t, "Subject: hello\r\n\r\nbody\r\n")
+	if err := relay.Send(msg); err != nil {
+		t.Fatalf("unexpected error relaying message: %s", err)
+	}
+	expected := "Subject: hello\r\n" + FINGERPRINT_HEADER + ": " + FingerprintKey("hello") + "\r\n\r\nbody\r\n"
+	if data := string(upstream.Sends[0].Contents()); data != expected {
+		t.Errorf("expected the message to be relayed with its fingerprint: %#v", data)
+	}
+
+	// The fingerprint matches the group's in a summary.
+	summary := makeSummaryMessage(t, "Subject: hello\r\n\r\nbody\r\n")
+	if fingerprint := Fingerprint(summary.UniqueMessages[0]); fingerprint != FingerprintKey("hello") {
+		t.Errorf("expected the same fingerprint as in summaries: %s", fingerprint)
+	}
+	if sent := upstream.Sends[0]; sent.Sender() != msg.Sender() || len(sent.Recipients()) != len(msg.Recipients()) {
+		t.Errorf("expected the message's envelope to be kept: %#v", sent)
+	}
+}
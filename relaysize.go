@@ -0,0 +1,134 @@
+// Awareness of the relay's message size limit. Relays advertise the largest
+// message they accept with the SIZE extension to EHLO; failmail checks it at
+// startup and then periodically, and splits (or, as a last resort, truncates)
+// summaries to fit it, rather than having the relay reject them at send time.
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Room left under the relay's limit for what's added to summaries after
+// they're rendered (e.g. `--summary-headers`, and dot-stuffing).
+const RELAY_SIZE_MARGIN = 1024
+
+// `RelaySize` tracks the size limit the relay advertises. A nil `RelaySize`
+// knows of no limit.
+type RelaySize struct {
+	Relay *LiveUpstream
+	Every time.Duration // how often to check the relay's limit again
+
+	lock    sync.RWMutex
+	limit   int
+	checked time.Time
+	err     error
+}
+
+// `RelaySizeStats` describes what's known of the relay's size limit.
+type RelaySizeStats struct {
+	Limit   int       // the relay's limit, in bytes, or 0 if it has none
+	Checked time.Time // when the limit was last checked
+	Error   string    // the error from the last check, if it failed
+}
+
+// Checks the relay's limit right away, and then every `Every` until `ctx` is
+// cancelled.
+func (r *RelaySize) Run(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	ticker := time.NewTicker(r.Every)
+	defer ticker.Stop()
+	for {
+		if err := r.Check(ctx); err != nil {
+			log.Printf("warning: couldn't check the relay's size limit: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Connects to the relay and records the size limit it advertises. If the
+// check fails, the last known limit is kept.
+func (r *RelaySize) Check(ctx context.Context) error {
+	limit, err := r.Relay.SizeLimit(ctx)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.checked = nowGetter()
+	r.err = err
+	if err == nil {
+		if limit != r.limit {
+			log.Printf("relay's size limit is %d bytes", limit)
+		}
+		r.limit = limit
+	}
+	return err
+}
+
+// Returns the relay's size limit, in bytes, or 0 if it has none (or it isn't
+// known yet).
+func (r *RelaySize) Limit() int {
+	if r == nil {
+		return 0
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.limit
+}
+
+// Returns the largest summary that will fit under the relay's limit, or 0 if
+// there's no limit.
+func (r *RelaySize) MaxSummarySize() int {
+	limit := r.Limit()
+	if limit <= 0 {
+		return 0
+	} else if limit <= 2*RELAY_SIZE_MARGIN {
+		return limit / 2
+	}
+	return limit - RELAY_SIZE_MARGIN
+}
+
+func (r *RelaySize) Stats() *RelaySizeStats {
+	if r == nil {
+		return nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	stats := &RelaySizeStats{Limit: r.limit, Checked: r.checked}
+	if r.err != nil {
+		stats.Error = r.err.Error()
+	}
+	return stats
+}
+
+// Connects to the server and returns the size limit it advertises with
+// SIZE, or 0 if it doesn't advertise one.
+func (u *LiveUpstream) SizeLimit(ctx context.Context) (int, error) {
+	client, stop, err := u.dial(ctx)
+	if err != nil {
+		return 0, contextErr(ctx, err)
+	}
+	defer stop()
+	defer client.Close()
+
+	ok, param := client.Extension("SIZE")
+	if !ok {
+		return 0, contextErr(ctx, client.Quit())
+	}
+	// A SIZE without a limit, or with 0, means there isn't one.
+	limit, _ := strconv.Atoi(strings.TrimSpace(param))
+	if limit < 0 {
+		limit = 0
+	}
+	return limit, contextErr(ctx, client.Quit())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelaySizeCheck(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10052")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	defer socket.Close()
+
+	listener := &Listener{Socket: socket, MaxSize: 20000}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	go func() {
+		var relaySize *RelaySize
+		if relaySize.Limit() != 0 || relaySize.MaxSummarySize() != 0 || relaySize.Stats() != nil {
+			t.Errorf("expected a nil relay size to know of no limit")
+		}
+
+		relaySize = &RelaySize{Relay: &LiveUpstream{Addr: "localhost:10052"}, Every: time.Hour}
+		if err := relaySize.Check(context.Background()); err != nil {
+			t.Errorf("unexpected error checking the relay's size limit: %s", err)
+		}
+		if limit := relaySize.Limit(); limit != 20000 {
+			t.Errorf("expected the relay's advertised limit, got %d", limit)
+		}
+		if size := relaySize.MaxSummarySize(); size != 20000-RELAY_SIZE_MARGIN {
+			t.Errorf("expected room under the limit for added headers, got %d", size)
+		}
+		if stats := relaySize.Stats(); stats.Limit != 20000 || stats.Error != "" || stats.Checked.IsZero() {
+			t.Errorf("unexpected stats: %#v", stats)
+		}
+		shutdown <- GracefulShutdown
+	}()
+
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+}
+
+func TestRelaySizeCheckFails(t *testing.T) {
+	relaySize := &RelaySize{Relay: &LiveUpstream{Addr: "localhost:1"}, Every: time.Hour, limit: 5000}
+	if err := relaySize.Check(context.Background()); err == nil {
+		t.Errorf("expected an error checking an unreachable relay")
+	}
+	if limit := relaySize.Limit(); limit != 5000 {
+		t.Errorf("expected the last known limit to be kept: %d", limit)
+	}
+	if stats := relaySize.Stats(); stats.Error == "" {
+		t.Errorf("expected the error in the stats: %#v", stats)
+	}
+}
+
+func TestRenderPartsTruncatesToLimit(t *testing.T) {
+	summary := makeBigSummary(t, "one")
+	summary.UniqueMessages[0].Body = strings.Repeat("é", 1000)
+
+	parts := RenderParts(&NoRenderer{}, summary, 0, 1200)
+	if len(parts) != 1 {
+		t.Fatalf("expected a single part: %d", len(parts))
+	}
+	contents := string(parts[0].Contents())
+	if len(contents) > 1200 {
+		t.Errorf("expected the summary to be truncated to the limit: %d bytes", len(contents))
+	} else if !strings.Contains(contents, "é"+TRUNCATED_MARKER) {
+		t.Errorf("expected the body to be marked as truncated: %s", contents)
+	}
+	if len(summary.UniqueMessages[0].Body) != 2000 {
+		t.Errorf("expected the original summary to be left alone")
+	}
+}
+
+func TestRenderPartsSplitsToLimit(t *testing.T) {
+	summary := makeBigSummary(t, "one", "two", "three")
+	if parts := RenderParts(&NoRenderer{}, summary, 100000, 1500); len(parts) != 3 {
+		t.Errorf("expected the relay's limit to split the summary into 3 parts: %d", len(parts))
+	}
+}
@@ -0,0 +1,89 @@
+// TLS verification for connections to the relay. By default, the relay's
+// certificate is checked against the system's trusted CAs; instead, it can be
+// checked against a private CA, or pinned to known public keys, so that a
+// relay with a self-signed or internal certificate can still be trusted.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Builds the TLS config for connections to the relay, or returns nil if the
+// defaults will do. If `caFile` is non-empty, the relay's certificate must be
+// signed by one of the CAs in that PEM file. If any `pins` are given, the
+// SHA-256 hash of the certificate's public key (its DER-encoded
+// SubjectPublicKeyInfo) must match one of them; without a CA file, the pins
+// stand in for verifying the certificate against a CA.
+func RelayTLSConfig(caFile string, pins []string) (*tls.Config, error) {
+	if caFile == "" && len(pins) == 0 {
+		return nil, nil
+	}
+
+	config := new(tls.Config)
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if len(pins) > 0 {
+		hashes, err := parsePins(pins)
+		if err != nil {
+			return nil, err
+		}
+		config.InsecureSkipVerify = caFile == ""
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return checkPins(state, hashes)
+		}
+	}
+	return config, nil
+}
+
+// Parses hex-encoded SHA-256 hashes, which may have colons between bytes.
+func parsePins(pins []string) (map[string]bool, error) {
+	hashes := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		hash, err := hex.DecodeString(strings.Replace(strings.TrimSpace(pin), ":", "", -1))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("--relay-pin-sha256 must be hex-encoded SHA-256 hashes: %#v", pin)
+		}
+		hashes[string(hash)] = true
+	}
+	return hashes, nil
+}
+
+// Checks that the public key of the server's certificate has one of the
+// pinned hashes. Only the server's own certificate counts, since the others
+// in the chain it presents may not have been verified.
+func checkPins(state tls.ConnectionState, hashes map[string]bool) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("relay presented no certificate")
+	}
+	hash := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	if !hashes[string(hash[:])] {
+		return fmt.Errorf("relay certificate doesn't match a pinned key (its key hash is %x)", hash)
+	}
+	return nil
+}
+
+// Returns a copy of the TLS config for connecting to the server at `host`,
+// or the default config if `config` is nil.
+func tlsConfigFor(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		return &tls.Config{ServerName: host}
+	}
+	copied := config.Clone()
+	copied.ServerName = host
+	return copied
+}
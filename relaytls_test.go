@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// Generates a self-signed certificate for localhost.
+func makeRelayCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func pinFor(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+func TestRelayTLSConfigDefault(t *testing.T) {
+	if config, err := RelayTLSConfig("", nil); config != nil || err != nil {
+		t.Errorf("expected no TLS config by default: %#v, %s", config, err)
+	}
+}
+
+func TestRelayTLSConfigPins(t *testing.T) {
+	_, cert := makeRelayCert(t)
+	_, other := makeRelayCert(t)
+
+	config, err := RelayTLSConfig("", []string{pinFor(cert)})
+	if err != nil {
+		t.Fatalf("unexpected error building TLS config: %s", err)
+	}
+	if !config.InsecureSkipVerify {
+		t.Errorf("expected pins to stand in for CA verification")
+	}
+	if err := config.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); err != nil {
+		t.Errorf("unexpected error verifying a pinned certificate: %s", err)
+	}
+	if err := config.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{other, cert}}); err == nil {
+		t.Errorf("expected an error verifying an unpinned certificate")
+	}
+}
+
+func TestRelayTLSConfigBadPin(t *testing.T) {
+	for _, pin := range []string{"xyz", "abcd"} {
+		if _, err := RelayTLSConfig("", []string{pin}); err == nil {
+			t.Errorf("expected an error for pin %#v", pin)
+		}
+	}
+}
+
+func TestRelayTLSConfigCAFile(t *testing.T) {
+	_, cert := makeRelayCert(t)
+
+	file, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("failed to create CA file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	file.Close()
+
+	config, err := RelayTLSConfig(file.Name(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error building TLS config: %s", err)
+	}
+	if config.InsecureSkipVerify {
+		t.Errorf("expected the certificate to be verified against the CA")
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: config.RootCAs, DNSName: "localhost"}); err != nil {
+		t.Errorf("expected the certificate to verify against the CA file: %s", err)
+	}
+
+	if _, err := RelayTLSConfig(os.DevNull, nil); err == nil {
+		t.Errorf("expected an error for a CA file without certificates")
+	}
+}
+
+func TestLiveUpstreamPinnedTLS(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10033")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	defer socket.Close()
+
+	serverCert, cert := makeRelayCert(t)
+	listener := &Listener{Socket: socket, Security: TLS_PRE_STARTTLS, TLSConfig: &tls.Config{Certificates: []tls.Certificate{serverCert}}}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	go func() {
+		req := <-received
+		req.StorageErrors <- nil
+	}()
+
+	go func() {
+		msg := &message{"test@example.com", []string{"test@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+
+		_, other := makeRelayCert(t)
+		wrong, _ := RelayTLSConfig("", []string{pinFor(other)})
+		if err := (&LiveUpstream{Addr: "localhost:10033", TLS: wrong}).Send(msg); err == nil {
+			t.Errorf("expected an error sending to a relay with an unpinned certificate")
+		}
+
+		pinned, _ := RelayTLSConfig("", []string{pinFor(cert)})
+		if err := (&LiveUpstream{Addr: "localhost:10033", TLS: pinned}).Send(msg); err != nil {
+			t.Errorf("unexpected error sending to a relay with a pinned certificate: %s", err)
+		}
+		shutdown <- GracefulShutdown
+	}()
+
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+}
@@ -6,20 +6,21 @@
 //   graceful shutdown of message handling goroutines (waiting until messages
 //   in flight are committed to storage or summarized and sent).
 //
-// * On shutdown, the listener returns file descriptor that should be passed to
-//   a new failmail process so that it can continue listening on the socket.
-//   Some system calls are made to ensure that that file descriptor (and no
-//   others) are in the right state for seamless inheritance by the child
-//   process.
+// * On shutdown, each listener (and the HTTP server) returns a file descriptor
+//   that should be passed to a new failmail process so that it can continue
+//   listening on the socket. Some system calls are made to ensure that that
+//   file descriptor (and no others) are in the right state for seamless
+//   inheritance by the child process.
 //
-// * If necessary, `TryReload` is called with the file descriptor returned by
-//   the listener, which executes a new failmail process, passing it the same
-//   arguments it was invoked with, plus the file descriptor it got from the
-//   listener.
+// * If necessary, `TryReload` is called with the file descriptors returned by
+//   the listeners, which executes a new failmail process, passing it the same
+//   arguments it was invoked with, plus the file descriptors it got from the
+//   listeners, and a manifest (in `FAILMAIL_FDS`) of which is which.
 //
 // * The parent process exits, but the now detached child process continues,
-//   inheriting the listening socket and opening it using the file descriptor
-//   number passed on the command line.
+//   inheriting the listening sockets and opening them using the file
+//   descriptor numbers in the manifest. It also takes over the pidfile, which
+//   the parent leaves in place.
 package main
 
 import (
@@ -27,28 +28,108 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
+// The environment variable that tells a reloaded process which inherited file
+// descriptor is which (see `ReloadFd`).
+const FD_MANIFEST_ENV = "FAILMAIL_FDS"
+
+// Arguments that a process being reloaded might have been given by the
+// process it was reloaded from, which are replaced for the new one.
+var RELOAD_ARGS = []string{"-socket-fd", "-http-fd", "-reloaded-from"}
+
+// `ReloadFd` is a listening socket to pass to the reloaded process, named for
+// what it's used for: "smtp" for the receiver's listeners, and "http" for the
+// HTTP server.
+type ReloadFd struct {
+	Name string
+	Fd   uintptr
+}
+
+// Formats the manifest of sockets passed to the reloaded process, which gets
+// them as fds 3, 4, and so on, in order, e.g. "smtp:3,smtp:4,http:5".
+func FormatFdManifest(fds []ReloadFd) string {
+	entries := make([]string, 0, len(fds))
+	for i, fd := range fds {
+		entries = append(entries, fmt.Sprintf("%s:%d", fd.Name, 3+i))
+	}
+	return strings.Join(entries, ",")
+}
+
+// Parses a manifest from `FormatFdManifest()`.
+func ParseFdManifest(manifest string) ([]ReloadFd, error) {
+	fds := make([]ReloadFd, 0)
+	for _, entry := range SplitAddresses(manifest) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid %s entry %#v", FD_MANIFEST_ENV, entry)
+		}
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil || fd <= 0 {
+			return nil, fmt.Errorf("invalid %s entry %#v", FD_MANIFEST_ENV, entry)
+		}
+		fds = append(fds, ReloadFd{parts[0], uintptr(fd)})
+	}
+	return fds, nil
+}
+
+// Reads (and then unsets, so that hooks don't inherit it) the manifest of
+// sockets passed to this process on reload, and sets `--socket-fd` and
+// `--http-fd` to open them, unless they're already set.
+func InheritFds(config *Config) error {
+	manifest := os.Getenv(FD_MANIFEST_ENV)
+	os.Unsetenv(FD_MANIFEST_ENV)
+	fds, err := ParseFdManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	smtp := make([]string, 0)
+	for _, fd := range fds {
+		switch fd.Name {
+		case "smtp":
+			smtp = append(smtp, strconv.Itoa(int(fd.Fd)))
+		case "http":
+			if config.HttpFd == 0 {
+				config.HttpFd = int(fd.Fd)
+			}
+		default:
+			log.Printf("ignoring inherited socket %s with fd %d", fd.Name, fd.Fd)
+		}
+	}
+	if len(smtp) > 0 && (config.SocketFd == "" || config.SocketFd == "0") {
+		config.SocketFd = strings.Join(smtp, ",")
+	}
+	return nil
+}
+
 // This should be called before shutting down, to check whether the program
-// should invoke a new copy of itself (which will be given the listening TCP
-// socket) before terminating, and to execute that new copy.
-func TryReload(shouldReload bool, fd uintptr) error {
+// should invoke a new copy of itself (which will be given the listening
+// sockets and the pidfile) before terminating, and to execute that new copy.
+func TryReload(shouldReload bool, fds []ReloadFd) error {
 	if !shouldReload {
 		return nil
 	}
 
-	if fd == 0 {
-		return fmt.Errorf("reload requested but socket fd was 0")
+	if len(fds) == 0 {
+		return fmt.Errorf("reload requested but there were no sockets")
+	}
+	for _, fd := range fds {
+		if fd.Fd == 0 {
+			return fmt.Errorf("reload requested but %s socket fd was 0", fd.Name)
+		}
 	}
 
-	log.Printf("passing socket with fd %d", fd)
+	manifest := FormatFdManifest(fds)
+	log.Printf("passing sockets with fds %v as %s", fds, manifest)
 
-	// Remove socket-fd from args.
+	// Remove the args for reloading from the args.
 	args := make([]string, 0)
 	consumeNextArg := false
 	for _, arg := range os.Args[1:] {
-		if !consumeNextArg && !strings.Contains(arg, "-socket-fd") {
+		if !consumeNextArg && !isReloadArg(arg) {
 			args = append(args, arg)
 		} else if consumeNextArg {
 			consumeNextArg = false
@@ -56,17 +137,32 @@ func TryReload(shouldReload bool, fd uintptr) error {
 			consumeNextArg = true
 		}
 	}
-	// The socket will always be fd 3 as long as it's ExtraFiles[0].
-	args = append(args, fmt.Sprintf("--socket-fd=%d", 3))
+
+	// The new process takes over the pidfile, rather than refusing to start
+	// because it exists.
+	args = append(args, fmt.Sprintf("--reloaded-from=%d", os.Getpid()))
 
 	log.Printf("command: %s %#v\n", os.Args[0], args)
 	cmd := exec.Command(os.Args[0], args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", FD_MANIFEST_ENV, manifest))
 
 	// If we don't put the fd in ExtraFiles, the child process gets a bad file
 	// descriptor error when it tries to use the socket.
-	cmd.ExtraFiles = []*os.File{os.NewFile(fd, "sock")}
+	cmd.ExtraFiles = make([]*os.File, 0, len(fds))
+	for _, fd := range fds {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, os.NewFile(fd.Fd, fd.Name))
+	}
 
 	return cmd.Start()
 }
+
+func isReloadArg(arg string) bool {
+	for _, name := range RELOAD_ARGS {
+		if strings.Contains(arg, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFdManifest(t *testing.T) {
+	manifest := FormatFdManifest([]ReloadFd{{"smtp", 10}, {"smtp", 12}, {"http", 11}})
+	if manifest != "smtp:3,smtp:4,http:5" {
+		t.Errorf("unexpected manifest: %#v", manifest)
+	}
+
+	if fds, err := ParseFdManifest(manifest); err != nil {
+		t.Errorf("unexpected error parsing manifest: %s", err)
+	} else if !reflect.DeepEqual(fds, []ReloadFd{{"smtp", 3}, {"smtp", 4}, {"http", 5}}) {
+		t.Errorf("unexpected fds from manifest: %v", fds)
+	}
+
+	if fds, err := ParseFdManifest(""); err != nil || len(fds) != 0 {
+		t.Errorf("expected an empty manifest to have no fds: %v, %s", fds, err)
+	}
+	for _, invalid := range []string{"smtp", "smtp:x", "http:0"} {
+		if _, err := ParseFdManifest(invalid); err == nil {
+			t.Errorf("expected an error parsing %#v", invalid)
+		}
+	}
+}
+
+func TestInheritFds(t *testing.T) {
+	defer os.Unsetenv(FD_MANIFEST_ENV)
+
+	config := Defaults()
+	os.Setenv(FD_MANIFEST_ENV, "smtp:3,smtp:4,http:5")
+	if err := InheritFds(config); err != nil {
+		t.Fatalf("unexpected error inheriting fds: %s", err)
+	}
+	if config.SocketFd != "3,4" || config.HttpFd != 5 {
+		t.Errorf("unexpected fds from manifest: %#v, %d", config.SocketFd, config.HttpFd)
+	}
+	if _, ok := os.LookupEnv(FD_MANIFEST_ENV); ok {
+		t.Errorf("expected the manifest to be unset once it's read")
+	}
+
+	// Fds given on the command line take precedence.
+	config = Defaults()
+	config.SocketFd = "6"
+	os.Setenv(FD_MANIFEST_ENV, "smtp:3")
+	if err := InheritFds(config); err != nil || config.SocketFd != "6" {
+		t.Errorf("expected --socket-fd to be kept: %#v, %s", config.SocketFd, err)
+	}
+
+	os.Setenv(FD_MANIFEST_ENV, "smtp:x")
+	if err := InheritFds(Defaults()); err == nil {
+		t.Errorf("expected an error from an invalid manifest")
+	}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"log"
+	"regexp"
+	"strings"
 	"text/template"
 	"time"
 )
@@ -11,6 +14,7 @@ var SUMMARY_TEMPLATE_FUNCS template.FuncMap = map[string]interface{}{
 	"time": func(t time.Time) string {
 		return t.Format(time.RFC1123Z)
 	},
+	"header": headerValue,
 }
 
 // `SummaryRenderer` turns a `SummaryMessage` into an `OutgoingMessage`.
@@ -52,3 +56,60 @@ func (r *TemplateRenderer) Render(s *SummaryMessage) OutgoingMessage {
 	}
 	return &message{s.From, s.To, normalizeNewlines(buf.String())}
 }
+
+// `SummaryHeaders` are headers added to every summary after it's rendered.
+// Their values are templates, evaluated against the `SummaryMessage`, so they
+// can be static (`X-Env: prod`) or depend on the summary (`X-Batch: {{.Key}}`).
+type SummaryHeaders struct {
+	Names  []string
+	values []*template.Template
+}
+
+// Matches the name of a header: printable ASCII other than spaces and colons.
+var headerNamePattern = regexp.MustCompile(`^[!-9;-~]+$`)
+
+// Parses semicolon-separated "Name: value" headers.
+func ParseSummaryHeaders(headers string) (*SummaryHeaders, error) {
+	result := &SummaryHeaders{Names: make([]string, 0), values: make([]*template.Template, 0)}
+	for _, header := range strings.Split(headers, ";") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(header, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !headerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("header %#v must be of the form Name: value", header)
+		}
+		value, err := template.New(name).Funcs(SUMMARY_TEMPLATE_FUNCS).Parse(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		result.Names = append(result.Names, name)
+		result.values = append(result.values, value)
+	}
+	return result, nil
+}
+
+// Returns a copy of `m` with the headers set, replacing any it already has.
+// A header whose value is empty is removed. A nil `SummaryHeaders` returns
+// `m` unchanged.
+func (h *SummaryHeaders) Apply(m OutgoingMessage, summary *SummaryMessage) OutgoingMessage {
+	if h == nil || len(h.Names) == 0 {
+		return m
+	}
+	headers := make(map[string]string, len(h.Names))
+	for i, name := range h.Names {
+		buf := new(bytes.Buffer)
+		if err := h.values[i].Execute(buf, summary); err != nil {
+			log.Printf("warning: couldn't render %s header: %s", name, err)
+			continue
+		}
+		if value := strings.TrimSpace(buf.String()); value != "" {
+			headers[name] = headerValue(value)
+		} else {
+			headers[name] = ""
+		}
+	}
+	return &message{m.Sender(), m.Recipients(), SetHeaders(m.Contents(), headers)}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"net/mail"
+	"reflect"
 	"strings"
 	"testing"
 	"text/template"
@@ -14,3 +17,45 @@ func TestRenderBadTemplate(t *testing.T) {
 		t.Errorf("expected the outgoing message body to report an error")
 	}
 }
+
+func TestSummaryHeaders(t *testing.T) {
+	headers, err := ParseSummaryHeaders(`X-Env: prod; Auto-Submitted: auto-generated; X-Batch: {{.Key}} ; X-Failmail-Last:`)
+	if err != nil {
+		t.Fatalf("unexpected error parsing headers: %s", err)
+	}
+
+	summary := makeSummaryMessage(t, "From: test@example.com\r\nTo: test@example.com\r\nSubject: test\r\n\r\ntest message\r\n")
+	summary.Key = "disk full"
+	msg := headers.Apply(summary, summary)
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(msg.Contents()))
+	if err != nil {
+		t.Fatalf("unexpected error parsing summary: %s", err)
+	}
+
+	expected := map[string]string{
+		"X-Env":                "prod",
+		"Auto-Submitted":       "auto-generated",
+		"X-Batch":              "disk full",
+		"X-Failmail-Last":      "",
+		"X-Failmail-Batch-Key": "disk full",
+	}
+	for name, value := range expected {
+		if actual := parsed.Header.Get(name); actual != value {
+			t.Errorf("expected %s to be %#v, got %#v", name, value, actual)
+		}
+	}
+	if !reflect.DeepEqual(msg.Recipients(), summary.Recipients()) {
+		t.Errorf("expected the envelope to be unchanged, got %v", msg.Recipients())
+	}
+
+	for _, invalid := range []string{"X-Env", "Bad Name: value", "X-Bad: {{.Missing"} {
+		if _, err := ParseSummaryHeaders(invalid); err == nil {
+			t.Errorf("expected an error parsing %#v", invalid)
+		}
+	}
+
+	var none *SummaryHeaders
+	if none.Apply(summary, summary) != OutgoingMessage(summary) {
+		t.Errorf("expected a nil SummaryHeaders to leave the summary alone")
+	}
+}
@@ -0,0 +1,136 @@
+// Sampling of stored messages, for extremely chatty sources. Only one in
+// every N messages in a group is stored; the messages in between aren't
+// stored, but are added to the count of the latest stored sample, so that
+// summaries still report the full number of messages.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The header an application can use to set the sample rate of a message.
+const SAMPLE_RATE_HEADER = "X-Failmail-Sample-Rate"
+
+// `SampleRule` sets the sample rate for groups whose keys match a pattern.
+type SampleRule struct {
+	Pattern *regexp.Regexp
+	Rate    int
+}
+
+// `ParseSampleRules` parses rules of the form `pattern=N`, separated by
+// semicolons.
+func ParseSampleRules(rules string) ([]*SampleRule, error) {
+	result := make([]*SampleRule, 0)
+	for _, rule := range strings.Split(rules, ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("sample rule %#v must be of the form pattern=N", rule)
+		}
+		pattern, err := regexp.Compile(rule[:i])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(rule[i+1:]))
+		if err != nil || rate < 1 {
+			return nil, fmt.Errorf("sample rule %#v must have a positive rate", rule)
+		}
+		result = append(result, &SampleRule{pattern, rate})
+	}
+	return result, nil
+}
+
+// `Sampler` stores one in every N messages in each group, where N is taken
+// from the message's `X-Failmail-Sample-Rate` header, the first rule matching
+// the group key, or `Rate`, in that order.
+type Sampler struct {
+	Rate   int
+	Rules  []*SampleRule
+	Batch  GroupBy
+	Group  GroupBy
+	groups map[string]*sampledGroup
+}
+
+// Tracks the latest stored sample in a group.
+type sampledGroup struct {
+	sample *ReceivedMessage
+	id     MessageId
+	seen   int // the number of messages seen since the group started
+}
+
+func NewSampler(rate int, rules []*SampleRule, batch GroupBy, group GroupBy) *Sampler {
+	return &Sampler{rate, rules, batch, group, make(map[string]*sampledGroup, 0)}
+}
+
+// Returns the sample rate for the message in the given group.
+func (s *Sampler) rate(msg *ReceivedMessage, group string) int {
+	if msg.Parsed != nil {
+		if rate, err := strconv.Atoi(strings.TrimSpace(msg.Parsed.Header.Get(SAMPLE_RATE_HEADER))); err == nil && rate > 0 {
+			return rate
+		}
+	}
+	for _, rule := range s.Rules {
+		if rule.Pattern.MatchString(group) {
+			return rule.Rate
+		}
+	}
+	return s.Rate
+}
+
+// Adds a message to the store if it's due to be sampled. Otherwise, the
+// latest sample in its group is replaced by a copy with a higher count.
+func (s *Sampler) Add(store MessageStore, now time.Time, msg *ReceivedMessage) (MessageId, error) {
+	batch, err := s.Batch(msg)
+	if err != nil {
+		return store.Add(now, msg)
+	}
+	group, err := s.Group(msg)
+	if err != nil {
+		return store.Add(now, msg)
+	}
+
+	rate := s.rate(msg, group)
+	if rate <= 1 {
+		return store.Add(now, msg)
+	}
+
+	key := strings.Join([]string{batch, group, strings.Join(msg.Recipients(), ",")}, "\x00")
+	sampled, ok := s.groups[key]
+	if ok && sampled.seen%rate != 0 {
+		// If the latest sample is gone, it's been summarized, so this message
+		// starts the group over.
+		if err := store.Remove(sampled.id); err == nil {
+			sampled.sample.Count = sampled.sample.Instances() + 1
+			sampled.seen += 1
+			id, err := store.Add(now, sampled.sample)
+			if err != nil {
+				delete(s.groups, key)
+			} else {
+				sampled.id = id
+			}
+			return id, err
+		}
+	}
+
+	if ok && sampled.seen%rate == 0 {
+		sampled.seen += 1
+	} else {
+		sampled = &sampledGroup{seen: 1}
+	}
+	id, err := store.Add(now, msg)
+	if err != nil {
+		delete(s.groups, key)
+		return id, err
+	}
+	sampled.sample = msg
+	sampled.id = id
+	s.groups[key] = sampled
+	return id, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseSampleRules(t *testing.T) {
+	rules, err := ParseSampleRules(`^db=10; a=b=2 ;`)
+	if err != nil {
+		t.Fatalf("unexpected error parsing rules: %s", err)
+	}
+	if len(rules) != 2 || rules[0].Pattern.String() != "^db" || rules[0].Rate != 10 || rules[1].Pattern.String() != "a=b" || rules[1].Rate != 2 {
+		t.Errorf("unexpected rules: %#v", rules)
+	}
+
+	for _, invalid := range []string{"db", "db=0", "db=x", "(=2"} {
+		if _, err := ParseSampleRules(invalid); err == nil {
+			t.Errorf("expected an error parsing %#v", invalid)
+		}
+	}
+}
+
+func TestSampler(t *testing.T) {
+	rules, _ := ParseSampleRules("^chatty=3")
+	sampler := NewSampler(1, rules, GroupByExpr("batch", ``), GroupByExpr("group", `{{.Header.Get "Subject"}}`))
+	store := NewMemoryStore()
+	now := time.Unix(1393650000, 0)
+
+	for i := 0; i < 7; i++ {
+		msg := makeReceivedMessage(t, fmt.Sprintf("To: test@example.com\r\nSubject: chatty\r\n\r\nbody %d\r\n", i))
+		if _, err := sampler.Add(store, now, msg); err != nil {
+			t.Fatalf("unexpected error adding message: %s", err)
+		}
+	}
+	sampler.Add(store, now, makeReceivedMessage(t, "To: test@example.com\r\nSubject: quiet\r\n\r\nbody\r\n"))
+	sampler.Add(store, now, makeReceivedMessage(t, "To: test@example.com\r\nSubject: quiet\r\n\r\nbody\r\n"))
+	sampler.Add(store, now, makeReceivedMessage(t, "To: test@example.com\r\nX-Failmail-Sample-Rate: 2\r\nSubject: quiet\r\n\r\nbody\r\n"))
+
+	stored, _ := store.MessagesNewerThan(time.Time{})
+	counts := make(map[string]int)
+	samples := make(map[string]int)
+	for _, msg := range stored {
+		subject := msg.Parsed.Header.Get("Subject")
+		counts[subject] += msg.Instances()
+		samples[subject] += 1
+	}
+	if samples["chatty"] != 3 || counts["chatty"] != 7 {
+		t.Errorf("unexpected samples for the sampled group: %d samples, %d messages", samples["chatty"], counts["chatty"])
+	}
+	if samples["quiet"] != 3 || counts["quiet"] != 3 {
+		t.Errorf("unexpected samples for the unsampled group: %d samples, %d messages", samples["quiet"], counts["quiet"])
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"fmt"
 	"github.com/mpapi/failmail/parse"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/mail"
+	"os"
 	"regexp"
 	"strings"
 )
@@ -38,9 +42,14 @@ const (
 
 var pattern = regexp.MustCompile(`\d+`)
 
+// `Response` is a reply to an SMTP command. Replies other than the greeting,
+// the reply to HELO or EHLO, and intermediate (3xx) replies also carry an
+// RFC 3463 enhanced status code (e.g. "5.7.0"), written before the text of
+// each line, since failmail advertises ENHANCEDSTATUSCODES.
 type Response struct {
-	Code int
-	Text string
+	Code   int
+	Text   string
+	Status string
 }
 
 func (r Response) IsClose() bool {
@@ -59,25 +68,47 @@ func (r Response) StartsTLS() bool {
 	return r.Text == "Ready to switch to TLS"
 }
 
+// Returns true if the client waits for this response before sending anything
+// else, so it can't be held back to send with the responses to later
+// pipelined commands.
+func (r Response) Waits() bool {
+	return r.IsClose() || r.NeedsAuthResponse() || r.NeedsData() || r.StartsTLS()
+}
+
+// Writes the response and flushes it to the client.
 func (r Response) WriteTo(writer stringWriter) error {
+	if err := r.Queue(writer); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// Writes the response without flushing it, so that the responses to several
+// pipelined commands can be sent together.
+func (r Response) Queue(writer stringWriter) error {
+	prefix := ""
+	if r.Status != "" {
+		prefix = r.Status + " "
+	}
+
 	text := strings.TrimSpace(r.Text)
 	lines := strings.Split(text, "\r\n")
 	if len(lines) > 1 {
 		for index, line := range lines {
 			if index < len(lines)-1 {
-				if _, err := writer.WriteString(fmt.Sprintf("%d-%s\r\n", r.Code, line)); err != nil {
+				if _, err := writer.WriteString(fmt.Sprintf("%d-%s%s\r\n", r.Code, prefix, line)); err != nil {
 					return err
 				}
 			} else {
-				if _, err := writer.WriteString(fmt.Sprintf("%d %s\r\n", r.Code, line)); err != nil {
+				if _, err := writer.WriteString(fmt.Sprintf("%d %s%s\r\n", r.Code, prefix, line)); err != nil {
 					return err
 				}
 			}
 		}
-	} else if _, err := writer.WriteString(fmt.Sprintf("%d %s\r\n", r.Code, r.Text)); err != nil {
+	} else if _, err := writer.WriteString(fmt.Sprintf("%d %s%s\r\n", r.Code, prefix, r.Text)); err != nil {
 		return err
 	}
-	return writer.Flush()
+	return nil
 }
 
 type stringReader interface {
@@ -95,6 +126,20 @@ func (r *debugReader) ReadString(delim byte) (string, error) {
 	return result, err
 }
 
+// `bareLFReader` accepts lines terminated with a bare "\n", as some clients
+// send, and normalizes them to end with "\r\n".
+type bareLFReader struct {
+	Reader stringReader
+}
+
+func (r *bareLFReader) ReadString(delim byte) (string, error) {
+	result, err := r.Reader.ReadString(delim)
+	if strings.HasSuffix(result, "\n") && !strings.HasSuffix(result, "\r\n") {
+		result = result[:len(result)-1] + "\r\n"
+	}
+	return result, err
+}
+
 type stringWriter interface {
 	WriteString(string) (int, error)
 	Flush() error
@@ -147,6 +192,22 @@ type Session struct {
 	auth      Auth
 	authState AuthState
 	security  SessionSecurity
+	full      func() bool // if non-nil, returns true when no messages can be accepted
+	readOnly  func() bool // if non-nil, returns true when messages are refused for maintenance
+	maxSize   int         // if positive, the largest message payload accepted, in bytes
+	client    string      // the IP address of the client, if known
+	user      string      // the user the client authenticated as, if any
+	greeted   bool        // false after STARTTLS, until the client sends EHLO again
+
+	// Message data read into memory is counted against a budget shared by all
+	// sessions, if there is one.
+	memory   *MemoryBudget
+	buffered int // the bytes of message data this session holds against `memory`
+
+	rate *RateLimit // if non-nil, limits how fast the client can send messages
+	log  ConnLog    // logs lines about the session, with its connection's ID
+
+	requireTLS bool // if true, MAIL, RCPT, and DATA are refused until the session is encrypted
 }
 
 // Sets up a session and returns the `Response` that should be sent to a
@@ -162,8 +223,23 @@ func (s *Session) Start(auth Auth, security SessionSecurity) Response {
 		s.authState = REQUIRED
 	}
 	s.security = security
+	s.greeted = true
 
-	return Response{220, fmt.Sprintf("%s Hi there", s.hostname)}
+	return Response{220, fmt.Sprintf("%s Hi there", s.hostname), ""}
+}
+
+// Switches the session to TLS, after the response to STARTTLS has been sent.
+// Everything the client said before the switch is forgotten, as RFC 3207
+// (section 4.2) requires: any message in progress is dropped, the client has
+// to send EHLO again before anything else, and it has to authenticate again.
+func (s *Session) StartTLS() {
+	s.security = TLS_POST_STARTTLS
+	s.Received = &ReceivedMessage{message: &message{}}
+	s.greeted = false
+	s.user = ""
+	if s.authState == AUTHENTICATED {
+		s.authState = REQUIRED
+	}
 }
 
 func (s *Session) initHostname() {
@@ -176,34 +252,61 @@ func (s *Session) initHostname() {
 
 func (s *Session) setFrom(from string) Response {
 	if len(s.Received.From) > 0 || len(s.Received.To) > 0 || len(s.Received.Data) > 0 {
-		return Response{503, "Command out of sequence"}
+		return Response{503, "Command out of sequence", "5.5.1"}
 	}
 	s.Received.From = from
-	return Response{250, "OK"}
+	return Response{250, "OK", "2.1.0"}
 }
 
 func (s *Session) addTo(to string) Response {
 	if len(s.Received.From) == 0 || len(s.Received.Data) > 0 {
-		return Response{503, "Command out of sequence"}
+		return Response{503, "Command out of sequence", "5.5.1"}
 	}
 	s.Received.To = append(s.Received.To, to)
-	return Response{250, "OK"}
+	return Response{250, "OK", "2.1.5"}
+}
+
+// Accepts a message whose payload was spooled to the file at `path`, parsing
+// only its headers.
+func (s *Session) setSpooled(path string) (Response, *ReceivedMessage) {
+	if len(s.Received.From) == 0 || len(s.Received.To) == 0 || len(s.Received.Data) > 0 {
+		return Response{503, "Command out of sequence", "5.5.1"}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return Response{451, "Failed to read spooled data", "4.3.0"}, nil
+	}
+	defer file.Close()
+
+	if msg, err := mail.ReadMessage(bufio.NewReader(file)); err != nil {
+		return Response{451, "Failed to parse data", "4.3.0"}, nil
+	} else {
+		received := s.Received
+		s.Received = &ReceivedMessage{message: &message{}}
+
+		received.Spooled = path
+		received.ClientAddr, received.AuthUser = s.client, s.user
+		received.Parsed = &mail.Message{Header: msg.Header, Body: new(bytes.Buffer)}
+		return Response{250, "Got the data", "2.0.0"}, received
+	}
 }
 
 func (s *Session) setData(data string) (Response, *ReceivedMessage) {
 	if len(s.Received.From) == 0 || len(s.Received.To) == 0 || len(s.Received.Data) > 0 {
-		return Response{503, "Command out of sequence"}, nil
+		return Response{503, "Command out of sequence", "5.5.1"}, nil
 	}
 	buf := bytes.NewBufferString(data)
 	if msg, err := mail.ReadMessage(buf); err != nil {
-		return Response{451, "Failed to parse data"}, nil
+		return Response{451, "Failed to parse data", "4.3.0"}, nil
 	} else {
 		received := s.Received
 		s.Received = &ReceivedMessage{message: &message{}}
 
 		received.Data = []byte(data)
+		received.ClientAddr, received.AuthUser = s.client, s.user
 		received.Parsed = msg
-		return Response{250, "Got the data"}, received
+		return Response{250, "Got the data", "2.0.0"}, received
 	}
 }
 
@@ -214,38 +317,131 @@ func (s *Session) setData(data string) (Response, *ReceivedMessage) {
 func (s *Session) ReadCommand(reader stringReader) (Response, error) {
 	line, err := reader.ReadString('\n')
 	if err != nil {
-		return Response{500, "Parse error"}, err
+		return Response{500, "Parse error", "5.5.2"}, err
 	}
 	return s.Advance(s.parser(line)), nil
 }
 
 // Reads the payload from a DATA command -- up to and including the "." on a
-// newline by itself.
+// newline by itself. The payload is held against the session's memory budget
+// until `ReleaseMemory()` is called, once the message has been stored.
 func (s *Session) ReadData(reader stringReader) (Response, *ReceivedMessage) {
 	data := new(bytes.Buffer)
+	if resp, ok := s.readData(reader, &budgetWriter{w: data, session: s}); !ok {
+		s.ReleaseMemory()
+		return resp, nil
+	}
+	resp, msg := s.setData(data.String())
+	if msg == nil {
+		s.ReleaseMemory()
+	}
+	return resp, msg
+}
+
+// Returns the memory held by the message data this session has read to its
+// memory budget.
+func (s *Session) ReleaseMemory() {
+	s.memory.Release(s.buffered)
+	s.buffered = 0
+}
+
+// Reads the payload from a DATA command like `ReadData()`, but writes it to a
+// file in the spool instead of holding it in memory. Only the headers of the
+// returned message are parsed.
+func (s *Session) SpoolData(reader stringReader, spool *Spool) (Response, *ReceivedMessage) {
+	file, err := spool.Create()
+	if err != nil {
+		s.log.Printf("couldn't create spool file: %s", err)
+		s.readData(reader, ioutil.Discard)
+		return Response{451, "Failed to spool data", "4.3.0"}, nil
+	}
+
+	writer := bufio.NewWriter(file)
+	resp, ok := s.readData(reader, writer)
+	if ok {
+		if err := writer.Flush(); err != nil {
+			resp, ok = Response{451, "Failed to spool data", "4.3.0"}, false
+		}
+	}
+	if err := spool.Close(file); err != nil && ok {
+		resp, ok = Response{451, "Failed to spool data", "4.3.0"}, false
+	}
+
+	var msg *ReceivedMessage
+	if ok {
+		resp, msg = s.setSpooled(file.Name())
+	}
+	if msg == nil {
+		os.Remove(file.Name())
+	}
+	return resp, msg
+}
+
+// Reads lines of a DATA payload into `w`, up to the "." on a newline by
+// itself, removing the extra "." that clients add to lines that start with one
+// (RFC 5321, section 4.5.2). If the payload is larger than the session's
+// maximum size, the rest of it is read and discarded, and a 552 response is
+// returned.
+func (s *Session) readData(reader stringReader, w io.Writer) (Response, bool) {
+	size := 0
+	var writeErr error
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			return Response{451, "Failed to read data"}, nil
+			return Response{451, "Failed to read data", "4.3.0"}, false
 		}
 
 		if line == ".\r\n" {
 			break
-		} else {
-			data.WriteString(line)
+		} else if strings.HasPrefix(line, ".") {
+			line = line[1:]
+		}
+
+		size += len(line)
+		if s.maxSize > 0 && size > s.maxSize {
+			continue
+		} else if _, err := io.WriteString(w, line); err != nil && writeErr == nil {
+			writeErr = err
 		}
 	}
-	return s.setData(data.String())
+
+	if s.maxSize > 0 && size > s.maxSize {
+		return Response{552, "Message exceeds fixed maximum message size", "5.3.4"}, false
+	} else if writeErr == ErrMemoryBudget {
+		used, _ := s.memory.Used()
+		s.log.Printf("refusing %d-byte message from %s: %d of %d bytes of memory in use", size, s.client, used, s.memory.Limit)
+		return Response{452, "Insufficient system storage, try again later", "4.3.1"}, false
+	} else if writeErr != nil {
+		s.log.Printf("couldn't write data: %s", writeErr)
+		return Response{451, "Failed to write data", "4.3.0"}, false
+	}
+	return Response{}, true
 }
 
 func (s *Session) ReadAuthResponse(reader stringReader) Response {
 	line, err := reader.ReadString('\n')
 	if err != nil {
-		return Response{500, "Parse error"}
+		return Response{500, "Parse error", "5.5.2"}
 	}
 	return s.checkCredentials(line)
 }
 
+func (s *Session) greetingRequired(command *parse.Node) bool {
+	switch strings.ToLower(command.Text) {
+	case "quit", "helo", "ehlo", "rset", "noop":
+		return false
+	}
+	return !s.greeted
+}
+
+func (s *Session) tlsRequired(command *parse.Node) bool {
+	switch strings.ToLower(command.Text) {
+	case "mail", "rcpt", "data":
+		return s.requireTLS && !s.security.IsEncrypted()
+	}
+	return false
+}
+
 func (s *Session) authRequired(command *parse.Node) bool {
 	switch strings.ToLower(command.Text) {
 	case "quit", "helo", "ehlo", "rset", "noop", "auth", "starttls":
@@ -257,9 +453,9 @@ func (s *Session) authRequired(command *parse.Node) bool {
 func (s *Session) authenticate(method string, payload string) Response {
 	switch {
 	case method != "PLAIN":
-		return Response{504, "Unrecognized authentication type"}
+		return Response{504, "Unrecognized authentication type", "5.5.4"}
 	case payload == "":
-		return Response{334, ""}
+		return Response{334, "", ""}
 	default:
 		return s.checkCredentials(payload)
 	}
@@ -268,19 +464,22 @@ func (s *Session) authenticate(method string, payload string) Response {
 func (s *Session) checkCredentials(payload string) Response {
 	data, err := base64.StdEncoding.DecodeString(payload)
 	if err != nil {
-		return Response{501, "Error decoding credentials"}
+		return Response{501, "Error decoding credentials", "5.5.2"}
 	}
 
 	valid, err := s.auth.ValidCredentials(string(data))
 	if err != nil {
-		return Response{501, "Error validating credentials"}
+		return Response{501, "Error validating credentials", "5.7.0"}
 	}
 
 	if !valid {
-		return Response{535, "Authentication failed"}
+		return Response{535, "Authentication failed", "5.7.8"}
 	} else {
 		s.authState = AUTHENTICATED
-		return Response{235, "Authentication successful"}
+		if parts := strings.Split(string(data), "\x00"); len(parts) == 3 {
+			s.user = parts[1]
+		}
+		return Response{235, "Authentication successful", "2.7.0"}
 	}
 }
 
@@ -290,46 +489,82 @@ func (s *Session) checkCredentials(payload string) Response {
 // specify the recipients and body of the message.
 func (s *Session) Advance(node *parse.Node) Response {
 	if node == nil {
-		return Response{500, "Parse error"}
+		return Response{500, "Parse error", "5.5.2"}
 	}
 
 	command, ok := node.Get("command")
 	if !ok {
-		return Response{500, "Parse error"}
+		return Response{500, "Parse error", "5.5.2"}
 	}
 
-	if s.authRequired(command) {
-		return Response{530, "Authentication required"}
+	if s.greetingRequired(command) {
+		return Response{503, "Send EHLO first", "5.5.1"}
+	} else if s.tlsRequired(command) {
+		return Response{530, "Must issue STARTTLS first", "5.7.0"}
+	} else if s.authRequired(command) {
+		return Response{530, "Authentication required", "5.7.0"}
 	}
 
 	switch strings.ToLower(command.Text) {
 	case "quit":
-		return Response{221, fmt.Sprintf("%s See ya", s.hostname)}
+		return Response{221, fmt.Sprintf("%s See ya", s.hostname), "2.0.0"}
 	case "helo":
-		return Response{250, "Hello"}
+		s.greeted = true
+		return Response{250, "Hello", ""}
 	case "ehlo":
-		text := "Hello\r\nAUTH PLAIN"
+		s.greeted = true
+		text := "Hello\r\nPIPELINING\r\nENHANCEDSTATUSCODES"
+		if s.authState == REQUIRED && s.auth.IsPermitted(s.security) {
+			text += "\r\nAUTH PLAIN"
+		}
 		if s.security.AllowStarttls() {
 			text += "\r\nSTARTTLS"
 		}
-		return Response{250, text}
+		if s.maxSize > 0 {
+			text += fmt.Sprintf("\r\nSIZE %d", s.maxSize)
+		}
+		return Response{250, text, ""}
 	case "noop":
-		return Response{250, "Noop"}
+		return Response{250, "Noop", "2.0.0"}
+	case "rset":
+		s.Received = &ReceivedMessage{message: &message{}}
+		return Response{250, "OK", "2.0.0"}
 	case "rcpt":
 		return s.addTo(node.Children["path"].Text)
 	case "mail":
+		if s.full != nil && s.full() {
+			return Response{452, "Insufficient system storage, try again later", "4.3.1"}
+		} else if !s.rate.Allow(s.client) {
+			s.log.Printf("refusing message from %s: over its rate limit", s.client)
+			return Response{450, "Too many messages from your address, try again later", "4.7.0"}
+		}
 		return s.setFrom(node.Children["path"].Text)
 	case "vrfy":
-		return Response{252, "Maybe"}
+		return Response{252, "Maybe", "2.0.0"}
 	case "data":
-		return Response{354, "Go"}
+		if s.readOnly != nil && s.readOnly() {
+			// The client will send the message again later, so there's no
+			// point keeping its envelope.
+			s.Received = &ReceivedMessage{message: &message{}}
+			return Response{452, READ_ONLY_RESPONSE, "4.3.0"}
+		} else if s.memory.Full() {
+			return Response{452, "Insufficient system storage, try again later", "4.3.1"}
+		} else if len(s.Received.From) == 0 {
+			// With pipelining, a client sends DATA without waiting to see
+			// whether MAIL and RCPT succeeded, so it's refused here rather
+			// than after the client sends the message.
+			return Response{503, "Command out of sequence", "5.5.1"}
+		} else if len(s.Received.To) == 0 {
+			return Response{554, "No valid recipients", "5.5.1"}
+		}
+		return Response{354, "Go", ""}
 	case "auth":
 		if s.authState == REQUIRED && !s.auth.IsPermitted(s.security) {
-			return Response{502, "An encrypted connection is required for authentication"}
+			return Response{502, "An encrypted connection is required for authentication", "5.7.0"}
 		} else if s.authState == AUTHENTICATED {
-			return Response{503, "Already authenticated"}
+			return Response{503, "Already authenticated", "5.5.1"}
 		} else if s.authState == NOT_PERMITTED {
-			return Response{502, "Authentication is not supported"}
+			return Response{502, "Authentication is not supported", "5.5.1"}
 		}
 		authType := node.Children["type"].Text
 		if payload, ok := node.Get("payload"); ok {
@@ -339,12 +574,12 @@ func (s *Session) Advance(node *parse.Node) Response {
 		}
 	case "starttls":
 		if s.security == TLS_POST_STARTTLS {
-			return Response{500, "Already using TLS"}
+			return Response{500, "Already using TLS", "5.5.1"}
 		} else if !s.security.AllowStarttls() {
-			return Response{500, "STARTTLS not supported"}
+			return Response{500, "STARTTLS not supported", "5.5.1"}
 		}
-		return Response{220, "Ready to switch to TLS"}
+		return Response{220, "Ready to switch to TLS", "2.0.0"}
 	default:
-		return Response{502, "Not implemented"}
+		return Response{502, "Not implemented", "5.5.1"}
 	}
 }
@@ -18,24 +18,24 @@ func (m mockStringReader) ReadString(delim byte) (string, error) {
 }
 
 func TestResponseIsClose(t *testing.T) {
-	r := Response{221, "Whatever"}
+	r := Response{221, "Whatever", ""}
 	if !r.IsClose() {
 		t.Errorf("expected 221 IsClose()")
 	}
 
-	r = Response{200, "Whatever"}
+	r = Response{200, "Whatever", ""}
 	if r.IsClose() {
 		t.Errorf("expected non-221 !IsClose()")
 	}
 }
 
 func TestResponseNeedsData(t *testing.T) {
-	r := Response{354, "Whatever"}
+	r := Response{354, "Whatever", ""}
 	if !r.NeedsData() {
 		t.Errorf("expected 354 NeedsData()")
 	}
 
-	r = Response{200, "Whatever"}
+	r = Response{200, "Whatever", ""}
 	if r.NeedsData() {
 		t.Errorf("expected non-354 !NeedsData()")
 	}
@@ -45,7 +45,7 @@ func TestResponseWriteTo(t *testing.T) {
 	output := new(bytes.Buffer)
 	buf := bufio.NewWriter(output)
 
-	Response{220, "Hello"}.WriteTo(buf)
+	Response{220, "Hello", ""}.WriteTo(buf)
 
 	contents := string(output.Bytes())
 	if contents != "220 Hello\r\n" {
@@ -57,7 +57,7 @@ func TestResponseWriteToMultiLine(t *testing.T) {
 	output := new(bytes.Buffer)
 	buf := bufio.NewWriter(output)
 
-	Response{250, "host1.example.com Hello host2.example.com\r\nAUTH PLAIN"}.WriteTo(buf)
+	Response{250, "host1.example.com Hello host2.example.com\r\nAUTH PLAIN", ""}.WriteTo(buf)
 
 	contents := string(output.Bytes())
 	if contents != "250-host1.example.com Hello host2.example.com\r\n250 AUTH PLAIN\r\n" {
@@ -65,6 +65,37 @@ func TestResponseWriteToMultiLine(t *testing.T) {
 	}
 }
 
+func TestResponseWriteToEnhancedStatus(t *testing.T) {
+	output := new(bytes.Buffer)
+	buf := bufio.NewWriter(output)
+
+	Response{550, "No such user\r\nTry another", "5.1.1"}.WriteTo(buf)
+
+	contents := string(output.Bytes())
+	if contents != "550-5.1.1 No such user\r\n550 5.1.1 Try another\r\n" {
+		t.Errorf("unexpected response: %s", contents)
+	}
+}
+
+func TestSessionEnhancedStatus(t *testing.T) {
+	s := new(Session)
+	s.Start(nil, UNENCRYPTED)
+	parser := SMTPParser()
+
+	if resp := s.Advance(parser("EHLO test.example.com\r\n")); resp.Status != "" {
+		t.Errorf("expected no enhanced status in the reply to EHLO: %#v", resp)
+	}
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Status != "2.1.0" {
+		t.Errorf("unexpected enhanced status for MAIL: %#v", resp)
+	}
+	if resp := s.Advance(parser("RCPT TO:<test@example.com>\r\n")); resp.Status != "2.1.5" {
+		t.Errorf("unexpected enhanced status for RCPT: %#v", resp)
+	}
+	if resp := s.Advance(parser("DATA\r\n")); resp.Code != 354 || resp.Status != "" {
+		t.Errorf("expected no enhanced status in the intermediate reply to DATA: %#v", resp)
+	}
+}
+
 func TestSessionStart(t *testing.T) {
 	s := new(Session)
 	resp := s.Start(nil, UNENCRYPTED)
@@ -203,8 +234,8 @@ func TestSessionAdvance(t *testing.T) {
 		t.Errorf("failed to parse subject from data payload: %s", subject)
 	}
 
-	if resp := s.Advance(parser("RSET\r\n")); resp.Code != 502 {
-		t.Errorf("RSET should get a 502 response")
+	if resp := s.Advance(parser("RSET\r\n")); resp.Code != 250 {
+		t.Errorf("RSET should get a 250 response")
 	}
 
 	if resp := s.Advance(parser("VRFY test\r\n")); resp.Code != 252 {
@@ -326,3 +357,117 @@ func TestAuthRepeated(t *testing.T) {
 		t.Errorf("repeated AUTH with a valid payload should get a 503 response")
 	}
 }
+
+func TestReadDataUnstuffsDots(t *testing.T) {
+	s := makeDataSession(t, 0)
+	buf := bytes.NewBufferString("Subject: test\r\n\r\n..\r\n...leading dots\r\n.\r\n")
+	if resp, msg := s.ReadData(buf); resp.Code != 250 || msg == nil {
+		t.Fatalf("DATA payload should get a 250 response: %d", resp.Code)
+	} else if body, _ := msg.ReadBody(); body != ".\r\n..leading dots\r\n" {
+		t.Errorf("expected leading dots to be unstuffed: %#v", body)
+	}
+}
+
+func TestAuthUserOnMessages(t *testing.T) {
+	auth := &SingleUserPlainAuth{"testuser", "testpass", true}
+	parser := SMTPParser()
+
+	s := new(Session)
+	s.Start(auth, UNENCRYPTED)
+	s.client = "10.0.0.1"
+	s.Advance(parser("HELO test.example.com\r\n"))
+	if resp := s.Advance(parser("AUTH PLAIN dGVzdHVzZXIAdGVzdHVzZXIAdGVzdHBhc3M=\r\n")); resp.Code != 235 {
+		t.Fatalf("AUTH with a valid payload should get a 235 response")
+	}
+	s.Advance(parser("MAIL FROM:<test@example.com>\r\n"))
+	s.Advance(parser("RCPT TO:<test@example.com>\r\n"))
+
+	buf := bytes.NewBufferString("Subject: test\r\n\r\ntest\r\n.\r\n")
+	if resp, msg := s.ReadData(buf); msg == nil {
+		t.Fatalf("DATA payload should get a 250 response: %d", resp.Code)
+	} else if msg.AuthUser != "testuser" || msg.ClientAddr != "10.0.0.1" {
+		t.Errorf("unexpected client details on message: %#v, %#v", msg.AuthUser, msg.ClientAddr)
+	}
+}
+
+func TestSessionStartTLS(t *testing.T) {
+	auth := &SingleUserPlainAuth{Username: "testuser", Password: "testpass"}
+	parser := SMTPParser()
+
+	s := new(Session)
+	s.Start(auth, TLS_PRE_STARTTLS)
+
+	if resp := s.Advance(parser("EHLO test.example.com\r\n")); resp.Text != "Hello\r\nPIPELINING\r\nENHANCEDSTATUSCODES\r\nSTARTTLS" {
+		t.Errorf("expected EHLO to advertise only STARTTLS before TLS: %#v", resp.Text)
+	}
+	if resp := s.Advance(parser("STARTTLS\r\n")); !resp.StartsTLS() {
+		t.Fatalf("STARTTLS should get a 220 response: %d", resp.Code)
+	}
+	s.StartTLS()
+
+	if resp := s.Advance(parser("AUTH PLAIN dGVzdHVzZXIAdGVzdHVzZXIAdGVzdHBhc3M=\r\n")); resp.Code != 503 {
+		t.Errorf("AUTH before EHLO after STARTTLS should get a 503 response: %d", resp.Code)
+	}
+	if resp := s.Advance(parser("EHLO test.example.com\r\n")); resp.Text != "Hello\r\nPIPELINING\r\nENHANCEDSTATUSCODES\r\nAUTH PLAIN" {
+		t.Errorf("expected EHLO to advertise only AUTH after TLS: %#v", resp.Text)
+	}
+	if resp := s.Advance(parser("AUTH PLAIN dGVzdHVzZXIAdGVzdHVzZXIAdGVzdHBhc3M=\r\n")); resp.Code != 235 {
+		t.Errorf("AUTH after STARTTLS should get a 235 response: %d", resp.Code)
+	}
+	if resp := s.Advance(parser("STARTTLS\r\n")); resp.Code != 500 {
+		t.Errorf("repeated STARTTLS should get a 500 response: %d", resp.Code)
+	}
+}
+
+func TestSessionStartTLSForgetsState(t *testing.T) {
+	auth := &SingleUserPlainAuth{"testuser", "testpass", true}
+	parser := SMTPParser()
+
+	s := new(Session)
+	s.Start(auth, TLS_PRE_STARTTLS)
+	s.Advance(parser("EHLO test.example.com\r\n"))
+	s.Advance(parser("AUTH PLAIN dGVzdHVzZXIAdGVzdHVzZXIAdGVzdHBhc3M=\r\n"))
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Code != 250 {
+		t.Fatalf("MAIL should get a 250 response: %d", resp.Code)
+	}
+	s.Advance(parser("STARTTLS\r\n"))
+	s.StartTLS()
+
+	if s.Received.From != "" || s.user != "" {
+		t.Errorf("expected the message in progress and the user to be forgotten: %#v, %#v", s.Received.From, s.user)
+	}
+	s.Advance(parser("EHLO test.example.com\r\n"))
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Code != 530 {
+		t.Errorf("MAIL should require authenticating again after STARTTLS: %d", resp.Code)
+	}
+}
+
+func TestSessionRequireTLS(t *testing.T) {
+	parser := SMTPParser()
+
+	s := &Session{requireTLS: true}
+	s.Start(nil, TLS_PRE_STARTTLS)
+	s.Advance(parser("EHLO test.example.com\r\n"))
+	for _, command := range []string{"MAIL FROM:<test@example.com>\r\n", "RCPT TO:<test@example.com>\r\n", "DATA\r\n"} {
+		if resp := s.Advance(parser(command)); resp.Code != 530 || resp.Text != "Must issue STARTTLS first" {
+			t.Errorf("expected %#v to require STARTTLS first: %#v", command, resp)
+		}
+	}
+	if resp := s.Advance(parser("NOOP\r\n")); resp.Code != 250 {
+		t.Errorf("NOOP shouldn't require STARTTLS: %d", resp.Code)
+	}
+
+	s.Advance(parser("STARTTLS\r\n"))
+	s.StartTLS()
+	s.Advance(parser("EHLO test.example.com\r\n"))
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Code != 250 {
+		t.Errorf("MAIL should be accepted after STARTTLS: %d", resp.Code)
+	}
+
+	s = new(Session)
+	s.Start(nil, TLS_PRE_STARTTLS)
+	s.Advance(parser("EHLO test.example.com\r\n"))
+	if resp := s.Advance(parser("MAIL FROM:<test@example.com>\r\n")); resp.Code != 250 {
+		t.Errorf("MAIL shouldn't require STARTTLS by default: %d", resp.Code)
+	}
+}
@@ -0,0 +1,119 @@
+// Message severities, so that the worst problems in a summary come first.
+// `--severity-expr` extracts a severity from each message (e.g. from an
+// `X-Severity` header, or a log level in its body), as a syslog level name
+// ("err", "warning", and so on, with some common aliases) or number (0 for
+// "emerg" to 7 for "debug"). Each group in a summary takes the most severe of
+// its messages' severities, and groups are sorted by severity, then by
+// count. With `--severity-passthrough`, messages at least as severe as the
+// given level skip batching, and are relayed immediately, as is.
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Other names for the syslog levels in `JOURNAL_PRIORITIES`.
+var SEVERITY_ALIASES = map[string]string{
+	"emergency":   "emerg",
+	"panic":       "emerg",
+	"critical":    "crit",
+	"fatal":       "crit",
+	"error":       "err",
+	"warn":        "warning",
+	"information": "info",
+	"trace":       "debug",
+}
+
+// Returns the syslog level name for a severity (e.g. "ERROR" or "3" is
+// "err"), or "" if it isn't one.
+func NormalizeSeverity(severity string) string {
+	severity = strings.ToLower(strings.TrimSpace(severity))
+	if alias, ok := SEVERITY_ALIASES[severity]; ok {
+		return alias
+	}
+	if level, err := strconv.Atoi(severity); err == nil && level >= 0 && level < len(JOURNAL_PRIORITIES) {
+		return JOURNAL_PRIORITIES[level]
+	}
+	for _, name := range JOURNAL_PRIORITIES {
+		if name == severity {
+			return name
+		}
+	}
+	return ""
+}
+
+// Returns the syslog level of a normalized severity, from 0 (the most
+// severe) to 7, or 8 (less severe than any) if it isn't one.
+func severityLevel(severity string) int {
+	for level, name := range JOURNAL_PRIORITIES {
+		if name == severity {
+			return level
+		}
+	}
+	return len(JOURNAL_PRIORITIES)
+}
+
+// `Severities` extracts messages' severities with `Expr`.
+type Severities struct {
+	Expr        GroupBy
+	Passthrough string // if non-empty, messages at least this severe are relayed instead of batched
+}
+
+// Returns the severity of a message, normalized, or "" if it has none.
+func (s *Severities) Of(msg *ReceivedMessage) string {
+	severity, err := s.Expr(msg)
+	if err != nil {
+		log.Printf("warning: error extracting the severity of a message: %s", err)
+		return ""
+	}
+	return NormalizeSeverity(severity)
+}
+
+// Returns true if the message is severe enough to be relayed as is instead
+// of batched. A nil `Severities` never relays messages.
+func (s *Severities) PassesThrough(msg *ReceivedMessage) bool {
+	if s == nil || s.Passthrough == "" {
+		return false
+	}
+	severity := s.Of(msg)
+	return severity != "" && severityLevel(severity) <= severityLevel(s.Passthrough)
+}
+
+// Sets `Severity` on each of the summary's unique messages to the most
+// severe of its messages' severities, finding each message's group with
+// `group`, then sorts them by severity, most severe first, and then by
+// count. A nil `Severities` leaves them alone.
+func (s *Severities) Annotate(group GroupBy, summary *SummaryMessage) {
+	if s == nil {
+		return
+	}
+
+	uniques := make(map[string]*UniqueMessage, len(summary.UniqueMessages))
+	for _, unique := range summary.UniqueMessages {
+		uniques[unique.Template] = unique
+	}
+	for _, stored := range summary.StoredMessages {
+		key, err := group(stored.ReceivedMessage)
+		if err != nil {
+			continue
+		}
+		unique, ok := uniques[key]
+		if !ok {
+			continue
+		}
+		if severity := s.Of(stored.ReceivedMessage); severity != "" && severityLevel(severity) < severityLevel(unique.Severity) {
+			unique.Severity = severity
+		}
+	}
+
+	sorted := summary.UniqueMessages
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if left, right := severityLevel(sorted[i].Severity), severityLevel(sorted[j].Severity); left != right {
+			return left < right
+		}
+		return sorted[i].Count > sorted[j].Count
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSeverity(t *testing.T) {
+	for severity, expected := range map[string]string{
+		"err":      "err",
+		"ERROR":    "err",
+		" Fatal ":  "crit",
+		"warn":     "warning",
+		"0":        "emerg",
+		"7":        "debug",
+		"8":        "",
+		"-1":       "",
+		"":         "",
+		"whatever": "",
+	} {
+		if actual := NormalizeSeverity(severity); actual != expected {
+			t.Errorf("expected severity %#v to be %#v, got %#v", severity, expected, actual)
+		}
+	}
+}
+
+func TestSeveritiesPassesThrough(t *testing.T) {
+	severities := &Severities{GroupByExpr("severity", `{{.Header.Get "X-Severity"}}`), "crit"}
+	for severity, expected := range map[string]bool{"alert": true, "critical": true, "err": false, "": false} {
+		msg := makeReceivedMessage(t, "X-Severity: "+severity+"\r\nSubject: test\r\n\r\nbody\r\n")
+		if severities.PassesThrough(msg) != expected {
+			t.Errorf("expected a message with severity %#v to pass through: %v", severity, expected)
+		}
+	}
+
+	msg := makeReceivedMessage(t, "X-Severity: emerg\r\nSubject: test\r\n\r\nbody\r\n")
+	severities.Passthrough = ""
+	if severities.PassesThrough(msg) {
+		t.Errorf("expected no messages to pass through without a threshold")
+	}
+	if (*Severities)(nil).PassesThrough(msg) {
+		t.Errorf("expected a nil Severities not to pass messages through")
+	}
+}
+
+func TestSeveritiesAnnotate(t *testing.T) {
+	summary := makeSummaryMessage(t,
+		"X-Severity: info\r\nSubject: one\r\n\r\nbody\r\n",
+		"X-Severity: warning\r\nSubject: two\r\n\r\nbody\r\n",
+		"X-Severity: err\r\nSubject: two\r\n\r\nbody\r\n",
+		"Subject: three\r\n\r\nbody\r\n",
+		"Subject: three\r\n\r\nbody\r\n",
+		"X-Severity: info\r\nSubject: four\r\n\r\nbody\r\n",
+		"X-Severity: info\r\nSubject: four\r\n\r\nbody\r\n",
+	)
+	severities := &Severities{Expr: GroupByExpr("severity", `{{.Header.Get "X-Severity"}}`)}
+	severities.Annotate(GroupByExpr("group", `{{.Header.Get "Subject"}}`), summary)
+
+	order := make([]string, 0)
+	for _, unique := range summary.UniqueMessages {
+		order = append(order, unique.Subject+"="+unique.Severity)
+	}
+	if actual := strings.Join(order, ","); actual != "two=err,four=info,one=info,three=" {
+		t.Errorf("expected groups sorted by severity, then count: %s", actual)
+	}
+	if contents := string(summary.Contents()); !strings.Contains(contents, "- Message group 1 of 4: 2 instances\r\n  From") || !strings.Contains(contents, "  Severity: err\r\n") {
+		t.Errorf("expected the summary to note each group's severity: %s", contents)
+	}
+}
+
+func TestRelaySeverityPassthrough(t *testing.T) {
+	relay := &Relay{Severities: &Severities{GroupByExpr("severity", `{{.Header.Get "X-Severity"}}`), "crit"}}
+	if relay.Matches(makeReceivedMessage(t, "X-Severity: crit\r\nSubject: test\r\n\r\nbody\r\n")) {
+		t.Errorf("expected a critical message to be relayed")
+	}
+	if !relay.Matches(makeReceivedMessage(t, "X-Severity: err\r\nSubject: test\r\n\r\nbody\r\n")) {
+		t.Errorf("expected a less severe message to be batched without a filter")
+	}
+}
+
+func TestConfigSeverities(t *testing.T) {
+	config := Defaults()
+	if severities, err := config.Severities(); err != nil || severities != nil {
+		t.Errorf("expected no severities by default: %v, %v", severities, err)
+	}
+
+	config.SeverityPassthrough = "crit"
+	if _, err := config.Severities(); err == nil {
+		t.Errorf("expected an error from --severity-passthrough without --severity-expr")
+	}
+
+	config.SeverityExpr = `{{.Header.Get "X-Severity"}}`
+	config.SeverityPassthrough = "severe"
+	if _, err := config.Severities(); err == nil {
+		t.Errorf("expected an error from an invalid --severity-passthrough")
+	}
+
+	config.SeverityPassthrough = "2"
+	if severities, err := config.Severities(); err != nil || severities.Passthrough != "crit" {
+		t.Errorf("expected --severity-passthrough to be normalized: %v, %v", severities, err)
+	}
+}
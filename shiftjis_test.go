@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDecodeShiftJIS(t *testing.T) {
+	tests := map[string]string{
+		"disk full":                        "disk full",
+		"\x83\x66\x83\x42\x83\x58\x83\x4e": "ディスク",
+		"\xc3\xbd\xc4":                     "ﾃｽﾄ",
+		"\x87\x40\x95\x5c":                 "①表",
+		"\x83":                             "�",
+		"\x83\x20ok":                       "� ok",
+		"\xa0\xfd":                         "��",
+	}
+	for input, expected := range tests {
+		if decoded := decodeShiftJIS([]byte(input)); decoded != expected {
+			t.Errorf("unexpected decoding of %#v: %#v", input, decoded)
+		}
+	}
+}
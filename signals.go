@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
@@ -12,21 +13,35 @@ type TerminationRequest int
 const (
 	GracefulShutdown TerminationRequest = iota
 	Reload
+
+	// Like `GracefulShutdown`, but batches are sent as they come due, rather
+	// than all at once.
+	Drain
 )
 
-// Listens for a SIGTERM or SIGUSR1, forwards it on as a `TerminationRequest`
-// to all subscribers, and returns true if a reload is required.
-func HandleSignals(reqs []chan<- TerminationRequest) bool {
+// Listens for a SIGTERM, SIGUSR1, or SIGQUIT, forwards it on as a
+// `TerminationRequest` to all subscribers, and returns true if a reload is
+// required. If another of those signals arrives afterwards, `cancel` is
+// called, so that a shutdown that's taking too long can be hurried along.
+func HandleSignals(reqs []chan<- TerminationRequest, cancel context.CancelFunc) bool {
 	signals := make(chan os.Signal, 0)
-	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGQUIT)
 	sig := <-signals
 	log.Printf("caught signal %s", sig)
 	for _, req := range reqs {
-		if sig == syscall.SIGUSR1 {
+		switch sig {
+		case syscall.SIGUSR1:
 			req <- Reload
-		} else {
+		case syscall.SIGQUIT:
+			req <- Drain
+		default:
 			req <- GracefulShutdown
 		}
 	}
+	go func() {
+		sig := <-signals
+		log.Printf("caught signal %s again, cancelling", sig)
+		cancel()
+	}()
 	return sig == syscall.SIGUSR1
 }
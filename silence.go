@@ -0,0 +1,60 @@
+// Support for silencing a noisy batch for a while, e.g. by an operator who
+// already knows about the problem it's reporting.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// `Silences` tracks the batch keys that are silenced, and until when. It's
+// safe to use from multiple goroutines.
+type Silences struct {
+	until map[string]time.Time
+	lock  sync.Mutex
+}
+
+func NewSilences() *Silences {
+	return &Silences{until: make(map[string]time.Time, 0)}
+}
+
+// Silences the batch key until the given time. A time that isn't after now
+// lifts the silence.
+func (s *Silences) Silence(key string, until time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if until.After(nowGetter()) {
+		s.until[key] = until
+	} else {
+		delete(s.until, key)
+	}
+}
+
+// Returns true if the batch key is silenced at `now`. A nil `Silences` never
+// silences anything.
+func (s *Silences) IsSilenced(key string, now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	until, ok := s.until[key]
+	if ok && !now.Before(until) {
+		delete(s.until, key)
+		return false
+	}
+	return ok
+}
+
+// Returns a copy of the active silences, keyed by batch key.
+func (s *Silences) Active(now time.Time) map[string]time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make(map[string]time.Time, len(s.until))
+	for key, until := range s.until {
+		if now.Before(until) {
+			result[key] = until
+		}
+	}
+	return result
+}
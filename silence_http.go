@@ -0,0 +1,61 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// `SilenceRequest` is the JSON payload accepted by `POST /api/silence`.
+type SilenceRequest struct {
+	Key      string
+	Duration string // e.g. "30m"; "0s" lifts an existing silence
+}
+
+// Serves `/api/silence`: GET lists the active silences, and POST adds (or
+// lifts) one.
+func (s *Silences) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, s.Active(nowGetter()))
+	case "POST":
+		req := new(SilenceRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		} else if duration < 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Duration must not be negative"))
+			return
+		}
+
+		until := nowGetter().Add(duration)
+		s.Silence(req.Key, until)
+		log.Printf("silenced batch %#v for %s", req.Key, duration)
+		writeJSON(w, map[string]time.Time{req.Key: until})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("must be a GET or POST"))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if bytes, err := json.Marshal(value); err == nil {
+		fmt.Fprintf(w, "%s\n", bytes)
+	} else {
+		log.Printf("error serializing response: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "{}\n")
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSilencesHTTP(t *testing.T) {
+	defer patchTime(time.Unix(1393650000, 0))()
+	silences := NewSilences()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/silence", bytes.NewBufferString(`{"key": "noisy", "duration": "1h"}`))
+	silences.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status silencing a key: %d %s", w.Code, w.Body)
+	}
+	if !silences.IsSilenced("noisy", nowGetter()) {
+		t.Errorf("expected the key to be silenced")
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/api/silence", nil)
+	silences.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"noisy"`) {
+		t.Errorf("expected the silence to be listed: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/api/silence", bytes.NewBufferString(`{"key": "noisy", "duration": "forever"}`))
+	silences.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid duration to be rejected: %d", w.Code)
+	}
+}
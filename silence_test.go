@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSilences(t *testing.T) {
+	now := time.Unix(1393650000, 0)
+	defer patchTime(now)()
+
+	silences := NewSilences()
+	silences.Silence("noisy", now.Add(time.Minute))
+	if !silences.IsSilenced("noisy", now) {
+		t.Errorf("expected the key to be silenced")
+	}
+	if silences.IsSilenced("other", now) {
+		t.Errorf("expected another key not to be silenced")
+	}
+	if silences.IsSilenced("noisy", now.Add(time.Minute)) {
+		t.Errorf("expected the silence to expire")
+	}
+	if active := silences.Active(now); len(active) != 0 {
+		t.Errorf("expected an expired silence to be forgotten: %v", active)
+	}
+
+	var nilSilences *Silences
+	if nilSilences.IsSilenced("noisy", now) {
+		t.Errorf("expected nil silences not to silence anything")
+	}
+}
+
+func TestFlushSilenced(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Silences = NewSilences()
+	outgoing := make(chan *SendRequest, 64)
+
+	summaries := make([]*SummaryMessage, 0)
+	go func() {
+		for req := range outgoing {
+			summaries = append(summaries, req.Message.(*SummaryMessage))
+			req.SendErrors <- nil
+		}
+	}()
+
+	start := time.Unix(1393650000, 0)
+	defer patchTime(start)()
+	buf.Silences.Silence("test", start.Add(time.Minute))
+	buf.Store.Add(start, makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest 1"))
+	buf.Store.Add(start, makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest 2"))
+	buf.Flush(context.Background(), start, outgoing, false)
+	buf.Flush(context.Background(), start.Add(30*time.Second), outgoing, true)
+	if count := len(summaries); count != 0 {
+		t.Fatalf("expected no summaries while silenced: %d", count)
+	}
+
+	buf.Flush(context.Background(), start.Add(time.Minute), outgoing, false)
+	if count := len(summaries); count != 1 {
+		t.Fatalf("expected a summary after the silence expired: %d", count)
+	}
+	if contents := string(summaries[0].Contents()); !strings.Contains(contents, "2 messages suppressed while silenced") {
+		t.Errorf("expected a note about silenced messages: %s", contents)
+	}
+}
@@ -0,0 +1,341 @@
+// Scripted end-to-end tests of a configuration. `failmail test` runs a spec
+// file through an in-memory copy of the configured receiver, writer, and
+// summarizer, with a virtual clock, and checks the responses and summaries
+// they produce, so that batch and group expressions and templates can be
+// regression-tested before they're deployed. (See "Testing a configuration"
+// in the README for the format of spec files.)
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The time the virtual clock starts at when running a spec.
+var SPEC_START = time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+// How far the virtual clock moves each time a message is received, so that
+// messages received at the same point in a spec are in a well-defined order.
+const SPEC_RECEIVE_TICK = time.Millisecond
+
+// Matches a step in a spec: an actor ("D" for a downstream connection, "T"
+// for the clock, or "U" for the upstream server), an optional number, an
+// operation, and its argument.
+var specStepPattern = regexp.MustCompile(`^([DTU])(\d*)([<>=]) ?(.*)$`)
+
+// `SpecRunner` runs spec files against a pipeline built from a `Config`.
+type SpecRunner struct {
+	listener *Listener
+	auth     Auth
+	buffer   *MessageBuffer
+	received chan *StorageRequest
+	outgoing chan *SendRequest
+	upstream *specUpstream
+	conns    map[int]*specConn
+	clock    *VirtualClock
+	checks   int
+	failures []string
+}
+
+// The state of a downstream connection in a spec.
+type specConn struct {
+	session   *Session
+	responses []Response    // responses not yet checked by a "D<" step
+	data      *bytes.Buffer // if non-nil, the DATA payload being sent
+	auth      bool          // if true, the next line answers an AUTH challenge
+	closed    bool          // if true, the client sent QUIT, and the next line reconnects
+}
+
+// Collects the summaries sent by a spec's pipeline.
+type specUpstream struct {
+	sent []OutgoingMessage
+}
+
+func (u *specUpstream) Send(m OutgoingMessage) error {
+	u.sent = append(u.sent, m)
+	return nil
+}
+
+// Builds the receiver, writer, and summarizer from `config`, with a memory
+// store, and without writing any files or relaying any messages.
+func NewSpecRunner(config *Config) (*SpecRunner, error) {
+	specConfig := *config
+	specConfig.MemoryStore = true
+	specConfig.WatchStore = false
+	specConfig.Lease = 0
+	specConfig.History = ""
+	specConfig.KeepReceipts = 0
+
+	auth, err := specConfig.Auth()
+	if err != nil {
+		return nil, err
+	}
+	rewriter, err := specConfig.Rewriter()
+	if err != nil {
+		return nil, err
+	}
+	writer, err := specConfig.MakeWriter()
+	if err != nil {
+		return nil, err
+	}
+	if writer.Relay != nil {
+		writer.Relay.Upstream = &DebugUpstream{ioutil.Discard}
+	}
+	buffer, err := specConfig.MakeSummarizer()
+	if err != nil {
+		return nil, err
+	}
+	clock := NewVirtualClock(SPEC_START)
+	writer.Clock = clock
+	buffer.Store = writer.Store
+	buffer.Clock = clock
+
+	runner := &SpecRunner{
+		listener: &Listener{Rewriter: rewriter, Loops: specConfig.LoopDetector(), MaxSize: specConfig.MaxMessageSize},
+		auth:     auth,
+		buffer:   buffer,
+		received: make(chan *StorageRequest, 0),
+		outgoing: make(chan *SendRequest, 0),
+		upstream: new(specUpstream),
+		conns:    make(map[int]*specConn, 0),
+		clock:    clock,
+	}
+	go writer.Run(runner.received)
+	go (&Sender{Upstream: runner.upstream, Clock: clock}).Run(context.Background(), runner.outgoing)
+	return runner, nil
+}
+
+// Runs the steps in a spec, and returns the checks that failed, each prefixed
+// with `name` and its line number. Returns an error if the spec can't be
+// read or has a step that can't be run.
+func (r *SpecRunner) Run(name string, spec io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(spec)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		failure, err := r.step(line)
+		if err != nil {
+			return r.failures, fmt.Errorf("%s:%d: %s", name, lineno, err)
+		} else if failure != "" {
+			r.failures = append(r.failures, fmt.Sprintf("%s:%d: %s", name, lineno, failure))
+		}
+	}
+	return r.failures, scanner.Err()
+}
+
+// Returns the number of checks run so far.
+func (r *SpecRunner) Checks() int {
+	return r.checks
+}
+
+// Stops the pipeline. The runner can't be used afterwards.
+func (r *SpecRunner) Close() {
+	close(r.received)
+	close(r.outgoing)
+}
+
+// Runs a single step, returning a description of the failure if it's a check
+// that fails.
+func (r *SpecRunner) step(line string) (string, error) {
+	match := specStepPattern.FindStringSubmatch(line)
+	if match == nil {
+		return "", fmt.Errorf("invalid step %#v", line)
+	}
+	actor, number, op, text := match[1], match[2], match[3], match[4]
+
+	n := 0
+	if number != "" {
+		n, _ = strconv.Atoi(number)
+	}
+	switch {
+	case actor == "D" && op == ">" && n > 0:
+		r.send(r.conn(n), text)
+		return "", nil
+	case actor == "D" && op == "<" && n > 0:
+		return r.expectResponse(r.conn(n), text), nil
+	case actor == "T" && op == ">" && number == "":
+		duration, err := time.ParseDuration(strings.TrimPrefix(strings.TrimSpace(text), "+"))
+		if err != nil {
+			return "", err
+		} else if duration < 0 {
+			return "", fmt.Errorf("the clock can't go backwards")
+		}
+		now := r.clock.Advance(duration)
+		start := len(r.upstream.sent)
+		err = r.buffer.Flush(context.Background(), now, r.outgoing, false)
+		r.sortSummaries(start)
+		return "", err
+	case actor == "U" && op == "<" && n > 0:
+		return r.expectSummary(n, text), nil
+	case actor == "U" && op == "=" && number == "":
+		count, err := strconv.Atoi(strings.TrimSpace(text))
+		if err != nil {
+			return "", err
+		}
+		r.checks += 1
+		if sent := len(r.upstream.sent); sent != count {
+			return fmt.Sprintf("expected %s, got %d", Plural(count, "summary", "summaries"), sent), nil
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid step %#v", line)
+	}
+}
+
+// Returns the downstream connection numbered `n`, connecting it if it isn't
+// connected. The greeting isn't checked.
+func (r *SpecRunner) conn(n int) *specConn {
+	if conn, ok := r.conns[n]; ok {
+		return conn
+	}
+	session := new(Session)
+	session.maxSize = r.listener.MaxSize
+	session.Start(r.auth, UNENCRYPTED)
+	conn := &specConn{session: session, responses: make([]Response, 0)}
+	r.conns[n] = conn
+	return conn
+}
+
+// Sends a line to the receiver on a connection, as `Listener` would read it
+// from a client.
+func (r *SpecRunner) send(conn *specConn, text string) {
+	line := text + "\r\n"
+	switch {
+	case conn.data != nil && text == ".":
+		conn.data.WriteString(line)
+		resp, msg := conn.session.ReadData(bufio.NewReader(conn.data))
+		conn.data = nil
+		if msg != nil {
+			r.clock.Advance(SPEC_RECEIVE_TICK)
+			resp = r.listener.store(conn.session.log, msg, resp, r.received)
+		}
+		conn.responses = append(conn.responses, resp)
+	case conn.data != nil:
+		conn.data.WriteString(line)
+	case conn.auth:
+		conn.auth = false
+		resp := conn.session.ReadAuthResponse(bufio.NewReader(strings.NewReader(line)))
+		conn.responses = append(conn.responses, resp)
+	default:
+		if conn.closed {
+			conn.session.Start(r.auth, UNENCRYPTED)
+			conn.closed = false
+		}
+		resp := conn.session.Advance(conn.session.parser(line))
+		conn.responses = append(conn.responses, resp)
+		conn.auth = resp.NeedsAuthResponse()
+		conn.closed = resp.IsClose()
+		if resp.NeedsData() {
+			conn.data = new(bytes.Buffer)
+		}
+	}
+}
+
+// Checks that the oldest unchecked response on a connection starts with
+// `expected` (e.g. "250" or "250 Got the data").
+func (r *SpecRunner) expectResponse(conn *specConn, expected string) string {
+	r.checks += 1
+	if len(conn.responses) == 0 {
+		return fmt.Sprintf("expected response %#v, but there are no more responses", expected)
+	}
+	resp := conn.responses[0]
+	conn.responses = conn.responses[1:]
+
+	actual := fmt.Sprintf("%d %s", resp.Code, resp.Text)
+	if !strings.HasPrefix(actual, expected) {
+		return fmt.Sprintf("expected response %#v, got %#v", expected, actual)
+	}
+	return ""
+}
+
+// Checks that a line of the `n`th summary sent contains `expected`.
+// Summaries sent at the same time are numbered in order of recipient, then
+// subject.
+func (r *SpecRunner) expectSummary(n int, expected string) string {
+	r.checks += 1
+	if n > len(r.upstream.sent) {
+		return fmt.Sprintf("expected summary %d to contain %#v, but %s sent", n, expected, Plural(len(r.upstream.sent), "summary was", "summaries were"))
+	}
+
+	contents := string(r.upstream.sent[n-1].Contents())
+	for _, line := range strings.Split(strings.Replace(contents, "\r\n", "\n", -1), "\n") {
+		if strings.Contains(line, expected) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("expected summary %d to contain %#v, got:\n%s", n, expected, contents)
+}
+
+// Orders the summaries from index `start` on, which were sent by one flush, by
+// recipient and then subject, since batches are flushed in no particular
+// order.
+func (r *SpecRunner) sortSummaries(start int) {
+	sent := r.upstream.sent[start:]
+	keys := make([]string, len(sent))
+	for i, m := range sent {
+		keys[i] = strings.Join(m.Recipients(), ",")
+		if parsed, err := mail.ReadMessage(bytes.NewBuffer(m.Contents())); err == nil {
+			keys[i] += "\x00" + parsed.Header.Get("Subject")
+		}
+	}
+	sort.Sort(&specSummaries{sent, keys})
+}
+
+type specSummaries struct {
+	sent []OutgoingMessage
+	keys []string
+}
+
+func (s *specSummaries) Len() int           { return len(s.sent) }
+func (s *specSummaries) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s *specSummaries) Swap(i, j int) {
+	s.sent[i], s.sent[j] = s.sent[j], s.sent[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// `TestCommand` runs the spec file given by `--spec` against the configured
+// pipeline, and reports the checks that failed.
+func TestCommand(config *Config, out io.Writer) error {
+	if config.Spec == "" {
+		return fmt.Errorf("--spec is required")
+	}
+
+	file, err := os.Open(config.Spec)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	runner, err := NewSpecRunner(config)
+	if err != nil {
+		return err
+	}
+	defer runner.Close()
+
+	failures, err := runner.Run(config.Spec, file)
+	if err != nil {
+		return err
+	}
+	for _, failure := range failures {
+		fmt.Fprintf(out, "%s\n", failure)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %s failed", len(failures), Plural(runner.Checks(), "check", "checks"))
+	}
+	fmt.Fprintf(out, "ok %s (%s)\n", config.Spec, Plural(runner.Checks(), "check", "checks"))
+	return nil
+}
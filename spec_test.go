@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runSpec(t *testing.T, config *Config, spec string) []string {
+	runner, err := NewSpecRunner(config)
+	if err != nil {
+		t.Fatalf("unexpected error creating runner: %s", err)
+	}
+	defer runner.Close()
+
+	failures, err := runner.Run("spec", strings.NewReader(spec))
+	if err != nil {
+		t.Fatalf("unexpected error running spec: %s", err)
+	}
+	return failures
+}
+
+func TestSpecFiles(t *testing.T) {
+	files, err := filepath.Glob("testfiles/*")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("expected spec files, got %v (%v)", files, err)
+	}
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("couldn't open %s: %s", name, err)
+		}
+		runner, err := NewSpecRunner(Defaults())
+		if err != nil {
+			t.Fatalf("unexpected error creating runner: %s", err)
+		}
+		if failures, err := runner.Run(name, file); err != nil {
+			t.Errorf("unexpected error running %s: %s", name, err)
+		} else if len(failures) > 0 {
+			t.Errorf("unexpected failures in %s:\n%s", name, strings.Join(failures, "\n"))
+		}
+		runner.Close()
+		file.Close()
+	}
+}
+
+func TestSpecFailures(t *testing.T) {
+	failures := runSpec(t, Defaults(), "D1> HELO localhost\nD1< 500\nD1< 250\nT> 1m\nU= 1\nU1< Subject: test\n")
+	if len(failures) != 4 {
+		t.Fatalf("expected 4 failures, got %#v", failures)
+	}
+	for i, expected := range []string{
+		`spec:2: expected response "500", got "250 Hello"`,
+		`spec:3: expected response "250", but there are no more responses`,
+		`spec:5: expected 1 summary, got 0`,
+		`spec:6: expected summary 1 to contain "Subject: test", but 0 summaries were sent`,
+	} {
+		if failures[i] != expected {
+			t.Errorf("expected failure %#v, got %#v", expected, failures[i])
+		}
+	}
+}
+
+func TestSpecOrdersSummaries(t *testing.T) {
+	message := func(conn string, to string, subject string) string {
+		return strings.Replace("DN> MAIL FROM:<app@example.com>\nDN> RCPT TO:<"+to+">\nDN> DATA\nDN> Subject: "+subject+"\nDN> X-Failmail-Split: "+subject+"\nDN>\nDN> test\nDN> .\n", "DN", conn, -1)
+	}
+	config := Defaults()
+	config.Workers = 4
+	spec := "D1> HELO localhost\n" +
+		message("D1", "b@example.com", "zzz") +
+		message("D1", "b@example.com", "aaa") +
+		message("D1", "a@example.com", "mmm") +
+		"T> 1h\nU= 3\nU1< Subject: [failmail] 1 instance: mmm\nU2< Subject: [failmail] 1 instance: aaa\nU3< Subject: [failmail] 1 instance: zzz\n"
+	if failures := runSpec(t, config, spec); len(failures) > 0 {
+		t.Errorf("unexpected failures:\n%s", strings.Join(failures, "\n"))
+	}
+}
+
+func TestSpecInvalidSteps(t *testing.T) {
+	for _, spec := range []string{"X1> HELO", "D> HELO", "T> soon", "T> -5m", "U< Subject", "U1= 2"} {
+		runner, _ := NewSpecRunner(Defaults())
+		if _, err := runner.Run("spec", strings.NewReader(spec)); err == nil {
+			t.Errorf("expected an error for %#v", spec)
+		}
+		runner.Close()
+	}
+}
@@ -0,0 +1,110 @@
+// Splitting of summaries that are too large to send. A big enough incident
+// can produce a summary that the relay would reject for its size; rather
+// than losing it, failmail sends it as several numbered summaries, each with
+// some of the unique messages.
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Renders the summary, splitting it into parts ("part 2 of 3") at unique
+// message boundaries if it's larger than `maxSize` bytes, or than `limit`,
+// the most the relay accepts (0 for either means no limit). A part with a
+// single unique message is sent as is, even if it's still too large, unless
+// it's over `limit`, in which case the message's body is truncated to fit.
+func RenderParts(renderer SummaryRenderer, summary *SummaryMessage, maxSize int, limit int) []OutgoingMessage {
+	if limit > 0 && (maxSize <= 0 || limit < maxSize) {
+		maxSize = limit
+	}
+	if maxSize <= 0 {
+		return []OutgoingMessage{renderer.Render(summary)}
+	}
+
+	parts := splitSummary(renderer, summary, maxSize)
+	if len(parts) == 1 {
+		return []OutgoingMessage{renderer.Render(truncateSummary(renderer, summary, limit))}
+	}
+
+	result := make([]OutgoingMessage, 0, len(parts))
+	for i, part := range parts {
+		part.Subject = partSubject(summary.Subject, i+1, len(parts))
+		result = append(result, renderer.Render(truncateSummary(renderer, part, limit)))
+	}
+	return result
+}
+
+func partSubject(subject string, part int, parts int) string {
+	return fmt.Sprintf("%s (part %d of %d)", subject, part, parts)
+}
+
+// Halves the summary's unique messages until each part fits.
+func splitSummary(renderer SummaryRenderer, summary *SummaryMessage, maxSize int) []*SummaryMessage {
+	// Measure with the longest subject a part is likely to get.
+	measured := *summary
+	measured.Subject = partSubject(summary.Subject, 999, 999)
+	if len(summary.UniqueMessages) < 2 || len(renderer.Render(&measured).Contents()) <= maxSize {
+		return []*SummaryMessage{summary}
+	}
+
+	half := len(summary.UniqueMessages) / 2
+	first, second := *summary, *summary
+	first.UniqueMessages = summary.UniqueMessages[:half]
+	second.UniqueMessages = summary.UniqueMessages[half:]
+	return append(splitSummary(renderer, &first, maxSize), splitSummary(renderer, &second, maxSize)...)
+}
+
+// The marker left at the end of a body that was truncated to fit the relay's
+// size limit.
+const TRUNCATED_MARKER = "\r\n[truncated to fit the relay's size limit]"
+
+// Truncates the longest bodies of a summary's unique messages until it's
+// rendered in at most `limit` bytes (if `limit` is positive), as a last
+// resort for a summary that can't be split any further. The summary and its
+// unique messages are copied, rather than changed.
+func truncateSummary(renderer SummaryRenderer, summary *SummaryMessage, limit int) *SummaryMessage {
+	if limit <= 0 {
+		return summary
+	}
+
+	for {
+		size := len(renderer.Render(summary).Contents())
+		if size <= limit {
+			return summary
+		}
+
+		longest := 0
+		for i, unique := range summary.UniqueMessages {
+			if len(unique.Body) > len(summary.UniqueMessages[longest].Body) {
+				longest = i
+			}
+		}
+		if len(summary.UniqueMessages) == 0 || len(summary.UniqueMessages[longest].Body) <= len(TRUNCATED_MARKER) {
+			// Nothing left to truncate; the relay will have to refuse it.
+			return summary
+		}
+
+		truncated := *summary
+		truncated.UniqueMessages = append([]*UniqueMessage{}, summary.UniqueMessages...)
+		unique := *summary.UniqueMessages[longest]
+		unique.Body = truncateBody(unique.Body, len(unique.Body)-(size-limit)-len(TRUNCATED_MARKER))
+		truncated.UniqueMessages[longest] = &unique
+		summary = &truncated
+	}
+}
+
+// Cuts `body` to at most `keep` bytes (without splitting a character), and
+// marks it as truncated. The result is always shorter than `body`.
+func truncateBody(body string, keep int) string {
+	if max := len(body) - len(TRUNCATED_MARKER) - 1; keep > max {
+		keep = max
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	for keep > 0 && !utf8.RuneStart(body[keep]) {
+		keep--
+	}
+	return body[:keep] + TRUNCATED_MARKER
+}
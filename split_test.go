@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeBigSummary(t *testing.T, subjects ...string) *SummaryMessage {
+	data := make([]string, 0, len(subjects))
+	for _, subject := range subjects {
+		data = append(data, "To: test@example.com\r\nSubject: "+subject+"\r\n\r\n"+strings.Repeat("x", 500)+"\r\n")
+	}
+	return makeSummaryMessage(t, data...)
+}
+
+func TestRenderPartsUnderLimit(t *testing.T) {
+	summary := makeBigSummary(t, "one", "two")
+	parts := RenderParts(&NoRenderer{}, summary, 100000, 0)
+	if len(parts) != 1 || parts[0] != summary || summary.Subject != "test" {
+		t.Errorf("expected the summary to be sent whole: %v", parts)
+	}
+}
+
+func TestRenderPartsSplits(t *testing.T) {
+	summary := makeBigSummary(t, "one", "two", "three")
+	parts := RenderParts(&NoRenderer{}, summary, 1500, 0)
+	if len(parts) != 3 {
+		t.Fatalf("expected the summary to be split into 3 parts: %d", len(parts))
+	}
+
+	for i, part := range parts {
+		contents := string(part.Contents())
+		if len(contents) > 1500 {
+			t.Errorf("part %d is too large: %d bytes", i+1, len(contents))
+		}
+		subject := []string{"one", "two", "three"}[i]
+		if !strings.Contains(contents, fmt.Sprintf("Subject: test (part %d of 3)\r\n", i+1)) {
+			t.Errorf("expected part %d to be numbered: %s", i+1, contents)
+		} else if !strings.Contains(contents, `Subject: "`+subject+`"`) {
+			t.Errorf("expected part %d to contain %s: %s", i+1, subject, contents)
+		}
+	}
+	if summary.Subject != "test" {
+		t.Errorf("expected the original summary to be left alone: %s", summary.Subject)
+	}
+}
+
+func TestRenderPartsSingleUnique(t *testing.T) {
+	summary := makeBigSummary(t, "one")
+	if parts := RenderParts(&NoRenderer{}, summary, 100, 0); len(parts) != 1 {
+		t.Errorf("expected a summary with one unique message not to be split: %d", len(parts))
+	}
+}
+
+func TestFlushSplitsSummaries(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.MaxSize = 1500
+	outgoing := make(chan *SendRequest, 64)
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	for _, subject := range []string{"one", "two"} {
+		buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: "+subject+"\r\n\r\n"+strings.Repeat("x", 500)+"\r\n"))
+	}
+	buf.Batch = GroupByExpr("batch", `all`)
+
+	sent := make(chan int, 1)
+	go func() {
+		count := 0
+		for req := range outgoing {
+			count += 1
+			req.SendErrors <- nil
+		}
+		sent <- count
+	}()
+
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, true); err != nil {
+		t.Errorf("unexpected error from flush: %s", err)
+	}
+	close(outgoing)
+	if count := <-sent; count != 2 {
+		t.Errorf("expected the summary to be sent in 2 parts: %d", count)
+	}
+}
@@ -0,0 +1,34 @@
+// Spooling of incoming message data to disk. Rather than holding the whole
+// payload of a DATA command in memory, a receiver can write it straight to a
+// file in the store's maildir, from where the store moves it into place.
+package main
+
+import (
+	"os"
+)
+
+// `Spool` creates files for incoming message data in the `tmp` subdirectory
+// of the maildir backing a `DiskStore`.
+type Spool struct {
+	Maildir *Maildir
+}
+
+// Creates a new, empty spool file.
+func (s *Spool) Create() (*os.File, error) {
+	name, err := s.Maildir.NextUniqueName()
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(s.Maildir.path(name, MAILDIR_TMP), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// Finishes writing a spool file, syncing it to disk if the maildir is durable.
+func (s *Spool) Close(file *os.File) error {
+	if s.Maildir.Durable {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a session that's ready to read a DATA payload.
+func makeDataSession(t *testing.T, maxSize int) *Session {
+	s := new(Session)
+	s.Start(nil, UNENCRYPTED)
+	s.maxSize = maxSize
+	parser := SMTPParser()
+	for _, command := range []string{"MAIL FROM:<test@example.com>\r\n", "RCPT TO:<test@example.com>\r\n", "DATA\r\n"} {
+		if resp := s.Advance(parser(command)); resp.Code != 250 && resp.Code != 354 {
+			t.Fatalf("unexpected response to %#v: %d", command, resp.Code)
+		}
+	}
+	return s
+}
+
+func TestReadDataMaxSize(t *testing.T) {
+	s := makeDataSession(t, 20)
+	if resp := s.Advance(SMTPParser()("EHLO test.example.com\r\n")); !strings.Contains(resp.Text, "SIZE 20") {
+		t.Errorf("expected EHLO to advertise the size limit: %s", resp.Text)
+	}
+
+	reader := bytes.NewBufferString("Subject: test\r\n\r\nthis body is too long\r\n.\r\nQUIT\r\n")
+	if resp, msg := s.ReadData(reader); resp.Code != 552 || msg != nil {
+		t.Errorf("expected a 552 response for a message over the size limit: %d", resp.Code)
+	}
+	if rest := reader.String(); rest != "QUIT\r\n" {
+		t.Errorf("expected the rest of the payload to be read: %#v", rest)
+	}
+}
+
+func TestSpoolData(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+	spool := &Spool{maildir}
+
+	s := makeDataSession(t, 0)
+	resp, msg := s.SpoolData(bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n.\r\n"), spool)
+	if resp.Code != 250 || msg == nil {
+		t.Fatalf("expected a 250 response for a spooled message: %d", resp.Code)
+	} else if msg.Data != nil {
+		t.Errorf("expected the data not to be held in memory")
+	} else if subject := msg.Parsed.Header.Get("Subject"); subject != "test" {
+		t.Errorf("unexpected subject: %s", subject)
+	} else if contents := string(msg.Contents()); contents != "Subject: test\r\n\r\nbody\r\n" {
+		t.Errorf("unexpected contents: %#v", contents)
+	}
+
+	// Storing the message moves the spool file into place.
+	store, _ := NewDiskStore(maildir)
+	if _, err := store.Add(time.Unix(1393650000, 0), msg); err != nil {
+		t.Fatalf("failed to add spooled message to store: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(path.Join(maildir.Path, "tmp")); len(files) != 0 {
+		t.Errorf("expected the spool file to be moved: %d files in tmp", len(files))
+	}
+	if stored, err := store.MessagesNewerThan(time.Time{}); err != nil || len(stored) != 1 {
+		t.Fatalf("unexpected messages in store: %v, %s", stored, err)
+	} else if body, _ := stored[0].ReadBody(); body != "body\r\n" {
+		t.Errorf("unexpected body: %#v", body)
+	}
+}
+
+func TestSpoolDataMaxSize(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	s := makeDataSession(t, 10)
+	if resp, msg := s.SpoolData(bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n.\r\n"), &Spool{maildir}); resp.Code != 552 || msg != nil {
+		t.Errorf("expected a 552 response for a message over the size limit: %d", resp.Code)
+	}
+	if files, _ := ioutil.ReadDir(path.Join(maildir.Path, "tmp")); len(files) != 0 {
+		t.Errorf("expected the spool file to be removed: %d files in tmp", len(files))
+	}
+}
+
+func TestMessageWriterUnspools(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	s := makeDataSession(t, 0)
+	_, msg := s.SpoolData(bytes.NewBufferString("Precedence: bulk\r\nSubject: test\r\n\r\nbody\r\n.\r\n"), &Spool{maildir})
+
+	store, _ := NewDiskStore(maildir)
+	writer := &MessageWriter{Store: store, DropAutoGenerated: true}
+	received := make(chan *StorageRequest, 1)
+	errors := make(chan error, 1)
+	received <- &StorageRequest{msg, errors}
+	close(received)
+	writer.Run(received)
+
+	if err := <-errors; err != nil {
+		t.Errorf("unexpected error dropping a message: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(path.Join(maildir.Path, "tmp")); len(files) != 0 {
+		t.Errorf("expected the spool file of a dropped message to be removed: %d files in tmp", len(files))
+	}
+}
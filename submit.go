@@ -0,0 +1,158 @@
+// Support for receiving messages over HTTP, for applications that would
+// rather not speak SMTP.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `Submission` is the JSON payload accepted by a `Submitter`. It's converted
+// to a message with the given headers, envelope, and body.
+type Submission struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+	Headers map[string]string
+}
+
+// Builds a `ReceivedMessage` from the submission, as if it had been received
+// via SMTP.
+func (s *Submission) Message() (*ReceivedMessage, error) {
+	if s.From == "" || len(s.To) == 0 {
+		return nil, fmt.Errorf("From and To are required")
+	}
+	if strings.ContainsAny(s.From+strings.Join(s.To, "")+s.Subject, "\r\n") {
+		return nil, fmt.Errorf("From, To, and Subject can't contain newlines")
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", s.Subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", nowGetter().Format(time.RFC1123Z))
+
+	names := make([]string, 0, len(s.Headers))
+	for name, _ := range s.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.ContainsAny(name+s.Headers[name], "\r\n") {
+			return nil, fmt.Errorf("header %#v contains a newline", name)
+		}
+		fmt.Fprintf(buf, "%s: %s\r\n", name, s.Headers[name])
+	}
+	fmt.Fprintf(buf, "\r\n")
+	buf.Write(normalizeNewlines(s.Body))
+
+	data := buf.Bytes()
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	return &ReceivedMessage{message: &message{s.From, s.To, data}, Parsed: parsed}, nil
+}
+
+// Builds a `ReceivedMessage` from a raw RFC 822 message. The envelope sender
+// and recipients are `from` and `to` if they're given, or else are taken from
+// the message's From, To, and Cc headers.
+func RawMessage(data []byte, from string, to []string) (*ReceivedMessage, error) {
+	data = normalizeNewlines(string(data))
+	parsed, err := mail.ReadMessage(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if from == "" {
+		if addr, err := mail.ParseAddress(parsed.Header.Get("From")); err == nil {
+			from = addr.Address
+		}
+	}
+	if len(to) == 0 {
+		for _, header := range []string{"To", "Cc"} {
+			if addrs, err := parsed.Header.AddressList(header); err == nil {
+				for _, addr := range addrs {
+					to = append(to, addr.Address)
+				}
+			}
+		}
+	}
+	if from == "" || len(to) == 0 {
+		return nil, fmt.Errorf("a sender and recipients are required")
+	}
+	return &ReceivedMessage{message: &message{from, to, data}, Parsed: parsed}, nil
+}
+
+// `Submitter` is an HTTP handler that accepts `Submission`s POSTed as JSON (or
+// raw messages, POSTed as `message/rfc822`), and puts them on a channel for
+// storage, the same way a `Listener` does for messages received via SMTP.
+type Submitter struct {
+	Rewriter AddressRewriter
+	MaxSize  int       // if positive, refuse request bodies larger than this many bytes
+	Origins  []string  // browser origins allowed to submit messages ("*" for any)
+	ReadOnly *ReadOnly // if enabled, refuses submissions with a 503
+	received chan *StorageRequest
+	closed   bool
+	lock     sync.RWMutex
+}
+
+func NewSubmitter(rewriter AddressRewriter) *Submitter {
+	return &Submitter{Rewriter: rewriter, received: make(chan *StorageRequest, 0)}
+}
+
+// Returns the channel that submitted messages are put on. It's closed when
+// the submitter shuts down.
+func (s *Submitter) Received() <-chan *StorageRequest {
+	return s.received
+}
+
+// Waits for a shutdown/reload request, then stops accepting submissions and
+// closes the channel returned by `Received()`.
+func (s *Submitter) Run(done <-chan TerminationRequest) {
+	<-done
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	close(s.received)
+}
+
+// Puts a message on the channel for storage, and waits for it to be stored.
+func (s *Submitter) Submit(msg *ReceivedMessage) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return fmt.Errorf("shutting down")
+	}
+
+	log.Printf("received submitted message with subject %#v", msg.Parsed.Header.Get("Subject"))
+	msg.RedirectedTo = s.Rewriter.RewriteAll(msg.To)
+
+	errors := make(chan error, 0)
+	s.received <- &StorageRequest{msg, errors}
+	return <-errors
+}
+
+// Puts the requests from each of `inputs` onto `output`, and closes `output`
+// once all of the inputs are closed.
+func MergeStorageRequests(output chan<- *StorageRequest, inputs ...<-chan *StorageRequest) {
+	waitGroup := new(sync.WaitGroup)
+	for _, input := range inputs {
+		waitGroup.Add(1)
+		go func(input <-chan *StorageRequest) {
+			defer waitGroup.Done()
+			for req := range input {
+				output <- req
+			}
+		}(input)
+	}
+	waitGroup.Wait()
+	close(output)
+}
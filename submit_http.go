@@ -0,0 +1,111 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+)
+
+// Returns true if the request's body is a raw RFC 822 message, rather than a
+// JSON `Submission`.
+func isRawMessage(r *http.Request) bool {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return contentType == "message/rfc822"
+}
+
+func (s *Submitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.allowOrigin(w, r)
+	if r.Method == "OPTIONS" {
+		// A CORS preflight request from a browser.
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("must be a POST"))
+		return
+	}
+
+	if s.ReadOnly.Enabled() {
+		w.Header().Set("Retry-After", "60")
+		writeJSONError(w, http.StatusServiceUnavailable, errors.New(READ_ONLY_RESPONSE))
+		return
+	}
+
+	if s.MaxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(s.MaxSize))
+	}
+
+	msg, err := s.readMessage(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		msg.ClientAddr = host
+	}
+
+	if err := s.Submit(msg); err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	fmt.Fprintf(w, "{}\n")
+}
+
+// Reads the message from a request, either as a JSON `Submission` or as a raw
+// message. Raw messages may give their envelope in `from` and `to` query
+// parameters.
+func (s *Submitter) readMessage(r *http.Request) (*ReceivedMessage, error) {
+	if !isRawMessage(r) {
+		submission := new(Submission)
+		if err := json.NewDecoder(r.Body).Decode(submission); err != nil {
+			return nil, err
+		}
+		return submission.Message()
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	to := make([]string, 0)
+	for _, addrs := range query["to"] {
+		to = append(to, SplitAddresses(addrs)...)
+	}
+	return RawMessage(data, query.Get("from"), to)
+}
+
+// Sets the CORS header allowing the request's origin to read the response,
+// if it's one of `Origins`.
+func (s *Submitter) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	for _, allowed := range s.Origins {
+		if allowed == "*" || allowed == origin {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			w.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if bytes, jsonErr := json.Marshal(map[string]string{"Error": err.Error()}); jsonErr == nil {
+		fmt.Fprintf(w, "%s\n", bytes)
+	} else {
+		fmt.Fprintf(w, "{}\n")
+	}
+}
@@ -0,0 +1,210 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmissionMessage(t *testing.T) {
+	defer patchTime(time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC))()
+
+	submission := &Submission{
+		From:    "app@example.com",
+		To:      []string{"test@example.com"},
+		Subject: "error",
+		Body:    "line 1\nline 2\n",
+		Headers: map[string]string{"X-Failmail-Split": "app"},
+	}
+	msg, err := submission.Message()
+	if err != nil {
+		t.Fatalf("unexpected error from Message(): %s", err)
+	}
+
+	expected := "From: app@example.com\r\nTo: test@example.com\r\nSubject: error\r\n" +
+		"Date: Sat, 01 Mar 2014 00:00:00 +0000\r\nX-Failmail-Split: app\r\n\r\nline 1\r\nline 2\r\n"
+	if data := string(msg.Contents()); data != expected {
+		t.Errorf("unexpected message contents: %#v", data)
+	}
+	if from := msg.Sender(); from != "app@example.com" {
+		t.Errorf("unexpected envelope sender: %s", from)
+	}
+	if split := msg.Parsed.Header.Get("X-Failmail-Split"); split != "app" {
+		t.Errorf("unexpected parsed header: %s", split)
+	}
+}
+
+func TestSubmissionMessageInvalid(t *testing.T) {
+	if _, err := (&Submission{From: "app@example.com"}).Message(); err == nil {
+		t.Errorf("expected an error for a submission without recipients")
+	}
+
+	submission := &Submission{
+		From:    "app@example.com",
+		To:      []string{"test@example.com"},
+		Headers: map[string]string{"X-Test": "a\r\nBcc: other@example.com"},
+	}
+	if _, err := submission.Message(); err == nil {
+		t.Errorf("expected an error for a header containing a newline")
+	}
+
+	for _, submission := range []*Submission{
+		{From: "app@example.com\r\nBcc: other@example.com", To: []string{"test@example.com"}},
+		{From: "app@example.com", To: []string{"test@example.com", "x\nBcc: other@example.com"}},
+		{From: "app@example.com", To: []string{"test@example.com"}, Subject: "x\r\nBcc: other@example.com"},
+	} {
+		if _, err := submission.Message(); err == nil {
+			t.Errorf("expected an error for a newline in %#v", submission)
+		}
+	}
+}
+
+func TestSubmitter(t *testing.T) {
+	submitter := NewSubmitter(AddressRewriter{})
+	go func() {
+		req := <-submitter.Received()
+		if subject := req.Message.Parsed.Header.Get("Subject"); subject != "error" {
+			t.Errorf("unexpected subject: %s", subject)
+		}
+		req.StorageErrors <- nil
+	}()
+
+	body := `{"From": "app@example.com", "To": ["test@example.com"], "Subject": "error", "Body": "test"}`
+	w := httptest.NewRecorder()
+	submitter.ServeHTTP(w, httptest.NewRequest("POST", "/api/submit", bytes.NewBufferString(body)))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status for submission: %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	submitter.ServeHTTP(w, httptest.NewRequest("POST", "/api/submit", bytes.NewBufferString("{")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for invalid submission: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	submitter.ServeHTTP(w, httptest.NewRequest("GET", "/api/submit", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status for GET: %d", w.Code)
+	}
+
+	done := make(chan TerminationRequest, 1)
+	done <- GracefulShutdown
+	submitter.Run(done)
+
+	w = httptest.NewRecorder()
+	submitter.ServeHTTP(w, httptest.NewRequest("POST", "/api/submit", bytes.NewBufferString(body)))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "shutting down") {
+		t.Errorf("unexpected response after shutdown: %d %s", w.Code, w.Body)
+	}
+	if _, ok := <-submitter.Received(); ok {
+		t.Errorf("expected the submitter's channel to be closed")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	data := []byte("From: App <app@example.com>\nTo: ops@example.com\nCc: dev@example.com\nSubject: error\n\nline 1\n")
+	msg, err := RawMessage(data, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error from RawMessage(): %s", err)
+	}
+	if from := msg.Sender(); from != "app@example.com" {
+		t.Errorf("unexpected envelope sender: %s", from)
+	}
+	if to := msg.Recipients(); len(to) != 2 || to[0] != "ops@example.com" || to[1] != "dev@example.com" {
+		t.Errorf("unexpected envelope recipients: %v", to)
+	}
+	if contents := string(msg.Contents()); !strings.HasSuffix(contents, "Subject: error\r\n\r\nline 1\r\n") {
+		t.Errorf("expected newlines to be normalized: %#v", contents)
+	}
+
+	msg, err = RawMessage(data, "other@example.com", []string{"test@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error from RawMessage(): %s", err)
+	} else if msg.Sender() != "other@example.com" || len(msg.Recipients()) != 1 {
+		t.Errorf("expected the given envelope to be used: %s %v", msg.Sender(), msg.Recipients())
+	}
+
+	if _, err := RawMessage([]byte("Subject: error\n\nbody\n"), "", nil); err == nil {
+		t.Errorf("expected an error for a message without an envelope")
+	}
+}
+
+func TestSubmitterRawMessages(t *testing.T) {
+	submitter := NewSubmitter(AddressRewriter{})
+	submitter.MaxSize = 200
+	received := make(chan *ReceivedMessage, 1)
+	go func() {
+		req := <-submitter.Received()
+		received <- req.Message
+		req.StorageErrors <- nil
+	}()
+
+	req := httptest.NewRequest("POST", "/api/messages?from=app@example.com&to=ops@example.com", bytes.NewBufferString("Subject: error\n\ntest\n"))
+	req.Header.Set("Content-Type", "message/rfc822")
+	w := httptest.NewRecorder()
+	submitter.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status for raw message: %d %s", w.Code, w.Body)
+	}
+	if msg := <-received; msg.Parsed.Header.Get("Subject") != "error" || msg.Recipients()[0] != "ops@example.com" {
+		t.Errorf("unexpected message: %#v", msg)
+	}
+
+	req = httptest.NewRequest("POST", "/api/messages?from=app@example.com&to=ops@example.com", bytes.NewBufferString("Subject: "+strings.Repeat("x", 200)+"\n\n"))
+	req.Header.Set("Content-Type", "message/rfc822")
+	w = httptest.NewRecorder()
+	submitter.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for a message that's too large: %d", w.Code)
+	}
+}
+
+func TestSubmitterCORS(t *testing.T) {
+	submitter := NewSubmitter(AddressRewriter{})
+	submitter.Origins = []string{"https://app.example.com"}
+
+	for _, origin := range []string{"https://app.example.com", "https://evil.example.com"} {
+		req := httptest.NewRequest("OPTIONS", "/api/messages", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		submitter.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("unexpected status for preflight request: %d", w.Code)
+		}
+
+		allowed := w.Header().Get("Access-Control-Allow-Origin")
+		if origin == submitter.Origins[0] && allowed != origin {
+			t.Errorf("expected %s to be allowed, got %#v", origin, allowed)
+		} else if origin != submitter.Origins[0] && allowed != "" {
+			t.Errorf("expected %s not to be allowed, got %#v", origin, allowed)
+		}
+	}
+}
+
+func TestMergeStorageRequests(t *testing.T) {
+	output := make(chan *StorageRequest, 2)
+	input1 := make(chan *StorageRequest, 1)
+	input2 := make(chan *StorageRequest, 1)
+
+	input1 <- &StorageRequest{}
+	input2 <- &StorageRequest{}
+	close(input1)
+	close(input2)
+
+	MergeStorageRequests(output, input1, input2)
+
+	count := 0
+	for _ = range output {
+		count += 1
+	}
+	if count != 2 {
+		t.Errorf("expected 2 merged requests, got %d", count)
+	}
+}
@@ -0,0 +1,111 @@
+// Per-domain settings, so that one failmail instance can serve several teams
+// with different digest policies. Settings in a `[domain example.com]` section
+// of the config file apply to summaries for recipients in that domain.
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// The settings that can be given in a domain section of the config file.
+var TENANT_SETTINGS = map[string]bool{
+	"batch-expr":     true,
+	"wait-period":    true,
+	"max-wait":       true,
+	"template":       true,
+	"relay-addr":     true,
+	"relay-user":     true,
+	"relay-password": true,
+}
+
+// `Tenant` holds the settings for summarizing messages for recipients in one
+// domain.
+type Tenant struct {
+	Batch     GroupBy
+	SoftLimit time.Duration
+	HardLimit time.Duration
+	Renderer  SummaryRenderer
+}
+
+// Returns the domain of an email address, in lower case, or "" if it has
+// none.
+func AddressDomain(address string) string {
+	address = NormalizeAddress(address)
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return strings.ToLower(address[i+1:])
+	}
+	return ""
+}
+
+// `DomainUpstream` sends messages via a different upstream for recipients in
+// some domains. Recipients in other domains get messages via `Default`.
+type DomainUpstream struct {
+	Default Upstream
+	Domains map[string]Upstream
+}
+
+func (u *DomainUpstream) upstream(recipient string) Upstream {
+	if upstream, ok := u.Domains[AddressDomain(recipient)]; ok {
+		return upstream
+	}
+	return u.Default
+}
+
+// Splits the recipients by the upstream that handles them, in the order the
+// upstreams are first needed.
+func (u *DomainUpstream) split(to []string) ([]Upstream, map[Upstream][]string) {
+	order := make([]Upstream, 0)
+	recipients := make(map[Upstream][]string, 0)
+	for _, addr := range to {
+		upstream := u.upstream(addr)
+		if _, ok := recipients[upstream]; !ok {
+			order = append(order, upstream)
+		}
+		recipients[upstream] = append(recipients[upstream], addr)
+	}
+	return order, recipients
+}
+
+// Sends the message to each group of recipients via their upstream, and
+// returns the first error.
+func (u *DomainUpstream) Send(m OutgoingMessage) error {
+	return u.SendContext(context.Background(), m)
+}
+
+func (u *DomainUpstream) SendContext(ctx context.Context, m OutgoingMessage) error {
+	order, recipients := u.split(m.Recipients())
+	if len(order) == 1 {
+		return sendContext(ctx, order[0], m)
+	}
+
+	var result error
+	for _, upstream := range order {
+		err := sendContext(ctx, upstream, &message{m.Sender(), recipients[upstream], m.Contents()})
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Verifies each group of recipients with their upstream, if it can verify
+// recipients. Recipients of upstreams that can't are assumed to be valid.
+func (u *DomainUpstream) Verify(from string, to []string) ([]string, error) {
+	order, recipients := u.split(to)
+	valid := make([]string, 0, len(to))
+	for _, upstream := range order {
+		verifier, ok := upstream.(RecipientVerifier)
+		if !ok {
+			valid = append(valid, recipients[upstream]...)
+			continue
+		}
+		accepted, err := verifier.Verify(from, recipients[upstream])
+		if err != nil {
+			return nil, err
+		}
+		valid = append(valid, accepted...)
+	}
+	return valid, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddressDomain(t *testing.T) {
+	for address, expected := range map[string]string{
+		"test@example.com":                 "example.com",
+		"Test <test@Ops.Example.com>":      "ops.example.com",
+		"test":                             "",
+		"\"a@b\" <test@subdomain.example>": "subdomain.example",
+	} {
+		if domain := AddressDomain(address); domain != expected {
+			t.Errorf("expected domain %q for %q, got %q", expected, address, domain)
+		}
+	}
+}
+
+func TestDomainUpstreamSend(t *testing.T) {
+	def := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	ops := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	upstream := &DomainUpstream{def, map[string]Upstream{"ops.example.com": ops}}
+
+	msg := &message{"failmail@example.com", []string{"a@example.com", "b@ops.example.com", "c@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+	if err := upstream.Send(msg); err != nil {
+		t.Fatalf("unexpected error sending: %s", err)
+	}
+
+	if len(def.Sends) != 1 || !reflect.DeepEqual(def.Sends[0].Recipients(), []string{"a@example.com", "c@example.com"}) {
+		t.Errorf("expected one send to the default recipients: %v", def.Sends)
+	}
+	if len(ops.Sends) != 1 || !reflect.DeepEqual(ops.Sends[0].Recipients(), []string{"b@ops.example.com"}) {
+		t.Errorf("expected one send to the domain's recipients: %v", ops.Sends)
+	}
+}
+
+func TestDomainUpstreamSendError(t *testing.T) {
+	def := &TestUpstream{make([]OutgoingMessage, 0), nil}
+	ops := &TestUpstream{nil, errors.New("relay down")}
+	upstream := &DomainUpstream{def, map[string]Upstream{"ops.example.com": ops}}
+
+	msg := &message{"failmail@example.com", []string{"b@ops.example.com", "a@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+	if err := upstream.Send(msg); err == nil {
+		t.Errorf("expected an error from the domain's upstream")
+	}
+	if len(def.Sends) != 1 {
+		t.Errorf("expected the other recipients to get the message anyway: %v", def.Sends)
+	}
+}
+
+func TestMessageBufferTenants(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Tenants = map[string]*Tenant{
+		"ops.example.com": &Tenant{
+			Batch:     GroupByExpr("batch", `{{.Header.Get "X-Service"}}`),
+			SoftLimit: 10 * time.Minute,
+			HardLimit: time.Hour,
+			Renderer:  &NoRenderer{},
+		},
+	}
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: a@example.com\r\nTo: b@ops.example.com\r\nSubject: disk full\r\nX-Service: db\r\n\r\ntest"))
+
+	outgoing := make(chan *SendRequest, 64)
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, false); err != nil {
+		t.Fatalf("unexpected error from flush: %s", err)
+	}
+
+	def := RecipientKey{"disk full", "a@example.com"}
+	ops := RecipientKey{"db", "b@ops.example.com"}
+	for _, key := range []RecipientKey{def, ops} {
+		if _, ok := buf.first[key]; !ok {
+			t.Errorf("expected a batch for %v: %v", key, buf.first)
+		}
+	}
+
+	later := nowGetter().Add(2 * time.Minute)
+	if !buf.NeedsFlush(later, def) {
+		t.Errorf("expected the default batch to need flushing")
+	}
+	if buf.NeedsFlush(later, ops) {
+		t.Errorf("expected the domain's batch to wait longer")
+	}
+	if next := buf.NextFlush(ops); !next.Equal(nowGetter().Add(10 * time.Minute)) {
+		t.Errorf("unexpected next flush for the domain's batch: %s", next)
+	}
+}
@@ -0,0 +1,87 @@
+// Timeouts for SMTP clients that stop responding. Without them, a client that
+// connects and never sends anything (or stops partway through a message)
+// holds its connection and goroutine open forever. With `--command-timeout`,
+// each read from or write to the client has to finish in time, and with
+// `--idle-timeout`, the client has to finish sending each command in time,
+// however slowly it trickles it in. Either way, the client gets a 421 and is
+// disconnected.
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// The response sent to clients that time out, before they're disconnected.
+var TIMEOUT_RESPONSE = Response{421, "Timed out waiting for client, closing connection", "4.4.2"}
+
+// `deadlineConn` sets a deadline on each read and write on a connection.
+type deadlineConn struct {
+	net.Conn
+	timeout   time.Duration // for each read or write, if positive
+	idle      time.Duration // for each command, if positive
+	idleUntil time.Time     // when the command being waited for is due, if any
+	timedOut  bool
+}
+
+// Wraps `conn` with the timeouts, or returns nil if there are none.
+func newDeadlineConn(conn net.Conn, timeout time.Duration, idle time.Duration) *deadlineConn {
+	if timeout <= 0 && idle <= 0 {
+		return nil
+	}
+	return &deadlineConn{Conn: conn, timeout: timeout, idle: idle}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	if !c.idleUntil.IsZero() && (deadline.IsZero() || c.idleUntil.Before(deadline)) {
+		deadline = c.idleUntil
+	}
+	c.Conn.SetReadDeadline(deadline)
+	n, err := c.Conn.Read(p)
+	c.checkTimeout(err)
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	n, err := c.Conn.Write(p)
+	c.checkTimeout(err)
+	return n, err
+}
+
+func (c *deadlineConn) checkTimeout(err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		c.timedOut = true
+	}
+}
+
+// Starts the idle timeout while waiting for the client's next command.
+func (c *deadlineConn) WaitForCommand() {
+	if c != nil && c.idle > 0 {
+		c.idleUntil = time.Now().Add(c.idle)
+	}
+}
+
+// Stops the idle timeout once the client has sent a command.
+func (c *deadlineConn) GotCommand() {
+	if c != nil {
+		c.idleUntil = time.Time{}
+	}
+}
+
+// Returns true if a read or write timed out. If it did, the client is sent
+// `TIMEOUT_RESPONSE` (with a fresh deadline for writing it).
+func (c *deadlineConn) TimedOut(writer stringWriter) bool {
+	if c == nil || !c.timedOut {
+		return false
+	}
+	c.timedOut = false
+	TIMEOUT_RESPONSE.WriteTo(writer)
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func listenWithTimeouts(t *testing.T, commandTimeout time.Duration, idleTimeout time.Duration, client func(*textproto.Conn)) {
+	socket, conn := NewMockSocket()
+	defer conn.Close()
+
+	listener := &Listener{Socket: socket, CommandTimeout: commandTimeout, IdleTimeout: idleTimeout}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	go func() {
+		client(textproto.NewConn(conn))
+		shutdown <- GracefulShutdown
+	}()
+	listener.Listen(context.Background(), received, shutdown, time.Second)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	listenWithTimeouts(t, 5*time.Millisecond, 0, func(conn *textproto.Conn) {
+		if _, _, err := conn.ReadCodeLine(220); err != nil {
+			t.Errorf("unexpected response from server: %s", err)
+		}
+
+		// A client that sends nothing is disconnected.
+		start := time.Now()
+		if _, _, err := conn.ReadCodeLine(421); err != nil {
+			t.Errorf("expected a 421 from the server: %s", err)
+		} else if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expected the client to be timed out sooner: %s", elapsed)
+		}
+		if _, err := conn.ReadLine(); err == nil {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	listenWithTimeouts(t, time.Second, 20*time.Millisecond, func(conn *textproto.Conn) {
+		if _, _, err := conn.ReadCodeLine(220); err != nil {
+			t.Errorf("unexpected response from server: %s", err)
+		}
+		sendAndExpect(conn, t, "HELO localhost", 250)
+
+		// A client that trickles in a command, without finishing it, is
+		// disconnected too.
+		go func() {
+			for _, c := range "HELO localhost" {
+				if _, err := conn.W.WriteString(string(c)); err != nil || conn.W.Flush() != nil {
+					return
+				}
+				time.Sleep(4 * time.Millisecond)
+			}
+		}()
+		if _, _, err := conn.ReadCodeLine(421); err != nil {
+			t.Errorf("expected a 421 from the server: %s", err)
+		}
+	})
+}
+
+func TestNoTimeouts(t *testing.T) {
+	conn := newDeadlineConn(nil, 0, 0)
+	if conn != nil {
+		t.Errorf("expected no connection wrapper without timeouts")
+	}
+	conn.WaitForCommand()
+	conn.GotCommand()
+	if conn.TimedOut(nil) {
+		t.Errorf("expected no timeouts without a wrapper")
+	}
+}
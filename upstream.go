@@ -3,10 +3,20 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // `Upstream` is the interface that wraps the method to send an
@@ -15,6 +25,34 @@ type Upstream interface {
 	Send(OutgoingMessage) error
 }
 
+// `ContextUpstream` is implemented by upstreams that can give up on a send
+// when a context is cancelled, e.g. by closing their connection to a relay.
+type ContextUpstream interface {
+	SendContext(context.Context, OutgoingMessage) error
+}
+
+// Sends a message via `upstream`, giving up when `ctx` is cancelled if the
+// upstream supports it.
+func sendContext(ctx context.Context, upstream Upstream, m OutgoingMessage) error {
+	if u, ok := upstream.(ContextUpstream); ok {
+		return u.SendContext(ctx, m)
+	}
+	return upstream.Send(m)
+}
+
+// Closes `conn` if `ctx` is cancelled before the returned function is called.
+func closeOnCancel(ctx context.Context, conn io.Closer) func() {
+	stop := make(chan bool, 0)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
 // A `LiveUpstream` represents an upstream SMTP server that we can connect to
 // for sending email messages.
 type LiveUpstream struct {
@@ -23,6 +61,10 @@ type LiveUpstream struct {
 	// Used for PLAIN auth if non-empty.
 	User     string
 	Password string
+
+	// If non-nil, the server must support STARTTLS, and its certificate is
+	// verified using this config rather than the defaults.
+	TLS *tls.Config
 }
 
 // Builds an Auth object, or nil if no authentication should be used to connect
@@ -36,11 +78,136 @@ func (u *LiveUpstream) auth() smtp.Auth {
 }
 
 func (u *LiveUpstream) Send(m OutgoingMessage) error {
+	return u.SendContext(context.Background(), m)
+}
+
+// Sends the message, closing the connection to the server (and returning the
+// context's error) if `ctx` is cancelled first.
+func (u *LiveUpstream) SendContext(ctx context.Context, m OutgoingMessage) error {
 	from := m.Sender()
 	to := m.Recipients()
 	log.Printf("sending message to %v", to)
-	auth := u.auth()
-	return smtp.SendMail(u.Addr, auth, from, to, m.Contents())
+
+	client, stop, err := u.dial(ctx)
+	if err != nil {
+		return contextErr(ctx, err)
+	}
+	defer stop()
+	defer client.Close()
+
+	// The writer from `smtp.Client.Data` adds a "." to lines of the message
+	// that start with one, as the client side of SMTP must.
+	if err := client.Mail(from); err != nil {
+		return contextErr(ctx, err)
+	}
+	for _, addr := range to {
+		if err := client.Rcpt(addr); err != nil {
+			return contextErr(ctx, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return contextErr(ctx, err)
+	}
+	if _, err := w.Write(m.Contents()); err != nil {
+		return contextErr(ctx, err)
+	}
+	if err := w.Close(); err != nil {
+		return contextErr(ctx, err)
+	}
+	return contextErr(ctx, client.Quit())
+}
+
+// Returns the context's error if it's been cancelled, since that's what caused
+// `err`, or `err` otherwise.
+func contextErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Connects to the server, and starts TLS and authenticates if possible. The
+// returned function must be called when done with the client, to stop
+// watching `ctx`.
+func (u *LiveUpstream) dial(ctx context.Context) (*smtp.Client, func(), error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", u.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := closeOnCancel(ctx, conn)
+
+	client, err := u.handshake(conn)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, nil, err
+	}
+	return client, stop, nil
+}
+
+// Greets the server on `conn`, and starts TLS and authenticates if possible.
+func (u *LiveUpstream) handshake(conn net.Conn) (*smtp.Client, error) {
+	host, _, _ := net.SplitHostPort(u.Addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(tlsConfigFor(u.TLS, host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	} else if u.TLS != nil {
+		client.Close()
+		return nil, fmt.Errorf("relay %s doesn't support STARTTLS", u.Addr)
+	}
+	if auth := u.auth(); auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(auth); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+	return client, nil
+}
+
+// `RecipientVerifier` is the interface that wraps the method to check which
+// recipients an upstream server will accept, without sending a message.
+type RecipientVerifier interface {
+	Verify(from string, to []string) ([]string, error)
+}
+
+// Returns the recipients the server accepts with RCPT TO. Recipients that get
+// a temporary (4xx) failure are assumed to be valid, and left for sending to
+// sort out.
+func (u *LiveUpstream) Verify(from string, to []string) ([]string, error) {
+	client, stop, err := u.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	defer client.Close()
+
+	if err := client.Mail(from); err != nil {
+		return nil, err
+	}
+	valid := make([]string, 0, len(to))
+	for _, addr := range to {
+		err := client.Rcpt(addr)
+		if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code >= 500 {
+			continue
+		} else if err != nil && !ok {
+			return nil, err
+		}
+		valid = append(valid, addr)
+	}
+
+	client.Reset()
+	client.Quit()
+	return valid, nil
 }
 
 type DebugUpstream struct {
@@ -70,8 +237,12 @@ func NewMultiUpstream(upstreams ...Upstream) Upstream {
 }
 
 func (u *MultiUpstream) Send(m OutgoingMessage) error {
+	return u.SendContext(context.Background(), m)
+}
+
+func (u *MultiUpstream) SendContext(ctx context.Context, m OutgoingMessage) error {
 	for _, upstream := range u.upstreams {
-		if err := upstream.Send(m); err != nil {
+		if err := sendContext(ctx, upstream, m); err != nil {
 			return err
 		}
 	}
@@ -81,22 +252,198 @@ func (u *MultiUpstream) Send(m OutgoingMessage) error {
 type Sender struct {
 	Upstream      Upstream
 	FailedMaildir *Maildir
+	Retries       int               // retry failed sends this many times
+	RetryWait     time.Duration     // wait this long between retries
+	Alerter       Alerter           // if non-nil, called when retries are exhausted
+	Verifier      RecipientVerifier // if non-nil, checks recipients with the relay before sending
+	Clock         Clock             // if non-nil, waits between retries instead of the system clock
+	Failures      *SendFailures     // if non-nil, counts the sends that failed
 }
 
-func (s *Sender) Run(outgoing <-chan *SendRequest) {
+// The header added to messages written to the failed maildir without being
+// sent, explaining why.
+const FAILURE_HEADER = "X-Failmail-Failure"
+
+// Sends each message from `outgoing` until it's closed. Cancelling `ctx`
+// abandons any send in progress (and any wait to retry it), reporting the
+// context's error to the requester without saving the message as a dead
+// letter, since it's still in the store.
+func (s *Sender) Run(ctx context.Context, outgoing <-chan *SendRequest) {
 	for req := range outgoing {
-		sendErr := s.Upstream.Send(req.Message)
-		if sendErr != nil {
-			log.Printf("couldn't send message: %s", sendErr)
-			if _, saveErr := s.FailedMaildir.Write([]byte(req.Message.Contents())); saveErr != nil {
+		msg, rejected := s.verify(req.Message)
+		if msg == nil {
+			// Retrying won't help, so the message is diverted to the failed
+			// maildir and the send is reported as done.
+			reason := fmt.Sprintf("relay rejected all recipients: %s", strings.Join(rejected, ", "))
+			log.Printf("not sending message: %s", reason)
+			data := SetHeaders(req.Message.Contents(), map[string]string{FAILURE_HEADER: reason})
+			if _, saveErr := SaveDeadLetter(s.FailedMaildir, req.Message, data); saveErr != nil {
+				log.Printf("couldn't save message: %s", saveErr)
+			}
+			req.SendErrors <- nil
+			continue
+		}
+
+		sendErr := s.send(ctx, msg)
+		switch {
+		case sendErr == nil:
+		case ctx.Err() != nil:
+			log.Printf("gave up sending message: %s", sendErr)
+		case IsPermanent(sendErr):
+			// Sending it again would only be refused again, so, as with
+			// rejected recipients, it's diverted to the failed maildir and
+			// reported as done.
+			log.Printf("relay refused message, not sending it again: %s", sendErr)
+			s.Failures.add(true)
+			data := SetHeaders(req.Message.Contents(), map[string]string{FAILURE_HEADER: sendErr.Error()})
+			if _, saveErr := SaveDeadLetter(s.FailedMaildir, req.Message, data); saveErr != nil {
 				log.Printf("couldn't save message: %s", saveErr)
 			}
+			s.alert(req.Message, sendErr)
+			sendErr = nil
+		default:
+			// The requester keeps the message to send again later.
+			log.Printf("couldn't send message: %s", sendErr)
+			s.Failures.add(false)
+			s.alert(req.Message, sendErr)
 		}
 		req.SendErrors <- sendErr
 	}
 	log.Printf("done sending")
 }
 
+func (s *Sender) alert(m OutgoingMessage, err error) {
+	if s.Alerter == nil {
+		return
+	}
+	if alertErr := s.Alerter.Alert(m, err); alertErr != nil {
+		log.Printf("couldn't send alert: %s", alertErr)
+	}
+}
+
+// Checks the message's recipients with the `Verifier`, and returns the message
+// addressed to only the recipients the relay accepts (or nil if it accepts
+// none of them), along with the rejected recipients. If the check fails, the
+// message is returned unchanged.
+func (s *Sender) verify(m OutgoingMessage) (OutgoingMessage, []string) {
+	if s.Verifier == nil {
+		return m, nil
+	}
+
+	valid, err := s.Verifier.Verify(m.Sender(), m.Recipients())
+	if err != nil {
+		log.Printf("couldn't verify recipients, sending anyway: %s", err)
+		return m, nil
+	}
+
+	accepted := make(map[string]bool, len(valid))
+	for _, addr := range valid {
+		accepted[addr] = true
+	}
+	rejected := make([]string, 0)
+	for _, addr := range m.Recipients() {
+		if !accepted[addr] {
+			rejected = append(rejected, addr)
+		}
+	}
+
+	switch {
+	case len(rejected) == 0:
+		return m, nil
+	case len(valid) == 0:
+		return nil, rejected
+	default:
+		log.Printf("relay rejected recipients %v, sending to the rest", rejected)
+		return &message{m.Sender(), valid, m.Contents()}, rejected
+	}
+}
+
+// Sends a message, retrying up to `Retries` times if sending fails
+// temporarily, or until `ctx` is cancelled. The wait between retries starts at
+// `RetryWait` and doubles each time, or is as long as the relay asks, if
+// that's longer. Permanent failures aren't retried.
+func (s *Sender) send(ctx context.Context, m OutgoingMessage) error {
+	err := sendContext(ctx, s.Upstream, m)
+	wait := s.RetryWait
+	for i := 0; err != nil && !IsPermanent(err) && i < s.Retries; i++ {
+		if after := retryAfter(err); after > wait {
+			wait = after
+		}
+		log.Printf("couldn't send message, retrying in %s: %s", wait, err)
+		select {
+		case <-clockOr(s.Clock).After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err = sendContext(ctx, s.Upstream, m)
+		wait *= 2
+	}
+	return err
+}
+
+// Returns true if `err` is a permanent (5xx) refusal from the relay, which
+// sending again won't get past. Anything else, including a temporary (4xx)
+// refusal or failing to reach the relay at all, may work if sent again.
+func IsPermanent(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
+
+// The longest a relay can have a retry wait for, however long it asks.
+const MAX_RETRY_AFTER = 10 * time.Minute
+
+var retryAfterPattern = regexp.MustCompile(`(?i)\b(?:try again|retry)(?: later)? (?:in|after) (\d+) ?(s|secs?|seconds?|m|mins?|minutes?)\b`)
+
+// Returns how long a temporary refusal from the relay asks to wait before
+// trying again (as in "try again in 30 seconds"), or 0 if it doesn't say.
+func retryAfter(err error) time.Duration {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code < 400 || protoErr.Code >= 500 {
+		return 0
+	}
+	match := retryAfterPattern.FindStringSubmatch(protoErr.Msg)
+	if match == nil {
+		return 0
+	}
+
+	n, _ := strconv.Atoi(match[1])
+	after := time.Duration(n) * time.Second
+	if strings.HasPrefix(strings.ToLower(match[2]), "m") {
+		after = time.Duration(n) * time.Minute
+	}
+	if after > MAX_RETRY_AFTER {
+		after = MAX_RETRY_AFTER
+	}
+	return after
+}
+
+// `SendFailures` counts the sends that failed, by whether the relay's refusal
+// was temporary, so the message was kept to send again later, or permanent,
+// so it was saved as a dead letter instead. A nil `SendFailures` counts
+// nothing.
+type SendFailures struct {
+	Temporary int64
+	Permanent int64
+}
+
+func (f *SendFailures) add(permanent bool) {
+	if f == nil {
+		return
+	} else if permanent {
+		atomic.AddInt64(&f.Permanent, 1)
+	} else {
+		atomic.AddInt64(&f.Temporary, 1)
+	}
+}
+
+// Returns a copy of the counts, or nil if there are none.
+func (f *SendFailures) Stats() *SendFailures {
+	if f == nil {
+		return nil
+	}
+	return &SendFailures{atomic.LoadInt64(&f.Temporary), atomic.LoadInt64(&f.Permanent)}
+}
+
 // `SendRequest` instructs a `Sender` to send an outgoing message, and gives
 // the requester the opportunity to block on/check for an error response.
 type SendRequest struct {
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/mail"
+	"net/textproto"
 	"path"
 	"testing"
 	"time"
@@ -127,8 +130,8 @@ func TestSender(t *testing.T) {
 
 	done := make(chan bool, 0)
 	go func() {
-		sender := &Sender{upstream, failedMaildir}
-		sender.Run(outgoing)
+		sender := &Sender{Upstream: upstream, FailedMaildir: failedMaildir}
+		sender.Run(context.Background(), outgoing)
 		done <- true
 	}()
 
@@ -164,14 +167,16 @@ func TestSenderFailed(t *testing.T) {
 
 	done := make(chan bool, 0)
 	go func() {
-		sender := &Sender{upstream, failedMaildir}
-		sender.Run(outgoing)
+		sender := &Sender{Upstream: upstream, FailedMaildir: failedMaildir}
+		sender.Run(context.Background(), outgoing)
 		done <- true
 	}()
 
 	errors := make(chan error, 0)
 	outgoing <- &SendRequest{&message{"test", []string{"test"}, []byte("test")}, errors}
-	<-errors
+	if err := <-errors; err == nil {
+		t.Errorf("expected a temporary failure to be reported, so the message is kept")
+	}
 	close(outgoing)
 
 	select {
@@ -181,17 +186,288 @@ func TestSenderFailed(t *testing.T) {
 	}
 
 	if count := len(upstream.Sends); count != 0 {
-		t.Errorf("expected one successful upstream send, got %d", count)
+		t.Errorf("expected no successful upstream sends, got %d", count)
 	}
 
 	msgs, err := failedMaildir.List(MAILDIR_CUR)
 	if err != nil {
 		t.Errorf("unexpected error listing maildir for failed messages: %s", err)
-	} else if count := len(msgs); count != 1 {
-		t.Errorf("expected no messages in failed maildir, got %d", count)
+	} else if count := len(msgs); count != 0 {
+		t.Errorf("expected a temporary failure not to be saved in the failed maildir, got %d", count)
+	}
+}
+
+func TestSenderPermanentFailure(t *testing.T) {
+	failedMaildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	upstream := &FlakyUpstream{Failures: 3, Err: &textproto.Error{Code: 554, Msg: "5.7.1 Message rejected"}}
+	alerter := &TestAlerter{}
+	failures := new(SendFailures)
+	sender := &Sender{Upstream: upstream, FailedMaildir: failedMaildir, Retries: 2, Alerter: alerter, Failures: failures}
+
+	outgoing := make(chan *SendRequest, 1)
+	errors := make(chan error, 1)
+	outgoing <- &SendRequest{&message{"test", []string{"test"}, []byte("Subject: test\r\n\r\nbody\r\n")}, errors}
+	close(outgoing)
+	sender.Run(context.Background(), outgoing)
+
+	if err := <-errors; err != nil {
+		t.Errorf("expected a permanent failure to be reported as done, got %s", err)
+	}
+	if upstream.Attempts != 1 {
+		t.Errorf("expected a permanent failure not to be retried, got %d attempts", upstream.Attempts)
+	}
+	if len(alerter.Alerts) != 1 {
+		t.Errorf("expected an alert for a permanent failure: %v", alerter.Alerts)
+	}
+	if stats := failures.Stats(); stats.Permanent != 1 || stats.Temporary != 0 {
+		t.Errorf("unexpected failure counts: %#v", stats)
+	}
+
+	msgs, err := failedMaildir.List(MAILDIR_CUR)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected the message in the failed maildir, got %d (%v)", len(msgs), err)
+	}
+	if data, err := failedMaildir.ReadBytes(msgs[0].Name(), MAILDIR_CUR); err != nil || !bytes.Contains(data, []byte(FAILURE_HEADER+": 554")) || !bytes.Contains(data, []byte("Message rejected")) {
+		t.Errorf("expected the failure to be recorded in the dead letter: %s (%v)", data, err)
+	}
+}
+
+func TestSenderTemporaryFailureBacksOff(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1393650000, 0))
+	upstream := &FlakyUpstream{Failures: 3, Err: &textproto.Error{Code: 451, Msg: "4.7.1 Rate limited, try again in 5 minutes"}}
+	failures := new(SendFailures)
+	sender := &Sender{Upstream: upstream, Retries: 3, RetryWait: time.Minute, Clock: clock, Failures: failures}
+
+	sent := make(chan bool, 0)
+	var err error
+	go func() {
+		err = sender.send(context.Background(), makeSummaryMessage(t, TEST_MESSAGE))
+		close(sent)
+	}()
+	advanceUntil(t, clock, time.Minute, 100, sent)
+
+	// Waits of 5m (as the relay asked), 10m, and 20m.
+	if err != nil || upstream.Attempts != 4 {
+		t.Errorf("expected the send to succeed on the fourth attempt, got %d attempts and %v", upstream.Attempts, err)
+	} else if elapsed := clock.Now().Sub(time.Unix(1393650000, 0)); elapsed < 35*time.Minute {
+		t.Errorf("expected the retries to back off, but only waited %s", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := map[error]time.Duration{
+		&textproto.Error{Code: 451, Msg: "Try again in 30 seconds"}:        30 * time.Second,
+		&textproto.Error{Code: 421, Msg: "4.7.0 retry after 2 min"}:        2 * time.Minute,
+		&textproto.Error{Code: 450, Msg: "try again later in 3 hours"}:     0,
+		&textproto.Error{Code: 451, Msg: "Try again in 600 minutes"}:       MAX_RETRY_AFTER,
+		&textproto.Error{Code: 550, Msg: "Do not try again in 30 seconds"}: 0,
+		errors.New("try again in 30 seconds"):                              0,
+	}
+	for err, expected := range tests {
+		if after := retryAfter(err); after != expected {
+			t.Errorf("unexpected wait for %s: %s", err, after)
+		}
+	}
+}
+
+func TestSenderRetriesAndAlerts(t *testing.T) {
+	failedMaildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	upstream := &FlakyUpstream{Failures: 2}
+	alerter := &TestAlerter{}
+	sender := &Sender{Upstream: upstream, FailedMaildir: failedMaildir, Retries: 2, Alerter: alerter}
+
+	msg := &message{"test", []string{"test"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+	if err := sender.send(context.Background(), msg); err != nil {
+		t.Errorf("expected the send to succeed after retrying: %s", err)
+	} else if upstream.Attempts != 3 {
+		t.Errorf("unexpected number of send attempts: %d", upstream.Attempts)
+	}
+
+	upstream = &FlakyUpstream{Failures: 3}
+	sender.Upstream = upstream
+	outgoing := make(chan *SendRequest, 1)
+	errors := make(chan error, 1)
+	outgoing <- &SendRequest{msg, errors}
+	close(outgoing)
+	sender.Run(context.Background(), outgoing)
+
+	if err := <-errors; err == nil {
+		t.Errorf("expected the send to fail after exhausting retries")
+	}
+	if len(alerter.Alerts) != 1 || alerter.Alerts[0] != "test: fail" {
+		t.Errorf("expected an alert after exhausting retries: %v", alerter.Alerts)
+	}
+}
+
+func TestSenderCancelled(t *testing.T) {
+	failedMaildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	upstream := &FlakyUpstream{Failures: 3}
+	alerter := &TestAlerter{}
+	sender := &Sender{Upstream: upstream, FailedMaildir: failedMaildir, Retries: 3, RetryWait: time.Hour, Alerter: alerter}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	outgoing := make(chan *SendRequest, 1)
+	errors := make(chan error, 1)
+	outgoing <- &SendRequest{&message{"test", []string{"test"}, []byte("Subject: test\r\n\r\nbody\r\n")}, errors}
+	close(outgoing)
+	sender.Run(ctx, outgoing)
+
+	if err := <-errors; err != context.Canceled {
+		t.Errorf("expected the send to be cancelled instead of waiting to retry, got %v", err)
+	}
+	if upstream.Attempts != 1 {
+		t.Errorf("expected no retries once cancelled, got %d attempts", upstream.Attempts)
+	}
+	if len(alerter.Alerts) != 0 {
+		t.Errorf("expected no alerts for a cancelled send: %v", alerter.Alerts)
+	}
+	if msgs, err := failedMaildir.List(MAILDIR_CUR); err != nil {
+		t.Errorf("unexpected error listing maildir for failed messages: %s", err)
+	} else if len(msgs) != 0 {
+		t.Errorf("expected a cancelled send not to be saved as failed, got %d", len(msgs))
+	}
+}
+
+func TestLiveUpstreamCancelled(t *testing.T) {
+	// A server that accepts connections, but never greets the client.
+	socket, err := net.Listen("tcp", "localhost:10034")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	defer socket.Close()
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	upstream := &LiveUpstream{Addr: "localhost:10034"}
+	msg := &message{"test", []string{"test"}, []byte("Subject: test\r\n\r\nbody\r\n")}
+	sent := make(chan error, 1)
+	go func() { sent <- upstream.SendContext(ctx, msg) }()
+
+	select {
+	case err := <-sent:
+		if err != context.Canceled {
+			t.Errorf("expected the send to be cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected cancelling to abandon the connection to the relay")
+	}
+}
+
+// A `RecipientVerifier` that accepts only the given recipients.
+type TestVerifier struct {
+	Valid map[string]bool
+}
+
+func (v *TestVerifier) Verify(from string, to []string) ([]string, error) {
+	valid := make([]string, 0)
+	for _, addr := range to {
+		if v.Valid[addr] {
+			valid = append(valid, addr)
+		}
+	}
+	return valid, nil
+}
+
+func TestSenderVerifiesRecipients(t *testing.T) {
+	failedMaildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	upstream := &TestUpstream{}
+	verifier := &TestVerifier{map[string]bool{"good@example.com": true}}
+	sender := &Sender{Upstream: upstream, FailedMaildir: failedMaildir, Verifier: verifier}
+
+	outgoing := make(chan *SendRequest, 2)
+	errors := make(chan error, 2)
+	data := []byte("Subject: test\r\n\r\nbody\r\n")
+	outgoing <- &SendRequest{&message{"test", []string{"good@example.com", "bad@example.com"}, data}, errors}
+	outgoing <- &SendRequest{&message{"test", []string{"bad@example.com"}, data}, errors}
+	close(outgoing)
+	sender.Run(context.Background(), outgoing)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errors; err != nil {
+			t.Errorf("unexpected error from send %d: %s", i, err)
+		}
+	}
+
+	if len(upstream.Sends) != 1 {
+		t.Fatalf("expected one message to be sent: %d", len(upstream.Sends))
+	} else if to := upstream.Sends[0].Recipients(); len(to) != 1 || to[0] != "good@example.com" {
+		t.Errorf("expected only valid recipients to be sent to: %v", to)
+	}
+
+	if msgs, err := ReadMaildirMessages(failedMaildir, time.Time{}); err != nil || len(msgs) != 1 {
+		t.Fatalf("expected one message in the failed maildir: %v, %s", msgs, err)
+	} else if reason := msgs[0].Parsed.Header.Get(FAILURE_HEADER); reason != "relay rejected all recipients: bad@example.com" {
+		t.Errorf("unexpected failure reason: %#v", reason)
+	}
+}
+
+func TestLiveUpstreamVerify(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10032")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	defer socket.Close()
+
+	listener := &Listener{Socket: socket}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	go func() {
+		upstream := &LiveUpstream{Addr: "localhost:10032"}
+		if valid, err := upstream.Verify("test@example.com", []string{"a@example.com", "b@example.com"}); err != nil {
+			t.Errorf("unexpected error verifying: %s", err)
+		} else if len(valid) != 2 {
+			t.Errorf("expected both recipients to be accepted: %v", valid)
+		}
+		shutdown <- GracefulShutdown
+	}()
+
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+	if len(received) != 0 {
+		t.Errorf("expected no message to be sent while verifying")
 	}
 }
 
+// An `Upstream` that fails a given number of times before succeeding.
+type FlakyUpstream struct {
+	Failures int
+	Attempts int
+	Err      error // if non-nil, returned instead of a generic error
+}
+
+func (u *FlakyUpstream) Send(m OutgoingMessage) error {
+	u.Attempts += 1
+	if u.Attempts <= u.Failures && u.Err != nil {
+		return u.Err
+	} else if u.Attempts <= u.Failures {
+		return fmt.Errorf("fail")
+	}
+	return nil
+}
+
 func makeReceivedMessage(t *testing.T, data string) *ReceivedMessage {
 	buf := bytes.NewBufferString(data)
 	msg, err := mail.ReadMessage(buf)
@@ -211,7 +487,7 @@ func makeSummaryMessage(t *testing.T, data ...string) *SummaryMessage {
 		msgs = append(msgs, makeReceivedMessage(t, d))
 	}
 	stored := makeStoredMessages(msgs...)
-	compacted, err := Compact(GroupByExpr("group", `{{.Header.Get "Subject"}}`), stored)
+	compacted, err := Compact(GroupByExpr("group", `{{.Header.Get "Subject"}}`), stored, nil)
 	if err != nil {
 		t.Fatalf("error in Compact(): %s", err)
 	}
@@ -225,3 +501,37 @@ func makeSummaryMessage(t *testing.T, data ...string) *SummaryMessage {
 		UniqueMessages: compacted,
 	}
 }
+
+func TestLiveUpstreamRoundTripsDots(t *testing.T) {
+	socket, err := NewTCPServerSocket("localhost:10031")
+	if err != nil {
+		t.Fatalf("failed to create socket: %s", err)
+	}
+	defer socket.Close()
+
+	listener := &Listener{Socket: socket}
+	shutdown := make(chan TerminationRequest, 0)
+	received := make(chan *StorageRequest, 1)
+
+	bodies := make(chan string, 1)
+	go func() {
+		req := <-received
+		body, _ := req.Message.ReadBody()
+		bodies <- body
+		req.StorageErrors <- nil
+	}()
+
+	go func() {
+		upstream := &LiveUpstream{Addr: "localhost:10031"}
+		msg := &message{"test@example.com", []string{"test@example.com"}, []byte("Subject: test\r\n\r\n.\r\n.leading dot\r\n")}
+		if err := upstream.Send(msg); err != nil {
+			t.Errorf("unexpected error sending: %s", err)
+		}
+		shutdown <- GracefulShutdown
+	}()
+
+	listener.Listen(context.Background(), received, shutdown, 100*time.Millisecond)
+	if body := <-bodies; body != ".\r\n.leading dot\r\n" {
+		t.Errorf("expected lines with leading dots to survive a round trip: %#v", body)
+	}
+}
@@ -0,0 +1,56 @@
+// Variable envelope return paths (VERP). With `--verp`, each summary is sent
+// from an envelope sender that encodes its batch, its summary id, and its
+// recipient, like
+//
+//	failmail+disk-full.1a2b3c4d5e6f7a8b=alice=example.com@failmail.example.com
+//
+// so that a bounce, which is sent to the envelope sender, identifies exactly
+// which summary couldn't be delivered to whom, even if the bounce itself
+// doesn't quote the summary.
+package main
+
+import (
+	"strings"
+)
+
+// The most characters of the batch key included in a VERP address, to keep
+// the local part short.
+const VERP_KEY_LENGTH = 24
+
+// Returns the VERP envelope sender for a summary of the batch `key`, with
+// summary id `id`, sent to `recipient`, based on the address `sender`.
+func VerpSender(sender string, key string, id string, recipient string) string {
+	sender = NormalizeAddress(sender)
+	local, domain := sender, ""
+	if i := strings.LastIndex(sender, "@"); i >= 0 {
+		local, domain = sender[:i], sender[i:]
+	}
+
+	tag := id
+	if key := verpKey(key); key != "" {
+		tag = key + "." + id
+	}
+	return local + "+" + tag + "=" + strings.Replace(NormalizeAddress(recipient), "@", "=", 1) + domain
+}
+
+// Returns a readable form of a batch key that's safe to use in the local part
+// of an address: letters, digits, and dashes, with no more than
+// `VERP_KEY_LENGTH` characters.
+func verpKey(key string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '-'
+		}
+	}, key)
+	for strings.Contains(safe, "--") {
+		safe = strings.Replace(safe, "--", "-", -1)
+	}
+	safe = strings.Trim(safe, "-")
+	if len(safe) > VERP_KEY_LENGTH {
+		safe = strings.TrimRight(safe[:VERP_KEY_LENGTH], "-")
+	}
+	return strings.ToLower(safe)
+}
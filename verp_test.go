@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestVerpSender(t *testing.T) {
+	cases := []struct {
+		sender, key, recipient, expected string
+	}{
+		{"failmail@example.com", "disk full on db1!", "Alice@Example.com", "failmail+disk-full-on-db1.0123=alice=example.com@example.com"},
+		{"bounces@example.com", "", "bob@example.org", "bounces+0123=bob=example.org@example.com"},
+		{"Failmail <failmail@example.com>", "a very long batch key that goes on and on", "bob@example.org", "failmail+a-very-long-batch-key-th.0123=bob=example.org@example.com"},
+	}
+	for _, c := range cases {
+		if actual := VerpSender(c.sender, c.key, "0123", c.recipient); actual != c.expected {
+			t.Errorf("expected VerpSender(%#v, %#v, ...) to be %#v, got %#v", c.sender, c.key, c.expected, actual)
+		}
+	}
+}
+
+func TestFlushVerp(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.From = "failmail@example.com"
+	buf.Verp = true
+	outgoing := make(chan *SendRequest, 64)
+
+	defer patchTime(time.Unix(1393650000, 0))()
+	buf.Store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: disk full\r\n\r\ntest"))
+
+	sent := make(chan OutgoingMessage, 1)
+	go func() {
+		for req := range outgoing {
+			sent <- req.Message
+			req.SendErrors <- nil
+		}
+	}()
+	if err := buf.Flush(context.Background(), nowGetter(), outgoing, true); err != nil {
+		t.Errorf("unexpected error from flush: %s", err)
+	}
+	close(outgoing)
+
+	msg := <-sent
+	summary, _ := ReadSentSummary(msg)
+	parsed, _ := NewHookMessage(msg.Sender(), msg.Recipients(), msg.Contents())
+	id := parsed.Headers.Get("X-Failmail-Summary-Id")
+	if id == "" || summary == nil {
+		t.Fatalf("expected the summary to have an id")
+	}
+	if expected := "failmail+disk-full." + id + "=test=example.com@example.com"; msg.Sender() != expected {
+		t.Errorf("expected the envelope sender to be %s, got %s", expected, msg.Sender())
+	}
+}
@@ -0,0 +1,34 @@
+// Watching the store for new messages. Rather than only checking the store
+// every `--poll`, a sender can be woken as soon as a receiver (possibly in
+// another process) stores a message, using inotify where it's available.
+package main
+
+// `StoreWatcher` watches a disk store's maildir, and sends on `Changes` when
+// a message is stored. Changes that arrive before the last one is received
+// are coalesced.
+type StoreWatcher struct {
+	Changes <-chan bool
+	closer  func() error
+}
+
+// Watches the maildir backing a `DiskStore`. Messages are stored once their
+// metadata is moved into place, so only the metadata directory is watched.
+func WatchMaildir(maildir *Maildir) (*StoreWatcher, error) {
+	return watchDir(maildir.path("", MAILDIR_META))
+}
+
+// Stops watching. A nil `StoreWatcher` has nothing to stop.
+func (w *StoreWatcher) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.closer()
+}
+
+// Notes a change, without blocking if one is already waiting.
+func notify(changes chan<- bool) {
+	select {
+	case changes <- true:
+	default:
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"syscall"
+)
+
+func watchDir(dir string) (*StoreWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_MOVED_TO|syscall.IN_CLOSE_WRITE); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// Since the descriptor is non-blocking, reads go through the runtime's
+	// poller, and closing the file interrupts them.
+	file := os.NewFile(uintptr(fd), "inotify")
+	changes := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			if _, err := file.Read(buf); err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					log.Printf("warning: stopped watching %s: %s", dir, err)
+				}
+				return
+			}
+			notify(changes)
+		}
+	}()
+	return &StoreWatcher{changes, file.Close}, nil
+}
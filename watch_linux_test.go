@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchMaildir(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	watcher, err := WatchMaildir(maildir)
+	if err != nil {
+		t.Fatalf("unexpected error watching maildir: %s", err)
+	}
+	defer watcher.Close()
+
+	store, _ := NewDiskStore(maildir)
+	store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+
+	select {
+	case <-watcher.Changes:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a change after storing a message")
+	}
+}
+
+func TestWatchMaildirClose(t *testing.T) {
+	maildir, cleanup := makeTestMaildir(t)
+	defer cleanup()
+
+	watcher, err := WatchMaildir(maildir)
+	if err != nil {
+		t.Fatalf("unexpected error watching maildir: %s", err)
+	}
+	if err := watcher.Close(); err != nil {
+		t.Errorf("unexpected error closing watcher: %s", err)
+	}
+
+	store, _ := NewDiskStore(maildir)
+	store.Add(nowGetter(), makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	select {
+	case <-watcher.Changes:
+		t.Errorf("expected no changes after closing the watcher")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
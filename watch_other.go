@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+func watchDir(dir string) (*StoreWatcher, error) {
+	return nil, fmt.Errorf("watching the store isn't supported on this platform")
+}
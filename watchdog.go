@@ -0,0 +1,111 @@
+// A watchdog that notices when messages stop arriving, which usually means
+// that whatever feeds failmail is broken, rather than that all is well.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// `Watchdog` keeps track of when messages were last received, and generates
+// a notification when none have been received for longer than `Window`.
+type Watchdog struct {
+	Window   time.Duration
+	PerBatch bool // if true, track each batch key separately
+	From     string
+	heard    map[string]*heardFrom
+}
+
+// Tracks the last message received for a batch key (or for all messages).
+type heardFrom struct {
+	Last       time.Time
+	Recipients map[string]bool
+	Notified   bool
+}
+
+func NewWatchdog(window time.Duration, perBatch bool, from string) *Watchdog {
+	return &Watchdog{window, perBatch, from, make(map[string]*heardFrom, 0)}
+}
+
+// Records that a message with the given batch key was received.
+func (w *Watchdog) Heard(key string, at time.Time, recipients []string) {
+	if w == nil {
+		return
+	}
+	if !w.PerBatch {
+		key = ""
+	}
+
+	heard, ok := w.heard[key]
+	if !ok {
+		heard = &heardFrom{Recipients: make(map[string]bool, 0)}
+		w.heard[key] = heard
+	}
+	if at.After(heard.Last) {
+		heard.Last = at
+	}
+	heard.Notified = false
+	for _, to := range recipients {
+		heard.Recipients[NormalizeAddress(to)] = true
+	}
+}
+
+// Forgets everything heard so far, e.g. after losing the lease on the store.
+func (w *Watchdog) Reset() {
+	if w != nil {
+		w.heard = make(map[string]*heardFrom, 0)
+	}
+}
+
+// Returns notifications for the batch keys (or all messages) that have been
+// quiet for longer than the window and haven't been notified about yet, keyed
+// by batch key. Call `Notified()` once a notification has been sent.
+func (w *Watchdog) Check(now time.Time) map[string]OutgoingMessage {
+	result := make(map[string]OutgoingMessage, 0)
+	if w == nil {
+		return result
+	}
+
+	for key, heard := range w.heard {
+		if heard.Notified || now.Sub(heard.Last) < w.Window {
+			continue
+		}
+		result[key] = w.notification(now, key, heard)
+	}
+	return result
+}
+
+// Records that a notification was sent for the batch key, so that another
+// isn't sent until messages start arriving again.
+func (w *Watchdog) Notified(key string) {
+	if heard, ok := w.heard[key]; ok {
+		heard.Notified = true
+	}
+}
+
+func (w *Watchdog) notification(now time.Time, key string, heard *heardFrom) OutgoingMessage {
+	to := make([]string, 0, len(heard.Recipients))
+	for addr, _ := range heard.Recipients {
+		to = append(to, addr)
+	}
+	sort.Strings(to)
+
+	source := "anything"
+	if w.PerBatch {
+		source = fmt.Sprintf("%#v", key)
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", w.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: [failmail] failmail has heard nothing from %s in %s\r\n", source, w.Window)
+	fmt.Fprintf(buf, "Date: %s\r\n", now.Format(time.RFC822))
+	fmt.Fprintf(buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(buf, "\r\n")
+	fmt.Fprintf(buf, "failmail has received no messages from %s since %s.\r\n", source, heard.Last.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Whatever sends them may have stopped working.\r\n")
+	return &message{w.From, to, buf.Bytes()}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	start := time.Unix(1393650000, 0)
+	watchdog := NewWatchdog(time.Hour, false, "failmail@example.com")
+
+	watchdog.Heard("a", start, []string{"Test <TEST@example.com>"})
+	watchdog.Heard("b", start.Add(time.Minute), []string{"other@example.com"})
+	if notifications := watchdog.Check(start.Add(time.Hour)); len(notifications) != 0 {
+		t.Errorf("unexpected notifications before the window passed: %v", notifications)
+	}
+
+	notifications := watchdog.Check(start.Add(61 * time.Minute))
+	if len(notifications) != 1 {
+		t.Fatalf("expected one notification for all messages: %v", notifications)
+	}
+	notification := notifications[""]
+	if to := notification.Recipients(); len(to) != 2 || to[0] != "other@example.com" || to[1] != "test@example.com" {
+		t.Errorf("unexpected notification recipients: %v", to)
+	}
+	if contents := string(notification.Contents()); !strings.Contains(contents, "Subject: [failmail] failmail has heard nothing from anything in 1h0m0s\r\n") {
+		t.Errorf("unexpected notification contents: %s", contents)
+	}
+
+	watchdog.Notified("")
+	if notifications := watchdog.Check(start.Add(2 * time.Hour)); len(notifications) != 0 {
+		t.Errorf("expected only one notification until messages arrive again: %v", notifications)
+	}
+
+	watchdog.Heard("a", start.Add(2*time.Hour), []string{"test@example.com"})
+	if notifications := watchdog.Check(start.Add(4 * time.Hour)); len(notifications) != 1 {
+		t.Errorf("expected another notification after messages stop again: %v", notifications)
+	}
+}
+
+func TestWatchdogPerBatch(t *testing.T) {
+	start := time.Unix(1393650000, 0)
+	watchdog := NewWatchdog(time.Hour, true, "failmail@example.com")
+
+	watchdog.Heard("a", start, []string{"test@example.com"})
+	watchdog.Heard("b", start.Add(30*time.Minute), []string{"test@example.com"})
+
+	notifications := watchdog.Check(start.Add(time.Hour))
+	if len(notifications) != 1 {
+		t.Fatalf("expected a notification for one batch: %v", notifications)
+	} else if _, ok := notifications["a"]; !ok {
+		t.Errorf("expected a notification for the quiet batch: %v", notifications)
+	}
+	if contents := string(notifications["a"].Contents()); !strings.Contains(contents, `heard nothing from "a"`) {
+		t.Errorf("unexpected notification contents: %s", contents)
+	}
+}
+
+func TestFlushWatchdog(t *testing.T) {
+	buf := makeMessageBuffer()
+	buf.Watchdog = NewWatchdog(time.Minute, false, "failmail@example.com")
+	outgoing := make(chan *SendRequest, 64)
+
+	sent := make([]OutgoingMessage, 0)
+	go func() {
+		for req := range outgoing {
+			sent = append(sent, req.Message)
+			req.SendErrors <- nil
+		}
+	}()
+
+	start := time.Unix(1393650000, 0)
+	buf.Store.Add(start, makeReceivedMessage(t, "To: test@example.com\r\nSubject: test\r\n\r\ntest"))
+	buf.Flush(context.Background(), start, outgoing, false)
+	buf.Flush(context.Background(), start.Add(10*time.Second), outgoing, false)
+	if count := len(sent); count != 1 {
+		t.Fatalf("expected only the summary to be sent: %d", count)
+	}
+
+	buf.Flush(context.Background(), start.Add(time.Minute), outgoing, false)
+	buf.Flush(context.Background(), start.Add(2*time.Minute), outgoing, false)
+	if count := len(sent); count != 2 {
+		t.Fatalf("expected one watchdog notification: %d", count)
+	} else if to := sent[1].Recipients(); len(to) != 1 || to[0] != "test@example.com" {
+		t.Errorf("unexpected watchdog notification recipients: %v", to)
+	}
+}
@@ -0,0 +1,219 @@
+// Zstandard framing for `.tar.zst` backups. Go's standard library has no
+// Zstandard compressor, so archives are written as Zstandard frames of raw
+// (uncompressed) blocks: `zstd -d` and `tar --zstd` read them like any other
+// .zst file, but they're no smaller than the tar they hold. Reading supports
+// the same raw blocks (and RLE ones), so failmail can restore its own
+// archives; compressed archives from other tools have to be decompressed
+// with `zstd -d` first.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	ZSTD_MAGIC          = 0xFD2FB528
+	ZSTD_MAX_BLOCK_SIZE = 128 * 1024
+
+	// A 128KB window (2^(10+7)), the smallest that holds a full block.
+	zstdWindowDescriptor = 7 << 3
+
+	zstdBlockRaw        = 0
+	zstdBlockRLE        = 1
+	zstdBlockCompressed = 2
+)
+
+var ErrZstdCompressed = errors.New("compressed zstd blocks aren't supported (decompress the archive with zstd -d, and restore the .tar)")
+
+// `zstdWriter` writes a single Zstandard frame of raw blocks.
+type zstdWriter struct {
+	w       io.Writer
+	block   []byte
+	started bool
+}
+
+func newZstdWriter(w io.Writer) *zstdWriter {
+	return &zstdWriter{w: w, block: make([]byte, 0, ZSTD_MAX_BLOCK_SIZE)}
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(z.block) == ZSTD_MAX_BLOCK_SIZE {
+			if err := z.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(z.block[len(z.block):ZSTD_MAX_BLOCK_SIZE], p)
+		z.block = z.block[:len(z.block)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Writes the last block, which ends the frame.
+func (z *zstdWriter) Close() error {
+	return z.flush(true)
+}
+
+func (z *zstdWriter) flush(last bool) error {
+	if !z.started {
+		// The frame header: no content size, dictionary, or checksum.
+		header := make([]byte, 6)
+		binary.LittleEndian.PutUint32(header, ZSTD_MAGIC)
+		header[5] = zstdWindowDescriptor
+		if _, err := z.w.Write(header); err != nil {
+			return err
+		}
+		z.started = true
+	}
+
+	blockHeader := uint32(len(z.block))<<3 | zstdBlockRaw<<1
+	if last {
+		blockHeader |= 1
+	}
+	if _, err := z.w.Write([]byte{byte(blockHeader), byte(blockHeader >> 8), byte(blockHeader >> 16)}); err != nil {
+		return err
+	}
+	_, err := z.w.Write(z.block)
+	z.block = z.block[:0]
+	return err
+}
+
+// `zstdReader` reads the contents of Zstandard frames made of raw and RLE
+// blocks, returning `ErrZstdCompressed` at the first compressed block.
+type zstdReader struct {
+	r       *bufio.Reader
+	left    int  // bytes left in the current block
+	rle     bool // if true, the current block repeats `rleByte`
+	rleByte byte
+	last    bool // true if the current block is the last in its frame
+	inFrame bool
+	check   bool // true if the current frame ends with a checksum
+}
+
+func newZstdReader(r io.Reader) *zstdReader {
+	return &zstdReader{r: bufio.NewReader(r)}
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.left == 0 {
+		if err := z.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p) > z.left {
+		p = p[:z.left]
+	}
+	if z.rle {
+		for i := range p {
+			p[i] = z.rleByte
+		}
+		z.left -= len(p)
+		return len(p), nil
+	}
+	n, err := z.r.Read(p)
+	z.left -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Reads the header of the next block (and of the next frame, if the last one
+// has ended).
+func (z *zstdReader) nextBlock() error {
+	if z.inFrame && z.last {
+		if z.check {
+			if _, err := z.r.Discard(4); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+		}
+		z.inFrame = false
+	}
+	if !z.inFrame {
+		if err := z.readFrameHeader(); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(z.r, header); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	value := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	z.last = value&1 == 1
+	z.left = int(value >> 3)
+	z.rle = false
+
+	switch (value >> 1) & 3 {
+	case zstdBlockRaw:
+	case zstdBlockRLE:
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		z.rle, z.rleByte = true, b
+	case zstdBlockCompressed:
+		return ErrZstdCompressed
+	default:
+		return fmt.Errorf("invalid zstd block type")
+	}
+	return nil
+}
+
+// Reads a frame header, skipping any skippable frames before it. Returns
+// `io.EOF` if there are no more frames.
+func (z *zstdReader) readFrameHeader() error {
+	for {
+		magic := make([]byte, 4)
+		if n, err := io.ReadFull(z.r, magic); n == 0 && err == io.EOF {
+			return io.EOF
+		} else if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		switch value := binary.LittleEndian.Uint32(magic); {
+		case value == ZSTD_MAGIC:
+		case value&0xFFFFFFF0 == 0x184D2A50:
+			size := make([]byte, 4)
+			if _, err := io.ReadFull(z.r, size); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(size))); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			continue
+		default:
+			return fmt.Errorf("not a zstd archive")
+		}
+		break
+	}
+
+	descriptor, err := z.r.ReadByte()
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if descriptor&3 != 0 {
+		return fmt.Errorf("zstd dictionaries aren't supported")
+	}
+	singleSegment := descriptor&0x20 != 0
+	skip := []int{0, 2, 4, 8}[descriptor>>6]
+	if !singleSegment {
+		skip += 1 // the window descriptor
+	} else if descriptor>>6 == 0 {
+		skip += 1 // a one-byte content size
+	}
+	if _, err := z.r.Discard(skip); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	z.inFrame, z.last, z.check = true, false, descriptor&4 != 0
+	return nil
+}
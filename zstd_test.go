@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+)
+
+func TestZstdRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, ZSTD_MAX_BLOCK_SIZE, 3*ZSTD_MAX_BLOCK_SIZE + 17} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		archive := new(bytes.Buffer)
+		w := newZstdWriter(archive)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("unexpected error writing %d bytes: %s", size, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error closing after %d bytes: %s", size, err)
+		}
+
+		if read, err := ioutil.ReadAll(newZstdReader(archive)); err != nil {
+			t.Errorf("unexpected error reading %d bytes: %s", size, err)
+		} else if !bytes.Equal(read, data) {
+			t.Errorf("expected %d bytes back, got %d different ones", size, len(read))
+		}
+	}
+}
+
+func TestZstdReaderFrames(t *testing.T) {
+	frames := []byte{
+		// A skippable frame with 2 bytes of data.
+		0x50, 0x2a, 0x4d, 0x18, 0x02, 0x00, 0x00, 0x00, 0xaa, 0xbb,
+		// A single-segment frame with a 1-byte content size and a checksum,
+		// holding a raw block of "ab" and a last RLE block of three "c"s.
+		0x28, 0xb5, 0x2f, 0xfd, 0x24, 0x05,
+		0x10, 0x00, 0x00, 'a', 'b',
+		0x1b, 0x00, 0x00, 'c',
+		0x00, 0x00, 0x00, 0x00,
+	}
+	if read, err := ioutil.ReadAll(newZstdReader(bytes.NewReader(frames))); err != nil || string(read) != "abccc" {
+		t.Errorf("expected abccc, got %#v (%v)", string(read), err)
+	}
+
+	compressed := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x38, 0x15, 0x00, 0x00}
+	if _, err := ioutil.ReadAll(newZstdReader(bytes.NewReader(compressed))); err != ErrZstdCompressed {
+		t.Errorf("expected an error for a compressed block, got %v", err)
+	}
+	if _, err := ioutil.ReadAll(newZstdReader(bytes.NewReader([]byte("not zstd")))); err == nil {
+		t.Errorf("expected an error for data that isn't zstd")
+	}
+}
+
+func TestZstdWriterWithZstd(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd isn't installed")
+	}
+
+	data := bytes.Repeat([]byte("failmail\n"), ZSTD_MAX_BLOCK_SIZE/4)
+	archive := new(bytes.Buffer)
+	w := newZstdWriter(archive)
+	w.Write(data)
+	w.Close()
+
+	cmd := exec.Command(zstd, "-d", "-c")
+	cmd.Stdin = archive
+	if out, err := cmd.Output(); err != nil {
+		t.Fatalf("zstd failed to decompress the archive: %s", err)
+	} else if !bytes.Equal(out, data) {
+		t.Errorf("expected zstd to decompress %d bytes, got %d", len(data), len(out))
+	}
+}